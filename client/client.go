@@ -0,0 +1,184 @@
+// Package client talks to a database server over the native wire protocol.
+// DBManager, CollectionManager and DocumentManager mirror the local managers
+// of the same names, so code can switch between embedded and remote use.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/server/wire"
+)
+
+// notFound is a server's error saying a document does not exist; it wraps
+// documents.ErrNotFound as the local managers' errors do
+type notFound string
+
+func (e notFound) Error() string { return string(e) }
+
+func (e notFound) Unwrap() error { return documents.ErrNotFound }
+
+// Option configures a client
+type Option func(*DBManager)
+
+// WithPoolSize sets how many connections requests are spread over
+func WithPoolSize(size int) Option {
+	return func(dbm *DBManager) {
+		if size > 0 {
+			dbm.pool.conns = make([]*conn, size)
+		}
+	}
+}
+
+// WithTimeout bounds how long a single request may take
+func WithTimeout(timeout time.Duration) Option {
+	return func(dbm *DBManager) { dbm.timeout = timeout }
+}
+
+// WithDialTimeout bounds how long connecting to the server may take
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(dbm *DBManager) { dbm.pool.dialTimeout = timeout }
+}
+
+// WithCredentials authenticates every connection as a user
+func WithCredentials(name, password string) Option {
+	return func(dbm *DBManager) {
+		dbm.pool.auth = &wire.Request{Name: name, Password: password}
+	}
+}
+
+// DBManager is the remote counterpart of db.DBManager
+type DBManager struct {
+	pool    *pool
+	ids     atomic.Uint64
+	timeout time.Duration
+}
+
+// Dial connects to a server on a "tcp" address or a "unix" socket path.
+// Broken connections are replaced transparently by later requests.
+func Dial(network, addr string, opts ...Option) (*DBManager, error) {
+	dbm := &DBManager{
+		pool: &pool{
+			network:     network,
+			addr:        addr,
+			dialTimeout: 5 * time.Second,
+			conns:       make([]*conn, 4),
+		},
+		timeout: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(dbm)
+	}
+
+	// Fail early if the server cannot be reached
+	if err := dbm.Ping(); err != nil {
+		dbm.Close()
+		return nil, err
+	}
+	return dbm, nil
+}
+
+// Close closes every connection
+func (dbm *DBManager) Close() {
+	dbm.pool.close()
+}
+
+// Ping checks that the server answers
+func (dbm *DBManager) Ping() error {
+	return dbm.call(wire.OpPing, wire.Request{}, nil)
+}
+
+func (dbm *DBManager) CreateDatabase(name string) (*models.Database, error) {
+	var db models.Database
+	if err := dbm.call(wire.OpCreateDatabase, wire.Request{Name: name}, &db); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (dbm *DBManager) UseDatabase(name string) (*models.Database, error) {
+	var db models.Database
+	if err := dbm.call(wire.OpUseDatabase, wire.Request{Name: name}, &db); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (dbm *DBManager) DeleteDatabase(name string) error {
+	return dbm.call(wire.OpDeleteDatabase, wire.Request{Name: name}, nil)
+}
+
+func (dbm *DBManager) ListDatabases() ([]string, error) {
+	var names []string
+	err := dbm.call(wire.OpListDatabases, wire.Request{}, &names)
+	return names, err
+}
+
+func (dbm *DBManager) RenameDatabase(oldName, newName string) error {
+	return dbm.call(wire.OpRenameDatabase, wire.Request{Name: oldName, NewName: newName}, nil)
+}
+
+func (dbm *DBManager) CopyDatabase(src, dst string) (*models.Database, error) {
+	var db models.Database
+	if err := dbm.call(wire.OpCopyDatabase, wire.Request{Name: src, NewName: dst}, &db); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (dbm *DBManager) DatabaseStats(name string) (*models.DatabaseStats, error) {
+	var stats models.DatabaseStats
+	if err := dbm.call(wire.OpDatabaseStats, wire.Request{Name: name}, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// call sends one request and decodes its result into result, if not nil.
+// A request that never reached the server is retried once on a new connection.
+func (dbm *DBManager) call(op byte, req wire.Request, result interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+	frame := wire.Frame{ID: dbm.ids.Add(1), Code: op, Body: body}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbm.timeout)
+	defer cancel()
+
+	var response wire.Frame
+	for attempt := 0; ; attempt++ {
+		c, err := dbm.pool.get(ctx, &dbm.ids)
+		if err != nil {
+			return err
+		}
+		var sent bool
+		response, sent, err = c.roundTrip(ctx, frame)
+		if err == nil {
+			break
+		}
+		if sent || attempt > 0 {
+			return err
+		}
+	}
+
+	switch response.Code {
+	case wire.StatusError:
+		return errors.New(string(response.Body))
+	case wire.StatusNotFound:
+		return notFound(response.Body)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Body, result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
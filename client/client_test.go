@@ -0,0 +1,145 @@
+package client_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"Build-your-own-database/client"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/server/wire"
+)
+
+// serve starts a wire protocol server on a new storage root and returns a
+// client connected to it
+func serve(t *testing.T) (*client.DBManager, *db.DBManager) {
+	t.Helper()
+	local := db.Open(t.TempDir())
+	t.Cleanup(local.Close)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go wire.New(local).Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+
+	remote, err := client.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(remote.Close)
+	return remote, local
+}
+
+func TestCreateCollectionSettings(t *testing.T) {
+	remote, local := serve(t)
+	database, err := remote.CreateDatabase("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := client.NewCollectionManager(remote, database)
+
+	tests := []struct {
+		name  string
+		opts  []collections.CollectionOption
+		check func(*models.Collection) bool
+	}{
+		{"history", []collections.CollectionOption{collections.WithHistory(3, 0)}, func(c *models.Collection) bool {
+			return c.History != nil && c.History.MaxVersions == 3
+		}},
+		{"capped", []collections.CollectionOption{collections.WithCapped(10, 0)}, func(c *models.Collection) bool {
+			return c.Capped != nil && c.Capped.MaxDocuments == 10
+		}},
+		{"encrypted fields", []collections.CollectionOption{collections.WithEncryptedFields(models.EncryptedField{Path: "ssn", Mode: models.Deterministic})}, func(c *models.Collection) bool {
+			return len(c.Encrypted) == 1 && c.Encrypted[0].Path == "ssn"
+		}},
+		{"compression", []collections.CollectionOption{collections.WithCompression(storage.Gzip, 0)}, func(c *models.Collection) bool {
+			return c.Compression != nil && c.Compression.Algorithm == storage.Gzip
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Base(t.Name())
+			returned, err := cm.CreateCollection(name, tt.opts...)
+			if err != nil {
+				t.Fatalf("CreateCollection() error = %v", err)
+			}
+			if !tt.check(returned) {
+				t.Errorf("CreateCollection() returned settings %+v", returned)
+			}
+			// The server keeps the settings, not just the reply
+			shop, err := local.UseDatabase("shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := collections.NewCollectionManager(shop).UseCollection(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(stored) {
+				t.Errorf("the server stored settings %+v", stored.Settings())
+			}
+		})
+	}
+}
+
+func TestReturnedDocumentsDoNotWriteLocally(t *testing.T) {
+	remote, _ := serve(t)
+	database, err := remote.CreateDatabase("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := client.NewCollectionManager(remote, database)
+	col, err := cm.CreateCollection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := client.NewDocumentManager(cm, col)
+	if _, err := dm.CreateDocument("a", map[string]interface{}{"n": 1.0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run from an empty directory so a stray write would show up in it
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	doc, err := dm.UseDocument("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := dm.FindDocuments(nil)
+	if err != nil || len(found) != 1 {
+		t.Fatalf("FindDocuments() = %v, %v", found, err)
+	}
+	tests := []struct {
+		name  string
+		write func() error
+	}{
+		{"Update", func() error { return doc.Update("n", 2.0) }},
+		{"Add", func() error { return doc.Add("m", 3.0) }},
+		{"DeleteKey", func() error { return doc.DeleteKey("n") }},
+		{"Rename", func() error { return doc.Rename("renamed") }},
+		{"Save of a found document", func() error { return found[0].Save() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(); err == nil {
+				t.Errorf("%s() wrote a document returned by the server", tt.name)
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("the client wrote %d file(s) locally", len(entries))
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Build-your-own-database/server/wire"
+)
+
+// conn is one connection to the server. Requests from many goroutines are
+// pipelined over it and their responses matched by request ID.
+type conn struct {
+	netConn net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint64]chan wire.Frame
+	err     error         // Why the connection broke, once it has
+	broken  chan struct{} // Closed when the connection breaks
+}
+
+func dial(network, addr string, timeout time.Duration) (*conn, error) {
+	netConn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	c := &conn{
+		netConn: netConn,
+		pending: make(map[uint64]chan wire.Frame),
+		broken:  make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *conn) readLoop() {
+	reader := bufio.NewReader(c.netConn)
+	for {
+		frame, err := wire.ReadFrame(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[frame.ID]
+		delete(c.pending, frame.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- frame
+		}
+	}
+}
+
+// fail marks the connection broken, which wakes every waiting request
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.broken)
+	c.netConn.Close()
+}
+
+func (c *conn) isBroken() bool {
+	select {
+	case <-c.broken:
+		return true
+	default:
+		return false
+	}
+}
+
+// roundTrip sends a request and waits for its response. sent reports whether
+// the request may have reached the server, i.e. whether retrying is unsafe.
+func (c *conn) roundTrip(ctx context.Context, request wire.Frame) (response wire.Frame, sent bool, err error) {
+	ch := make(chan wire.Frame, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return wire.Frame{}, false, c.err
+	}
+	c.pending[request.ID] = ch
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.netConn.SetWriteDeadline(deadline)
+	}
+	err = wire.WriteFrame(c.netConn, request)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+		c.forget(request.ID)
+		return wire.Frame{}, false, err
+	}
+
+	select {
+	case response = <-ch:
+		return response, true, nil
+	case <-c.broken:
+		c.forget(request.ID)
+		return wire.Frame{}, true, fmt.Errorf("connection lost: %v", c.err)
+	case <-ctx.Done():
+		c.forget(request.ID)
+		return wire.Frame{}, true, ctx.Err()
+	}
+}
+
+// authenticate logs the connection in before it is used
+func (c *conn) authenticate(ctx context.Context, id uint64, credentials *wire.Request) error {
+	body, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	response, _, err := c.roundTrip(ctx, wire.Frame{ID: id, Code: wire.OpAuth, Body: body})
+	if err != nil {
+		return err
+	}
+	if response.Code == wire.StatusError {
+		return fmt.Errorf("authentication failed: %s", response.Body)
+	}
+	return nil
+}
+
+func (c *conn) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *conn) close() {
+	c.fail(errors.New("client closed"))
+}
+
+// pool keeps up to size connections, handing them out round robin and
+// replacing broken ones on demand
+type pool struct {
+	network, addr string
+	dialTimeout   time.Duration
+	auth          *wire.Request // Credentials sent on every new connection
+
+	mu     sync.Mutex
+	conns  []*conn
+	next   int
+	closed bool
+}
+
+func (p *pool) get(ctx context.Context, ids *atomic.Uint64) (*conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errors.New("client is closed")
+	}
+
+	slot := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if c := p.conns[slot]; c != nil && !c.isBroken() {
+		return c, nil
+	}
+
+	c, err := dial(p.network, p.addr, p.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.auth != nil {
+		if err := c.authenticate(ctx, ids.Add(1), p.auth); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	p.conns[slot] = c
+	return c, nil
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.conns {
+		if c != nil {
+			c.close()
+		}
+	}
+}
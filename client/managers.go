@@ -0,0 +1,163 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/server/wire"
+)
+
+// CollectionManager is the remote counterpart of collections.CollectionManager
+type CollectionManager struct {
+	dbm *DBManager
+	db  string
+}
+
+// NewCollectionManager manages the collections of a database on the server
+func NewCollectionManager(dbm *DBManager, db *models.Database) *CollectionManager {
+	return &CollectionManager{dbm: dbm, db: db.Name}
+}
+
+// CreateCollection accepts the same options as the local manager
+func (cm *CollectionManager) CreateCollection(name string, opts ...collections.CollectionOption) (*models.Collection, error) {
+	settings := &models.Collection{Name: name}
+	for _, opt := range opts {
+		opt(settings)
+	}
+	return cm.collection(wire.OpCreateCollection, wire.Request{Name: name, Settings: settings})
+}
+
+func (cm *CollectionManager) UseCollection(name string) (*models.Collection, error) {
+	return cm.collection(wire.OpUseCollection, wire.Request{Name: name})
+}
+
+func (cm *CollectionManager) DeleteCollection(name string) error {
+	return cm.call(wire.OpDeleteCollection, wire.Request{Name: name}, nil)
+}
+
+func (cm *CollectionManager) ListCollections() ([]string, error) {
+	var names []string
+	err := cm.call(wire.OpListCollections, wire.Request{}, &names)
+	return names, err
+}
+
+func (cm *CollectionManager) RenameCollection(oldName, newName string) error {
+	return cm.call(wire.OpRenameCollection, wire.Request{Name: oldName, NewName: newName}, nil)
+}
+
+func (cm *CollectionManager) CloneCollection(src, dst string, filter models.Filter) (*models.Collection, error) {
+	return cm.collection(wire.OpCloneCollection, wire.Request{Name: src, NewName: dst, Filter: filter})
+}
+
+func (cm *CollectionManager) Stats(name string) (*models.CollectionStats, error) {
+	var stats models.CollectionStats
+	if err := cm.call(wire.OpCollectionStats, wire.Request{Name: name}, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (cm *CollectionManager) CreateIndex(colName, field string, unique bool) error {
+	return cm.call(wire.OpCreateIndex, wire.Request{Name: colName, Field: field, Unique: unique}, nil)
+}
+
+func (cm *CollectionManager) CreateTTLIndex(colName, field string, expireAfter time.Duration) error {
+	return cm.call(wire.OpCreateTTLIndex, wire.Request{Name: colName, Field: field, ExpireAfter: expireAfter}, nil)
+}
+
+func (cm *CollectionManager) SetHistory(colName string, history *models.HistoryOptions) error {
+	return cm.call(wire.OpSetHistory, wire.Request{Name: colName, History: history}, nil)
+}
+
+func (cm *CollectionManager) collection(op byte, req wire.Request) (*models.Collection, error) {
+	var col models.Collection
+	if err := cm.call(op, req, &col); err != nil {
+		return nil, err
+	}
+	return &col, nil
+}
+
+func (cm *CollectionManager) call(op byte, req wire.Request, result interface{}) error {
+	req.Database = cm.db
+	return cm.dbm.call(op, req, result)
+}
+
+// DocumentManager is the remote counterpart of documents.DocumentManager
+type DocumentManager struct {
+	cm         *CollectionManager
+	collection string
+}
+
+// NewDocumentManager manages the documents of a collection on the server
+func NewDocumentManager(cm *CollectionManager, collection *models.Collection) *DocumentManager {
+	return &DocumentManager{cm: cm, collection: collection.Name}
+}
+
+func (dm *DocumentManager) CreateDocument(name string, data map[string]interface{}) (*models.Document, error) {
+	return dm.document(wire.OpCreateDocument, wire.Request{Name: name, Data: data})
+}
+
+func (dm *DocumentManager) UseDocument(name string) (*models.Document, error) {
+	return dm.document(wire.OpUseDocument, wire.Request{Name: name})
+}
+
+func (dm *DocumentManager) DeleteDocument(name string) error {
+	return dm.call(wire.OpDeleteDocument, wire.Request{Name: name}, nil)
+}
+
+func (dm *DocumentManager) RenameDocument(oldName, newName string) error {
+	return dm.call(wire.OpRenameDocument, wire.Request{Name: oldName, NewName: newName}, nil)
+}
+
+// FindDocument returns the documents whose key equals val; like the local
+// manager it reports no error, so a failed request finds nothing
+func (dm *DocumentManager) FindDocument(key string, val interface{}) []*models.Document {
+	var results []*models.Document
+	if err := dm.call(wire.OpFindDocument, wire.Request{Field: key, Value: val}, &results); err != nil {
+		fmt.Println("Failed to find documents:", err)
+		return nil
+	}
+	return detach(results)
+}
+
+func (dm *DocumentManager) FindDocuments(filter models.Filter) ([]*models.Document, error) {
+	var results []*models.Document
+	err := dm.call(wire.OpFindDocuments, wire.Request{Filter: filter}, &results)
+	return detach(results), err
+}
+
+func (dm *DocumentManager) UpdateDocument(name string, set map[string]interface{}, unset []string) (*models.Document, error) {
+	return dm.document(wire.OpUpdateDocument, wire.Request{Name: name, Set: set, Unset: unset})
+}
+
+func (dm *DocumentManager) SetExpireAt(name string, at time.Time) error {
+	return dm.call(wire.OpSetExpireAt, wire.Request{Name: name, ExpireAt: at}, nil)
+}
+
+func (dm *DocumentManager) document(op byte, req wire.Request) (*models.Document, error) {
+	var doc models.Document
+	if err := dm.call(op, req, &doc); err != nil {
+		return nil, err
+	}
+	return detach([]*models.Document{&doc})[0], nil
+}
+
+// detach clears the paths of documents the server returned, which name its
+// files rather than the client's. Documents without a path refuse Save,
+// Update and the other methods that write their file, so changes go through
+// the manager instead.
+func detach(docs []*models.Document) []*models.Document {
+	for _, doc := range docs {
+		if doc != nil {
+			doc.Path = ""
+		}
+	}
+	return docs
+}
+
+func (dm *DocumentManager) call(op byte, req wire.Request, result interface{}) error {
+	req.Collection = dm.collection
+	return dm.cm.call(op, req, result)
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"Build-your-own-database/config"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/transfer"
+	"Build-your-own-database/server/cluster"
+	"Build-your-own-database/server/httpserver"
+	"Build-your-own-database/server/mongo"
+	"Build-your-own-database/server/replication"
+	"Build-your-own-database/server/resp"
+	"Build-your-own-database/server/shard"
+	"Build-your-own-database/server/wire"
+)
+
+// commands maps a command-line subcommand to its implementation
+var commands = map[string]func(args []string) error{
+	"serve":   serve,
+	"user":    user,
+	"role":    role,
+	"keys":    keys,
+	"fsck":    fsck,
+	"backup":  backup,
+	"restore": restore,
+	"export":  export,
+	"import":  importData,
+	"shard":   shardCommand,
+}
+
+// runCommand runs the subcommand named in args, if any, and reports whether one ran
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Println("❌ Unknown command:", args[0])
+		os.Exit(2)
+	}
+	if err := command(args[1:]); err != nil {
+		fmt.Println("❌", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// serve starts the network frontends and blocks until interrupted
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	httpAddr := flags.String("http", ":8080", "address for the HTTP API and change streams (empty to disable)")
+	respAddr := flags.String("resp", "", "address for the Redis protocol frontend, e.g. :6380 (empty to disable)")
+	wireAddr := flags.String("wire", "", "TCP address for the native wire protocol, e.g. :7070 (empty to disable)")
+	wireSocket := flags.String("socket", "", "Unix socket path for the native wire protocol (empty to disable)")
+	mongoAddr := flags.String("mongo", "", "address for the MongoDB protocol frontend, e.g. :27017 (empty to disable)")
+	replAddr := flags.String("replication", "", "TCP address to serve replicas on, e.g. :7400 (empty to disable)")
+	primary := flags.String("replica-of", "", "address of a primary's replication listener to follow as a read-only replica")
+	replUser := flags.String("replica-user", "", "user the replica authenticates to its primary as, once the primary has users")
+	replPassword := flags.String("replica-password", "", "password of -replica-user, sent unencrypted")
+	clusterAddr := flags.String("cluster", "", "TCP address this node is known by to its cluster, e.g. 127.0.0.1:7500 (empty to disable)")
+	clusterPeers := flags.String("cluster-peers", "", "comma-separated addresses of every first member, this one included, to bootstrap a new cluster")
+	clusterJoin := flags.String("cluster-join", "", "address of a member of an existing cluster to join")
+	clusterKey := flags.String("cluster-key", "", "key shared by every member of the cluster")
+	clusterReads := flags.String("cluster-reads", "local", "default read consistency over HTTP: local or linearizable")
+	flags.Parse(args)
+
+	if *clusterAddr != "" && (*replAddr != "" || *primary != "") {
+		return fmt.Errorf("invalid flags: a cluster member replicates through the cluster; drop -replication and -replica-of")
+	}
+	if *clusterReads != "local" && *clusterReads != "linearizable" {
+		return fmt.Errorf("invalid -cluster-reads '%s': use local or linearizable", *clusterReads)
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+
+	var node *replication.Node
+	if *replAddr != "" || *primary != "" {
+		var err error
+		if node, err = replication.New(dbManager); err != nil {
+			return err
+		}
+		defer node.Close()
+	}
+	if *primary != "" {
+		if err := node.Follow(*primary, replication.FollowOptions{User: *replUser, Password: *replPassword}); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, 7)
+	var member *cluster.Node
+	if *clusterAddr != "" {
+		var err error
+		if member, err = cluster.New(dbManager, *clusterAddr); err != nil {
+			return err
+		}
+		defer member.Close()
+		member.Key = *clusterKey
+		if *clusterPeers != "" {
+			if err := member.Bootstrap(strings.Split(*clusterPeers, ",")); err != nil {
+				return err
+			}
+		}
+		go func() { errs <- member.ListenAndServe() }()
+		if *clusterJoin != "" {
+			go member.Join(*clusterJoin)
+		}
+	}
+
+	if *httpAddr != "" {
+		server := httpserver.New(dbManager)
+		server.Replication = node
+		server.Shards = shard.NewManager(dbManager)
+		server.BackupDir = config.BackupPath
+		server.ShardDir = config.ShardPath
+		defer server.Shards.Close()
+		if member != nil {
+			server.Cluster = member
+			server.LinearizableReads = *clusterReads == "linearizable"
+		}
+		go func() { errs <- server.ListenAndServe(*httpAddr) }()
+	}
+	if *replAddr != "" {
+		go func() { errs <- node.ListenAndServe(*replAddr) }()
+	}
+	if *respAddr != "" {
+		go func() { errs <- resp.New(dbManager).ListenAndServe(*respAddr) }()
+	}
+	if *wireAddr != "" {
+		go func() { errs <- wire.New(dbManager).ListenAndServe("tcp", *wireAddr) }()
+	}
+	if *wireSocket != "" {
+		go func() { errs <- wire.New(dbManager).ListenAndServe("unix", *wireSocket) }()
+	}
+	if *mongoAddr != "" {
+		go func() { errs <- mongo.New(dbManager).ListenAndServe(*mongoAddr) }()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case <-interrupt:
+		fmt.Println("Shutting down")
+		return nil
+	}
+}
+
+// user manages the accounts the network frontends authenticate against:
+// user create NAME PASSWORD [ROLE...] | user drop NAME | user passwd NAME PASSWORD |
+// user grant NAME ROLE... | user revoke NAME ROLE... | user list
+func user(args []string) error {
+	usage := fmt.Errorf("usage: user create NAME PASSWORD [ROLE...] | drop NAME | passwd NAME PASSWORD | grant NAME ROLE... | revoke NAME ROLE... | list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+	users := auth.NewUserManager(dbManager)
+
+	switch {
+	case args[0] == "create" && len(args) >= 3:
+		for _, name := range args[3:] {
+			if _, err := users.GetRole(name); err != nil {
+				return err
+			}
+		}
+		if err := users.CreateUser(args[1], args[2]); err != nil {
+			return err
+		}
+		if len(args) > 3 {
+			if err := users.GrantRoles(args[1], args[3:]...); err != nil {
+				return err
+			}
+		}
+		fmt.Println("✅ Created user:", args[1])
+	case args[0] == "drop" && len(args) == 2:
+		if err := users.DropUser(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("✅ Dropped user:", args[1])
+	case args[0] == "passwd" && len(args) == 3:
+		if err := users.ChangePassword(args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("✅ Changed password of user:", args[1])
+	case args[0] == "grant" && len(args) >= 3:
+		if err := users.GrantRoles(args[1], args[2:]...); err != nil {
+			return err
+		}
+		fmt.Println("✅ Granted roles to user:", args[1])
+	case args[0] == "revoke" && len(args) >= 3:
+		if err := users.RevokeRoles(args[1], args[2:]...); err != nil {
+			return err
+		}
+		fmt.Println("✅ Revoked roles from user:", args[1])
+	case args[0] == "list" && len(args) == 1:
+		names, err := users.ListUsers()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			u, err := users.GetUser(name)
+			if err != nil {
+				return err
+			}
+			fmt.Println(name, u.Roles)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
+
+// role manages the roles granted to users. A grant is written
+// database[/collection]:privilege[,privilege...] with the privileges read,
+// write, index-manage and admin; "*" as database means every database.
+// role create NAME GRANT... | role drop NAME | role list
+func role(args []string) error {
+	usage := fmt.Errorf("usage: role create NAME GRANT... | drop NAME | list (GRANT is database[/collection]:read,write,index-manage,admin)")
+	if len(args) == 0 {
+		return usage
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+	users := auth.NewUserManager(dbManager)
+
+	switch {
+	case args[0] == "create" && len(args) >= 3:
+		var grants []access.Grant
+		for _, arg := range args[2:] {
+			grant, err := access.ParseGrant(arg)
+			if err != nil {
+				return err
+			}
+			grants = append(grants, grant)
+		}
+		if err := users.CreateRole(args[1], grants); err != nil {
+			return err
+		}
+		fmt.Println("✅ Created role:", args[1])
+	case args[0] == "drop" && len(args) == 2:
+		if err := users.DropRole(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("✅ Dropped role:", args[1])
+	case args[0] == "list" && len(args) == 1:
+		names, err := users.ListRoles()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			r, err := users.GetRole(name)
+			if err != nil {
+				return err
+			}
+			fmt.Println(name, r.Grants)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
+
+// keys manages encryption at rest. "generate" prints a new master key to set
+// as ENCRYPTION_KEY; "rotate" re-encrypts databases (all of them by default)
+// under new data keys; "rewrap" moves the data keys to a new master key;
+// "seal" encrypts what is left in plaintext and refuses plaintext from then on.
+// keys generate | keys rotate [DATABASE...] | keys rewrap NEW_KEY | keys seal | keys list
+func keys(args []string) error {
+	usage := fmt.Errorf("usage: keys generate | rotate [DATABASE...] | rewrap NEW_KEY | seal | list")
+	if len(args) == 0 {
+		return usage
+	}
+	if args[0] == "generate" && len(args) == 1 {
+		key, err := storage.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+	keyring, err := storage.KeyringOf(config.BasePath)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		return fmt.Errorf("encryption is not configured, set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE")
+	}
+
+	switch {
+	case args[0] == "rotate":
+		names := args[1:]
+		if len(names) == 0 {
+			if names, err = dbManager.ListDatabases(); err != nil {
+				return err
+			}
+			names = append(names, db.SystemDatabase)
+		}
+		for _, name := range names {
+			id, err := dbManager.RotateKeys(name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✅ Rotated database %s to key %s\n", name, id)
+		}
+	case args[0] == "rewrap" && len(args) == 2:
+		master, err := storage.ParseKey(args[1])
+		if err != nil {
+			return err
+		}
+		if err := keyring.Rewrap(master); err != nil {
+			return err
+		}
+		fmt.Println("✅ Rewrapped data keys, configure the new master key from now on")
+	case args[0] == "seal" && len(args) == 1:
+		sealed, err := dbManager.Seal()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✅ Sealed %d file(s), plaintext files are refused from now on\n", sealed)
+	case args[0] == "list" && len(args) == 1:
+		for _, info := range keyring.Keys() {
+			active := ""
+			if info.Active {
+				active = " (active)"
+			}
+			fmt.Printf("%s %s %s%s\n", info.ID, info.Database, info.CreatedAt.Format("2006-01-02 15:04:05"), active)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
+
+// fsck verifies the stored files of every database, or of those named, and
+// with -repair fixes what it can. It fails while problems remain.
+// fsck [-repair] [DATABASE...]
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix what can be fixed; stop the server first")
+	flags.Parse(args)
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+
+	report, err := dbManager.Fsck(*repair, flags.Args()...)
+	if err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		status := "❌"
+		if issue.Repaired {
+			status = "🔧"
+		}
+		fmt.Printf("%s %s %s: %s\n", status, issue.Kind, issue.Path, issue.Detail)
+	}
+	fmt.Printf("Checked %d database(s), %d collection(s), %d document(s), %d file(s): %d issue(s), %d repaired\n",
+		report.Databases, report.Collections, report.Documents, report.Files,
+		len(report.Issues), len(report.Issues)-report.Unrepaired())
+	if remaining := report.Unrepaired(); remaining > 0 {
+		return fmt.Errorf("%d issue(s) remain", remaining)
+	}
+	fmt.Println("✅ No problems remain")
+	return nil
+}
+
+// backup copies every database, or those named, into a new directory with a
+// manifest of checksums. With -base it saves only the changes made since the
+// base backup, full or incremental, to the databases it holds. To back up a
+// running server, use its POST /backup endpoint so changes made during the
+// copy are captured.
+// backup DEST [DATABASE...] | backup -base BASE DEST
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	base := flags.String("base", "", "backup to continue with an incremental backup of its databases")
+	flags.Parse(args)
+	if flags.NArg() == 0 || (*base != "" && flags.NArg() != 1) {
+		return fmt.Errorf("usage: backup DEST [DATABASE...] | backup -base BASE DEST")
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+
+	var manifest *db.BackupManifest
+	var err error
+	if *base != "" {
+		manifest, err = dbManager.BackupIncremental(flags.Arg(0), *base)
+	} else {
+		manifest, err = dbManager.Backup(flags.Arg(0), flags.Args()[1:]...)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Backed up %d database(s), %d file(s), up to LSN %d (backup %s)\n", len(manifest.Databases), len(manifest.Files), manifest.EndLSN, manifest.ID)
+	return nil
+}
+
+// restore verifies a backup and restores its databases, or one of them under
+// its own name or a new one, replaying the incremental backups listed after it
+// up to the point -until names. With -verify it only checks the backups.
+// restore [-verify] [-db NAME [-as NEW_NAME]] [-until LSN|TIME] FULL [INCREMENT...]
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "only check the backups against their manifests")
+	database := flags.String("db", "", "database of the backup to restore (default all)")
+	as := flags.String("as", "", "name to restore the -db database under")
+	until := flags.String("until", "", "last change to replay, as an LSN or an RFC 3339 time (default all)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: restore [-verify] [-db NAME [-as NEW_NAME]] [-until LSN|TIME] FULL [INCREMENT...]")
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+
+	if *verify {
+		for _, src := range flags.Args() {
+			manifest, err := dbManager.VerifyBackup(src)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✅ Backup %s of %v taken %s is intact (%d file(s), LSN %d to %d)\n", manifest.ID,
+				manifest.Databases, manifest.CreatedAt.Format(time.RFC3339), len(manifest.Files), manifest.StartLSN, manifest.EndLSN)
+		}
+		return nil
+	}
+
+	opts := db.RestoreOptions{Database: *database, As: *as, Increments: flags.Args()[1:]}
+	if *until != "" {
+		if lsn, err := strconv.ParseUint(*until, 10, 64); err == nil {
+			opts.UntilLSN = lsn
+		} else if opts.UntilTime, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("invalid -until '%s': expected an LSN or an RFC 3339 time", *until)
+		}
+	}
+	names, err := dbManager.RestoreBackup(flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println("✅ Restored:", strings.Join(names, ", "))
+	return nil
+}
+
+// export writes a collection to a file, or every collection of a database to
+// its own file in a directory, as JSON Lines, a JSON array or CSV. The format
+// defaults to the file's extension.
+// export [-format FORMAT] [-filter JSON] [-fields A,B] [-batch N] DATABASE[/COLLECTION] OUT
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "", "jsonl, json or csv (default from OUT's extension, else jsonl)")
+	filter := flags.String("filter", "", "export only documents matching this JSON filter")
+	fields := flags.String("fields", "", "comma-separated CSV columns (default every field)")
+	batch := flags.Int("batch", 0, "documents written between progress reports (default 1000)")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: export [-format FORMAT] [-filter JSON] [-fields A,B] [-batch N] DATABASE[/COLLECTION] OUT")
+	}
+
+	opts := transfer.ExportOptions{Format: *format, BatchSize: *batch, Progress: showProgress}
+	if *filter != "" {
+		if err := json.Unmarshal([]byte(*filter), &opts.Filter); err != nil {
+			return fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+	if *fields != "" {
+		opts.Fields = strings.Split(*fields, ",")
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+
+	database, colName, _ := strings.Cut(flags.Arg(0), "/")
+	target, err := dbManager.UseDatabase(database)
+	if err != nil {
+		return err
+	}
+	colManager := collections.NewCollectionManager(target)
+	out := flags.Arg(1)
+
+	var count int
+	if colName == "" {
+		count, err = transfer.ExportDatabase(colManager, out, opts)
+	} else {
+		if opts.Format == "" {
+			opts.Format = transfer.FormatOf(out)
+		}
+		var file *os.File
+		if file, err = os.Create(out); err != nil {
+			return err
+		}
+		count, err = transfer.ExportCollection(colManager, colName, file, opts)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Exported %d document(s) to %s\n", count, out)
+	return nil
+}
+
+// importData reads documents into a collection from a file, or into every
+// collection named by the files of a directory. The format defaults to each
+// file's extension. With -upsert, documents whose name exists are replaced.
+// import [-format FORMAT] [-name FIELD] [-upsert] [-columns H=F,...] [-noinfer] [-batch N] DATABASE[/COLLECTION] IN
+func importData(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "jsonl, json or csv (default from the file extension, else jsonl)")
+	name := flags.String("name", "", "field naming each document (default "+transfer.NameField+")")
+	upsert := flags.Bool("upsert", false, "replace documents whose name already exists")
+	columns := flags.String("columns", "", "CSV header mapping, e.g. 'E-mail=email,Zip=address.zip,Notes=-'")
+	noInfer := flags.Bool("noinfer", false, "keep CSV values as strings")
+	batch := flags.Int("batch", 0, "records read between progress reports (default 1000)")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: import [-format FORMAT] [-name FIELD] [-upsert] [-columns H=F,...] [-noinfer] [-batch N] DATABASE[/COLLECTION] IN")
+	}
+
+	mapping, err := transfer.ParseColumns(*columns)
+	if err != nil {
+		return err
+	}
+	opts := transfer.ImportOptions{
+		Format:    *format,
+		NameField: *name,
+		Upsert:    *upsert,
+		Columns:   mapping,
+		NoInfer:   *noInfer,
+		BatchSize: *batch,
+		Progress:  showProgress,
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+
+	database, colName, _ := strings.Cut(flags.Arg(0), "/")
+	target, err := dbManager.UseDatabase(database)
+	if err != nil {
+		if target, err = dbManager.CreateDatabase(database); err != nil {
+			return err
+		}
+	}
+	colManager := collections.NewCollectionManager(target)
+	in := flags.Arg(1)
+
+	var results []*transfer.Result
+	if colName == "" {
+		results, err = transfer.ImportDatabase(colManager, in, opts)
+	} else {
+		if opts.Format == "" {
+			opts.Format = transfer.FormatOf(in)
+		}
+		var file *os.File
+		if file, err = os.Open(in); err != nil {
+			return err
+		}
+		var result *transfer.Result
+		result, err = transfer.ImportCollection(colManager, colName, file, opts)
+		file.Close()
+		if result != nil {
+			results = append(results, result)
+		}
+	}
+	for _, result := range results {
+		fmt.Printf("✅ %s: %d inserted, %d updated\n", result.Collection, result.Inserted, result.Updated)
+	}
+	return err
+}
+
+// showProgress reports export and import progress on stderr
+func showProgress(p transfer.Progress) {
+	if p.Total > 0 {
+		fmt.Fprintf(os.Stderr, "⏳ %s: %d/%d document(s)\n", p.Collection, p.Documents, p.Total)
+	} else {
+		fmt.Fprintf(os.Stderr, "⏳ %s: %d record(s)\n", p.Collection, p.Documents)
+	}
+}
+
+// shardCommand manages the sharded collections whose layouts are kept under
+// the storage root. Stop a server routing the collection first, or use its
+// /shards endpoints instead.
+// shard create [-key FIELD] DATABASE COLLECTION LOCATION... | shard add DATABASE COLLECTION LOCATION |
+// shard rebalance DATABASE COLLECTION | shard status DATABASE COLLECTION | shard list
+func shardCommand(args []string) error {
+	usage := fmt.Errorf("usage: shard create [-key FIELD] DATABASE COLLECTION LOCATION... | add DATABASE COLLECTION LOCATION | rebalance DATABASE COLLECTION | status DATABASE COLLECTION | list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	dbManager := db.NewDBManager()
+	defer dbManager.Close()
+	shards := shard.NewManager(dbManager)
+	defer shards.Close()
+
+	switch {
+	case args[0] == "create":
+		flags := flag.NewFlagSet("shard create", flag.ExitOnError)
+		key := flags.String("key", "", "field to place documents by (default the document name)")
+		flags.Parse(args[1:])
+		if flags.NArg() < 3 {
+			return usage
+		}
+		router, err := shards.Create(flags.Arg(0), flags.Arg(1), *key, flags.Args()[2:])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✅ Sharded collection '%s.%s' over %d shard(s)\n", flags.Arg(0), flags.Arg(1), len(router.Layout().Shards))
+	case args[0] == "add" && len(args) == 4:
+		router, err := shards.Router(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		if err := router.AddShard(args[3]); err != nil {
+			return err
+		}
+		fmt.Println("✅ Added shard; run shard rebalance to move documents to it")
+	case args[0] == "rebalance" && len(args) == 3:
+		router, err := shards.Router(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		report, err := router.Rebalance()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✅ Moved %d bucket(s) and %d document(s), removed %d stale copies\n", report.Buckets, report.Moved, report.Removed)
+	case args[0] == "status" && len(args) == 3:
+		router, err := shards.Router(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		stats, err := router.Stats()
+		if err != nil {
+			return err
+		}
+		for _, s := range stats {
+			line := fmt.Sprintf("%s: %d bucket(s), %d document(s)", s.Location, s.Buckets, s.Documents)
+			if s.Misplaced > 0 {
+				line += fmt.Sprintf(", %d stale copies", s.Misplaced)
+			}
+			if s.Error != "" {
+				line += " ❌ " + s.Error
+			}
+			fmt.Println(line)
+		}
+	case args[0] == "list" && len(args) == 1:
+		layouts, err := shards.List()
+		if err != nil {
+			return err
+		}
+		for _, layout := range layouts {
+			key := layout.Key
+			if key == "" {
+				key = "(name)"
+			}
+			fmt.Printf("%s.%s by %s: %s\n", layout.Database, layout.Collection, key, strings.Join(layout.Shards, ", "))
+		}
+	default:
+		return usage
+	}
+	return nil
+}
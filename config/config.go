@@ -5,11 +5,51 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
 	// BasePath is the root directory where databases will be stored
 	BasePath = getEnv("BASE_PATH", "C:\\Users\\bhargav\\OneDrive\\Desktop\\DatabaseStorage")
+
+	// TTLInterval is how often expired documents are looked for and removed (0 disables the reaper)
+	TTLInterval = getDurationEnv("TTL_INTERVAL", time.Minute)
+
+	// PurgeInterval is how often trash and change log entries past their
+	// retention are looked for and removed (0 disables the purger)
+	PurgeInterval = getDurationEnv("PURGE_INTERVAL", time.Minute)
+
+	// TrashRetention is how long deleted databases, collections and documents
+	// stay restorable before being purged (0 deletes immediately)
+	TrashRetention = getDurationEnv("TRASH_RETENTION", 7*24*time.Hour)
+
+	// ChangeRetention is how long change log entries are kept once every
+	// replica and the latest backup have moved past them (0 keeps them forever)
+	ChangeRetention = getDurationEnv("CHANGE_RETENTION", 7*24*time.Hour)
+
+	// BackupPath is the directory the HTTP server takes backups into and
+	// restores them from; backup paths sent over HTTP are relative to it.
+	// Backups over HTTP are refused when it is empty.
+	BackupPath = getEnv("BACKUP_PATH", "")
+
+	// ShardPath is the directory the HTTP server creates directory shards in;
+	// shard paths sent over HTTP are relative to it. Directory shards over
+	// HTTP are refused when it is empty.
+	ShardPath = getEnv("SHARD_PATH", "")
+
+	// AllowRemoteSetup lets clients on other hosts use the network frontends,
+	// unauthenticated and with every privilege, while no user exists. Without
+	// it only loopback and Unix socket clients are served until then.
+	AllowRemoteSetup = getBoolEnv("ALLOW_REMOTE_SETUP", false)
+
+	// EncryptionKey is the master key for encryption at rest: 32 bytes, hex or
+	// base64 encoded. Files are written in plaintext when neither it nor
+	// EncryptionKeyFile is set.
+	EncryptionKey = getEnv("ENCRYPTION_KEY", "")
+
+	// EncryptionKeyFile names a file holding the master key, used when EncryptionKey is empty
+	EncryptionKeyFile = getEnv("ENCRYPTION_KEY_FILE", "")
 )
 
 // getEnv is a helper function to read environment variables with a default fallback
@@ -21,6 +61,34 @@ func getEnv(key string, defaultValue string) string {
 	return value
 }
 
+// getDurationEnv reads a duration such as "90s" or "1h" from an environment variable
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Invalid duration %s=%q, using %v\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// getBoolEnv reads a boolean such as "true" or "1" from an environment variable
+func getBoolEnv(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("Invalid boolean %s=%q, using %v\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
 // Validate checks if the required configurations are set correctly
 func Validate() error {
 	// You can add any other checks or validations for configuration
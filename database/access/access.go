@@ -0,0 +1,165 @@
+// Package access decides what a caller may do. The caller's identity travels
+// in a context.Context; the managers check it at their entry points.
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Privilege is a kind of access to a database or collection
+type Privilege string
+
+const (
+	Read        Privilege = "read"         // Read documents, stats and change streams
+	Write       Privilege = "write"        // Insert, update and delete documents (implies read)
+	IndexManage Privilege = "index-manage" // Create indexes and TTL indexes
+	Admin       Privilege = "admin"        // Create, drop, rename and configure (implies everything)
+)
+
+// AnyDatabase in a grant applies it to every database
+const AnyDatabase = "*"
+
+// ErrDenied is returned, wrapped, when the caller lacks a privilege
+var ErrDenied = errors.New("permission denied")
+
+// Grant gives privileges on a database or on a single collection of it
+type Grant struct {
+	Database   string      `json:"database"`             // A database name or AnyDatabase
+	Collection string      `json:"collection,omitempty"` // Empty for the whole database
+	Privileges []Privilege `json:"privileges"`
+}
+
+// Role is a named set of grants assigned to users
+type Role struct {
+	Name   string  `json:"name"`
+	Grants []Grant `json:"grants"`
+}
+
+// Identity is an authenticated caller and the grants of all its roles
+type Identity struct {
+	User   string
+	Grants []Grant
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context carrying the caller's identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the caller's identity, or nil for in-process callers
+func FromContext(ctx context.Context) *Identity {
+	if ctx == nil {
+		return nil
+	}
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// Check returns an error unless the caller holds privilege on the collection,
+// or on the database as a whole when collection is empty. Contexts without an
+// identity belong to the process itself and may do anything.
+func Check(ctx context.Context, privilege Privilege, database, collection string) error {
+	identity := FromContext(ctx)
+	if identity == nil {
+		return nil
+	}
+	for _, grant := range identity.Grants {
+		if grant.covers(database, collection) && grant.holds(privilege) {
+			return nil
+		}
+	}
+
+	target := fmt.Sprintf("database '%s'", database)
+	if collection != "" {
+		target = fmt.Sprintf("collection '%s.%s'", database, collection)
+	}
+	return fmt.Errorf("%w: user '%s' lacks %s on %s", ErrDenied, identity.User, privilege, target)
+}
+
+// Visible reports whether the caller holds any privilege on the collection, or
+// anywhere in the database when collection is empty. Listings only show what
+// is visible, and a database must be visible to be opened.
+func Visible(ctx context.Context, database, collection string) bool {
+	identity := FromContext(ctx)
+	if identity == nil {
+		return true
+	}
+	for _, grant := range identity.Grants {
+		if grant.Database != AnyDatabase && grant.Database != database {
+			continue
+		}
+		if collection == "" || grant.Collection == "" || grant.Collection == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckVisible is Visible as an error, for opening a database or collection
+func CheckVisible(ctx context.Context, database, collection string) error {
+	if Visible(ctx, database, collection) {
+		return nil
+	}
+	return Check(ctx, Read, database, collection)
+}
+
+// ParseGrant reads a grant written as "database:privileges" or
+// "database/collection:privileges", privileges separated by commas, such as
+// "shop/orders:read,write" or "*:admin"
+func ParseGrant(s string) (Grant, error) {
+	at := strings.LastIndex(s, ":")
+	if at < 0 {
+		return Grant{}, fmt.Errorf("invalid grant '%s', expected database[/collection]:privileges", s)
+	}
+	var grant Grant
+	grant.Database, grant.Collection, _ = strings.Cut(s[:at], "/")
+	for _, privilege := range strings.Split(s[at+1:], ",") {
+		grant.Privileges = append(grant.Privileges, Privilege(strings.TrimSpace(privilege)))
+	}
+	if err := grant.Validate(); err != nil {
+		return Grant{}, fmt.Errorf("invalid grant '%s': %v", s, err)
+	}
+	return grant, nil
+}
+
+// Validate rejects grants with unknown privileges or without a database
+func (g Grant) Validate() error {
+	if g.Database == "" {
+		return errors.New("grant needs a database")
+	}
+	if len(g.Privileges) == 0 {
+		return errors.New("grant needs at least one privilege")
+	}
+	for _, privilege := range g.Privileges {
+		switch privilege {
+		case Read, Write, IndexManage, Admin:
+		default:
+			return fmt.Errorf("unknown privilege '%s'", privilege)
+		}
+	}
+	return nil
+}
+
+// covers reports whether the grant applies to a collection, or to the whole
+// database when collection is empty
+func (g Grant) covers(database, collection string) bool {
+	if g.Database != AnyDatabase && g.Database != database {
+		return false
+	}
+	return g.Collection == "" || g.Collection == collection
+}
+
+// holds reports whether the grant's privileges include or imply privilege
+func (g Grant) holds(privilege Privilege) bool {
+	for _, p := range g.Privileges {
+		if p == privilege || p == Admin || (p == Write && privilege == Read) {
+			return true
+		}
+	}
+	return false
+}
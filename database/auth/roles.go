@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"Build-your-own-database/database/access"
+)
+
+// RolesCollection is the system database collection holding roles
+const RolesCollection = "roles"
+
+// RootRole is built in and grants admin on every database
+const RootRole = "root"
+
+var builtinRoles = map[string]access.Role{
+	RootRole: {Name: RootRole, Grants: []access.Grant{{Database: access.AnyDatabase, Privileges: []access.Privilege{access.Admin}}}},
+}
+
+// CreateRole defines a role from its grants
+func (um *UserManager) CreateRole(name string, grants []access.Grant) error {
+	if name == "" || strings.ContainsAny(name, ":/\\") {
+		return fmt.Errorf("invalid role name '%s'", name)
+	}
+	if _, builtin := builtinRoles[name]; builtin {
+		return fmt.Errorf("role '%s' already exists", name)
+	}
+	for _, grant := range grants {
+		if err := grant.Validate(); err != nil {
+			return fmt.Errorf("invalid grant for role '%s': %v", name, err)
+		}
+	}
+
+	dm, _, err := um.open(RolesCollection, true)
+	if err != nil {
+		return err
+	}
+	data, err := toData(access.Role{Name: name, Grants: grants})
+	if err != nil {
+		return err
+	}
+	if _, err := dm.CreateDocument(name, data); err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("role '%s' already exists", name)
+		}
+		return err
+	}
+	fmt.Println("Role created:", name)
+	return nil
+}
+
+// DropRole removes a role. Users keep its name but no longer get its grants.
+func (um *UserManager) DropRole(name string) error {
+	if _, builtin := builtinRoles[name]; builtin {
+		return fmt.Errorf("built-in role '%s' cannot be dropped", name)
+	}
+	dm, _, err := um.open(RolesCollection, false)
+	if err != nil {
+		return err
+	}
+	if dm == nil || dm.DeleteDocument(name) != nil {
+		return fmt.Errorf("role '%s' does not exist", name)
+	}
+	fmt.Println("Role dropped:", name)
+	return nil
+}
+
+// GetRole returns a built-in or stored role
+func (um *UserManager) GetRole(name string) (*access.Role, error) {
+	if role, builtin := builtinRoles[name]; builtin {
+		return &role, nil
+	}
+	var role access.Role
+	if _, err := um.read(RolesCollection, name, &role); err != nil {
+		return nil, fmt.Errorf("role '%s' does not exist", name)
+	}
+	return &role, nil
+}
+
+// ListRoles returns the names of the built-in and stored roles
+func (um *UserManager) ListRoles() ([]string, error) {
+	var names []string
+	for name := range builtinRoles {
+		names = append(names, name)
+	}
+
+	dm, _, err := um.open(RolesCollection, false)
+	if err != nil {
+		return nil, err
+	}
+	if dm != nil {
+		docs, err := dm.FindDocuments(nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			names = append(names, doc.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GrantRoles adds roles to a user
+func (um *UserManager) GrantRoles(name string, roles ...string) error {
+	for _, role := range roles {
+		if _, err := um.GetRole(role); err != nil {
+			return err
+		}
+	}
+	return um.updateRoles(name, func(current []string) []string {
+		for _, role := range roles {
+			if !contains(current, role) {
+				current = append(current, role)
+			}
+		}
+		return current
+	})
+}
+
+// RevokeRoles removes roles from a user
+func (um *UserManager) RevokeRoles(name string, roles ...string) error {
+	return um.updateRoles(name, func(current []string) []string {
+		var kept []string
+		for _, role := range current {
+			if !contains(roles, role) {
+				kept = append(kept, role)
+			}
+		}
+		return kept
+	})
+}
+
+// Identity resolves a user's roles into the identity the managers check.
+// Roles dropped since they were granted are skipped.
+func (um *UserManager) Identity(user *User) (*access.Identity, error) {
+	identity := &access.Identity{User: user.Name}
+	for _, name := range user.Roles {
+		role, err := um.GetRole(name)
+		if err != nil {
+			continue
+		}
+		identity.Grants = append(identity.Grants, role.Grants...)
+	}
+	return identity, nil
+}
+
+// updateRoles rewrites a user's role list
+func (um *UserManager) updateRoles(name string, change func([]string) []string) error {
+	user, err := um.GetUser(name)
+	if err != nil {
+		return err
+	}
+	roles := change(user.Roles)
+
+	dm, _, err := um.open(UsersCollection, false)
+	if err != nil {
+		return err
+	}
+	if len(roles) == 0 {
+		_, err = dm.UpdateDocument(name, nil, []string{"roles"})
+	} else {
+		_, err = dm.UpdateDocument(name, map[string]interface{}{"roles": roles}, nil)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Roles of user '%s': %v\n", name, roles)
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ScramMechanism is the SASL mechanism Scram implements
+const ScramMechanism = "SCRAM-SHA-256"
+
+// Scram is the server side of one SCRAM-SHA-256 conversation (RFC 5802, RFC 7677)
+type Scram struct {
+	um *UserManager
+
+	user            *User
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+	step            int
+}
+
+// NewScram starts a SCRAM-SHA-256 conversation
+func (um *UserManager) NewScram() *Scram {
+	return &Scram{um: um}
+}
+
+// User returns the authenticated user once the conversation has succeeded
+func (s *Scram) User() *User {
+	if s.step < 2 {
+		return nil
+	}
+	return s.user
+}
+
+// Step consumes a client message and returns the server's reply. done is set
+// with the final server message, once the client has proven its password.
+func (s *Scram) Step(message []byte) (reply []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		reply, err = s.clientFirst(string(message))
+	case 1:
+		reply, err = s.clientFinal(string(message))
+		done = err == nil
+	default:
+		return nil, false, errors.New("SCRAM conversation already finished")
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s.step++
+	return reply, done, nil
+}
+
+func (s *Scram) clientFirst(message string) ([]byte, error) {
+	// gs2 header: channel binding flag and optional authzid
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+	s.clientFirstBare = parts[2]
+
+	attrs := scramAttributes(s.clientFirstBare)
+	name, clientNonce := unescapeName(attrs["n"]), attrs["r"]
+	if name == "" || clientNonce == "" {
+		return nil, errors.New("invalid SCRAM client-first message")
+	}
+
+	user, err := s.um.GetUser(name)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	s.user = user
+
+	serverNonce := make([]byte, 24)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(user.Salt), user.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *Scram) clientFinal(message string) ([]byte, error) {
+	proofAt := strings.LastIndex(message, ",p=")
+	if proofAt < 0 {
+		return nil, errors.New("invalid SCRAM client-final message")
+	}
+	withoutProof := message[:proofAt]
+	attrs := scramAttributes(message)
+	if attrs["r"] != s.nonce {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errors.New("invalid SCRAM proof")
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	signature := hmacSHA256(s.user.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	stored := sha256.Sum256(clientKey)
+	if !hmac.Equal(stored[:], s.user.StoredKey) {
+		return nil, ErrInvalidCredentials
+	}
+
+	serverSignature := hmacSHA256(s.user.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// scramAttributes splits "a=1,b=2" into its attributes
+func scramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(message, ",") {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			attrs[key] = value
+		}
+	}
+	return attrs
+}
+
+// unescapeName decodes the "=2C" and "=3D" escapes SCRAM uses in user names
+func unescapeName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
@@ -0,0 +1,360 @@
+// Package auth manages users and verifies their passwords. Users live in the
+// internal system database; passwords are kept only as salted SCRAM-SHA-256
+// keys derived with PBKDF2, which also lets wire protocols run SCRAM.
+//
+// Authentication is enforced by the network frontends once at least one user
+// exists, so a fresh instance stays open until its first user is created:
+// to local clients only, unless config.AllowRemoteSetup is set.
+// What an authenticated user may do is set by its roles (see roles.go).
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"Build-your-own-database/config"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// UsersCollection is the system database collection holding users
+const UsersCollection = "users"
+
+// Iterations is the PBKDF2 iteration count for new passwords
+const Iterations = 15000
+
+// ErrInvalidCredentials is returned for an unknown user or a wrong password
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrRemoteSetup is returned to a client on another host while no user exists
+var ErrRemoteSetup = fmt.Errorf("%w: no user exists yet, so only local clients are served (create a user or set ALLOW_REMOTE_SETUP)", access.ErrDenied)
+
+// User is a stored user; its password is represented only by derived keys
+type User struct {
+	Name       string    `json:"name"`
+	Salt       []byte    `json:"salt"`
+	Iterations int       `json:"iterations"`
+	StoredKey  []byte    `json:"storedKey"`
+	ServerKey  []byte    `json:"serverKey"`
+	Roles      []string  `json:"roles,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// UserManager creates, changes and verifies users
+type UserManager struct {
+	dbm *db.DBManager
+
+	mu       sync.Mutex
+	verified map[string]verification // Recently verified passwords, to skip PBKDF2
+	secret   []byte                  // Keys the MACs of verified passwords; never leaves the process
+	enabled  bool                    // A user was seen, so Enabled need not look again
+}
+
+// verification remembers a password that matched a given revision of a user,
+// by its MAC under the manager's secret and the user's salt, so what is kept
+// is no help in guessing the password without the secret
+type verification struct {
+	revision int64
+	password [sha256.Size]byte
+}
+
+func NewUserManager(dbm *db.DBManager) *UserManager {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return &UserManager{dbm: dbm, verified: make(map[string]verification), secret: secret}
+}
+
+// CreateUser adds a user with a password
+func (um *UserManager) CreateUser(name, password string) error {
+	if name == "" || strings.ContainsAny(name, ":/\\") {
+		return fmt.Errorf("invalid user name '%s'", name)
+	}
+	if password == "" {
+		return fmt.Errorf("password for '%s' must not be empty", name)
+	}
+	dm, _, err := um.open(UsersCollection, true)
+	if err != nil {
+		return err
+	}
+
+	user, err := newUser(name, password)
+	if err != nil {
+		return err
+	}
+	data, err := toData(user)
+	if err != nil {
+		return err
+	}
+	if _, err := dm.CreateDocument(name, data); err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("user '%s' already exists", name)
+		}
+		return err
+	}
+	fmt.Println("User created:", name)
+	return nil
+}
+
+// DropUser removes a user
+func (um *UserManager) DropUser(name string) error {
+	dm, _, err := um.open(UsersCollection, false)
+	if err != nil {
+		return err
+	}
+	if dm == nil || dm.DeleteDocument(name) != nil {
+		return fmt.Errorf("user '%s' does not exist", name)
+	}
+	um.forget(name)
+	um.mu.Lock()
+	um.enabled = false
+	um.mu.Unlock()
+	fmt.Println("User dropped:", name)
+	return nil
+}
+
+// ChangePassword replaces a user's password
+func (um *UserManager) ChangePassword(name, password string) error {
+	if password == "" {
+		return fmt.Errorf("password for '%s' must not be empty", name)
+	}
+	existing, err := um.GetUser(name)
+	if err != nil {
+		return err
+	}
+	user, err := newUser(name, password)
+	if err != nil {
+		return err
+	}
+	user.CreatedAt = existing.CreatedAt
+	user.Roles = existing.Roles
+
+	data, err := toData(user)
+	if err != nil {
+		return err
+	}
+	dm, _, err := um.open(UsersCollection, false)
+	if err != nil {
+		return err
+	}
+	if _, err := dm.UpdateDocument(name, data, nil); err != nil {
+		return err
+	}
+	um.forget(name)
+	fmt.Println("Password changed for user:", name)
+	return nil
+}
+
+// ListUsers returns the names of every user
+func (um *UserManager) ListUsers() ([]string, error) {
+	dm, _, err := um.open(UsersCollection, false)
+	if err != nil || dm == nil {
+		return nil, err
+	}
+	docs, err := dm.FindDocuments(nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(docs))
+	for i, doc := range docs {
+		names[i] = doc.Name
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Enabled reports whether any user exists, and so whether frontends require
+// authentication. Once a user is seen the answer is kept until DropUser, so
+// frontends can ask on every request; a user dropped elsewhere leaves it
+// true, which only asks for credentials no one holds.
+func (um *UserManager) Enabled() (bool, error) {
+	um.mu.Lock()
+	enabled := um.enabled
+	um.mu.Unlock()
+	if enabled {
+		return true, nil
+	}
+
+	names, err := um.ListUsers()
+	if err != nil || len(names) == 0 {
+		return false, err
+	}
+	um.mu.Lock()
+	um.enabled = true
+	um.mu.Unlock()
+	return true, nil
+}
+
+// Required reports whether a client at remote must authenticate. It must once
+// users exist; until then a local client may do anything, including create
+// the first user, and any other client is refused with ErrRemoteSetup unless
+// config.AllowRemoteSetup is set.
+func (um *UserManager) Required(remote net.Addr) (bool, error) {
+	enabled, err := um.Enabled()
+	if err != nil || enabled {
+		return enabled, err
+	}
+	if !config.AllowRemoteSetup && !local(remote) {
+		return false, ErrRemoteSetup
+	}
+	return false, nil
+}
+
+// local reports whether an address is that of a loopback or Unix socket peer
+func local(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr != nil && addr.IP.IsLoopback()
+	}
+	return false
+}
+
+// GetUser returns a stored user
+func (um *UserManager) GetUser(name string) (*User, error) {
+	user, _, err := um.load(name)
+	return user, err
+}
+
+// Authenticate checks a user's password and returns the user
+func (um *UserManager) Authenticate(name, password string) (*User, error) {
+	user, revision, err := um.load(name)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	digest := um.mac(user.Salt, password)
+	um.mu.Lock()
+	cached, ok := um.verified[name]
+	um.mu.Unlock()
+	if ok && cached.revision == revision && subtle.ConstantTimeCompare(cached.password[:], digest[:]) == 1 {
+		return user, nil
+	}
+
+	storedKey, _ := scramKeys(password, user.Salt, user.Iterations)
+	if subtle.ConstantTimeCompare(storedKey, user.StoredKey) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	um.mu.Lock()
+	um.verified[name] = verification{revision: revision, password: digest}
+	um.mu.Unlock()
+	return user, nil
+}
+
+// mac returns the MAC of a password and its salt under the manager's secret
+func (um *UserManager) mac(salt []byte, password string) [sha256.Size]byte {
+	h := hmac.New(sha256.New, um.secret)
+	h.Write(salt)
+	h.Write([]byte(password))
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// load reads a user and the revision of its document
+func (um *UserManager) load(name string) (*User, int64, error) {
+	var user User
+	revision, err := um.read(UsersCollection, name, &user)
+	if err != nil {
+		return nil, 0, fmt.Errorf("user '%s' does not exist", name)
+	}
+	return &user, revision, nil
+}
+
+// read decodes a document of a system collection into v and returns its revision
+func (um *UserManager) read(collection, name string, v interface{}) (int64, error) {
+	dm, col, err := um.open(collection, false)
+	if err != nil {
+		return 0, err
+	}
+	if dm == nil {
+		return 0, fmt.Errorf("document '%s' does not exist", name)
+	}
+	doc, err := dm.UseDocument(name)
+	if err != nil {
+		return 0, err
+	}
+
+	col.Mutex.RLock()
+	raw, err := json.Marshal(doc.Data)
+	revision := doc.Revision
+	col.Mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return 0, fmt.Errorf("failed to decode '%s': %v", name, err)
+	}
+	return revision, nil
+}
+
+// open returns a DocumentManager for a collection of the system database.
+// Unless create is set, it is nil while the collection has never been created.
+func (um *UserManager) open(collection string, create bool) (*documents.DocumentManager, *models.Collection, error) {
+	system, err := um.dbm.System()
+	if err != nil {
+		return nil, nil, err
+	}
+	cm := collections.NewCollectionManager(system)
+	col, err := cm.UseCollection(collection)
+	if err != nil && create {
+		col, err = cm.CreateCollection(collection)
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			col, err = cm.UseCollection(collection)
+		}
+	}
+	if err != nil {
+		if !create && strings.Contains(err.Error(), "does not exist") {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	return documents.NewDocumentManager(col), col, nil
+}
+
+func (um *UserManager) forget(name string) {
+	um.mu.Lock()
+	delete(um.verified, name)
+	um.mu.Unlock()
+}
+
+func newUser(name, password string) (*User, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	storedKey, serverKey := scramKeys(password, salt, Iterations)
+	return &User{
+		Name:       name,
+		Salt:       salt,
+		Iterations: Iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// toData converts a user or role to document data
+func toData(v interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	err = json.Unmarshal(raw, &data)
+	return data, err
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"Build-your-own-database/config"
+	"Build-your-own-database/database/db"
+)
+
+func TestRequired(t *testing.T) {
+	dbm := db.Open(t.TempDir())
+	defer dbm.Close()
+	um := NewUserManager(dbm)
+
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	remote := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 50000}
+	socket := &net.UnixAddr{Name: "@", Net: "unix"}
+
+	tests := []struct {
+		name         string
+		users        bool
+		allowRemote  bool
+		addr         net.Addr
+		wantRequired bool
+		wantErr      error
+	}{
+		{"loopback before users", false, false, loopback, false, nil},
+		{"IPv6 loopback before users", false, false, &net.TCPAddr{IP: net.IPv6loopback}, false, nil},
+		{"Unix socket before users", false, false, socket, false, nil},
+		{"remote before users", false, false, remote, false, ErrRemoteSetup},
+		{"unknown address before users", false, false, nil, false, ErrRemoteSetup},
+		{"remote before users, allowed", false, true, remote, false, nil},
+		{"loopback with users", true, false, loopback, true, nil},
+		{"remote with users", true, false, remote, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if enabled, _ := um.Enabled(); enabled != tt.users {
+				if tt.users {
+					if err := um.CreateUser("alice", "s3cret"); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := um.DropUser("alice"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer func(allow bool) { config.AllowRemoteSetup = allow }(config.AllowRemoteSetup)
+			config.AllowRemoteSetup = tt.allowRemote
+
+			required, err := um.Required(tt.addr)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Required(%v) error = %v, want %v", tt.addr, err, tt.wantErr)
+			}
+			if required != tt.wantRequired {
+				t.Errorf("Required(%v) = %v, want %v", tt.addr, required, tt.wantRequired)
+			}
+		})
+	}
+}
+
+func TestEnabledFollowsUserChanges(t *testing.T) {
+	dbm := db.Open(t.TempDir())
+	defer dbm.Close()
+	um := NewUserManager(dbm)
+
+	steps := []struct {
+		name   string
+		change func() error
+		want   bool
+	}{
+		{"no users", nil, false},
+		{"first user created", func() error { return um.CreateUser("alice", "s3cret") }, true},
+		{"second user created", func() error { return um.CreateUser("bob", "s3cret") }, true},
+		{"one of two dropped", func() error { return um.DropUser("alice") }, true},
+		{"last user dropped", func() error { return um.DropUser("bob") }, false},
+		{"user created again", func() error { return um.CreateUser("carol", "s3cret") }, true},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			if err := step.change(); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+		// Asked twice, so a cached answer is checked as well as a fresh one
+		for i := 0; i < 2; i++ {
+			if got, err := um.Enabled(); err != nil || got != step.want {
+				t.Fatalf("%s: Enabled() = %v, %v, want %v", step.name, got, err, step.want)
+			}
+		}
+	}
+}
+
+func TestDropAfterReopen(t *testing.T) {
+	tests := []struct {
+		name          string
+		drop          func(um *UserManager) error
+		listed        func(um *UserManager) ([]string, error)
+		dropped, kept string
+	}{
+		{"user", func(um *UserManager) error { return um.DropUser("alice") }, (*UserManager).ListUsers, "alice", "bob"},
+		{"role", func(um *UserManager) error { return um.DropRole("reader") }, (*UserManager).ListRoles, "reader", "writer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dbm := db.Open(root)
+			um := NewUserManager(dbm)
+			for _, name := range []string{"alice", "bob"} {
+				if err := um.CreateUser(name, "s3cret"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range []string{"reader", "writer"} {
+				if err := um.CreateRole(name, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dbm.Close()
+
+			// A new process has read none of the documents yet
+			dbm = db.Open(root)
+			defer dbm.Close()
+			um = NewUserManager(dbm)
+			if err := tt.drop(um); err != nil {
+				t.Fatalf("drop error = %v", err)
+			}
+			got, err := tt.listed(um)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listed := "," + strings.Join(got, ",") + ","
+			if strings.Contains(listed, ","+tt.dropped+",") || !strings.Contains(listed, ","+tt.kept+",") {
+				t.Errorf("listed %v after dropping '%s', want '%s' and not '%s'", got, tt.dropped, tt.kept, tt.dropped)
+			}
+		})
+	}
+}
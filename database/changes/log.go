@@ -0,0 +1,437 @@
+package changes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// Dir is the directory under the storage root that holds the change log
+const Dir = ".changes"
+
+// LogFile is the file in Dir holding the log's entries
+const LogFile = "changes.log"
+
+// Log is the durable, append-only record of every change under a storage root.
+// Each change is one JSON line, numbered by a log sequence number (LSN). Old
+// entries are dropped by Compact once every consumer holding them, such as a
+// replica or the next incremental backup, has moved past them.
+type Log struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File        // Open for appending
+	size    int64           // Bytes written so far
+	first   uint64          // LSN of the first entry kept in the file
+	last    uint64          // LSN of the most recent entry
+	offsets []int64         // offsets[i] is where the entry with LSN first+i starts
+	signal  chan struct{}   // Closed and replaced on every append
+	holds   map[string]hold // Consumers whose entries Compact keeps, by name
+}
+
+var (
+	logsMu sync.Mutex
+	logs   = make(map[string]*Log)
+)
+
+func init() {
+	models.OnCommit(record)
+}
+
+// record appends an emitted change event to the log of its storage root,
+// under the LSN it was proposed with if it has one. A change that cannot be
+// recorded fails the write that made it, as it would reach no watcher,
+// replica or backup.
+func record(event models.ChangeEvent) error {
+	if event.Root == "" {
+		return nil
+	}
+	log, err := Open(event.Root)
+	switch {
+	case err != nil:
+	case event.LSN != 0:
+		err = log.Mirror(event)
+	default:
+		_, err = log.Append(event)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record change: %v", err)
+	}
+	return nil
+}
+
+// Open returns the change log kept under a storage root, creating it if needed.
+// Every caller gets the same Log for the same root.
+func Open(root string) (*Log, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	logsMu.Lock()
+	defer logsMu.Unlock()
+
+	if log, ok := logs[abs]; ok {
+		return log, nil
+	}
+
+	dir := filepath.Join(abs, Dir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create change log directory: %v", err)
+	}
+	log := &Log{path: filepath.Join(dir, LogFile), holds: make(map[string]hold)}
+	if err := log.load(); err != nil {
+		return nil, err
+	}
+	if err := log.loadHolds(); err != nil {
+		log.file.Close()
+		return nil, err
+	}
+	logs[abs] = log
+	return log, nil
+}
+
+// load indexes the entries already in the log file and opens it for appending.
+// A torn final line, left by a crash mid-append, has no newline and is cut off.
+func (l *Log) load() error {
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open change log: %v", err)
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to read change log: %v", err)
+		}
+		// A complete line that cannot be read is not a torn append: cutting it
+		// off would lose every entry after it, so refuse to open the log
+		event, err := decodeEntry(l.path, line)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("corrupt change log entry after LSN %d: %v", l.last, err)
+		}
+		if len(l.offsets) == 0 {
+			l.first = event.LSN
+		}
+		l.offsets = append(l.offsets, offset)
+		l.last = event.LSN
+		offset += int64(len(line))
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to repair change log: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = offset
+	return nil
+}
+
+// Append records an event, assigning it the next LSN, and returns that LSN
+func (l *Log) Append(event models.ChangeEvent) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	event.LSN = l.last + 1
+	if err := l.write(event); err != nil {
+		return 0, err
+	}
+	return event.LSN, nil
+}
+
+// Mirror records an event read from another log, such as a primary's, under
+// the LSN it already has. It must directly follow the last entry, so the two
+// logs stay the same entry for entry.
+func (l *Log) Mirror(event models.ChangeEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if event.LSN != l.last+1 {
+		return fmt.Errorf("invalid change: LSN %d does not follow the last entry, LSN %d", event.LSN, l.last)
+	}
+	return l.write(event)
+}
+
+// write appends an event whose LSN is set and syncs it to disk, so a change
+// acknowledged to its writer survives a crash; the caller holds mu
+func (l *Log) write(event models.ChangeEvent) error {
+	line, err := encodeEntry(l.path, event)
+	if err != nil {
+		return fmt.Errorf("failed to encode change: %v", err)
+	}
+	_, err = l.file.Write(line)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// Cut off whatever part of the line made it, so the next append starts a line
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, io.SeekStart)
+		return fmt.Errorf("failed to append change: %v", err)
+	}
+
+	if len(l.offsets) == 0 {
+		l.first = event.LSN
+	}
+	l.offsets = append(l.offsets, l.size)
+	l.size += int64(len(line))
+	l.last = event.LSN
+
+	if l.signal != nil {
+		close(l.signal)
+		l.signal = nil
+	}
+	return nil
+}
+
+// LastLSN returns the LSN of the most recent entry, 0 for an empty log
+func (l *Log) LastLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// FirstLSN returns the LSN of the oldest entry still kept, 0 for an empty log
+func (l *Log) FirstLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.first
+}
+
+// Read calls fn, in order, with every entry after the given LSN that was in
+// the log when Read was called. Returning an error from fn stops the read.
+func (l *Log) Read(after uint64, fn func(models.ChangeEvent) error) error {
+	return l.scan(after, func(_ []byte, event models.ChangeEvent) error {
+		return fn(event)
+	})
+}
+
+// Entry returns the entry with the given LSN
+func (l *Log) Entry(lsn uint64) (models.ChangeEvent, error) {
+	var found models.ChangeEvent
+	if lsn == 0 || lsn > l.LastLSN() {
+		return found, fmt.Errorf("change at LSN %d does not exist", lsn)
+	}
+	err := l.Read(lsn-1, func(event models.ChangeEvent) error {
+		found = event
+		return errStop
+	})
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	return found, err
+}
+
+// Follow calls fn, in order, with every entry after the given LSN and then
+// with each new entry as it is appended, until ctx is done or fn returns an
+// error, which Follow returns
+func (l *Log) Follow(ctx context.Context, after uint64, fn func(models.ChangeEvent) error) error {
+	for {
+		// Take the signal before reading so an append during the read is not missed
+		changed := l.changed()
+		err := l.Read(after, func(event models.ChangeEvent) error {
+			after = event.LSN
+			return fn(event)
+		})
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Export writes the entries after one LSN, up to and including another, that
+// keep accepts, exactly as they are stored, and returns how many it wrote.
+// Sealed entries stay sealed under the root's keys; see ReadFile.
+func (l *Log) Export(w io.Writer, after, until uint64, keep func(models.ChangeEvent) bool) (int, error) {
+	count := 0
+	err := l.scan(after, func(line []byte, event models.ChangeEvent) error {
+		if event.LSN > until {
+			return errStop
+		}
+		if keep != nil && !keep(event) {
+			return nil
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	return count, err
+}
+
+// errStop ends a scan early without failing it
+var errStop = errors.New("stop")
+
+// scan calls fn with the stored line and decoded event of every entry after
+// the given LSN that was in the log when scan was called
+func (l *Log) scan(after uint64, fn func([]byte, models.ChangeEvent) error) error {
+	l.mu.Lock()
+	if after >= l.last {
+		l.mu.Unlock()
+		return nil
+	}
+	if after+1 < l.first {
+		l.mu.Unlock()
+		return fmt.Errorf("changes after LSN %d are no longer in the log", after)
+	}
+	start, end, until := l.offsets[after+1-l.first], l.size, l.last
+	// Opened before unlocking, so a compaction cannot replace the file the offsets point into
+	file, err := os.Open(l.path)
+	l.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to open change log: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, start, end-start))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read change log: %v", err)
+		}
+		event, err := decodeEntry(l.path, line)
+		if err != nil {
+			return fmt.Errorf("corrupt change log entry after LSN %d: %v", after, err)
+		}
+		if err := fn(line, event); err != nil {
+			return err
+		}
+		after = event.LSN
+		if after >= until {
+			return nil
+		}
+	}
+}
+
+// ReadFile calls fn, in order, with every entry of a file written by Export.
+// Sealed entries are opened with the keys of the storage root holding the file.
+func ReadFile(path string, fn func(models.ChangeEvent) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return storage.Corrupt(path, "truncated entry")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read changes: %v", err)
+		}
+		event, err := decodeEntry(path, line)
+		if err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// changed returns a channel closed by the next append
+func (l *Log) changed() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.signal == nil {
+		l.signal = make(chan struct{})
+	}
+	return l.signal
+}
+
+// encodeEntry turns an event into a log line: the event's JSON preceded by
+// its CRC32C checksum in hex, or the base64 of the sealed JSON when the storage
+// root is encrypted
+func encodeEntry(path string, event models.ChangeEvent) ([]byte, error) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if storage.Encrypted(path) {
+		sealed, err := storage.Encode(path, line)
+		if err != nil {
+			return nil, err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
+	} else {
+		line = append(fmt.Appendf(nil, "%08x ", crc32.Checksum(line, castagnoli)), line...)
+	}
+	return append(line, '\n'), nil
+}
+
+// decodeEntry reads a log line written by encodeEntry, or a bare JSON line
+// from before checksums
+func decodeEntry(path string, line []byte) (models.ChangeEvent, error) {
+	var event models.ChangeEvent
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	switch {
+	case len(line) > 0 && line[0] == '{':
+	case len(line) > checksumPrefix && line[checksumPrefix-1] == ' ':
+		var sum uint32
+		if _, err := fmt.Sscanf(string(line[:checksumPrefix-1]), "%08x", &sum); err != nil {
+			return event, storage.Corrupt(path, "invalid entry checksum")
+		}
+		line = line[checksumPrefix:]
+		if crc32.Checksum(line, castagnoli) != sum {
+			return event, storage.Corrupt(path, "checksum mismatch in entry")
+		}
+	default:
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return event, storage.Corrupt(path, "undecodable entry")
+		}
+		if line, err = storage.DecodeEntry(path, sealed); err != nil {
+			return event, err
+		}
+	}
+	if err := json.Unmarshal(line, &event); err != nil {
+		return event, storage.Corrupt(path, "invalid entry: %v", err)
+	}
+	return event, nil
+}
+
+// checksumPrefix is the length of "xxxxxxxx " before a checksummed entry
+const checksumPrefix = 9
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
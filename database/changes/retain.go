@@ -0,0 +1,175 @@
+package changes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"Build-your-own-database/database/storage"
+)
+
+// holdsFile, in Dir, records the holds kept across restarts
+const holdsFile = "holds.json"
+
+// hold keeps the entries after an LSN for one consumer of the log
+type hold struct {
+	lsn   uint64
+	saved bool // Kept across restarts
+}
+
+// Retain keeps the entries from lsn on for a consumer, such as a connected
+// replica, until Release: the entry it holds, which shows its position is one
+// this log went through, and those it still needs. Calling it again moves the
+// consumer's hold.
+func (l *Log) Retain(name string, lsn uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holds[name] = hold{lsn: lsn}
+}
+
+// RetainSaved is Retain for a consumer that comes back after a restart, such
+// as the next incremental backup; the hold is saved with the log
+func (l *Log) RetainSaved(name string, lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous, had := l.holds[name]
+	l.holds[name] = hold{lsn: lsn, saved: true}
+	if err := l.saveHolds(); err != nil {
+		if had {
+			l.holds[name] = previous
+		} else {
+			delete(l.holds, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Release drops a consumer's hold
+func (l *Log) Release(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.holds[name]
+	delete(l.holds, name)
+	if ok && h.saved {
+		return l.saveHolds()
+	}
+	return nil
+}
+
+// Compact drops the entries made before cutoff that every hold has moved
+// past, and returns how many it dropped. The last entry is always kept, so
+// LSNs carry on from it after a restart.
+func (l *Log) Compact(cutoff time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.offsets) < 2 {
+		return 0, nil
+	}
+	keep := l.last
+	for _, h := range l.holds {
+		keep = min(keep, h.lsn)
+	}
+
+	// Entries are appended in time order, so the first one made since cutoff ends the scan
+	reader := bufio.NewReader(io.NewSectionReader(l.file, 0, l.size))
+	drop := 0
+	for l.first+uint64(drop) < keep {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return 0, fmt.Errorf("failed to read change log: %v", err)
+		}
+		event, err := decodeEntry(l.path, line)
+		if err != nil {
+			return 0, err
+		}
+		if !event.Time.Before(cutoff) {
+			break
+		}
+		drop++
+	}
+	if drop == 0 {
+		return 0, nil
+	}
+	if err := l.cut(drop); err != nil {
+		return 0, fmt.Errorf("failed to compact change log: %v", err)
+	}
+	return drop, nil
+}
+
+// cut replaces the log file with one without its first n entries, leaving
+// at least one; the caller holds mu
+func (l *Log) cut(n int) error {
+	start := l.offsets[n]
+	tmp := l.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, io.NewSectionReader(l.file, start, l.size-start))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// The new file is the log from now on; readers that opened the old one finish with it
+	l.file.Close()
+	l.file = file
+	offsets := make([]int64, len(l.offsets)-n)
+	for i := range offsets {
+		offsets[i] = l.offsets[n+i] - start
+	}
+	l.offsets = offsets
+	l.first += uint64(n)
+	l.size -= start
+	return nil
+}
+
+// loadHolds reads the holds saved with the log
+func (l *Log) loadHolds() error {
+	path := filepath.Join(filepath.Dir(l.path), holdsFile)
+	raw, err := storage.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read change log holds: %v", err)
+	}
+	var saved map[string]uint64
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return storage.Corrupt(path, "invalid change log holds: %v", err)
+	}
+	for name, lsn := range saved {
+		l.holds[name] = hold{lsn: lsn, saved: true}
+	}
+	return nil
+}
+
+// saveHolds writes the holds kept across restarts; the caller holds mu
+func (l *Log) saveHolds() error {
+	saved := make(map[string]uint64)
+	for name, h := range l.holds {
+		if h.saved {
+			saved[name] = h.lsn
+		}
+	}
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFile(filepath.Join(filepath.Dir(l.path), holdsFile), raw); err != nil {
+		return fmt.Errorf("failed to save change log holds: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package changes
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"Build-your-own-database/database/models"
+)
+
+// WatchOptions selects which changes a watcher receives
+type WatchOptions struct {
+	Database     string        // Only changes in this database ("" for every database)
+	Collection   string        // Only changes in this collection ("" for every collection)
+	Ops          []string      // Only these operations (every operation when empty)
+	Filter       models.Filter // Only document changes whose document matches
+	FullDocument bool          // Deliver before and after images of documents
+	ResumeAfter  string        // Token of the last event already handled; empty starts with new changes
+}
+
+// Stream delivers the change events selected by a watch, in log order.
+// C is closed when the watch's context ends or reading the log fails.
+type Stream struct {
+	C     <-chan models.ChangeEvent
+	Start string // Token the stream started after, usable to resume before any event arrives
+
+	mu  sync.Mutex
+	err error
+}
+
+// Err returns the error that ended the stream, if it did not end with its context
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// ParseToken turns a resume token back into the LSN it names
+func ParseToken(token string) (uint64, error) {
+	lsn, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resume token '%s'", token)
+	}
+	return lsn, nil
+}
+
+// Watch streams the changes selected by opts until ctx is done. Changes
+// already in the log after opts.ResumeAfter are delivered first.
+func (l *Log) Watch(ctx context.Context, opts WatchOptions) (*Stream, error) {
+	position := l.LastLSN()
+	if opts.ResumeAfter != "" {
+		lsn, err := ParseToken(opts.ResumeAfter)
+		if err != nil {
+			return nil, err
+		}
+		if lsn > position {
+			return nil, fmt.Errorf("resume token '%s' is ahead of the change log", opts.ResumeAfter)
+		}
+		if first := l.FirstLSN(); first > 0 && lsn+1 < first {
+			return nil, fmt.Errorf("resume token '%s' is older than the change log", opts.ResumeAfter)
+		}
+		position = lsn
+	}
+
+	events := make(chan models.ChangeEvent)
+	stream := &Stream{C: events, Start: strconv.FormatUint(position, 10)}
+
+	go func() {
+		defer close(events)
+		err := l.Follow(ctx, position, func(event models.ChangeEvent) error {
+			if !opts.Match(event) {
+				return nil
+			}
+			if !opts.FullDocument {
+				event.Before, event.After = nil, nil
+			}
+			select {
+			case events <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			stream.mu.Lock()
+			stream.err = err
+			stream.mu.Unlock()
+		}
+	}()
+	return stream, nil
+}
+
+// Match reports whether an event is selected by the options
+func (opts WatchOptions) Match(event models.ChangeEvent) bool {
+	// Internal databases only reach watchers that name them
+	if opts.Database == "" && strings.HasPrefix(event.Database, ".") {
+		return false
+	}
+	if opts.Database != "" && event.Database != opts.Database &&
+		!(event.Op == models.OpRenameDatabase && event.OldName == opts.Database) {
+		return false
+	}
+	// Database-wide events such as drops also concern every collection in it
+	if opts.Collection != "" && event.Collection != "" && event.Collection != opts.Collection &&
+		!(event.Op == models.OpRenameCollection && event.OldName == opts.Collection) {
+		return false
+	}
+
+	if len(opts.Ops) > 0 {
+		found := false
+		for _, op := range opts.Ops {
+			if op == event.Op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(opts.Filter) > 0 {
+		doc := event.After
+		if doc == nil {
+			doc = event.Before
+		}
+		if doc == nil || !opts.Filter.Match(doc) {
+			return false
+		}
+	}
+	return true
+}
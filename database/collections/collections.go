@@ -1,29 +1,105 @@
 package collections
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"Build-your-own-database/config"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/document"
 	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/trash"
 )
 
 // CollectionManager handles operations related to collections within a database
 type CollectionManager struct {
 	db     *models.Database
-	colMux sync.RWMutex
+	colMux *sync.RWMutex   // Shared by every manager of the database
+	ctx    context.Context // Carries the caller's identity, see WithContext
 }
 
 // NewCollectionManager initializes a CollectionManager for a given database
 func NewCollectionManager(db *models.Database) *CollectionManager {
-	return &CollectionManager{db: db}
+	return &CollectionManager{db: db, colMux: &db.Mutex, ctx: context.Background()}
+}
+
+// Context returns the context the manager checks access against
+func (cm *CollectionManager) Context() context.Context {
+	return cm.ctx
+}
+
+// WithContext returns a copy of the manager whose operations are checked
+// against the identity in ctx (see the access package)
+func (cm *CollectionManager) WithContext(ctx context.Context) *CollectionManager {
+	bound := *cm
+	bound.ctx = ctx
+	return &bound
+}
+
+// check verifies the caller holds privilege on a collection of the database,
+// and that the database accepts changes when privilege is more than reading
+func (cm *CollectionManager) check(privilege access.Privilege, name string) error {
+	if privilege != access.Read {
+		if err := storage.Writable(cm.db.Path); err != nil {
+			return err
+		}
+	}
+	return access.Check(cm.ctx, privilege, cm.db.Name, name)
+}
+
+// CollectionOption configures a collection as it is created
+type CollectionOption func(*models.Collection)
+
+// WithHistory keeps up to maxVersions previous versions of each document,
+// each for at most maxAgeDays once replaced (0 means no limit)
+func WithHistory(maxVersions, maxAgeDays int) CollectionOption {
+	return func(c *models.Collection) {
+		c.History = &models.HistoryOptions{MaxVersions: maxVersions, MaxAgeDays: maxAgeDays}
+	}
+}
+
+// WithCapped limits the collection to maxDocuments documents and maxBytes bytes
+// of document data (0 means no limit, but one must be set), evicting the
+// oldest when an insert or update goes past either
+func WithCapped(maxDocuments int, maxBytes int64) CollectionOption {
+	return func(c *models.Collection) {
+		c.Capped = &models.CappedOptions{MaxDocuments: maxDocuments, MaxBytes: maxBytes}
+	}
+}
+
+// WithEncryptedFields marks field paths whose values clients encrypt before
+// saving (see DocumentManager.WithFieldKey)
+func WithEncryptedFields(fields ...models.EncryptedField) CollectionOption {
+	return func(c *models.Collection) {
+		c.Encrypted = append([]models.EncryptedField(nil), fields...)
+	}
+}
+
+// WithSettings gives the collection every persisted setting of another, such
+// as the settings a remote client sends: indexes, history, capping, encrypted
+// fields and compression
+func WithSettings(settings *models.Collection) CollectionOption {
+	return func(c *models.Collection) {
+		copyOptions(c, settings)
+	}
 }
 
 // CreateCollection creates a new collection inside the database and persists it
-func (cm *CollectionManager) CreateCollection(name string) (*models.Collection, error) {
+func (cm *CollectionManager) CreateCollection(name string, opts ...CollectionOption) (*models.Collection, error) {
+	if err := cm.check(access.Admin, name); err != nil {
+		return nil, err
+	}
+
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
 	cm.colMux.Lock()
 	defer cm.colMux.Unlock()
 
@@ -32,12 +108,10 @@ func (cm *CollectionManager) CreateCollection(name string) (*models.Collection,
 		return nil, fmt.Errorf("collection '%s' already exists", name)
 	}
 
-	// Define the collection path using config.BasePath
-	colPath := filepath.Join(config.BasePath, cm.db.Name, name)
-
-	// Ensure the collection directory is created
-	if err := os.MkdirAll(colPath, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("failed to create collection directory '%s': %v", name, err)
+	// Define the collection path inside the database directory
+	colPath := filepath.Join(cm.db.Path, name)
+	if _, err := os.Stat(filepath.Join(colPath, models.MetadataFile)); err == nil {
+		return nil, fmt.Errorf("collection '%s' already exists", name)
 	}
 
 	// Create collection object
@@ -46,14 +120,39 @@ func (cm *CollectionManager) CreateCollection(name string) (*models.Collection,
 		Documents: make(map[string]*models.Document),
 		Path:      colPath,
 	}
-
-	// Persist collection metadata
-	if err := cm.saveCollection(collection); err != nil {
-		return nil, fmt.Errorf("failed to save collection metadata: %v", err)
+	for _, opt := range opts {
+		opt(collection)
+	}
+	if err := validateEncrypted(collection.Encrypted); err != nil {
+		return nil, err
+	}
+	if collection.Compression != nil {
+		if err := collection.Compression.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if collection.Capped != nil {
+		if err := collection.Capped.Validate(); err != nil {
+			return nil, err
+		}
 	}
 
-	// Store in memory
-	cm.db.Collections[name] = collection
+	err := cm.change(models.ChangeEvent{Op: models.OpCreateCollection, Collection: name, Name: name, Metadata: collection.Settings()}, func() error {
+		// Ensure the collection directory is created
+		if err := os.MkdirAll(colPath, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create collection directory '%s': %v", name, err)
+		}
+		// Persist collection metadata
+		if err := cm.saveCollection(collection); err != nil {
+			return fmt.Errorf("failed to save collection metadata: %v", err)
+		}
+		// Store in memory
+		cm.db.Collections[name] = collection
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("Collection created:", name)
 	return collection, nil
@@ -61,6 +160,10 @@ func (cm *CollectionManager) CreateCollection(name string) (*models.Collection,
 
 // UseCollection retrieves an existing collection, loading from disk if necessary
 func (cm *CollectionManager) UseCollection(name string) (*models.Collection, error) {
+	if err := access.CheckVisible(cm.ctx, cm.db.Name, name); err != nil {
+		return nil, err
+	}
+
 	cm.colMux.RLock()
 	collection, exists := cm.db.Collections[name]
 	cm.colMux.RUnlock()
@@ -93,60 +196,252 @@ func (cm *CollectionManager) UseCollection(name string) (*models.Collection, err
 
 // DeleteCollection removes a collection from the database and disk
 func (cm *CollectionManager) DeleteCollection(name string) error {
+	if err := cm.check(access.Admin, name); err != nil {
+		return err
+	}
+
 	cm.colMux.Lock()
 	defer cm.colMux.Unlock()
 
-	// Check if collection exists
+	// Define collection path
+	colPath := filepath.Join(cm.db.Path, name)
+
+	// Check if collection exists, in memory or on disk
 	if _, exists := cm.db.Collections[name]; !exists {
-		return fmt.Errorf("collection '%s' does not exist", name)
+		if _, err := os.Stat(filepath.Join(colPath, models.MetadataFile)); err != nil {
+			return fmt.Errorf("collection '%s' %w", name, documents.ErrNotFound)
+		}
 	}
 
-	// Define collection path
-	colPath := filepath.Join(config.BasePath, cm.db.Name, name)
+	err := cm.change(models.ChangeEvent{Op: models.OpDropCollection, Collection: name, Name: name}, func() error {
+		// Move the collection directory to the trash, or delete it outright
+		if config.TrashRetention > 0 {
+			if _, err := trash.Move(cm.trashRoot(), trash.Entry{
+				Kind:       trash.KindCollection,
+				Database:   cm.db.Name,
+				Collection: name,
+				Name:       name,
+				Path:       colPath,
+			}); err != nil {
+				return err
+			}
+		} else if err := os.RemoveAll(colPath); err != nil {
+			return fmt.Errorf("failed to delete collection '%s' from disk: %v", name, err)
+		}
 
-	// Delete collection directory from disk
-	if err := os.RemoveAll(colPath); err != nil {
-		return fmt.Errorf("failed to delete collection '%s' from disk: %v", name, err)
+		// Remove from memory
+		delete(cm.db.Collections, name)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Remove from memory
-	delete(cm.db.Collections, name)
-
 	fmt.Println("Collection deleted:", name)
 	return nil
 }
 
+// CreateIndex declares an index on a field of a collection and persists it.
+// Declaring an index that already exists with the same options is a no-op.
+func (cm *CollectionManager) CreateIndex(colName, field string, unique bool) error {
+	if err := cm.check(access.IndexManage, colName); err != nil {
+		return err
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	for i, index := range collection.Indexes {
+		if index.Field != field {
+			continue
+		}
+		if index.Unique == unique {
+			return nil
+		}
+		return cm.updateCollection(collection, func(settings *models.Collection) {
+			settings.Indexes[i].Unique = unique
+		})
+	}
+
+	err = cm.updateCollection(collection, func(settings *models.Collection) {
+		settings.Indexes = append(settings.Indexes, models.Index{Field: field, Unique: unique})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+
+	fmt.Printf("Index created on '%s.%s'\n", colName, field)
+	return nil
+}
+
+// CreateTTLIndex declares a TTL index: documents expire once the date stored in
+// field is older than expireAfter. Replaces any TTL already set on the field.
+func (cm *CollectionManager) CreateTTLIndex(colName, field string, expireAfter time.Duration) error {
+	if err := cm.check(access.IndexManage, colName); err != nil {
+		return err
+	}
+
+	seconds := int64(expireAfter / time.Second)
+	if seconds <= 0 {
+		return fmt.Errorf("TTL for '%s.%s' must be at least one second", colName, field)
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	err = cm.updateCollection(collection, func(settings *models.Collection) {
+		found := false
+		for i := range settings.Indexes {
+			if settings.Indexes[i].Field == field {
+				settings.Indexes[i].ExpireAfterSeconds = seconds
+				found = true
+			}
+		}
+		if !found {
+			settings.Indexes = append(settings.Indexes, models.Index{Field: field, ExpireAfterSeconds: seconds})
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+
+	fmt.Printf("TTL index created on '%s.%s' (%ds)\n", colName, field, seconds)
+	return nil
+}
+
+// SetHistory changes how many previous document versions a collection keeps;
+// nil turns history off without discarding versions already kept
+func (cm *CollectionManager) SetHistory(colName string, history *models.HistoryOptions) error {
+	if err := cm.check(access.Admin, colName); err != nil {
+		return err
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	err = cm.updateCollection(collection, func(settings *models.Collection) {
+		settings.History = history
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+	return nil
+}
+
+// SetEncryptedFields changes which field paths clients encrypt. Values already
+// stored keep the mode they were sealed with and stay readable; values stored
+// in clear before a field was marked are sealed the next time they are written
+// with the field key.
+func (cm *CollectionManager) SetEncryptedFields(colName string, fields []models.EncryptedField) error {
+	if err := cm.check(access.Admin, colName); err != nil {
+		return err
+	}
+	if err := validateEncrypted(fields); err != nil {
+		return err
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	err = cm.updateCollection(collection, func(settings *models.Collection) {
+		settings.Encrypted = append([]models.EncryptedField(nil), fields...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+	return nil
+}
+
+// validateEncrypted rejects invalid or repeated encrypted fields
+func validateEncrypted(fields []models.EncryptedField) error {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if err := field.Validate(); err != nil {
+			return err
+		}
+		if seen[field.Path] {
+			return fmt.Errorf("invalid encrypted fields: '%s' is listed twice", field.Path)
+		}
+		seen[field.Path] = true
+	}
+	return nil
+}
+
+// updateCollection changes a copy of a collection's settings with change,
+// then makes the change: the settings are persisted, taken by the collection
+// and announced. A change that is not made leaves the collection as it was.
+// The caller holds the collection's Mutex.
+func (cm *CollectionManager) updateCollection(collection *models.Collection, change func(*models.Collection)) error {
+	settings := collection.Settings()
+	change(settings)
+	return collection.Change(models.ChangeEvent{Op: models.OpUpdateCollection, Name: collection.Name, Metadata: settings}, func() error {
+		previous := collection.Settings()
+		copyOptions(collection, settings)
+		if err := cm.saveCollection(collection); err != nil {
+			copyOptions(collection, previous)
+			return err
+		}
+		return nil
+	})
+}
+
+// change makes a change to one of the database's collections with apply;
+// see models.Change
+func (cm *CollectionManager) change(event models.ChangeEvent, apply func() error) error {
+	event.Database = cm.db.Name
+	event.Root = filepath.Dir(cm.db.Path)
+	return models.Change(event, apply)
+}
+
 // saveCollection writes the collection metadata to a JSON file
 func (cm *CollectionManager) saveCollection(collection *models.Collection) error {
-	metadataPath := filepath.Join(collection.Path, "metadata.json")
-	file, err := os.Create(metadataPath)
+	raw, err := json.Marshal(collection)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(collection)
+	return storage.WriteFile(filepath.Join(collection.Path, models.MetadataFile), append(raw, '\n'))
 }
 
 // loadCollection reads a collection from its metadata file
 func (cm *CollectionManager) loadCollection(name string) (*models.Collection, error) {
-	colPath := filepath.Join(config.BasePath, cm.db.Name, name)
-	metadataPath := filepath.Join(colPath, "metadata.json")
+	return readCollection(filepath.Join(cm.db.Path, name), name)
+}
 
-	file, err := os.Open(metadataPath)
+// readCollection reads the collection kept at colPath from its metadata file
+func readCollection(colPath, name string) (*models.Collection, error) {
+	metadataPath := filepath.Join(colPath, models.MetadataFile)
+
+	raw, err := storage.ReadFile(metadataPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("collection '%s' does not exist on disk", name)
+			return nil, fmt.Errorf("collection '%s' %w on disk", name, documents.ErrNotFound)
 		}
 		return nil, err
 	}
-	defer file.Close()
 
 	var collection models.Collection
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&collection); err != nil {
-		return nil, err
+	if err := json.Unmarshal(raw, &collection); err != nil {
+		return nil, storage.Corrupt(metadataPath, "invalid collection metadata: %v", err)
 	}
 
 	// Ensure Documents map is initialized
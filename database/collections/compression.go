@@ -0,0 +1,150 @@
+package collections
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// dictionarySamples is how many documents TrainDictionary learns from
+const dictionarySamples = 1000
+
+// WithCompression compresses the collection's document files with algorithm
+// (storage.Gzip or storage.Flate) at level 1 to 9, 0 for the default
+func WithCompression(algorithm string, level int) CollectionOption {
+	return func(c *models.Collection) {
+		c.Compression = &storage.Compression{Algorithm: algorithm, Level: level}
+	}
+}
+
+// SetCompression changes how a collection's documents are compressed; nil
+// turns compression off. Documents are compressed as they are next written,
+// or all at once with Recompress.
+func (cm *CollectionManager) SetCompression(colName string, compression *storage.Compression) error {
+	if err := cm.check(access.Admin, colName); err != nil {
+		return err
+	}
+	if compression != nil {
+		if err := compression.Validate(); err != nil {
+			return err
+		}
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	err = cm.updateCollection(collection, func(settings *models.Collection) {
+		settings.Compression = compression
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+	return nil
+}
+
+// TrainDictionary builds a compression dictionary from the collection's
+// documents and switches the collection to dictionary compression, which
+// shrinks small documents far better than plain deflate. size caps the
+// dictionary (0 for the largest deflate can use).
+func (cm *CollectionManager) TrainDictionary(colName string, size int) (storage.DictID, error) {
+	if err := cm.check(access.Admin, colName); err != nil {
+		return storage.DictID{}, err
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return storage.DictID{}, err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	paths, err := collection.DocumentFiles()
+	if err != nil {
+		return storage.DictID{}, err
+	}
+	var samples [][]byte
+	for _, path := range paths {
+		if len(samples) == dictionarySamples {
+			break
+		}
+		if raw, err := storage.ReadFile(path); err == nil {
+			samples = append(samples, raw)
+		}
+	}
+	dict := storage.TrainDictionary(samples, size)
+	if dict == nil {
+		return storage.DictID{}, fmt.Errorf("invalid training set: collection '%s' needs more similar documents", colName)
+	}
+
+	id, err := storage.SaveDictionary(filepath.Dir(cm.db.Path), dict)
+	if err != nil {
+		return id, err
+	}
+
+	err = cm.updateCollection(collection, func(settings *models.Collection) {
+		compression := &storage.Compression{Algorithm: storage.Dict, Dictionary: id.String()}
+		if settings.Compression != nil {
+			compression.Level = settings.Compression.Level
+		}
+		settings.Compression = compression
+	})
+	if err != nil {
+		return id, fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+
+	fmt.Printf("Trained a %d byte dictionary for collection '%s' from %d document(s)\n", len(dict), colName, len(samples))
+	return id, nil
+}
+
+// Recompress rewrites every document and history version of a collection with
+// its current compression, returning how many files were rewritten
+func (cm *CollectionManager) Recompress(colName string) (int, error) {
+	if err := cm.check(access.Admin, colName); err != nil {
+		return 0, err
+	}
+
+	collection, err := cm.UseCollection(colName)
+	if err != nil {
+		return 0, err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	count := 0
+	err = filepath.WalkDir(collection.Path, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || name == models.MetadataFile || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		data, err := storage.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := storage.WriteCompressed(path, data, collection.Compression); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to recompress collection '%s': %v", colName, err)
+	}
+
+	fmt.Printf("Recompressed %d file(s) of collection '%s'\n", count, colName)
+	return count, nil
+}
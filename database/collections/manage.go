@@ -0,0 +1,364 @@
+package collections
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// ListCollections lists every collection stored in the database, including ones not loaded yet
+func (cm *CollectionManager) ListCollections() ([]string, error) {
+	entries, err := os.ReadDir(cm.db.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database '%s': %v", cm.db.Name, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !access.Visible(cm.ctx, cm.db.Name, entry.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(cm.db.Path, entry.Name(), models.MetadataFile)); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RenameCollection renames a collection's directory and updates its metadata
+// and the path recorded in each of its documents
+func (cm *CollectionManager) RenameCollection(oldName, newName string) error {
+	if err := validateName(newName); err != nil {
+		return err
+	}
+	if err := cm.check(access.Admin, oldName); err != nil {
+		return err
+	}
+	if err := cm.check(access.Admin, newName); err != nil {
+		return err
+	}
+
+	collection, err := cm.UseCollection(oldName)
+	if err != nil {
+		return err
+	}
+
+	cm.colMux.Lock()
+	defer cm.colMux.Unlock()
+
+	newPath := filepath.Join(cm.db.Path, newName)
+	if _, exists := cm.db.Collections[newName]; exists {
+		return fmt.Errorf("collection '%s' already exists", newName)
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("collection '%s' already exists", newName)
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	err = cm.change(models.ChangeEvent{Op: models.OpRenameCollection, Collection: newName, Name: newName, OldName: oldName}, func() error {
+		oldPath := collection.Path
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return fmt.Errorf("failed to rename collection '%s': %v", oldName, err)
+		}
+		collection.Name = newName
+		err := collection.Relocate(newPath)
+		if err == nil {
+			if err = cm.saveCollection(collection); err != nil {
+				err = fmt.Errorf("failed to save collection metadata: %v", err)
+			}
+		}
+		// Deleted documents are restored into the collection under its new name
+		var moved []string
+		if err == nil {
+			moved, err = cm.relocateTrash(oldName, newName, newPath, nil)
+		}
+		if err != nil {
+			collection.Name = oldName
+			if len(moved) > 0 {
+				cm.relocateTrash(newName, oldName, oldPath, moved)
+			}
+			if undo := os.Rename(newPath, oldPath); undo != nil {
+				return fmt.Errorf("%v; the collection is left at '%s': %v", err, newName, undo)
+			}
+			if undo := collection.Relocate(oldPath); undo != nil {
+				return fmt.Errorf("%v; moving its documents back failed too: %v", err, undo)
+			}
+			if undo := cm.saveCollection(collection); undo != nil {
+				return fmt.Errorf("%v; restoring its metadata failed too: %v", err, undo)
+			}
+			return err
+		}
+
+		delete(cm.db.Collections, oldName)
+		cm.db.Collections[newName] = collection
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Renamed collection '%s' to '%s'\n", oldName, newName)
+	return nil
+}
+
+// CloneCollection copies a collection's options and the documents matching
+// filter (all of them when filter is empty) into a new collection
+func (cm *CollectionManager) CloneCollection(src, dst string, filter models.Filter) (*models.Collection, error) {
+	if err := cm.check(access.Read, src); err != nil {
+		return nil, err
+	}
+	if err := cm.check(access.Admin, dst); err != nil {
+		return nil, err
+	}
+
+	source, err := cm.UseCollection(src)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := documents.NewDocumentManager(source).FindDocuments(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	clone, err := cm.CreateCollection(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	source.Mutex.RLock()
+	options := source.Settings()
+	source.Mutex.RUnlock()
+	clone.Mutex.Lock()
+	err = cm.updateCollection(clone, func(settings *models.Collection) {
+		copyOptions(settings, options)
+	})
+	clone.Mutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+
+	docManager := documents.NewDocumentManager(clone)
+	for _, doc := range docs {
+		if _, err := docManager.CreateDocument(doc.Name, models.CloneData(doc.Data)); err != nil {
+			return nil, fmt.Errorf("failed to clone document '%s': %v", doc.Name, err)
+		}
+		if doc.ExpireAt != nil {
+			if err := docManager.SetExpireAt(doc.Name, *doc.ExpireAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fmt.Printf("Cloned %d document(s) from '%s' into '%s'\n", len(docs), src, dst)
+	return clone, nil
+}
+
+// Stats reports document counts and sizes for a collection
+func (cm *CollectionManager) Stats(name string) (*models.CollectionStats, error) {
+	if err := cm.check(access.Read, name); err != nil {
+		return nil, err
+	}
+
+	collection, err := cm.UseCollection(name)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := documents.NewDocumentManager(collection).FindDocuments(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &models.CollectionStats{
+		Name:          name,
+		Documents:     len(docs),
+		IndexSizes:    make(map[string]int64),
+		StorageEngine: models.StorageEngine,
+	}
+	for _, doc := range docs {
+		stats.DataSize += doc.Size
+	}
+	if len(docs) > 0 {
+		stats.AvgDocumentSize = float64(stats.DataSize) / float64(len(docs))
+	}
+
+	collection.Mutex.RLock()
+	indexes := append([]models.Index(nil), collection.Indexes...)
+	collection.Mutex.RUnlock()
+	for _, index := range indexes {
+		var size int64
+		for _, doc := range docs {
+			if val, ok := doc.Field(index.Field); ok {
+				raw, _ := json.Marshal(val)
+				size += int64(len(raw) + len(doc.ID))
+			}
+		}
+		stats.IndexSizes[index.Field] = size
+	}
+
+	if stats.StorageSize, _, err = models.DiskUsage(collection.Path); err != nil {
+		return nil, fmt.Errorf("failed to measure collection '%s': %v", name, err)
+	}
+
+	collection.Mutex.RLock()
+	if collection.Compression != nil {
+		stats.Compression = collection.Compression.Algorithm
+	}
+	collection.Mutex.RUnlock()
+	for _, doc := range docs {
+		info, err := os.Stat(doc.Path)
+		if err != nil {
+			continue
+		}
+		raw, err := storage.ReadFile(doc.Path)
+		if err != nil {
+			continue
+		}
+		stats.CompressedSize += info.Size()
+		stats.UncompressedSize += int64(len(raw))
+	}
+	if stats.CompressedSize > 0 {
+		stats.CompressionRatio = float64(stats.UncompressedSize) / float64(stats.CompressedSize)
+	}
+	return stats, nil
+}
+
+// copyOptions gives dst the same indexes, retention, size limits, encrypted
+// fields and compression as src
+func copyOptions(dst, src *models.Collection) {
+	settings := src.Settings()
+	dst.Indexes = settings.Indexes
+	dst.History = settings.History
+	dst.Capped = settings.Capped
+	dst.Encrypted = settings.Encrypted
+	dst.Compression = settings.Compression
+}
+
+// validateName rejects collection names that cannot be used as a directory
+func validateName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid collection name '%s'", name)
+	}
+	return nil
+}
+
+// Relocate updates every collection of the database after the database
+// directory has been moved or copied to db.Path
+func (cm *CollectionManager) Relocate() error {
+	names, err := cm.ListCollections()
+	if err != nil {
+		return err
+	}
+
+	cm.colMux.Lock()
+	defer cm.colMux.Unlock()
+
+	for _, name := range names {
+		collection, loaded := cm.db.Collections[name]
+		if !loaded {
+			if collection, err = cm.loadCollection(name); err != nil {
+				return err
+			}
+		}
+
+		collection.Mutex.Lock()
+		err := collection.Relocate(filepath.Join(cm.db.Path, name))
+		if err == nil {
+			err = cm.saveCollection(collection)
+		}
+		collection.Mutex.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to relocate collection '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Announce adds the collection kept at staged, outside the database, to it
+// as name, through the changes that recreate it elsewhere: its creation
+// followed by an insert for every document, oldest first. Each part is moved
+// into place as its change is made; its documents' history follows once they
+// all are. Used when a collection appears other than through CreateCollection,
+// such as a restore or a copy. What is left at staged is the caller's to remove.
+func (cm *CollectionManager) Announce(staged, name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	source, err := readCollection(staged, name)
+	if err != nil {
+		return err
+	}
+	if err := source.LoadDocuments(); err != nil {
+		return err
+	}
+	docs := make([]*models.Document, 0, len(source.Documents))
+	for _, doc := range source.Documents {
+		docs = append(docs, doc)
+	}
+	models.SortByInsertion(docs)
+
+	cm.colMux.Lock()
+	path := filepath.Join(cm.db.Path, name)
+	if _, exists := cm.db.Collections[name]; exists {
+		cm.colMux.Unlock()
+		return fmt.Errorf("collection '%s' already exists", name)
+	}
+	if _, err := os.Stat(path); err == nil {
+		cm.colMux.Unlock()
+		return fmt.Errorf("collection '%s' already exists", name)
+	}
+	collection := &models.Collection{
+		Name:      name,
+		Path:      path,
+		Documents: make(map[string]*models.Document),
+	}
+	copyOptions(collection, source)
+	err = cm.change(models.ChangeEvent{Op: models.OpCreateCollection, Collection: name, Name: name, Metadata: collection.Settings()}, func() error {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create collection directory '%s': %v", name, err)
+		}
+		if err := cm.saveCollection(collection); err != nil {
+			return fmt.Errorf("failed to save collection metadata: %v", err)
+		}
+		cm.db.Collections[name] = collection
+		return nil
+	})
+	cm.colMux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+	for _, doc := range docs {
+		doc := collection.Adopt(doc)
+		err := collection.Change(models.ChangeEvent{Op: models.OpInsert, DocumentID: doc.ID, Name: doc.Name, After: doc.Snapshot()}, func() error {
+			if err := doc.Rewrite(); err != nil {
+				return err
+			}
+			collection.Documents[doc.ID] = doc
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add document '%s' to collection '%s', which lacks it and the documents after it: %v", doc.Name, name, err)
+		}
+	}
+
+	history := filepath.Join(staged, models.HistoryDir)
+	if _, err := os.Stat(history); err == nil {
+		if err := os.Rename(history, filepath.Join(path, models.HistoryDir)); err != nil {
+			return fmt.Errorf("failed to move the document history of collection '%s': %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package collections
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"Build-your-own-database/database/models"
+)
+
+// Apply replays a change read from a change log, writing the documents and
+// collection settings it describes without checking access, enforcing indexes
+// or recording a new change. Unique indexes were enforced when the change was
+// made; a replay over a copy can clash with them until a later change is
+// applied, so callers check them once replay is done (see
+// models.Collection.VerifyUnique). Replaying a change the database already holds
+// leaves it as it is, so a log can be replayed over a copy taken while it was
+// being written. Database-level changes are left to the caller.
+func (cm *CollectionManager) Apply(event models.ChangeEvent) error {
+	var err error
+	switch event.Op {
+	case models.OpInsert, models.OpUpdate, models.OpRename:
+		err = cm.applyWrite(event)
+	case models.OpDelete:
+		err = cm.applyDelete(event)
+	case models.OpCreateCollection, models.OpUpdateCollection:
+		err = cm.applySettings(event)
+	case models.OpDropCollection:
+		err = cm.applyDrop(event)
+	case models.OpRenameCollection:
+		err = cm.applyRename(event)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply %s change at LSN %d: %v", event.Op, event.LSN, err)
+	}
+	return nil
+}
+
+// applyWrite stores the document as the change left it
+func (cm *CollectionManager) applyWrite(event models.ChangeEvent) error {
+	after := event.After
+	if after == nil {
+		return fmt.Errorf("invalid change: no document")
+	}
+	collection, err := cm.UseCollection(event.Collection)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	doc := collection.Adopt(after)
+
+	// A document whose ID changed leaves its old file behind
+	if before := event.Before; before != nil && before.ID != after.ID {
+		if err := os.Remove(filepath.Join(collection.Path, before.ID+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(collection.Documents, before.ID)
+	}
+
+	if _, err := collection.Archive(doc); err != nil {
+		return err
+	}
+	if err := doc.Rewrite(); err != nil {
+		return err
+	}
+	collection.Documents[doc.ID] = doc
+	return nil
+}
+
+// applyDelete removes the document's file, archiving it first
+func (cm *CollectionManager) applyDelete(event models.ChangeEvent) error {
+	collection, err := cm.UseCollection(event.Collection)
+	if err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	doc := collection.NewDocument(event.DocumentID, event.Name, nil)
+	if _, err := collection.Archive(doc); err != nil {
+		return err
+	}
+	if err := os.Remove(doc.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(collection.Documents, event.DocumentID)
+	return nil
+}
+
+// applySettings creates the collection if needed and saves the settings the change recorded
+func (cm *CollectionManager) applySettings(event models.ChangeEvent) error {
+	if event.Metadata == nil {
+		return fmt.Errorf("invalid change: no collection settings")
+	}
+	if err := validateName(event.Collection); err != nil {
+		return err
+	}
+
+	cm.colMux.Lock()
+	defer cm.colMux.Unlock()
+
+	colPath := filepath.Join(cm.db.Path, event.Collection)
+	collection, loaded := cm.db.Collections[event.Collection]
+	if !loaded {
+		if _, err := os.Stat(filepath.Join(colPath, models.MetadataFile)); err == nil {
+			var err error
+			if collection, err = cm.loadCollection(event.Collection); err != nil {
+				return err
+			}
+		} else {
+			collection = &models.Collection{
+				Name:      event.Collection,
+				Path:      colPath,
+				Documents: make(map[string]*models.Document),
+			}
+		}
+	}
+	if err := os.MkdirAll(colPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	collection.Mutex.Lock()
+	copyOptions(collection, event.Metadata)
+	err := cm.saveCollection(collection)
+	collection.Mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+	cm.db.Collections[event.Collection] = collection
+	return nil
+}
+
+// applyDrop removes the collection and everything in it
+func (cm *CollectionManager) applyDrop(event models.ChangeEvent) error {
+	cm.colMux.Lock()
+	defer cm.colMux.Unlock()
+
+	if err := os.RemoveAll(filepath.Join(cm.db.Path, event.Collection)); err != nil {
+		return err
+	}
+	delete(cm.db.Collections, event.Collection)
+	return nil
+}
+
+// applyRename moves the collection to its new name, unless it is already there
+func (cm *CollectionManager) applyRename(event models.ChangeEvent) error {
+	if err := validateName(event.Name); err != nil {
+		return err
+	}
+
+	cm.colMux.Lock()
+	defer cm.colMux.Unlock()
+
+	oldPath := filepath.Join(cm.db.Path, event.OldName)
+	newPath := filepath.Join(cm.db.Path, event.Name)
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return nil
+	}
+
+	collection, loaded := cm.db.Collections[event.OldName]
+	if !loaded {
+		var err error
+		if collection, err = cm.loadCollection(event.OldName); err != nil {
+			return err
+		}
+	}
+
+	collection.Mutex.Lock()
+	defer collection.Mutex.Unlock()
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	collection.Name = event.Name
+	if err := collection.Relocate(newPath); err != nil {
+		return err
+	}
+	if err := cm.saveCollection(collection); err != nil {
+		return fmt.Errorf("failed to save collection metadata: %v", err)
+	}
+	delete(cm.db.Collections, event.OldName)
+	cm.db.Collections[event.Name] = collection
+	return nil
+}
@@ -0,0 +1,112 @@
+package collections
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/trash"
+)
+
+// ListTrash lists the deleted collections and documents of this database that can still be restored
+func (cm *CollectionManager) ListTrash() ([]trash.Entry, error) {
+	entries, err := trash.List(cm.trashRoot())
+	if err != nil {
+		return nil, err
+	}
+
+	var mine []trash.Entry
+	for _, entry := range entries {
+		if cm.ownsEntry(entry) && cm.restorable(entry) {
+			mine = append(mine, entry)
+		}
+	}
+	return mine, nil
+}
+
+// Restore brings a deleted collection, or a document of one of this database's
+// collections, back from the trash
+func (cm *CollectionManager) Restore(entryID string) error {
+	entry, err := trash.Get(cm.trashRoot(), entryID)
+	if err != nil {
+		return err
+	}
+	if !cm.ownsEntry(*entry) {
+		return fmt.Errorf("trash entry '%s' does not belong to database '%s'", entryID, cm.db.Name)
+	}
+
+	if entry.Kind == trash.KindDocument {
+		collection, err := cm.UseCollection(entry.Collection)
+		if err != nil {
+			return fmt.Errorf("restore collection '%s' before its documents: %v", entry.Collection, err)
+		}
+		_, err = documents.NewDocumentManager(collection).WithContext(cm.ctx).Restore(entryID)
+		return err
+	}
+	if err := cm.check(access.Admin, entry.Name); err != nil {
+		return err
+	}
+
+	// The collection comes back through the changes that recreate it, each
+	// taking its part out of the trash as it is made
+	if err := cm.Announce(entry.Data(cm.trashRoot()), entry.Name); err != nil {
+		return err
+	}
+	if err := trash.Discard(cm.trashRoot(), entryID); err != nil {
+		return err
+	}
+
+	fmt.Println("Restored collection:", entry.Name)
+	return nil
+}
+
+// PurgeTrash permanently removes this database's collections and documents deleted more than olderThan ago
+func (cm *CollectionManager) PurgeTrash(olderThan time.Duration) (int, error) {
+	if err := cm.check(access.Admin, ""); err != nil {
+		return 0, err
+	}
+	return trash.Purge(cm.trashRoot(), olderThan, cm.ownsEntry)
+}
+
+// ownsEntry reports whether a trash entry is a collection or document of this database
+func (cm *CollectionManager) ownsEntry(entry trash.Entry) bool {
+	return entry.Kind != trash.KindDatabase && entry.Database == cm.db.Name
+}
+
+// restorable reports whether the caller may restore an entry: collections
+// need admin, documents need write on their collection
+func (cm *CollectionManager) restorable(entry trash.Entry) bool {
+	if entry.Kind == trash.KindCollection {
+		return cm.check(access.Admin, entry.Name) == nil
+	}
+	return cm.check(access.Write, entry.Collection) == nil
+}
+
+// trashRoot is the storage root holding the database
+func (cm *CollectionManager) trashRoot() string {
+	return filepath.Dir(cm.db.Path)
+}
+
+// relocateTrash points the trash entries of a collection's deleted documents
+// at the collection under its new name, and returns the IDs of those it
+// changed. With only set, just those entries are changed. The history of its
+// documents moves with its directory.
+func (cm *CollectionManager) relocateTrash(oldName, newName, newPath string, only []string) ([]string, error) {
+	var changed []string
+	err := trash.Rewrite(cm.trashRoot(), func(entry *trash.Entry) bool {
+		if entry.Kind != trash.KindDocument || entry.Database != cm.db.Name || entry.Collection != oldName {
+			return false
+		}
+		if only != nil && !slices.Contains(only, entry.ID) {
+			return false
+		}
+		entry.Collection = newName
+		entry.Path = filepath.Join(newPath, filepath.Base(entry.Path))
+		changed = append(changed, entry.ID)
+		return true
+	})
+	return changed, err
+}
@@ -0,0 +1,25 @@
+package collections
+
+import (
+	"context"
+	"path/filepath"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/changes"
+)
+
+// Watch streams changes to a collection and its documents, along with
+// changes to the database as a whole
+func (cm *CollectionManager) Watch(ctx context.Context, name string, opts changes.WatchOptions) (*changes.Stream, error) {
+	if err := cm.check(access.Read, name); err != nil {
+		return nil, err
+	}
+
+	log, err := changes.Open(filepath.Dir(cm.db.Path))
+	if err != nil {
+		return nil, err
+	}
+	opts.Database = cm.db.Name
+	opts.Collection = name
+	return log.Watch(ctx, opts)
+}
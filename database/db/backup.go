@@ -0,0 +1,543 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/changes"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// BackupManifestFile names the file describing a backup. It is written last,
+// so a backup directory without one is incomplete.
+const BackupManifestFile = "manifest.json"
+
+// backupHold names the change log's hold on the changes after the latest backup
+const backupHold = "backup"
+
+// backupLogFile holds the changes made while a backup was being copied
+const backupLogFile = "changes.log"
+
+// backupVersion is the layout version recorded in new manifests
+const backupVersion = 1
+
+// BackupManifest describes a backup: what it holds, the span of the change
+// log it covers and a checksum of every file in it
+type BackupManifest struct {
+	Version   int          `json:"version"`
+	ID        string       `json:"id"`
+	Base      string       `json:"base,omitempty"` // ID of the backup an incremental backup continues
+	CreatedAt time.Time    `json:"createdAt"`
+	StartLSN  uint64       `json:"startLsn"` // Last change before copying began
+	EndLSN    uint64       `json:"endLsn"`   // Last change the backup restores to
+	Databases []string     `json:"databases"`
+	Encrypted bool         `json:"encrypted"` // Restoring needs the same master key
+	Files     []BackupFile `json:"files"`
+}
+
+// BackupFile is one file of a backup
+type BackupFile struct {
+	Path     string `json:"path"` // Relative to the backup directory, with forward slashes
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // CRC32C of the contents, in hex
+}
+
+// RestoreOptions selects what RestoreBackup brings back
+type RestoreOptions struct {
+	Database string // Restore only this database of the backup; empty for all of them
+	As       string // Name to restore Database under instead of its own
+
+	Increments []string  // Incremental backups taken after the full one, oldest first
+	UntilLSN   uint64    // Replay no change after this LSN; 0 for every change saved
+	UntilTime  time.Time // Replay no change made after this time; zero for every change saved
+}
+
+// Backup copies the named databases, or every database when none are named,
+// into dest, a new directory outside the storage root, while they stay open
+// for writes. Each collection is locked only while its own files are copied;
+// changes made meanwhile are saved alongside, and RestoreBackup replays them
+// so the restored databases are as they were when Backup returned. Files are
+// copied as stored, so an encrypted backup needs the same master key to restore.
+func (dbm *DBManager) Backup(dest string, names ...string) (*BackupManifest, error) {
+	if len(names) == 0 {
+		var err error
+		if names, err = dbm.ListDatabases(); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		if err := access.Check(dbm.ctx, access.Admin, name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	dest, err := dbm.backupDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	manifest, err := dbm.backup(dest, names)
+	if err != nil {
+		os.RemoveAll(dest)
+		return nil, err
+	}
+	fmt.Printf("Backed up %d database(s) to '%s' (changes up to LSN %d)\n", len(names), dest, manifest.EndLSN)
+	return manifest, nil
+}
+
+func (dbm *DBManager) backup(dest string, names []string) (*BackupManifest, error) {
+	log, err := changes.Open(dbm.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		Version:   backupVersion,
+		ID:        newBackupID(),
+		CreatedAt: time.Now().UTC(),
+		StartLSN:  log.LastLSN(),
+		Databases: names,
+		Encrypted: storage.Encrypted(dbm.basePath),
+	}
+	// The changes made while copying are saved at the end
+	inProgress := "backup " + manifest.ID
+	log.Retain(inProgress, manifest.StartLSN)
+	defer log.Release(inProgress)
+
+	for _, name := range names {
+		db, err := dbm.UseDatabase(name)
+		if err != nil {
+			return nil, err
+		}
+		files, err := dbm.backupDatabase(db, dest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up database '%s': %v", name, err)
+		}
+		manifest.Files = append(manifest.Files, files...)
+	}
+	manifest.EndLSN = log.LastLSN()
+
+	// Changes made while copying, so restores reach a single point in time
+	moved, err := saveChanges(log, dest, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if moved != "" {
+		return nil, fmt.Errorf("database '%s' was dropped or renamed during the backup", moved)
+	}
+	return manifest, dbm.finishBackup(log, dest, manifest)
+}
+
+// saveChanges writes the log entries of the manifest's databases between its
+// start and end LSNs into the backup, following databases that are renamed and
+// listing them under their new names. It returns the first of the databases
+// dropped or renamed, if any.
+func saveChanges(log *changes.Log, dest string, manifest *BackupManifest) (string, error) {
+	names := slices.Clone(manifest.Databases)
+	included := make(map[string]bool)
+	for _, name := range names {
+		included[name] = true
+	}
+
+	var moved string
+	file, err := os.Create(filepath.Join(dest, backupLogFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to save changes: %v", err)
+	}
+	_, err = log.Export(file, manifest.StartLSN, manifest.EndLSN, func(event models.ChangeEvent) bool {
+		switch {
+		case event.Op == models.OpDropDatabase && included[event.Database] && moved == "":
+			moved = event.Database
+		case event.Op == models.OpRenameDatabase && included[event.OldName]:
+			if moved == "" {
+				moved = event.OldName
+			}
+			included[event.OldName], included[event.Name] = false, true
+			if i := slices.Index(names, event.OldName); i >= 0 {
+				names[i] = event.Name
+			}
+		}
+		return included[event.Database]
+	})
+	manifest.Databases = names
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to save changes: %v", err)
+	}
+
+	entry, err := backupFile(dest, filepath.Join(dest, backupLogFile))
+	if err != nil {
+		return "", err
+	}
+	manifest.Files = append(manifest.Files, entry)
+	return moved, nil
+}
+
+// finishBackup copies the keyring and compression dictionaries into the backup
+// and writes its manifest. Keys and dictionaries go last so they cover every
+// file and change saved before. The change log then keeps the changes after
+// the backup for the next incremental one.
+func (dbm *DBManager) finishBackup(log *changes.Log, dest string, manifest *BackupManifest) error {
+	keyring := filepath.Join(dbm.basePath, storage.KeyringFile)
+	if _, err := os.Stat(keyring); err == nil {
+		entry, err := copyBackupFile(keyring, filepath.Join(dest, storage.KeyringFile), dest)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+	files, err := copyBackupTree(filepath.Join(dbm.basePath, storage.DictionariesDir), filepath.Join(dest, storage.DictionariesDir), dest)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to back up dictionaries: %v", err)
+	}
+	manifest.Files = append(manifest.Files, files...)
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dest, BackupManifestFile), append(raw, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %v", err)
+	}
+	return log.RetainSaved(backupHold, manifest.EndLSN)
+}
+
+// backupDatabase copies a database's collections one at a time, each under its
+// read lock so no write lands halfway through its copy
+func (dbm *DBManager) backupDatabase(db *models.Database, dest string) ([]BackupFile, error) {
+	colManager := collections.NewCollectionManager(db).WithContext(dbm.ctx)
+	names, err := colManager.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dest, db.Name), os.ModePerm); err != nil {
+		return nil, err
+	}
+	var files []BackupFile
+	for _, colName := range names {
+		collection, err := colManager.UseCollection(colName)
+		if err != nil {
+			// Dropped since it was listed; the saved changes record the drop
+			if _, statErr := os.Stat(filepath.Join(db.Path, colName)); os.IsNotExist(statErr) {
+				continue
+			}
+			return nil, err
+		}
+		collection.Mutex.RLock()
+		copied, err := copyBackupTree(collection.Path, filepath.Join(dest, db.Name, colName), dest)
+		collection.Mutex.RUnlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy collection '%s': %v", colName, err)
+		}
+		files = append(files, copied...)
+	}
+	return files, nil
+}
+
+// VerifyBackup reads a backup's manifest and checks every file it lists is
+// present and matches its checksum
+func (dbm *DBManager) VerifyBackup(src string) (*BackupManifest, error) {
+	raw, err := os.ReadFile(filepath.Join(src, BackupManifestFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("backup '%s' does not exist or is incomplete", src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %v", err)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, storage.Corrupt(filepath.Join(src, BackupManifestFile), "invalid backup manifest: %v", err)
+	}
+	if manifest.Version > backupVersion {
+		return nil, fmt.Errorf("invalid backup: version %d is newer than this server supports", manifest.Version)
+	}
+
+	for _, file := range manifest.Files {
+		path := filepath.Join(src, filepath.FromSlash(file.Path))
+		entry, err := backupFile(src, path)
+		if err != nil {
+			return &manifest, storage.Corrupt(path, "backup file is unreadable: %v", err)
+		}
+		if entry.Size != file.Size || entry.Checksum != file.Checksum {
+			return &manifest, storage.Corrupt(path, "backup file does not match its checksum")
+		}
+	}
+	return &manifest, nil
+}
+
+// RestoreBackup verifies a backup and restores its databases, or the one named
+// in opts, optionally under a new name. The changes saved in the incremental
+// backups listed in opts are replayed after it, up to the point in time opts
+// asks for. Restored databases must not exist yet; drop them first or restore
+// under another name. It returns the names of the databases restored.
+func (dbm *DBManager) RestoreBackup(src string, opts RestoreOptions) ([]string, error) {
+	if err := dbm.Writable(); err != nil {
+		return nil, err
+	}
+	if opts.As != "" && opts.Database == "" {
+		return nil, fmt.Errorf("invalid restore: a new name needs the database to restore")
+	}
+
+	manifest, err := dbm.VerifyBackup(src)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Base != "" {
+		return nil, fmt.Errorf("invalid restore: '%s' is an incremental backup; restore its full backup and list it as an increment", src)
+	}
+	names := manifest.Databases
+	if opts.Database != "" {
+		if !slices.Contains(names, opts.Database) {
+			return nil, fmt.Errorf("database '%s' does not exist in the backup", opts.Database)
+		}
+		names = []string{opts.Database}
+	}
+	// Restoring a database reveals its contents, so the caller must be able
+	// to read it as well as administer the database it becomes
+	targets := make(map[string]string)
+	for _, name := range names {
+		targets[name] = name
+		if opts.As != "" {
+			targets[name] = opts.As
+		}
+		if err := access.Check(dbm.ctx, access.Read, name, ""); err != nil {
+			return nil, err
+		}
+		if err := access.Check(dbm.ctx, access.Admin, targets[name], ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// The backup is read with its own copy of the keyring, while restoring only
+	done, err := storage.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup '%s': %v", src, err)
+	}
+	defer done()
+
+	events, err := dbm.backupChanges(src, manifest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []string
+	for _, name := range names {
+		replay, err := changesOf(events, name)
+		if err != nil {
+			return restored, err
+		}
+		if err := dbm.restoreDatabase(filepath.Join(src, name), targets[name], replay); err != nil {
+			return restored, err
+		}
+		restored = append(restored, targets[name])
+	}
+	return restored, nil
+}
+
+// restoreDatabase copies a database out of a backup under a new name, sealing
+// its files again under this root's keys, and replays the changes saved with it
+func (dbm *DBManager) restoreDatabase(src, name string, replay []models.ChangeEvent) error {
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	if _, err := dbm.freePath(name); err != nil {
+		return err
+	}
+	staged, err := dbm.stage()
+	if err != nil {
+		return fmt.Errorf("failed to restore database '%s': %v", name, err)
+	}
+	defer os.RemoveAll(staged)
+
+	// The database is put together outside the root's databases, then
+	// announced as the changes that recreate it
+	db := &models.Database{
+		Name:        name,
+		Path:        staged,
+		Collections: make(map[string]*models.Collection),
+	}
+	err = restoreTree(src, staged)
+	colManager := collections.NewCollectionManager(db)
+	for _, event := range replay {
+		if err != nil {
+			break
+		}
+		err = colManager.Apply(event)
+	}
+	// Replay skips the unique checks, as a change can clash with the copy it
+	// replays over until a later one is applied; the end result must not
+	if err == nil {
+		err = verifyUnique(db)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore database '%s': %v", name, err)
+	}
+
+	if _, err := dbm.announce(staged, name); err != nil {
+		return err
+	}
+	fmt.Printf("Restored database '%s' (%d change(s) replayed)\n", name, len(replay))
+	return nil
+}
+
+// verifyUnique checks the unique indexes of the database's loaded collections
+func verifyUnique(db *models.Database) error {
+	for _, collection := range db.Collections {
+		collection.Mutex.Lock()
+		err := collection.VerifyUnique()
+		collection.Mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDictionaries adds the backup's compression dictionaries this root lacks
+func (dbm *DBManager) restoreDictionaries(src string) error {
+	dir := filepath.Join(src, storage.DictionariesDir)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read backup dictionaries: %v", err)
+	}
+
+	target := filepath.Join(dbm.basePath, storage.DictionariesDir)
+	if err := os.MkdirAll(target, os.ModePerm); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(target, entry.Name())); err == nil {
+			continue
+		}
+		if err := storage.Copy(filepath.Join(dir, entry.Name()), filepath.Join(target, entry.Name())); err != nil {
+			return fmt.Errorf("failed to restore dictionary %s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// backupDir checks a backup destination and returns its absolute path. It must
+// be new or empty, and outside the storage root.
+func (dbm *DBManager) backupDir(dest string) (string, error) {
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.Abs(dbm.basePath)
+	if err != nil {
+		return "", err
+	}
+	if abs == root || strings.HasPrefix(abs, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid backup destination '%s': it is inside the storage root", dest)
+	}
+	if entries, err := os.ReadDir(abs); err == nil && len(entries) > 0 {
+		return "", fmt.Errorf("backup destination '%s' already exists", dest)
+	}
+	return abs, nil
+}
+
+// copyBackupTree copies every stored file below src to dst as it is, skipping
+// temporary files left by interrupted writes, and describes the copies
+func copyBackupTree(src, dst, dest string) ([]BackupFile, error) {
+	var files []BackupFile
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
+		}
+		file, err := copyBackupFile(path, target, dest)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// copyBackupFile copies one file into a backup and describes the copy
+func copyBackupFile(src, dst, dest string) (BackupFile, error) {
+	if err := copyFile(src, dst); err != nil {
+		return BackupFile{}, err
+	}
+	return backupFile(dest, dst)
+}
+
+// backupFile describes a file of the backup rooted at dest
+func backupFile(dest, path string) (BackupFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	rel, err := filepath.Rel(dest, path)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{
+		Path:     filepath.ToSlash(rel),
+		Size:     int64(len(raw)),
+		Checksum: fmt.Sprintf("%08x", crc32.Checksum(raw, castagnoli)),
+	}, nil
+}
+
+// restoreTree copies the stored files below src to dst, decoding each under
+// the backup's keys and sealing it again under dst's
+func restoreTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		return storage.Copy(path, target)
+	})
+}
+
+// newBackupID returns a backup ID that sorts by creation time
+func newBackupID() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// castagnoli is the CRC32C table backup checksums use, like stored files
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
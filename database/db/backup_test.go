@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	documents "Build-your-own-database/database/document"
+)
+
+// grants builds an identity holding one grant per database and privilege
+func grants(privileges map[string]access.Privilege) context.Context {
+	identity := &access.Identity{User: "eve"}
+	for database, privilege := range privileges {
+		identity.Grants = append(identity.Grants, access.Grant{Database: database, Privileges: []access.Privilege{privilege}})
+	}
+	return access.WithIdentity(context.Background(), identity)
+}
+
+func TestRestoreBackupAcrossDatabases(t *testing.T) {
+	dbm := Open(t.TempDir())
+	defer dbm.Close()
+	for _, name := range []string{"secret", "mine"} {
+		db, err := dbm.CreateDatabase(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		col, err := collections.NewCollectionManager(db).CreateCollection("notes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := documents.NewDocumentManager(col).CreateDocument("n1", map[string]interface{}{"text": name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := filepath.Join(t.TempDir(), "full")
+	if _, err := dbm.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		source     string
+		as         string
+		privileges map[string]access.Privilege
+		wantDenied bool
+	}{
+		{"admin of the target only", "secret", "copy1", map[string]access.Privilege{"copy1": access.Admin}, true},
+		{"read on the source only", "secret", "copy2", map[string]access.Privilege{"secret": access.Read}, true},
+		{"read on the source, admin of the target", "secret", "copy3", map[string]access.Privilege{"secret": access.Read, "copy3": access.Admin}, false},
+		{"admin of both", "mine", "copy4", map[string]access.Privilege{"mine": access.Admin, "copy4": access.Admin}, false},
+		{"admin of another source", "secret", "copy5", map[string]access.Privilege{"mine": access.Admin, "copy5": access.Admin}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored, err := dbm.WithContext(grants(tt.privileges)).RestoreBackup(backup, RestoreOptions{Database: tt.source, As: tt.as})
+			if tt.wantDenied {
+				if !errors.Is(err, access.ErrDenied) {
+					t.Fatalf("RestoreBackup() error = %v, want permission denied", err)
+				}
+				if _, err := dbm.UseDatabase(tt.as); err == nil {
+					t.Errorf("database '%s' was restored despite the denial", tt.as)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RestoreBackup() error = %v", err)
+			}
+			if len(restored) != 1 || restored[0] != tt.as {
+				t.Errorf("RestoreBackup() = %v, want [%s]", restored, tt.as)
+			}
+		})
+	}
+}
@@ -1,32 +1,95 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"Build-your-own-database/config"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/document"
 	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/trash"
 )
 
+// stagingDir is the directory under the storage root where databases are
+// built before they are announced, such as copies and restores
+const stagingDir = ".staging"
+
 type DBManager struct {
+	*engine
+	ctx context.Context // Carries the caller's identity, see WithContext
+}
+
+// engine is the state a DBManager shares with its WithContext copies
+type engine struct {
 	goDB     *models.GoDB
 	basePath string
 	mu       sync.RWMutex
+
+	system   *models.Database // Internal database, loaded on first use
+	systemMu sync.Mutex
+
+	stop      chan struct{}  // Closed by Close to end background work
+	closeOnce sync.Once      // Guards closing stop
+	workers   sync.WaitGroup // Background goroutines such as the TTL reaper
 }
 
 func NewDBManager() *DBManager {
+	return Open(config.BasePath)
+}
+
+// Open returns a manager of the databases under a storage root other than
+// the configured one, such as a shard's directory
+func Open(root string) *DBManager {
+	// A root whose keys cannot be opened refuses every read and write
+	if err := storage.Init(root); err != nil {
+		fmt.Println("Error opening storage:", err)
+	}
+
 	manager := &DBManager{
-		goDB: &models.GoDB{
-			Databases: make(map[string]*models.Database),
+		engine: &engine{
+			goDB: &models.GoDB{
+				Databases: make(map[string]*models.Database),
+			},
+			basePath: root,
+			stop:     make(chan struct{}),
 		},
-		basePath: config.BasePath,
+		ctx: context.Background(),
 	}
 	manager.loadDatabases()
+	manager.startReaper(config.TTLInterval)
+	manager.startPurger(config.PurgeInterval)
 	return manager
 }
 
+// Root returns the storage root the manager's databases live under
+func (dbm *DBManager) Root() string {
+	return dbm.basePath
+}
+
+// Context returns the context the manager checks access against
+func (dbm *DBManager) Context() context.Context {
+	return dbm.ctx
+}
+
+// WithContext returns a manager sharing dbm's databases whose operations are
+// checked against the identity in ctx (see the access package)
+func (dbm *DBManager) WithContext(ctx context.Context) *DBManager {
+	return &DBManager{engine: dbm.engine, ctx: ctx}
+}
+
+// Close stops the manager's background goroutines and waits for them to exit
+func (dbm *DBManager) Close() {
+	dbm.closeOnce.Do(func() { close(dbm.stop) })
+	dbm.workers.Wait()
+}
+
 func (dbm *DBManager) loadDatabases() {
 	dbm.mu.Lock()
 	defer dbm.mu.Unlock()
@@ -36,9 +99,12 @@ func (dbm *DBManager) loadDatabases() {
 		fmt.Println("Error reading basePath:", err)
 		return
 	}
+	// Whatever was being staged when the process stopped was never announced
+	os.RemoveAll(filepath.Join(dbm.basePath, stagingDir))
 
 	for _, entry := range entries {
-		if entry.IsDir() {
+		// Dot directories hold internal data such as the trash
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
 			dbName := entry.Name()
 			dbPath := filepath.Join(dbm.basePath, dbName)
 
@@ -56,6 +122,13 @@ func (dbm *DBManager) loadDatabases() {
 }
 
 func (dbm *DBManager) CreateDatabase(name string) (*models.Database, error) {
+	if err := dbm.Writable(); err != nil {
+		return nil, err
+	}
+	if err := access.Check(dbm.ctx, access.Admin, name, ""); err != nil {
+		return nil, err
+	}
+
 	dbm.mu.Lock()
 	defer dbm.mu.Unlock()
 
@@ -66,27 +139,28 @@ func (dbm *DBManager) CreateDatabase(name string) (*models.Database, error) {
 	if exists {
 		return nil, fmt.Errorf("database '%s' already exists", name)
 	}
-
-	dbPath := filepath.Join(dbm.basePath, name)
-	if err := os.MkdirAll(dbPath, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("failed to create database '%s': %v", name, err)
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid database name '%s'", name)
 	}
 
-	db := &models.Database{
-		Name:        name,
-		Path:        dbPath,
-		Collections: make(map[string]*models.Collection),
+	db, err := dbm.create(name)
+	if err != nil {
+		return nil, err
 	}
 
-	dbm.goDB.Mutex.Lock()
-	dbm.goDB.Databases[name] = db
-	dbm.goDB.Mutex.Unlock()
-
 	fmt.Println("Database created:", name)
 	return db, nil
 }
 
 func (dbm *DBManager) UseDatabase(name string) (*models.Database, error) {
+	// Internal databases such as the system database are not reachable by name
+	if !validName(name) {
+		return nil, fmt.Errorf("database '%s' %w", name, documents.ErrNotFound)
+	}
+	if err := access.CheckVisible(dbm.ctx, name, ""); err != nil {
+		return nil, err
+	}
+
 	dbm.mu.RLock()
 	defer dbm.mu.RUnlock()
 
@@ -101,7 +175,7 @@ func (dbm *DBManager) UseDatabase(name string) (*models.Database, error) {
 
 	dbPath := filepath.Join(dbm.basePath, name)
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("database '%s' does not exist", name)
+		return nil, fmt.Errorf("database '%s' %w", name, documents.ErrNotFound)
 	}
 
 	db = &models.Database{
@@ -119,6 +193,16 @@ func (dbm *DBManager) UseDatabase(name string) (*models.Database, error) {
 }
 
 func (dbm *DBManager) DeleteDatabase(name string) error {
+	if !validName(name) {
+		return fmt.Errorf("database '%s' %w", name, documents.ErrNotFound)
+	}
+	if err := dbm.Writable(); err != nil {
+		return err
+	}
+	if err := access.Check(dbm.ctx, access.Admin, name, ""); err != nil {
+		return err
+	}
+
 	dbm.mu.Lock()
 	defer dbm.mu.Unlock()
 
@@ -129,7 +213,7 @@ func (dbm *DBManager) DeleteDatabase(name string) error {
 	if !exists {
 		dbPath := filepath.Join(dbm.basePath, name)
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-			return fmt.Errorf("database '%s' does not exist", name)
+			return fmt.Errorf("database '%s' %w", name, documents.ErrNotFound)
 		}
 		db = &models.Database{
 			Name: name,
@@ -137,14 +221,99 @@ func (dbm *DBManager) DeleteDatabase(name string) error {
 		}
 	}
 
-	if err := os.RemoveAll(db.Path); err != nil {
-		return fmt.Errorf("failed to delete database '%s': %v", name, err)
-	}
+	err := dbm.change(models.ChangeEvent{Op: models.OpDropDatabase, Database: name, Name: name}, func() error {
+		if config.TrashRetention > 0 {
+			if _, err := trash.Move(dbm.basePath, trash.Entry{
+				Kind:     trash.KindDatabase,
+				Database: name,
+				Name:     name,
+				Path:     db.Path,
+			}); err != nil {
+				return err
+			}
+		} else if err := os.RemoveAll(db.Path); err != nil {
+			return fmt.Errorf("failed to delete database '%s': %v", name, err)
+		}
 
-	dbm.goDB.Mutex.Lock()
-	delete(dbm.goDB.Databases, name)
-	dbm.goDB.Mutex.Unlock()
+		dbm.goDB.Mutex.Lock()
+		delete(dbm.goDB.Databases, name)
+		dbm.goDB.Mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Database deleted:", name)
 	return nil
 }
+
+// Writable returns an error wrapping storage.ErrReadOnly while the storage
+// root refuses changes, such as while this process is a replica
+func (dbm *DBManager) Writable() error {
+	return storage.Writable(dbm.basePath)
+}
+
+// change makes a database-level change with apply; see models.Change
+func (dbm *DBManager) change(event models.ChangeEvent, apply func() error) error {
+	event.Root = dbm.basePath
+	return models.Change(event, apply)
+}
+
+// create makes an empty database, whose name the caller has checked is free.
+// The caller holds mu.
+func (dbm *DBManager) create(name string) (*models.Database, error) {
+	db := &models.Database{
+		Name:        name,
+		Path:        filepath.Join(dbm.basePath, name),
+		Collections: make(map[string]*models.Collection),
+	}
+	err := dbm.change(models.ChangeEvent{Op: models.OpCreateDatabase, Database: name, Name: name}, func() error {
+		if err := os.MkdirAll(db.Path, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create database '%s': %v", name, err)
+		}
+		dbm.goDB.Mutex.Lock()
+		dbm.goDB.Databases[name] = db
+		dbm.goDB.Mutex.Unlock()
+		return nil
+	})
+	if err != nil && !models.Uncommitted(err) {
+		return nil, err
+	}
+	return db, err
+}
+
+// announce adds the database kept at staged, outside the root's databases,
+// as name, through the changes that recreate it elsewhere: its creation, then
+// each of its collections' (see CollectionManager.Announce). Used for
+// databases that appear other than through CreateDatabase. The caller holds
+// mu, and removes what is left at staged.
+func (dbm *DBManager) announce(staged, name string) (*models.Database, error) {
+	db, err := dbm.create(name)
+	if err != nil {
+		return db, err
+	}
+
+	source := &models.Database{Name: name, Path: staged}
+	names, err := collections.NewCollectionManager(source).ListCollections()
+	if err != nil {
+		return db, err
+	}
+	colManager := collections.NewCollectionManager(db)
+	for _, col := range names {
+		if err := colManager.Announce(filepath.Join(staged, col), col); err != nil {
+			return db, err
+		}
+	}
+	return db, nil
+}
+
+// stage returns a new directory under the root, outside its databases, to
+// build a database in before it is announced
+func (dbm *DBManager) stage() (string, error) {
+	dir := filepath.Join(dbm.basePath, stagingDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, "")
+}
@@ -0,0 +1,454 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// LostFoundDir is the directory under the storage root where Fsck moves
+// files it cannot repair in place
+const LostFoundDir = ".lost+found"
+
+// Kinds of problem Fsck reports
+const (
+	IssueCorrupt       = "corrupt"        // A file fails its checksum or does not decode
+	IssueOrphan        = "orphan"         // A file or directory no collection accounts for
+	IssueDuplicateName = "duplicate-name" // Two documents of a collection share a name
+	IssueIDMismatch    = "id-mismatch"    // A document's ID or path disagrees with its file
+	IssueMetadata      = "metadata"       // Collection metadata is missing or inconsistent
+	IssueIndex         = "index"          // Documents violate a unique index
+	IssueNoChecksum    = "no-checksum"    // A file was written before checksums
+)
+
+// FsckIssue is a single problem found by Fsck
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// FsckReport lists what Fsck checked and found
+type FsckReport struct {
+	Databases   int         `json:"databases"`
+	Collections int         `json:"collections"`
+	Documents   int         `json:"documents"`
+	Files       int         `json:"files"`
+	Issues      []FsckIssue `json:"issues"`
+}
+
+// Unrepaired counts the issues still outstanding
+func (r *FsckReport) Unrepaired() int {
+	count := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// fsck carries the state of one Fsck run
+type fsck struct {
+	dbm    *DBManager
+	repair bool
+	report *FsckReport
+}
+
+// Fsck verifies the named databases, or every database and the system
+// database when none are named: the checksum and encoding of every file,
+// collection metadata, document IDs against file names, duplicate names and
+// unique indexes. With repair it fixes what it can: metadata and IDs are
+// rewritten, duplicates renamed, files without checksums rewritten with one,
+// and damaged documents restored from history or moved to LostFoundDir.
+// Repairs bypass the managers' caches, so run them while the database is idle.
+func (dbm *DBManager) Fsck(repair bool, names ...string) (*FsckReport, error) {
+	if len(names) == 0 {
+		var err error
+		if names, err = dbm.ListDatabases(); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(dbm.basePath, SystemDatabase)); err == nil {
+			names = append(names, SystemDatabase)
+		}
+	}
+
+	f := &fsck{dbm: dbm, repair: repair, report: &FsckReport{}}
+	for _, name := range names {
+		if err := access.Check(dbm.ctx, access.Admin, name, ""); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dbm.basePath, name)
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("database '%s' does not exist", name)
+		}
+		if err := f.database(name, path); err != nil {
+			return f.report, err
+		}
+		if repair {
+			dbm.forget(name)
+		}
+	}
+	return f.report, nil
+}
+
+// forget drops a database's cached collections so they are read again from disk
+func (dbm *DBManager) forget(name string) {
+	var db *models.Database
+	if name == SystemDatabase {
+		dbm.systemMu.Lock()
+		db = dbm.system
+		dbm.systemMu.Unlock()
+	} else {
+		dbm.goDB.Mutex.RLock()
+		db = dbm.goDB.Databases[name]
+		dbm.goDB.Mutex.RUnlock()
+	}
+	if db == nil {
+		return
+	}
+	db.Mutex.Lock()
+	db.Collections = make(map[string]*models.Collection)
+	db.Mutex.Unlock()
+}
+
+func (f *fsck) database(name, path string) error {
+	f.report.Databases++
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read database '%s': %v", name, err)
+	}
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			f.issue(IssueOrphan, entryPath, "not a collection", false)
+			continue
+		}
+		if err := f.collection(name, entry.Name(), entryPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fsck) collection(dbName, name, path string) error {
+	f.report.Collections++
+	col, err := f.metadata(dbName, name, path)
+	if err != nil || col == nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read collection '%s': %v", name, err)
+	}
+	var docs []*models.Document
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		switch {
+		case entry.Name() == models.MetadataFile:
+		case entry.IsDir() && entry.Name() == models.HistoryDir:
+			if err := f.history(col, entryPath); err != nil {
+				return err
+			}
+		case strings.HasSuffix(entry.Name(), ".tmp"):
+			repaired := f.repair && os.Remove(entryPath) == nil
+			f.issue(IssueOrphan, entryPath, "temporary file left by an interrupted write", repaired)
+		case entry.IsDir() || filepath.Ext(entry.Name()) != ".json":
+			f.issue(IssueOrphan, entryPath, "not a document", false)
+		default:
+			if doc := f.document(dbName, col, entryPath); doc != nil {
+				docs = append(docs, doc)
+			}
+		}
+	}
+
+	f.duplicates(docs)
+	f.indexes(col, docs)
+	return nil
+}
+
+// metadata checks a collection's metadata file, returning the collection it
+// describes, or nil when the directory cannot be treated as one
+func (f *fsck) metadata(dbName, name, path string) (*models.Collection, error) {
+	metadataPath := filepath.Join(path, models.MetadataFile)
+	fresh := &models.Collection{Name: name, Path: path}
+
+	raw, data, err := f.read(metadataPath)
+	if os.IsNotExist(err) {
+		files, _ := os.ReadDir(path)
+		if len(files) == 0 {
+			repaired := f.repair && os.Remove(path) == nil
+			f.issue(IssueOrphan, path, "empty directory without collection metadata", repaired)
+			return nil, nil
+		}
+		repaired := f.repair && f.saveMetadata(fresh) == nil
+		f.issue(IssueMetadata, metadataPath, "missing; recreated without indexes or options", repaired)
+		if !repaired {
+			return nil, nil
+		}
+		return fresh, nil
+	}
+	if err != nil {
+		repaired := f.repair && f.quarantine(dbName, metadataPath) == nil && f.saveMetadata(fresh) == nil
+		f.issue(IssueCorrupt, metadataPath, reason(err)+"; recreated without indexes or options", repaired)
+		return fresh, nil
+	}
+
+	var col models.Collection
+	if err := json.Unmarshal(data, &col); err != nil {
+		repaired := f.repair && f.quarantine(dbName, metadataPath) == nil && f.saveMetadata(fresh) == nil
+		f.issue(IssueCorrupt, metadataPath, fmt.Sprintf("invalid collection metadata: %v", err), repaired)
+		return fresh, nil
+	}
+
+	var problems []string
+	if col.Name != name {
+		problems = append(problems, fmt.Sprintf("name '%s' does not match directory '%s'", col.Name, name))
+		col.Name = name
+	}
+	if col.Path != path {
+		problems = append(problems, fmt.Sprintf("path '%s' does not match '%s'", col.Path, path))
+		col.Path = path
+	}
+	seen := make(map[string]bool)
+	var indexes []models.Index
+	for _, index := range col.Indexes {
+		if index.Field == "" || seen[index.Field] {
+			problems = append(problems, fmt.Sprintf("invalid or repeated index on '%s'", index.Field))
+			continue
+		}
+		seen[index.Field] = true
+		indexes = append(indexes, index)
+	}
+	col.Indexes = indexes
+	if len(problems) > 0 {
+		repaired := f.repair && f.saveMetadata(&col) == nil
+		f.issue(IssueMetadata, metadataPath, strings.Join(problems, "; "), repaired)
+	} else if !storage.HasChecksum(raw) {
+		repaired := f.repair && storage.Rewrite(metadataPath) == nil
+		f.issue(IssueNoChecksum, metadataPath, "written before checksums", repaired)
+	}
+
+	if col.Compression != nil {
+		if err := col.Compression.Validate(); err != nil {
+			f.issue(IssueMetadata, metadataPath, err.Error(), false)
+		}
+	}
+	for _, field := range col.Encrypted {
+		if err := field.Validate(); err != nil {
+			f.issue(IssueMetadata, metadataPath, err.Error(), false)
+		}
+	}
+	col.Documents = make(map[string]*models.Document)
+	return &col, nil
+}
+
+// document checks one document file, returning the document when it is readable
+func (f *fsck) document(dbName string, col *models.Collection, path string) *models.Document {
+	f.report.Documents++
+	raw, data, err := f.read(path)
+	if err == nil {
+		var doc *models.Document
+		if doc, err = col.ReadDocument(path); err == nil {
+			return f.documentFields(doc, path, raw, data)
+		}
+	}
+
+	if !f.repair || f.quarantine(dbName, path) != nil {
+		f.issue(IssueCorrupt, path, reason(err), false)
+		return nil
+	}
+	id := strings.TrimSuffix(filepath.Base(path), ".json")
+	if restored := f.restoreFromHistory(col, id); restored != nil {
+		f.issue(IssueCorrupt, path, fmt.Sprintf("%s; moved to %s and restored revision %d from history", reason(err), LostFoundDir, restored.Revision), true)
+		return restored
+	}
+	f.issue(IssueCorrupt, path, fmt.Sprintf("%s; moved to %s", reason(err), LostFoundDir), true)
+	return nil
+}
+
+// documentFields checks a readable document against its file
+func (f *fsck) documentFields(doc *models.Document, path string, raw, data []byte) *models.Document {
+	id := strings.TrimSuffix(filepath.Base(path), ".json")
+	var problems []string
+	if doc.ID != id {
+		problems = append(problems, fmt.Sprintf("ID '%s' does not match file name", doc.ID))
+		doc.ID = id
+	}
+	if recorded := recordedPath(data); recorded != "" && recorded != path {
+		problems = append(problems, fmt.Sprintf("recorded path '%s' does not match", recorded))
+	}
+	if doc.Name == "" {
+		problems = append(problems, "document has no name")
+		doc.Name = id
+	}
+	if len(problems) > 0 {
+		repaired := f.repair && doc.Rewrite() == nil
+		f.issue(IssueIDMismatch, path, strings.Join(problems, "; "), repaired)
+		return doc
+	}
+
+	if !storage.HasChecksum(raw) {
+		repaired := f.repair && doc.Rewrite() == nil
+		f.issue(IssueNoChecksum, path, "written before checksums", repaired)
+	}
+	return doc
+}
+
+// recordedPath returns the path written inside a document file
+func recordedPath(data []byte) string {
+	var recorded struct {
+		Path string `json:"path"`
+	}
+	json.Unmarshal(data, &recorded)
+	return recorded.Path
+}
+
+// restoreFromHistory replaces a damaged document file with its newest readable
+// archived version
+func (f *fsck) restoreFromHistory(col *models.Collection, id string) *models.Document {
+	versions, err := col.Versions(id)
+	if err != nil || len(versions) == 0 {
+		return nil
+	}
+	latest := versions[len(versions)-1]
+	doc := col.NewDocument(id, latest.Name, latest.Data)
+	doc.CreatedAt, doc.UpdatedAt = latest.CreatedAt, latest.UpdatedAt
+	doc.Revision, doc.Size = latest.Revision, latest.Size
+	doc.ExpireAt, doc.Seq = latest.ExpireAt, latest.Seq
+	if doc.Rewrite() != nil {
+		return nil
+	}
+	return doc
+}
+
+// history checks the archived versions of a collection
+func (f *fsck) history(col *models.Collection, dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			repaired := f.repair && os.Remove(path) == nil
+			f.issue(IssueOrphan, path, "temporary file left by an interrupted write", repaired)
+			return nil
+		}
+		raw, data, err := f.read(path)
+		if err == nil {
+			_, err = col.ReadDocument(path)
+		}
+		if err != nil {
+			repaired := f.repair && f.quarantine(col.DatabaseName(), path) == nil
+			f.issue(IssueCorrupt, path, reason(err), repaired)
+			return nil
+		}
+		if !storage.HasChecksum(raw) {
+			repaired := f.repair && storage.WriteCompressed(path, data, col.Compression) == nil
+			f.issue(IssueNoChecksum, path, "written before checksums", repaired)
+		}
+		return nil
+	})
+}
+
+// duplicates reports documents sharing a name. Repair keeps the most recently
+// updated one under the name and renames the others to "name~id".
+func (f *fsck) duplicates(docs []*models.Document) {
+	byName := make(map[string][]*models.Document)
+	for _, doc := range docs {
+		byName[doc.Name] = append(byName[doc.Name], doc)
+	}
+	for name, group := range byName {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].UpdatedAt.After(group[j].UpdatedAt) })
+		for _, doc := range group[1:] {
+			repaired := false
+			if f.repair {
+				doc.Name = name + "~" + doc.ID
+				repaired = doc.Rewrite() == nil
+			}
+			f.issue(IssueDuplicateName, doc.Path, fmt.Sprintf("name '%s' is also used by document %s", name, group[0].ID), repaired)
+		}
+	}
+}
+
+// indexes reports documents that break a unique index; which one to keep is
+// left to the user
+func (f *fsck) indexes(col *models.Collection, docs []*models.Document) {
+	for _, index := range col.Indexes {
+		if !index.Unique {
+			continue
+		}
+		var seen []*models.Document
+		for _, doc := range docs {
+			value, ok := doc.Field(index.Field)
+			if !ok {
+				continue
+			}
+			for _, other := range seen {
+				if existing, _ := other.Field(index.Field); models.Equal(existing, value) {
+					f.issue(IssueIndex, doc.Path, fmt.Sprintf("value '%v' of unique index '%s' is also held by document %s", value, index.Field, other.ID), false)
+					break
+				}
+			}
+			seen = append(seen, doc)
+		}
+	}
+}
+
+// read returns a file's raw and decoded contents, counting the file
+func (f *fsck) read(path string) (raw, data []byte, err error) {
+	if raw, err = os.ReadFile(path); err != nil {
+		return nil, nil, err
+	}
+	f.report.Files++
+	if data, err = storage.Decode(path, raw); err != nil {
+		return nil, nil, err
+	}
+	return raw, data, nil
+}
+
+// quarantine moves a file into LostFoundDir, keeping its path below the root
+func (f *fsck) quarantine(dbName, path string) error {
+	rel, err := filepath.Rel(f.dbm.basePath, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Join(dbName, filepath.Base(path))
+	}
+	target := filepath.Join(f.dbm.basePath, LostFoundDir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
+
+func (f *fsck) saveMetadata(col *models.Collection) error {
+	raw, err := json.Marshal(col)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(filepath.Join(col.Path, models.MetadataFile), append(raw, '\n'))
+}
+
+// reason describes why a file is corrupt without repeating its path
+func reason(err error) string {
+	var corrupt *storage.CorruptionError
+	if errors.As(err, &corrupt) {
+		return corrupt.Reason
+	}
+	return err.Error()
+}
+
+func (f *fsck) issue(kind, path, detail string, repaired bool) {
+	f.report.Issues = append(f.report.Issues, FsckIssue{Kind: kind, Path: path, Detail: detail, Repaired: repaired})
+}
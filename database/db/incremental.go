@@ -0,0 +1,156 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/changes"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// errPointReached stops reading saved changes once the point restored to is passed
+var errPointReached = errors.New("point in time reached")
+
+// BackupIncremental saves into dest the changes made to base's databases since
+// base, a full or incremental backup, was taken. It copies no data files, so
+// it is quick and small; restore it by listing it, after its base, in
+// RestoreOptions.Increments. Databases renamed since are followed.
+func (dbm *DBManager) BackupIncremental(dest, base string) (*BackupManifest, error) {
+	baseManifest, err := dbm.VerifyBackup(base)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range baseManifest.Databases {
+		if err := access.Check(dbm.ctx, access.Admin, name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	log, err := changes.Open(dbm.basePath)
+	if err != nil {
+		return nil, err
+	}
+	if baseManifest.EndLSN > log.LastLSN() {
+		return nil, fmt.Errorf("invalid base backup: it holds changes up to LSN %d, past the end of this change log", baseManifest.EndLSN)
+	}
+
+	dest, err = dbm.backupDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	manifest := &BackupManifest{
+		Version:   backupVersion,
+		ID:        newBackupID(),
+		Base:      baseManifest.ID,
+		CreatedAt: time.Now().UTC(),
+		StartLSN:  baseManifest.EndLSN,
+		EndLSN:    log.LastLSN(),
+		Databases: baseManifest.Databases,
+		Encrypted: storage.Encrypted(dbm.basePath),
+	}
+	if _, err = saveChanges(log, dest, manifest); err == nil {
+		err = dbm.finishBackup(log, dest, manifest)
+	}
+	if err != nil {
+		os.RemoveAll(dest)
+		return nil, err
+	}
+
+	fmt.Printf("Saved changes %d to %d of %d database(s) to '%s'\n", manifest.StartLSN+1, manifest.EndLSN, len(manifest.Databases), dest)
+	return manifest, nil
+}
+
+// backupChanges reads the changes saved with a full backup, which the caller
+// has opened with storage.Open, and with the increments in opts, checking each
+// increment continues the one before it.
+// The full backup's own changes are always needed, so the point in time asked
+// for cannot come before them; increments are read only up to it.
+func (dbm *DBManager) backupChanges(src string, manifest *BackupManifest, opts RestoreOptions) ([]models.ChangeEvent, error) {
+	if opts.UntilLSN != 0 && opts.UntilLSN < manifest.EndLSN {
+		return nil, fmt.Errorf("invalid point in time: the backup already holds changes up to LSN %d", manifest.EndLSN)
+	}
+	if !opts.UntilTime.IsZero() && opts.UntilTime.Before(manifest.CreatedAt) {
+		return nil, fmt.Errorf("invalid point in time: the backup was taken at %s", manifest.CreatedAt.Format(time.RFC3339))
+	}
+	passed := func(event models.ChangeEvent) bool {
+		return (opts.UntilLSN != 0 && event.LSN > opts.UntilLSN) ||
+			(!opts.UntilTime.IsZero() && event.Time.After(opts.UntilTime))
+	}
+
+	var events []models.ChangeEvent
+	previous := manifest
+	for i, dir := range append([]string{src}, opts.Increments...) {
+		current := manifest
+		if i > 0 {
+			var err error
+			if current, err = dbm.VerifyBackup(dir); err != nil {
+				return nil, err
+			}
+			if current.Base != previous.ID || current.StartLSN != previous.EndLSN {
+				return nil, fmt.Errorf("invalid increment '%s': it does not continue backup %s", dir, previous.ID)
+			}
+		}
+
+		// Each increment is read with its own copy of the keyring, as the
+		// caller reads the full backup
+		if i > 0 {
+			done, err := storage.Open(dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open backup '%s': %v", dir, err)
+			}
+			defer done()
+		}
+		if err := dbm.restoreDictionaries(dir); err != nil {
+			return nil, err
+		}
+
+		err := changes.ReadFile(filepath.Join(dir, backupLogFile), func(event models.ChangeEvent) error {
+			if event.LSN <= current.StartLSN || event.LSN > current.EndLSN {
+				return nil
+			}
+			if passed(event) {
+				if i == 0 {
+					return fmt.Errorf("invalid point in time: the backup already holds changes up to %s", event.Time.Format(time.RFC3339))
+				}
+				return errPointReached
+			}
+			events = append(events, event)
+			return nil
+		})
+		if errors.Is(err, errPointReached) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read changes of backup '%s': %v", dir, err)
+		}
+		previous = current
+	}
+	return events, nil
+}
+
+// changesOf picks the changes to one database out of a backup's, following it
+// through renames. A database dropped before the point restored to is gone.
+func changesOf(events []models.ChangeEvent, name string) ([]models.ChangeEvent, error) {
+	var picked []models.ChangeEvent
+	for _, event := range events {
+		switch {
+		case event.Op == models.OpRenameDatabase && event.OldName == name:
+			name = event.Name
+		case event.Op == models.OpDropDatabase && event.Database == name:
+			return nil, fmt.Errorf("database '%s' was dropped at LSN %d (%s); restore to an earlier point",
+				name, event.LSN, event.Time.Format(time.RFC3339))
+		case event.Database == name:
+			picked = append(picked, event)
+		}
+	}
+	return picked, nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/changes"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/trash"
+)
+
+// RotateKeys gives a database a new data key and re-encrypts its files under
+// it while the database stays online: each collection is locked only while its
+// own files are rewritten. Trash entries and change log records keep the key
+// they were written with; old keys stay in the keyring to read them.
+func (dbm *DBManager) RotateKeys(name string) (storage.KeyID, error) {
+	if err := access.Check(dbm.ctx, access.Admin, name, ""); err != nil {
+		return storage.KeyID{}, err
+	}
+
+	var db *models.Database
+	var err error
+	if name == SystemDatabase {
+		db, err = dbm.System()
+	} else {
+		db, err = dbm.UseDatabase(name)
+	}
+	if err != nil {
+		return storage.KeyID{}, err
+	}
+
+	id, err := storage.Rotate(dbm.basePath, name)
+	if err != nil {
+		return id, err
+	}
+
+	colManager := collections.NewCollectionManager(db).WithContext(dbm.ctx)
+	names, err := colManager.ListCollections()
+	if err != nil {
+		return id, err
+	}
+	for _, colName := range names {
+		collection, err := colManager.UseCollection(colName)
+		if err != nil {
+			return id, err
+		}
+		collection.Mutex.Lock()
+		err = rewriteTree(collection.Path)
+		collection.Mutex.Unlock()
+		if err != nil {
+			return id, fmt.Errorf("failed to re-encrypt collection '%s': %v", colName, err)
+		}
+	}
+
+	fmt.Printf("Rotated data key of database '%s' to %s\n", name, id)
+	return id, nil
+}
+
+// rewriteTree rewrites every stored file below dir under the current data key,
+// skipping temporary files left by interrupted writes
+func rewriteTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
+		}
+		return storage.Rewrite(path)
+	})
+}
+
+// Seal finishes the move to encryption at rest: it seals every file still in
+// plaintext, or encrypted before files were sealed under their name, then makes
+// the keyring strict so plaintext files are refused from then on. Run it with
+// the server stopped, like fsck -repair. It returns how many files it sealed.
+func (dbm *DBManager) Seal() (int, error) {
+	keyring, err := storage.KeyringOf(dbm.basePath)
+	if err != nil {
+		return 0, err
+	}
+	if keyring == nil {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+	if err := trash.Upgrade(dbm.basePath); err != nil {
+		return 0, err
+	}
+
+	sealed := 0
+	err = filepath.WalkDir(dbm.basePath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			// Quarantined files stay as they were found
+			if path != dbm.basePath && entry.Name() == LostFoundDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// The change log is sealed entry by entry
+		if entry.Name() == storage.KeyringFile || strings.HasSuffix(entry.Name(), ".tmp") ||
+			entry.Name() == changes.LogFile && filepath.Base(filepath.Dir(path)) == changes.Dir {
+			return nil
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !storage.NeedsSealing(raw) {
+			return nil
+		}
+		if err := storage.Rewrite(path); err != nil {
+			return fmt.Errorf("failed to seal %s: %v", path, err)
+		}
+		sealed++
+		return nil
+	})
+	if err != nil {
+		return sealed, err
+	}
+	return sealed, keyring.SetStrict()
+}
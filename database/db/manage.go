@@ -0,0 +1,260 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+)
+
+// ListDatabases lists every database stored under the base path
+func (dbm *DBManager) ListDatabases() ([]string, error) {
+	entries, err := os.ReadDir(dbm.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read basePath: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && access.Visible(dbm.ctx, entry.Name(), "") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RenameDatabase renames a database directory and updates the paths recorded
+// in its collections and documents
+func (dbm *DBManager) RenameDatabase(oldName, newName string) error {
+	if err := dbm.Writable(); err != nil {
+		return err
+	}
+	if err := access.Check(dbm.ctx, access.Admin, oldName, ""); err != nil {
+		return err
+	}
+	if err := access.Check(dbm.ctx, access.Admin, newName, ""); err != nil {
+		return err
+	}
+
+	db, err := dbm.UseDatabase(oldName)
+	if err != nil {
+		return err
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	newPath, err := dbm.freePath(newName)
+	if err != nil {
+		return err
+	}
+
+	err = dbm.change(models.ChangeEvent{Op: models.OpRenameDatabase, Database: newName, Name: newName, OldName: oldName}, func() error {
+		db.Mutex.Lock()
+		if err := os.Rename(db.Path, newPath); err != nil {
+			db.Mutex.Unlock()
+			return fmt.Errorf("failed to rename database '%s': %v", oldName, err)
+		}
+		db.Name = newName
+		db.Path = newPath
+		db.Mutex.Unlock()
+
+		if err := collections.NewCollectionManager(db).Relocate(); err != nil {
+			return err
+		}
+
+		dbm.goDB.Mutex.Lock()
+		delete(dbm.goDB.Databases, oldName)
+		dbm.goDB.Databases[newName] = db
+		dbm.goDB.Mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Renamed database '%s' to '%s'\n", oldName, newName)
+	return nil
+}
+
+// CopyDatabase copies a database, with all its collections and documents, to a new name
+func (dbm *DBManager) CopyDatabase(src, dst string) (*models.Database, error) {
+	if err := dbm.Writable(); err != nil {
+		return nil, err
+	}
+	if err := access.Check(dbm.ctx, access.Read, src, ""); err != nil {
+		return nil, err
+	}
+	if err := access.Check(dbm.ctx, access.Admin, dst, ""); err != nil {
+		return nil, err
+	}
+
+	source, err := dbm.UseDatabase(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	if _, err := dbm.freePath(dst); err != nil {
+		return nil, err
+	}
+	staged, err := dbm.stage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy database '%s': %v", src, err)
+	}
+	defer os.RemoveAll(staged)
+
+	// Unloaded collections cannot be written while the database is locked, as
+	// loading one needs it; loaded ones are locked one by one as they are copied
+	source.Mutex.RLock()
+	err = copyDatabase(source, staged)
+	source.Mutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy database '%s': %v", src, err)
+	}
+
+	db, err := dbm.announce(staged, dst)
+	if err == nil {
+		fmt.Printf("Copied database '%s' to '%s'\n", src, dst)
+	}
+	return db, err
+}
+
+// DatabaseStats reports collection and document counts and the disk footprint of a database
+func (dbm *DBManager) DatabaseStats(name string) (*models.DatabaseStats, error) {
+	if err := access.Check(dbm.ctx, access.Read, name, ""); err != nil {
+		return nil, err
+	}
+
+	db, err := dbm.UseDatabase(name)
+	if err != nil {
+		return nil, err
+	}
+
+	colManager := collections.NewCollectionManager(db)
+	colNames, err := colManager.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &models.DatabaseStats{Name: name, Collections: len(colNames)}
+	for _, colName := range colNames {
+		colStats, err := colManager.Stats(colName)
+		if err != nil {
+			return nil, err
+		}
+		stats.Documents += colStats.Documents
+		stats.DataSize += colStats.DataSize
+	}
+
+	if stats.Bytes, stats.LastModified, err = models.DiskUsage(db.Path); err != nil {
+		return nil, fmt.Errorf("failed to measure database '%s': %v", name, err)
+	}
+	return stats, nil
+}
+
+// freePath validates a new database name and returns its path, failing if
+// the name is taken. The caller must hold mu.
+func (dbm *DBManager) freePath(name string) (string, error) {
+	if !validName(name) {
+		return "", fmt.Errorf("invalid database name '%s'", name)
+	}
+
+	dbm.goDB.Mutex.RLock()
+	_, exists := dbm.goDB.Databases[name]
+	dbm.goDB.Mutex.RUnlock()
+
+	path := filepath.Join(dbm.basePath, name)
+	if _, err := os.Stat(path); exists || err == nil {
+		return "", fmt.Errorf("database '%s' already exists", name)
+	}
+	return path, nil
+}
+
+// validName reports whether a name can be used for a database. Names starting
+// with "." are reserved for internal directories and databases.
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// copyDatabase copies a database's directory, holding each loaded collection's
+// lock while copying it so no document write is caught half done. The caller
+// holds the database's lock.
+func copyDatabase(db *models.Database, dst string) error {
+	entries, err := os.ReadDir(db.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src, target := filepath.Join(db.Path, entry.Name()), filepath.Join(dst, entry.Name())
+		if !entry.IsDir() {
+			if err := copyFile(src, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		collection := db.Collections[entry.Name()]
+		if collection != nil {
+			collection.Mutex.RLock()
+		}
+		err := copyTree(src, target)
+		if collection != nil {
+			collection.Mutex.RUnlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the directory src to dst, which must not exist yet
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"Build-your-own-database/config"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// startReaper launches the goroutine that removes expired documents every interval
+func (dbm *DBManager) startReaper(interval time.Duration) {
+	dbm.every(interval, func() {
+		// A read-only root loses expired documents when the deletes reach it from its primary
+		if dbm.Writable() == nil {
+			if _, err := dbm.ReapExpired(); err != nil {
+				fmt.Println("TTL reaper:", err)
+			}
+		}
+	})
+}
+
+// startPurger launches the goroutine that purges trash, document history and
+// change log entries past their retention every interval, apart from the
+// reaper so that turning one off leaves the other running
+func (dbm *DBManager) startPurger(interval time.Duration) {
+	dbm.every(interval, func() {
+		if _, err := dbm.PruneHistory(); err != nil {
+			fmt.Println("History pruning:", err)
+		}
+		if config.TrashRetention > 0 {
+			if _, err := dbm.PurgeTrash(config.TrashRetention); err != nil {
+				fmt.Println("Trash purge:", err)
+			}
+		}
+		if config.ChangeRetention > 0 {
+			if _, err := dbm.CompactChanges(config.ChangeRetention); err != nil {
+				fmt.Println("Change log compaction:", err)
+			}
+		}
+	})
+}
+
+// every runs task every interval until the manager is closed; a zero interval never runs it
+func (dbm *DBManager) every(interval time.Duration, task func()) {
+	if interval <= 0 {
+		return
+	}
+
+	dbm.workers.Add(1)
+	go func() {
+		defer dbm.workers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-dbm.stop:
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
+}
+
+// ReapExpired deletes every expired document in every database and returns how
+// many were removed. A database or collection that fails does not stop the
+// sweep; its error is returned, joined with the others, once the sweep is done.
+func (dbm *DBManager) ReapExpired() (int, error) {
+	now := time.Now()
+	removed := 0
+	err := dbm.eachCollection(func(db *models.Database, collection *models.Collection) error {
+		docManager := documents.NewDocumentManager(collection)
+		names, err := docManager.ExpiredDocuments(now)
+		if err != nil {
+			return fmt.Errorf("collection '%s.%s': %v", db.Name, collection.Name, err)
+		}
+		var errs []error
+		for _, name := range names {
+			if err := docManager.DeleteDocument(name); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove expired document '%s' from '%s.%s': %v", name, db.Name, collection.Name, err))
+				continue
+			}
+			removed++
+		}
+		return errors.Join(errs...)
+	})
+	return removed, err
+}
+
+// PruneHistory drops the archived document versions that fall outside their
+// collection's history options in every database, including those of
+// documents not written since and of deleted ones, and returns how many were
+// dropped. Errors are collected as ReapExpired collects them.
+func (dbm *DBManager) PruneHistory() (int, error) {
+	if err := access.Check(dbm.ctx, access.Admin, access.AnyDatabase, ""); err != nil {
+		return 0, err
+	}
+	pruned := 0
+	err := dbm.eachCollection(func(db *models.Database, collection *models.Collection) error {
+		collection.Mutex.Lock()
+		n, err := collection.PruneHistory()
+		collection.Mutex.Unlock()
+		pruned += n
+		if err != nil {
+			return fmt.Errorf("collection '%s.%s': %v", db.Name, collection.Name, err)
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// eachCollection calls fn with every collection of every database, loading
+// those not yet in use. A database or collection that fails does not stop the
+// walk; the errors, fn's included, are returned joined once it is done.
+func (dbm *DBManager) eachCollection(fn func(db *models.Database, collection *models.Collection) error) error {
+	dbm.goDB.Mutex.RLock()
+	databases := make([]*models.Database, 0, len(dbm.goDB.Databases))
+	for _, db := range dbm.goDB.Databases {
+		databases = append(databases, db)
+	}
+	dbm.goDB.Mutex.RUnlock()
+
+	var errs []error
+	for _, db := range databases {
+		colManager := collections.NewCollectionManager(db)
+		colNames, err := colManager.ListCollections()
+		if err != nil {
+			if _, statErr := os.Stat(db.Path); !os.IsNotExist(statErr) {
+				errs = append(errs, fmt.Errorf("database '%s': %v", db.Name, err))
+			}
+			continue
+		}
+
+		for _, colName := range colNames {
+			db.Mutex.RLock()
+			collection, loaded := db.Collections[colName]
+			db.Mutex.RUnlock()
+			if !loaded {
+				if collection, err = colManager.UseCollection(colName); err != nil {
+					// One dropped since it was listed has nothing left to visit
+					if _, statErr := os.Stat(filepath.Join(db.Path, colName)); os.IsNotExist(statErr) {
+						continue
+					}
+					errs = append(errs, fmt.Errorf("collection '%s.%s': %v", db.Name, colName, err))
+					continue
+				}
+			}
+			if err := fn(db, collection); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"Build-your-own-database/config"
+	"Build-your-own-database/database/collections"
+	documents "Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// versions counts the archived versions of every document in a collection
+func versions(t *testing.T, col *models.Collection) int {
+	t.Helper()
+	ids, err := col.ArchivedIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, id := range ids {
+		kept, err := col.Versions(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(kept)
+	}
+	return n
+}
+
+// age backdates every archived version in a collection by days
+func age(t *testing.T, col *models.Collection, days int) {
+	t.Helper()
+	when := time.Now().AddDate(0, 0, -days)
+	err := filepath.WalkDir(filepath.Join(col.Path, models.HistoryDir), func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, when, when)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneHistoryOfIdleDocuments(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxAgeDays int
+		agedDays   int  // How long ago the versions were archived
+		deleted    bool // The document is deleted rather than left alone
+		scheduled  bool // Left to the purger rather than pruned directly
+		want       int  // Versions left
+	}{
+		{"versions past the age limit", 1, 2, false, false, 0},
+		{"versions within the age limit", 3, 2, false, false, 2},
+		{"no age limit", 0, 30, false, false, 2},
+		{"deleted document", 1, 2, true, false, 0},
+		{"by the purger", 1, 2, false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.scheduled {
+				defer func(interval time.Duration) { config.PurgeInterval = interval }(config.PurgeInterval)
+				config.PurgeInterval = 10 * time.Millisecond
+			}
+			dbm := Open(t.TempDir())
+			defer dbm.Close()
+			db, err := dbm.CreateDatabase("shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			col, err := collections.NewCollectionManager(db).CreateCollection("items", collections.WithHistory(0, tt.maxAgeDays))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dm := documents.NewDocumentManager(col)
+			if _, err := dm.CreateDocument("pen", map[string]interface{}{"price": 1}); err != nil {
+				t.Fatal(err)
+			}
+			for _, price := range []int{2, 3} {
+				if _, err := dm.UpdateDocument("pen", map[string]interface{}{"price": price}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.deleted {
+				if err := dm.DeleteDocument("pen"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			age(t, col, tt.agedDays)
+			before := versions(t, col)
+
+			// The document is not written again
+			if tt.scheduled {
+				deadline := time.Now().Add(5 * time.Second)
+				for versions(t, col) != tt.want && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			} else {
+				pruned, err := dbm.PruneHistory()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pruned != before-tt.want {
+					t.Errorf("PruneHistory() = %d, want %d", pruned, before-tt.want)
+				}
+			}
+			if got := versions(t, col); got != tt.want {
+				t.Errorf("%d versions left, want %d", got, tt.want)
+			}
+		})
+	}
+}
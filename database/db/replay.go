@@ -0,0 +1,134 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+)
+
+// Apply replays a change read from another storage root's change log, such as
+// a primary's, without checking access or recording a new change. Database
+// changes are applied here; the rest go to the collection manager of their
+// database, which is created first if this root lacks it. Like the collection
+// manager's Apply, replaying a change the root already holds leaves it as it is.
+func (dbm *DBManager) Apply(event models.ChangeEvent) error {
+	var err error
+	switch event.Op {
+	case models.OpCreateDatabase:
+		_, err = dbm.applyCreate(event.Database)
+	case models.OpDropDatabase:
+		err = dbm.applyDrop(event)
+	case models.OpRenameDatabase:
+		err = dbm.applyRename(event)
+	default:
+		var db *models.Database
+		if db, err = dbm.applyCreate(event.Database); err == nil {
+			return collections.NewCollectionManager(db).Apply(event)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply %s change at LSN %d: %v", event.Op, event.LSN, err)
+	}
+	return nil
+}
+
+// applyCreate returns the named database, creating it if it does not exist.
+// Changes to the system database reach it too.
+func (dbm *DBManager) applyCreate(name string) (*models.Database, error) {
+	if name == SystemDatabase {
+		return dbm.System()
+	}
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid database name '%s'", name)
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	dbm.goDB.Mutex.RLock()
+	db, exists := dbm.goDB.Databases[name]
+	dbm.goDB.Mutex.RUnlock()
+	if exists {
+		return db, nil
+	}
+
+	path := filepath.Join(dbm.basePath, name)
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	db = &models.Database{
+		Name:        name,
+		Path:        path,
+		Collections: make(map[string]*models.Collection),
+	}
+	dbm.goDB.Mutex.Lock()
+	dbm.goDB.Databases[name] = db
+	dbm.goDB.Mutex.Unlock()
+	return db, nil
+}
+
+// applyDrop removes the database and everything in it
+func (dbm *DBManager) applyDrop(event models.ChangeEvent) error {
+	if !validName(event.Database) {
+		return fmt.Errorf("invalid database name '%s'", event.Database)
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	if err := os.RemoveAll(filepath.Join(dbm.basePath, event.Database)); err != nil {
+		return err
+	}
+	dbm.goDB.Mutex.Lock()
+	delete(dbm.goDB.Databases, event.Database)
+	dbm.goDB.Mutex.Unlock()
+	return nil
+}
+
+// applyRename moves the database to its new name, unless it is already there
+func (dbm *DBManager) applyRename(event models.ChangeEvent) error {
+	if !validName(event.OldName) || !validName(event.Name) {
+		return fmt.Errorf("invalid database name '%s'", event.Name)
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	oldPath := filepath.Join(dbm.basePath, event.OldName)
+	newPath := filepath.Join(dbm.basePath, event.Name)
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return nil
+	}
+
+	dbm.goDB.Mutex.RLock()
+	db, loaded := dbm.goDB.Databases[event.OldName]
+	dbm.goDB.Mutex.RUnlock()
+	if !loaded {
+		db = &models.Database{Collections: make(map[string]*models.Collection)}
+	}
+
+	db.Mutex.Lock()
+	if err := os.Rename(oldPath, newPath); err != nil {
+		db.Mutex.Unlock()
+		return err
+	}
+	db.Name = event.Name
+	db.Path = newPath
+	db.Mutex.Unlock()
+
+	if err := collections.NewCollectionManager(db).Relocate(); err != nil {
+		return err
+	}
+
+	dbm.goDB.Mutex.Lock()
+	delete(dbm.goDB.Databases, event.OldName)
+	dbm.goDB.Databases[event.Name] = db
+	dbm.goDB.Mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"Build-your-own-database/database/models"
+)
+
+// SystemDatabase holds users and other server metadata. Its name starts with
+// "." so it is hidden from ListDatabases and unreachable through UseDatabase.
+const SystemDatabase = ".system"
+
+// System returns the internal system database, creating it if needed
+func (dbm *DBManager) System() (*models.Database, error) {
+	dbm.systemMu.Lock()
+	defer dbm.systemMu.Unlock()
+
+	if dbm.system != nil {
+		return dbm.system, nil
+	}
+
+	path := filepath.Join(dbm.basePath, SystemDatabase)
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create system database: %v", err)
+	}
+	dbm.system = &models.Database{
+		Name:        SystemDatabase,
+		Path:        path,
+		Collections: make(map[string]*models.Collection),
+	}
+	return dbm.system, nil
+}
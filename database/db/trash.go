@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/trash"
+)
+
+// ListTrash lists every deleted database, collection and document that can still be restored
+func (dbm *DBManager) ListTrash() ([]trash.Entry, error) {
+	entries, err := trash.List(dbm.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Callers see what they could restore
+	var allowed []trash.Entry
+	for _, entry := range entries {
+		if restorable(dbm.ctx, entry) {
+			allowed = append(allowed, entry)
+		}
+	}
+	return allowed, nil
+}
+
+// Restore brings a deleted database, collection or document back from the trash.
+// Collections and documents need their database to exist.
+func (dbm *DBManager) Restore(entryID string) error {
+	if err := dbm.Writable(); err != nil {
+		return err
+	}
+	entry, err := trash.Get(dbm.basePath, entryID)
+	if err != nil {
+		return err
+	}
+
+	if entry.Kind != trash.KindDatabase {
+		db, err := dbm.UseDatabase(entry.Database)
+		if err != nil {
+			return fmt.Errorf("restore database '%s' first: %v", entry.Database, err)
+		}
+		return collections.NewCollectionManager(db).WithContext(dbm.ctx).Restore(entryID)
+	}
+	if err := access.Check(dbm.ctx, access.Admin, entry.Name, ""); err != nil {
+		return err
+	}
+
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+
+	if _, err := dbm.freePath(entry.Name); err != nil {
+		return err
+	}
+	// The database comes back through the changes that recreate it, each
+	// taking its part out of the trash as it is made
+	if _, err := dbm.announce(entry.Data(dbm.basePath), entry.Name); err != nil {
+		return err
+	}
+	if err := trash.Discard(dbm.basePath, entryID); err != nil {
+		return err
+	}
+
+	fmt.Println("Restored database:", entry.Name)
+	return nil
+}
+
+// PurgeTrash permanently removes everything deleted more than olderThan ago
+func (dbm *DBManager) PurgeTrash(olderThan time.Duration) (int, error) {
+	if err := access.Check(dbm.ctx, access.Admin, access.AnyDatabase, ""); err != nil {
+		return 0, err
+	}
+	return trash.Purge(dbm.basePath, olderThan, nil)
+}
+
+// restorable reports whether the caller may restore a trash entry: databases
+// and collections need admin, documents need write on their collection
+func restorable(ctx context.Context, entry trash.Entry) bool {
+	switch entry.Kind {
+	case trash.KindDatabase:
+		return access.Check(ctx, access.Admin, entry.Database, "") == nil
+	case trash.KindCollection:
+		return access.Check(ctx, access.Admin, entry.Database, entry.Name) == nil
+	}
+	return access.Check(ctx, access.Write, entry.Database, entry.Collection) == nil
+}
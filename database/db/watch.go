@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/changes"
+)
+
+// Watch streams changes to a database, its collections and its documents.
+// An empty name watches every database.
+func (dbm *DBManager) Watch(ctx context.Context, name string, opts changes.WatchOptions) (*changes.Stream, error) {
+	scope := name
+	if scope == "" {
+		scope = access.AnyDatabase
+	}
+	if err := access.Check(dbm.ctx, access.Read, scope, ""); err != nil {
+		return nil, err
+	}
+
+	log, err := changes.Open(dbm.basePath)
+	if err != nil {
+		return nil, err
+	}
+	opts.Database = name
+	return log.Watch(ctx, opts)
+}
+
+// CompactChanges drops change log entries made more than olderThan ago that
+// every replica and the latest backup have moved past, and returns how many
+// it dropped. Watchers can no longer resume from before them.
+func (dbm *DBManager) CompactChanges(olderThan time.Duration) (int, error) {
+	if err := access.Check(dbm.ctx, access.Admin, access.AnyDatabase, ""); err != nil {
+		return 0, err
+	}
+	log, err := changes.Open(dbm.basePath)
+	if err != nil {
+		return 0, err
+	}
+	return log.Compact(time.Now().Add(-olderThan))
+}
@@ -0,0 +1,137 @@
+package documents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/models"
+)
+
+// checkCap refuses document data larger than a capped collection's byte
+// limit, which no eviction could make room for
+func (dm *DocumentManager) checkCap(name string, data map[string]interface{}) error {
+	capped := dm.collection.Capped
+	if capped == nil || capped.MaxBytes <= 0 {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if size := int64(len(raw)); size > capped.MaxBytes {
+		return fmt.Errorf("invalid document: '%s' is %d bytes, larger than the collection cap of %d", name, size, capped.MaxBytes)
+	}
+	return nil
+}
+
+// enforceCap evicts the oldest documents of a capped collection until it is
+// back within its limits, after written was inserted or grew. The document
+// written is never evicted; checkCap has made sure it fits on its own.
+// The caller must hold docMux for writing.
+func (dm *DocumentManager) enforceCap(written *models.Document) error {
+	capped := dm.collection.Capped
+	if capped == nil {
+		return nil
+	}
+
+	docs := make([]*models.Document, 0, len(dm.collection.Documents))
+	var total int64
+	for _, doc := range dm.collection.Documents {
+		docs = append(docs, doc)
+		total += doc.Size
+	}
+	models.SortByInsertion(docs)
+
+	for _, oldest := range docs {
+		overCount := capped.MaxDocuments > 0 && len(dm.collection.Documents) > capped.MaxDocuments
+		overBytes := capped.MaxBytes > 0 && total > capped.MaxBytes
+		if !overCount && !overBytes {
+			break
+		}
+		if oldest == written {
+			continue
+		}
+		// Evicted documents are gone for good: capped collections are rolling by design
+		err := dm.collection.Change(models.ChangeEvent{Op: models.OpDelete, DocumentID: oldest.ID, Name: oldest.Name, Before: oldest.Snapshot()}, func() error {
+			if err := os.Remove(oldest.Path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to evict document '%s': %v", oldest.Name, err)
+			}
+			delete(dm.collection.Documents, oldest.ID)
+			return nil
+		})
+		if err != nil && !models.Uncommitted(err) {
+			return err
+		}
+		total -= oldest.Size
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TailableCursor reads a capped collection in insertion order and, once it
+// reaches the end, waits for new documents instead of finishing
+type TailableCursor struct {
+	dm      *DocumentManager
+	lastSeq int64 // Sequence number of the last document returned
+}
+
+// Tail opens a tailable cursor on a capped collection. With fromStart the
+// cursor begins at the oldest document still kept; otherwise it only returns
+// documents inserted after it was opened.
+func (dm *DocumentManager) Tail(fromStart bool) (*TailableCursor, error) {
+	if err := dm.check(access.Read); err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	if dm.collection.Capped == nil {
+		return nil, fmt.Errorf("collection '%s' is not capped", dm.collection.Name)
+	}
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return nil, err
+	}
+
+	cursor := &TailableCursor{dm: dm}
+	if !fromStart {
+		for _, doc := range dm.collection.Documents {
+			if doc.Seq > cursor.lastSeq {
+				cursor.lastSeq = doc.Seq
+			}
+		}
+	}
+	return cursor, nil
+}
+
+// Next returns the next document in insertion order, blocking until one is
+// inserted or ctx is done
+func (c *TailableCursor) Next(ctx context.Context) (*models.Document, error) {
+	for {
+		c.dm.docMux.Lock()
+		var next *models.Document
+		for _, doc := range c.dm.collection.Documents {
+			if doc.Seq > c.lastSeq && (next == nil || doc.Seq < next.Seq) {
+				next = doc
+			}
+		}
+		if next != nil {
+			c.lastSeq = next.Seq
+			c.dm.docMux.Unlock()
+			return c.dm.open(next)
+		}
+		signal := c.dm.collection.InsertSignal()
+		c.dm.docMux.Unlock()
+
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
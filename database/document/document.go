@@ -1,27 +1,66 @@
 package documents
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"sync"
+	"time"
 
+	"Build-your-own-database/config"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/fieldcrypt"
 	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/trash"
 )
 
+// ErrNotFound is returned, wrapped, when a document does not exist. The
+// database and collection managers wrap it too when a database or collection
+// does not exist.
+var ErrNotFound = errors.New("does not exist")
+
 type DocumentManager struct {
 	collection *models.Collection
-	docMux     sync.RWMutex
+	docMux     *sync.RWMutex   // Shared by every manager of the collection
+	ctx        context.Context // Carries the caller's identity, see WithContext
+	fieldKey   *fieldcrypt.Key // Encrypts the collection's encrypted fields, see WithFieldKey
 }
 
 // Constructor
 func NewDocumentManager(collection *models.Collection) *DocumentManager {
 	return &DocumentManager{
 		collection: collection,
+		docMux:     &collection.Mutex,
+		ctx:        context.Background(),
+	}
+}
+
+// Context returns the context the manager checks access against
+func (dm *DocumentManager) Context() context.Context {
+	return dm.ctx
+}
+
+// WithContext returns a copy of the manager whose operations are checked
+// against the identity in ctx (see the access package)
+func (dm *DocumentManager) WithContext(ctx context.Context) *DocumentManager {
+	bound := *dm
+	bound.ctx = ctx
+	return &bound
+}
+
+// check verifies the caller holds privilege on the collection, and that the
+// collection accepts changes when privilege is more than reading
+func (dm *DocumentManager) check(privilege access.Privilege) error {
+	if privilege != access.Read {
+		if err := storage.Writable(dm.collection.Path); err != nil {
+			return err
+		}
 	}
+	return access.Check(dm.ctx, privilege, dm.collection.DatabaseName(), dm.collection.Name)
 }
 
 // Generate a random ID (internal use only)
@@ -33,48 +72,84 @@ func generateRandomID() string {
 
 // 1. CreateDocument (by name)
 func (dm *DocumentManager) CreateDocument(name string, data map[string]interface{}) (*models.Document, error) {
+	if err := dm.check(access.Write); err != nil {
+		return nil, err
+	}
+
 	dm.docMux.Lock()
 	defer dm.docMux.Unlock()
 
-	// Check if name already exists
-	for _, doc := range dm.collection.Documents {
-		if doc.Name == name {
+	// Names and unique indexes must hold across documents not yet loaded too
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return nil, err
+	}
+
+	// Check if name already exists; an expired holder of the name is removed
+	for id, doc := range dm.collection.Documents {
+		if doc.Name != name {
+			continue
+		}
+		if !dm.collection.Expired(doc, time.Now()) {
 			return nil, fmt.Errorf("document with name '%s' already exists", name)
 		}
+		if err := dm.removeDocument(id, doc); err != nil {
+			return nil, err
+		}
 	}
 
-	id := generateRandomID()
-	docPath := filepath.Join(dm.collection.Path, id+".json")
-	doc := &models.Document{
-		ID:   id,
-		Name: name,
-		Data: data,
-		Path: docPath,
+	data, err := dm.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := dm.checkCap(name, data); err != nil {
+		return nil, err
 	}
 
-	dm.collection.Documents[id] = doc
+	doc := dm.collection.NewDocument(generateRandomID(), name, data)
+	doc.Seq = dm.collection.NextSeq()
 
-	// Save to disk
-	file, err := os.Create(docPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create document file: %v", err)
+	// Save to disk; a change that may not last is still made, so memory follows it
+	saved := doc.Save()
+	if saved != nil && !models.Uncommitted(saved) {
+		return nil, fmt.Errorf("failed to create document '%s': %w", name, saved)
 	}
-	defer file.Close()
 
-	if err := json.NewEncoder(file).Encode(doc); err != nil {
-		return nil, fmt.Errorf("failed to encode document: %v", err)
+	dm.collection.Documents[doc.ID] = doc
+	if err := dm.enforceCap(doc); err != nil {
+		return nil, err
+	}
+	dm.collection.NotifyInsert()
+	if saved != nil {
+		return nil, saved
 	}
 
 	fmt.Println("Created document:", name)
-	return doc, nil
+	return dm.open(doc)
 }
 
 // 2. UseDocument (by name)
 func (dm *DocumentManager) UseDocument(name string) (*models.Document, error) {
+	if err := dm.check(access.Read); err != nil {
+		return nil, err
+	}
+	doc, err := dm.useDocument(name)
+	if err != nil {
+		return nil, err
+	}
+	return dm.open(doc)
+}
+
+// useDocument finds a document by name as it is stored, loading it if needed
+func (dm *DocumentManager) useDocument(name string) (*models.Document, error) {
+	now := time.Now()
+
 	dm.docMux.RLock()
 	for _, doc := range dm.collection.Documents {
 		if doc.Name == name {
 			dm.docMux.RUnlock()
+			if dm.collection.Expired(doc, now) {
+				return nil, fmt.Errorf("document '%s' %w", name, ErrNotFound)
+			}
 			fmt.Println("Using document from memory:", name)
 			return doc, nil
 		}
@@ -82,62 +157,108 @@ func (dm *DocumentManager) UseDocument(name string) (*models.Document, error) {
 	dm.docMux.RUnlock()
 
 	// Not in memory? Load from disk
-	files, err := os.ReadDir(dm.collection.Path)
+	paths, err := dm.collection.DocumentFiles()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read collection directory: %v", err)
+		return nil, err
 	}
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			path := filepath.Join(dm.collection.Path, file.Name())
-			f, err := os.Open(path)
-			if err != nil {
-				continue
-			}
-
-			var doc models.Document
-			if err := json.NewDecoder(f).Decode(&doc); err == nil {
-				f.Close()
-				if doc.Name == name {
-					doc.Path = path
-					dm.docMux.Lock()
-					dm.collection.Documents[doc.ID] = &doc
-					dm.docMux.Unlock()
-					fmt.Println("Loaded document from disk:", name)
-					return &doc, nil
-				}
+	// A corrupt file may be the document asked for, so it is reported
+	// rather than passed over as if the document did not exist
+	var corrupt error
+	for _, path := range paths {
+		doc, err := dm.collection.ReadDocument(path)
+		if err != nil {
+			if storage.IsCorrupt(err) && corrupt == nil {
+				corrupt = err
 			}
-			f.Close()
+			continue
+		}
+		if doc.Name == name && !dm.collection.Expired(doc, now) {
+			dm.docMux.Lock()
+			dm.collection.Documents[doc.ID] = doc
+			dm.docMux.Unlock()
+			fmt.Println("Loaded document from disk:", name)
+			return doc, nil
 		}
 	}
 
-	return nil, fmt.Errorf("document '%s' does not exist", name)
+	if corrupt != nil {
+		return nil, fmt.Errorf("document '%s' could not be looked up: %w", name, corrupt)
+	}
+	return nil, fmt.Errorf("document '%s' %w", name, ErrNotFound)
 }
 
 // 3. DeleteDocument (by name)
 func (dm *DocumentManager) DeleteDocument(name string) error {
+	if err := dm.check(access.Write); err != nil {
+		return err
+	}
+
 	dm.docMux.Lock()
 	defer dm.docMux.Unlock()
 
+	// The document may be on disk without having been read yet
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return err
+	}
+
 	for id, doc := range dm.collection.Documents {
 		if doc.Name == name {
-			if err := os.Remove(doc.Path); err != nil {
-				return fmt.Errorf("failed to delete document file: %v", err)
+			if err := dm.removeDocument(id, doc); err != nil {
+				return err
 			}
-			delete(dm.collection.Documents, id)
 			fmt.Println("Deleted document:", name)
 			return nil
 		}
 	}
 
-	return fmt.Errorf("document '%s' does not exist", name)
+	return fmt.Errorf("document '%s' %w", name, ErrNotFound)
+}
+
+// removeDocument deletes a document's file and drops it from memory.
+// The caller must hold docMux for writing.
+func (dm *DocumentManager) removeDocument(id string, doc *models.Document) error {
+	before, err := dm.collection.Previous(doc)
+	if err != nil {
+		return err
+	}
+	return dm.collection.Change(models.ChangeEvent{Op: models.OpDelete, DocumentID: id, Name: doc.Name, Before: before}, func() error {
+		if _, err := dm.collection.Archive(doc); err != nil {
+			return err
+		}
+		if config.TrashRetention > 0 {
+			if _, err := trash.Move(dm.trashRoot(), trash.Entry{
+				Kind:       trash.KindDocument,
+				Database:   dm.collection.DatabaseName(),
+				Collection: dm.collection.Name,
+				Name:       doc.Name,
+				DocumentID: id,
+				Path:       doc.Path,
+			}); err != nil {
+				return err
+			}
+		} else if err := os.Remove(doc.Path); err != nil {
+			return fmt.Errorf("failed to delete document file: %v", err)
+		}
+		delete(dm.collection.Documents, id)
+		return nil
+	})
 }
 
 // 4. RenameDocument (by name)
 func (dm *DocumentManager) RenameDocument(oldName, newName string) error {
+	if err := dm.check(access.Write); err != nil {
+		return err
+	}
+
 	dm.docMux.Lock()
 	defer dm.docMux.Unlock()
 
+	// Names must stay unique across documents not yet loaded too
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return err
+	}
+
 	// Check if newName already exists
 	for _, d := range dm.collection.Documents {
 		if d.Name == newName {
@@ -150,13 +271,11 @@ func (dm *DocumentManager) RenameDocument(oldName, newName string) error {
 			doc.Name = newName
 
 			// Save with updated name
-			file, err := os.Create(doc.Path)
-			if err != nil {
-				return fmt.Errorf("failed to update renamed doc: %v", err)
-			}
-			defer file.Close()
-			if err := json.NewEncoder(file).Encode(doc); err != nil {
-				return fmt.Errorf("failed to encode renamed doc: %v", err)
+			if err := doc.Save(); err != nil {
+				if !models.Uncommitted(err) {
+					doc.Name = oldName
+				}
+				return fmt.Errorf("failed to update renamed doc: %w", err)
 			}
 
 			fmt.Printf("Renamed document '%s' to '%s'\n", oldName, newName)
@@ -164,21 +283,179 @@ func (dm *DocumentManager) RenameDocument(oldName, newName string) error {
 		}
 	}
 
-	return fmt.Errorf("document '%s' not found", oldName)
+	return fmt.Errorf("document '%s' %w", oldName, ErrNotFound)
 }
 
-// 5. FindDocument (by key-value inside data)
+// 5. FindDocument (by one field, a metadata field or a dotted path)
 func (dm *DocumentManager) FindDocument(key string, val interface{}) []*models.Document {
-	dm.docMux.RLock()
-	defer dm.docMux.RUnlock()
+	if err := dm.check(access.Read); err != nil {
+		fmt.Println("Find failed:", err)
+		return nil
+	}
+	shown := val
+	val, err := dm.queryValue(key, val)
+	if err != nil {
+		fmt.Println("Find failed:", err)
+		return nil
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	if err := dm.collection.LoadDocuments(); err != nil {
+		fmt.Println("Find failed:", err)
+		return nil
+	}
+
+	now := time.Now()
+	var results []*models.Document
+	for _, doc := range dm.collection.Documents {
+		if dm.collection.Expired(doc, now) {
+			continue
+		}
+		if v, ok := doc.Field(key); ok && models.Equal(v, val) {
+			results = append(results, doc)
+		}
+	}
+
+	fmt.Printf("Found %d document(s) matching %s = %v\n", len(results), key, shown)
+	opened, err := dm.openAll(results)
+	if err != nil {
+		fmt.Println("Find failed:", err)
+		return nil
+	}
+	return opened
+}
+
+// 6. FindDocuments (by every field in a filter)
+func (dm *DocumentManager) FindDocuments(filter models.Filter) ([]*models.Document, error) {
+	if err := dm.check(access.Read); err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	filter, err := dm.queryFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return nil, err
+	}
 
+	now := time.Now()
 	var results []*models.Document
 	for _, doc := range dm.collection.Documents {
-		if v, ok := doc.Data[key]; ok && v == val {
+		if !dm.collection.Expired(doc, now) && filter.Match(doc) {
 			results = append(results, doc)
 		}
 	}
+	models.SortByInsertion(results)
+	return dm.openAll(results)
+}
+
+// 7. SetExpireAt (by name), a zero time clears the expiry
+func (dm *DocumentManager) SetExpireAt(name string, at time.Time) error {
+	if err := dm.check(access.Write); err != nil {
+		return err
+	}
+
+	doc, err := dm.useDocument(name)
+	if err != nil {
+		return err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
 
-	fmt.Printf("Found %d document(s) matching %s = %v\n", len(results), key, val)
-	return results
+	previous := doc.ExpireAt
+	if at.IsZero() {
+		doc.ExpireAt = nil
+	} else {
+		at = at.UTC()
+		doc.ExpireAt = &at
+	}
+	if err := doc.Save(); err != nil {
+		if !models.Uncommitted(err) {
+			doc.ExpireAt = previous
+		}
+		return fmt.Errorf("failed to save expiry of '%s': %w", name, err)
+	}
+	return nil
+}
+
+// 8. UpdateDocument (by name), sets and removes keys in a single write
+func (dm *DocumentManager) UpdateDocument(name string, set map[string]interface{}, unset []string) (*models.Document, error) {
+	if err := dm.check(access.Write); err != nil {
+		return nil, err
+	}
+
+	doc, err := dm.useDocument(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	data := make(map[string]interface{}, len(doc.Data)+len(set))
+	for k, v := range doc.Data {
+		data[k] = v
+	}
+	for k, v := range set {
+		data[k] = v
+	}
+	for _, k := range unset {
+		delete(data, k)
+	}
+	// Without the key only the new values are checked, so documents stored
+	// before a field was marked encrypted stay writable
+	if dm.fieldKey == nil {
+		err = fieldcrypt.CheckSealed(dm.collection.Encrypted, set)
+	} else {
+		data, err = dm.seal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return nil, err
+	}
+	if err := dm.checkCap(name, data); err != nil {
+		return nil, err
+	}
+
+	previous := doc.Data
+	doc.Data = data
+	if err := doc.Save(); err != nil {
+		if !models.Uncommitted(err) {
+			doc.Data = previous
+		}
+		return nil, fmt.Errorf("failed to update document '%s': %w", name, err)
+	}
+	// A document that grew may push the collection past its byte limit
+	if err := dm.enforceCap(doc); err != nil {
+		return nil, err
+	}
+	return dm.open(doc)
+}
+
+// ExpiredDocuments lists the names of documents that have passed their expiry
+func (dm *DocumentManager) ExpiredDocuments(now time.Time) ([]string, error) {
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, doc := range dm.collection.Documents {
+		if dm.collection.Expired(doc, now) {
+			names = append(names, doc.Name)
+		}
+	}
+	return names, nil
 }
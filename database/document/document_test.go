@@ -0,0 +1,226 @@
+package documents_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	documents "Build-your-own-database/database/document"
+	"Build-your-own-database/database/fieldcrypt"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// reopen returns the manager of a collection as a new process sees it, with
+// none of its documents loaded yet
+func reopen(t *testing.T, root string) *documents.DocumentManager {
+	t.Helper()
+	dbm := db.Open(root)
+	t.Cleanup(dbm.Close)
+	database, err := dbm.UseDatabase("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := collections.NewCollectionManager(database).UseCollection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return documents.NewDocumentManager(col)
+}
+
+func TestRenameDocumentAfterReopen(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		wantErr  string
+		wantIs   error
+	}{
+		{"to a name only on disk", "a", "b", "already exists", nil},
+		{"to a free name", "a", "c", "", nil},
+		{"a document only on disk", "b", "c", "", nil},
+		{"a missing document", "x", "c", "", documents.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dbm := db.Open(root)
+			database, err := dbm.CreateDatabase("shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			col, err := collections.NewCollectionManager(database).CreateCollection("items")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dm := documents.NewDocumentManager(col)
+			for _, name := range []string{"a", "b"} {
+				if _, err := dm.CreateDocument(name, map[string]interface{}{"n": name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dbm.Close()
+
+			dm = reopen(t, root)
+			// Only the document renamed is loaded, as a caller reading it first would
+			if tt.from == "a" {
+				if _, err := dm.UseDocument("a"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = dm.RenameDocument(tt.from, tt.to)
+			switch {
+			case tt.wantIs != nil:
+				if !errors.Is(err, tt.wantIs) {
+					t.Fatalf("RenameDocument() error = %v, want %v", err, tt.wantIs)
+				}
+				return
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("RenameDocument() error = %v, want one saying %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("RenameDocument() error = %v", err)
+			}
+
+			// Every name is held by one document, on disk as in memory
+			docs, err := reopen(t, root).FindDocuments(models.Filter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[string]int)
+			for _, doc := range docs {
+				seen[doc.Name]++
+			}
+			for name, n := range seen {
+				if n > 1 {
+					t.Errorf("%d documents are named '%s'", n, name)
+				}
+			}
+			if tt.wantErr == "" && seen[tt.to] != 1 {
+				t.Errorf("no document is named '%s' after the rename", tt.to)
+			}
+		})
+	}
+}
+
+func TestFindDocument(t *testing.T) {
+	root := t.TempDir()
+	dbm := db.Open(root)
+	database, err := dbm.CreateDatabase("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := collections.NewCollectionManager(database).CreateCollection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := documents.NewDocumentManager(col)
+	docs := map[string]map[string]interface{}{
+		"a": {"n": 1, "tags": []interface{}{"x", "y"}, "address": map[string]interface{}{"city": "Pune"}},
+		"b": {"n": 2, "tags": []interface{}{"y"}, "address": map[string]interface{}{"city": "Goa"}},
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := dm.CreateDocument(name, docs[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dm.UpdateDocument("b", map[string]interface{}{"n": 3}, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := dm.UseDocument("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := b.Revision
+	dbm.Close()
+
+	tests := []struct {
+		name string
+		key  string
+		val  interface{}
+		want []string
+	}{
+		{"number read back from disk", "n", 1, []string{"a"}},
+		{"array", "tags", []interface{}{"x", "y"}, []string{"a"}},
+		{"object", "address", map[string]interface{}{"city": "Goa"}, []string{"b"}},
+		{"dotted path", "address.city", "Pune", []string{"a"}},
+		{"metadata field", "revision", revision, []string{"b"}},
+		{"no match", "n", 7, nil},
+	}
+	dm = reopen(t, root)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, doc := range dm.FindDocument(tt.key, tt.val) {
+				got = append(got, doc.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("FindDocument(%q, %v) = %v, want %v", tt.key, tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveEncryptedFields(t *testing.T) {
+	key, err := fieldcrypt.NewKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssn := models.EncryptedField{Path: "ssn", Mode: models.Deterministic}
+	sealed, err := key.Seal(ssn, "123-45-6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]interface{} // Written by the manager with the key
+		write   func(doc *models.Document) error
+		wantErr bool
+	}{
+		{"clear value added", map[string]interface{}{"n": 1}, func(doc *models.Document) error { return doc.Add("ssn", "999-plain") }, true},
+		{"clear value updated", map[string]interface{}{"ssn": "123-45-6789"}, func(doc *models.Document) error { return doc.Update("ssn", "999-plain") }, true},
+		{"sealed value added", map[string]interface{}{"n": 1}, func(doc *models.Document) error { return doc.Add("ssn", sealed) }, false},
+		{"other field added", map[string]interface{}{"ssn": "123-45-6789"}, func(doc *models.Document) error { return doc.Add("n", 2) }, false},
+		{"encrypted field deleted", map[string]interface{}{"ssn": "123-45-6789"}, func(doc *models.Document) error { return doc.DeleteKey("ssn") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbm := db.Open(t.TempDir())
+			defer dbm.Close()
+			database, err := dbm.CreateDatabase("shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			col, err := collections.NewCollectionManager(database).CreateCollection("people", collections.WithEncryptedFields(ssn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dm := documents.NewDocumentManager(col)
+			if _, err := dm.WithFieldKey(key).CreateDocument("p", tt.data); err != nil {
+				t.Fatal(err)
+			}
+			doc, err := dm.UseDocument("p")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			col.Mutex.Lock()
+			err = tt.write(doc)
+			col.Mutex.Unlock()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("write error = %v, want error %v", err, tt.wantErr)
+			}
+
+			raw, err := storage.ReadFile(doc.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(raw), "plain") {
+				t.Errorf("document file holds the clear value: %s", raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package documents
+
+import (
+	"fmt"
+
+	"Build-your-own-database/database/fieldcrypt"
+	"Build-your-own-database/database/models"
+)
+
+// WithFieldKey returns a copy of the manager that encrypts the collection's
+// encrypted fields with key before documents are saved and decrypts them in
+// the documents it returns. Managers without the key read ciphertext and may
+// only write values that are already sealed.
+func (dm *DocumentManager) WithFieldKey(key *fieldcrypt.Key) *DocumentManager {
+	bound := *dm
+	bound.fieldKey = key
+	return &bound
+}
+
+// seal encrypts the encrypted fields of data about to be saved. The caller must hold docMux.
+func (dm *DocumentManager) seal(data map[string]interface{}) (map[string]interface{}, error) {
+	fields := dm.collection.Encrypted
+	if len(fields) == 0 {
+		return data, nil
+	}
+	if dm.fieldKey == nil {
+		return data, fieldcrypt.CheckSealed(fields, data)
+	}
+	return dm.fieldKey.SealData(fields, data)
+}
+
+// open returns doc with its encrypted fields decrypted, as a copy that cannot
+// be saved, or doc itself when there is nothing to decrypt
+func (dm *DocumentManager) open(doc *models.Document) (*models.Document, error) {
+	fields := dm.collection.Encrypted
+	if dm.fieldKey == nil || len(fields) == 0 || doc == nil {
+		return doc, nil
+	}
+	data, err := dm.fieldKey.OpenData(fields, doc.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt document '%s': %v", doc.Name, err)
+	}
+	return doc.Opened(data), nil
+}
+
+// openAll decrypts a list of documents
+func (dm *DocumentManager) openAll(docs []*models.Document) ([]*models.Document, error) {
+	if dm.fieldKey == nil || len(dm.collection.Encrypted) == 0 {
+		return docs, nil
+	}
+	opened := make([]*models.Document, len(docs))
+	for i, doc := range docs {
+		var err error
+		if opened[i], err = dm.open(doc); err != nil {
+			return nil, err
+		}
+	}
+	return opened, nil
+}
+
+// queryValue turns a value compared against a field into the form stored for
+// it: deterministic fields are matched on their ciphertext, randomized ones
+// cannot be matched at all
+func (dm *DocumentManager) queryValue(path string, value interface{}) (interface{}, error) {
+	field, encrypted := dm.collection.EncryptedField(path)
+	if !encrypted {
+		return value, nil
+	}
+	if field.Mode != models.Deterministic {
+		return nil, fmt.Errorf("invalid query: field '%s' uses randomized encryption and cannot be matched", path)
+	}
+	if fieldcrypt.IsSealed(value) {
+		return value, nil
+	}
+	if dm.fieldKey == nil {
+		return nil, fmt.Errorf("invalid query: field '%s' is encrypted and needs the field key", path)
+	}
+	return dm.fieldKey.Seal(field, value)
+}
+
+// queryFilter applies queryValue to every field of a filter
+func (dm *DocumentManager) queryFilter(filter models.Filter) (models.Filter, error) {
+	if len(dm.collection.Encrypted) == 0 {
+		return filter, nil
+	}
+	sealed := make(models.Filter, len(filter))
+	for path, value := range filter {
+		var err error
+		if sealed[path], err = dm.queryValue(path, value); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
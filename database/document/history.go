@@ -0,0 +1,156 @@
+package documents
+
+import (
+	"fmt"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/models"
+)
+
+// History lists the previous versions kept for a document, oldest first.
+// Versions of a deleted document remain available until they are pruned.
+func (dm *DocumentManager) History(name string) ([]*models.Document, error) {
+	if err := dm.check(access.Read); err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	id, err := dm.historyID(name)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := dm.collection.Versions(id)
+	if err != nil {
+		return nil, err
+	}
+	return dm.openAll(versions)
+}
+
+// GetVersion returns a single previous version of a document by revision
+func (dm *DocumentManager) GetVersion(name string, revision int64) (*models.Document, error) {
+	if err := dm.check(access.Read); err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	version, err := dm.version(name, revision)
+	if err != nil {
+		return nil, err
+	}
+	return dm.open(version)
+}
+
+// RestoreVersion makes a previous version the current content of a document,
+// recreating the document if it was deleted. The restore is itself a new revision.
+func (dm *DocumentManager) RestoreVersion(name string, revision int64) (*models.Document, error) {
+	if err := dm.check(access.Write); err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	version, err := dm.version(name, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc, exists := dm.collection.Documents[version.ID]; exists {
+		previousData, previousExpiry := doc.Data, doc.ExpireAt
+		doc.Data, doc.ExpireAt = version.Data, version.ExpireAt
+		if err := doc.Save(); err != nil {
+			if !models.Uncommitted(err) {
+				doc.Data, doc.ExpireAt = previousData, previousExpiry
+			}
+			return nil, fmt.Errorf("failed to restore '%s': %w", name, err)
+		}
+		fmt.Printf("Restored document '%s' to revision %d\n", name, revision)
+		return dm.open(doc)
+	}
+
+	// The document was deleted: bring it back under its old ID
+	for _, d := range dm.collection.Documents {
+		if d.Name == version.Name {
+			return nil, fmt.Errorf("document '%s' already exists", version.Name)
+		}
+	}
+
+	versions, err := dm.collection.Versions(version.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := dm.collection.NewDocument(version.ID, version.Name, version.Data)
+	doc.CreatedAt = version.CreatedAt
+	doc.ExpireAt = version.ExpireAt
+	doc.Revision = versions[len(versions)-1].Revision
+	saved := doc.Save()
+	if saved != nil && !models.Uncommitted(saved) {
+		return nil, fmt.Errorf("failed to restore '%s': %w", name, saved)
+	}
+	dm.collection.Documents[doc.ID] = doc
+	if saved != nil {
+		return nil, fmt.Errorf("failed to restore '%s': %w", name, saved)
+	}
+
+	fmt.Printf("Restored deleted document '%s' from revision %d\n", name, revision)
+	return dm.open(doc)
+}
+
+// version finds one archived revision of a document. The caller must hold docMux.
+func (dm *DocumentManager) version(name string, revision int64) (*models.Document, error) {
+	id, err := dm.historyID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := dm.collection.Versions(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Revision == revision {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d of document '%s' is not in history", revision, name)
+}
+
+// historyID resolves a name to the ID its history is kept under: the live
+// document's ID, or else the most recently changed deleted document with that
+// name. The caller must hold docMux.
+func (dm *DocumentManager) historyID(name string) (string, error) {
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return "", err
+	}
+	for id, doc := range dm.collection.Documents {
+		if doc.Name == name {
+			return id, nil
+		}
+	}
+
+	ids, err := dm.collection.ArchivedIDs()
+	if err != nil {
+		return "", err
+	}
+
+	var found *models.Document
+	for _, id := range ids {
+		versions, err := dm.collection.Versions(id)
+		if err != nil || len(versions) == 0 {
+			continue
+		}
+		latest := versions[len(versions)-1]
+		if latest.Name == name && (found == nil || latest.UpdatedAt.After(found.UpdatedAt)) {
+			found = latest
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("document '%s' has no history", name)
+	}
+	return found.ID, nil
+}
@@ -0,0 +1,110 @@
+package documents
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/trash"
+)
+
+// ListTrash lists the deleted documents of this collection that can still be restored
+func (dm *DocumentManager) ListTrash() ([]trash.Entry, error) {
+	if err := dm.check(access.Read); err != nil {
+		return nil, err
+	}
+
+	entries, err := trash.List(dm.trashRoot())
+	if err != nil {
+		return nil, err
+	}
+
+	var mine []trash.Entry
+	for _, entry := range entries {
+		if dm.ownsEntry(entry) {
+			mine = append(mine, entry)
+		}
+	}
+	return mine, nil
+}
+
+// Restore brings a deleted document back from the trash
+func (dm *DocumentManager) Restore(entryID string) (*models.Document, error) {
+	if err := dm.check(access.Write); err != nil {
+		return nil, err
+	}
+
+	dm.docMux.Lock()
+	defer dm.docMux.Unlock()
+
+	entry, err := trash.Get(dm.trashRoot(), entryID)
+	if err != nil {
+		return nil, err
+	}
+	if !dm.ownsEntry(*entry) {
+		return nil, fmt.Errorf("trash entry '%s' is not a document of collection '%s'", entryID, dm.collection.Name)
+	}
+
+	if err := dm.collection.LoadDocuments(); err != nil {
+		return nil, err
+	}
+	for _, doc := range dm.collection.Documents {
+		if doc.Name == entry.Name {
+			return nil, fmt.Errorf("document '%s' already exists", entry.Name)
+		}
+	}
+	// The document must not take a unique value another has taken since
+	raw, err := trash.Read(dm.trashRoot(), entryID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err = storage.Decode(entry.Path, raw)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := dm.collection.DecodeDocument(entry.Path, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := dm.collection.CheckUnique(doc); err != nil {
+		return nil, err
+	}
+
+	err = dm.collection.Change(models.ChangeEvent{Op: models.OpInsert, DocumentID: doc.ID, Name: doc.Name, After: doc.Snapshot()}, func() error {
+		if _, err := trash.Restore(dm.trashRoot(), entryID); err != nil {
+			return err
+		}
+		dm.collection.Documents[doc.ID] = doc
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Restored document:", doc.Name)
+	return dm.open(doc)
+}
+
+// PurgeTrash permanently removes this collection's documents deleted more than olderThan ago
+func (dm *DocumentManager) PurgeTrash(olderThan time.Duration) (int, error) {
+	if err := dm.check(access.Admin); err != nil {
+		return 0, err
+	}
+
+	return trash.Purge(dm.trashRoot(), olderThan, dm.ownsEntry)
+}
+
+// ownsEntry reports whether a trash entry is a document of this collection
+func (dm *DocumentManager) ownsEntry(entry trash.Entry) bool {
+	return entry.Kind == trash.KindDocument &&
+		entry.Database == dm.collection.DatabaseName() &&
+		entry.Collection == dm.collection.Name
+}
+
+// trashRoot is the storage root holding the collection's database
+func (dm *DocumentManager) trashRoot() string {
+	return filepath.Dir(filepath.Dir(dm.collection.Path))
+}
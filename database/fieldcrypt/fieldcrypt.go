@@ -0,0 +1,248 @@
+// Package fieldcrypt encrypts individual document fields on the client side,
+// before documents are saved. The key never leaves the process that holds it:
+// the collection, its files, history, change streams and every frontend only
+// ever see ciphertext for the fields a collection marks as encrypted.
+//
+// Values are sealed with AES-GCM under a key derived from the field key and
+// bound to the field path. Deterministic mode derives the nonce from the value
+// itself (an HMAC of path and value), so equal values seal to equal strings
+// and can be matched for equality; randomized mode uses a random nonce.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// prefix starts every sealed value
+const prefix = "$fle1:"
+
+const nonceSize = 12
+
+// Mode bytes inside a sealed value
+const (
+	modeDeterministic byte = 'D'
+	modeRandomized    byte = 'R'
+)
+
+// Documents saved directly, rather than through a document manager, are
+// checked too, so they cannot put clear values in encrypted fields
+func init() {
+	models.OnSeal(CheckSealed)
+}
+
+// Key encrypts and decrypts field values
+type Key struct {
+	gcm cipher.AEAD
+	mac []byte // Derives deterministic nonces
+}
+
+// NewKey builds a field key from 32 random bytes
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("field key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(derive(raw, "godb field encryption"))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{gcm: gcm, mac: derive(raw, "godb field nonce")}, nil
+}
+
+// ParseKey builds a field key written in hex or base64, as printed by
+// "go run . keys generate"
+func ParseKey(value string) (*Key, error) {
+	raw, err := storage.ParseKey(value)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(raw)
+}
+
+// Seal encrypts a value of a field
+func (k *Key) Seal(field models.EncryptedField, value interface{}) (string, error) {
+	plain, err := json.Marshal(models.Normalize(value))
+	if err != nil {
+		return "", fmt.Errorf("cannot encrypt field '%s': %v", field.Path, err)
+	}
+
+	mode := modeRandomized
+	nonce := make([]byte, nonceSize)
+	if field.Mode == models.Deterministic {
+		mode = modeDeterministic
+		mac := hmac.New(sha256.New, k.mac)
+		mac.Write([]byte(field.Path))
+		mac.Write([]byte{0})
+		mac.Write(plain)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := append([]byte{mode}, nonce...)
+	sealed = k.gcm.Seal(sealed, nonce, plain, additionalData(mode, field.Path))
+	return prefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed for a field
+func (k *Key) Open(path string, value interface{}) (interface{}, error) {
+	mode, nonce, ciphertext, ok := split(value)
+	if !ok {
+		return nil, fmt.Errorf("field '%s' is not encrypted", path)
+	}
+	plain, err := k.gcm.Open(nil, nonce, ciphertext, additionalData(mode, path))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt field '%s': wrong key or tampered value", path)
+	}
+	var out interface{}
+	if err := json.Unmarshal(plain, &out); err != nil {
+		return nil, fmt.Errorf("cannot decode field '%s': %v", path, err)
+	}
+	return out, nil
+}
+
+// IsSealed reports whether a value has the form of a sealed value. It does
+// not need the key and so cannot tell whether the value would decrypt.
+func IsSealed(value interface{}) bool {
+	_, _, _, ok := split(value)
+	return ok
+}
+
+// SealData returns a copy of data with every encrypted field sealed. Values
+// already sealed under this key are kept, so a document read back and
+// changed can be saved again.
+func (k *Key) SealData(fields []models.EncryptedField, data map[string]interface{}) (map[string]interface{}, error) {
+	for _, field := range fields {
+		var err error
+		data, err = transform(data, field.Path, func(value interface{}) (interface{}, error) {
+			if IsSealed(value) {
+				if _, err := k.Open(field.Path, value); err != nil {
+					return nil, err
+				}
+				return value, nil
+			}
+			return k.Seal(field, value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// OpenData returns a copy of data with every encrypted field decrypted.
+// Values stored before the field was marked are returned as they are.
+func (k *Key) OpenData(fields []models.EncryptedField, data map[string]interface{}) (map[string]interface{}, error) {
+	for _, field := range fields {
+		var err error
+		data, err = transform(data, field.Path, func(value interface{}) (interface{}, error) {
+			if !IsSealed(value) {
+				return value, nil
+			}
+			return k.Open(field.Path, value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// CheckSealed rejects data holding a clear value in an encrypted field, for
+// writers without the key: they may copy ciphertext but never add plaintext
+func CheckSealed(fields []models.EncryptedField, data map[string]interface{}) error {
+	for _, field := range fields {
+		_, err := transform(data, field.Path, func(value interface{}) (interface{}, error) {
+			if !IsSealed(value) {
+				return nil, fmt.Errorf("invalid value for field '%s': it is encrypted and must be written with the field key", field.Path)
+			}
+			return value, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transform replaces the value at a dotted path with fn's result, copying the
+// maps along the path so data itself is left untouched. Missing paths and
+// null values are left alone.
+func transform(data map[string]interface{}, path string, fn func(interface{}) (interface{}, error)) (map[string]interface{}, error) {
+	if value, ok := data[path]; ok {
+		if value == nil {
+			return data, nil
+		}
+		replaced, err := fn(value)
+		if err != nil {
+			return nil, err
+		}
+		return with(data, path, replaced), nil
+	}
+
+	head, rest, found := strings.Cut(path, ".")
+	if !found {
+		return data, nil
+	}
+	nested, ok := data[head].(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+	replaced, err := transform(nested, rest, fn)
+	if err != nil {
+		return nil, err
+	}
+	return with(data, head, replaced), nil
+}
+
+// with returns a copy of data with key set to value
+func with(data map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+// split takes a sealed value apart
+func split(value interface{}) (mode byte, nonce, ciphertext []byte, ok bool) {
+	s, isString := value.(string)
+	if !isString || !strings.HasPrefix(s, prefix) {
+		return 0, nil, nil, false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil || len(raw) < 1+nonceSize {
+		return 0, nil, nil, false
+	}
+	if raw[0] != modeDeterministic && raw[0] != modeRandomized {
+		return 0, nil, nil, false
+	}
+	return raw[0], raw[1 : 1+nonceSize], raw[1+nonceSize:], true
+}
+
+// additionalData binds a sealed value to its mode and field path, so it cannot
+// be moved to another field
+func additionalData(mode byte, path string) []byte {
+	return append([]byte{mode}, path...)
+}
+
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
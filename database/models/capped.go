@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CappedOptions limits a collection's size; writing past a limit evicts the oldest documents
+type CappedOptions struct {
+	MaxDocuments int   `json:"maxDocuments,omitempty"` // Most documents kept, 0 for no limit
+	MaxBytes     int64 `json:"maxBytes,omitempty"`     // Most bytes of document data kept, 0 for no limit
+}
+
+// Validate checks the limits are usable: neither negative, and at least one set
+func (o *CappedOptions) Validate() error {
+	if o.MaxDocuments < 0 || o.MaxBytes < 0 {
+		return fmt.Errorf("invalid capped collection: limits cannot be negative")
+	}
+	if o.MaxDocuments == 0 && o.MaxBytes == 0 {
+		return fmt.Errorf("invalid capped collection: set a document or byte limit")
+	}
+	return nil
+}
+
+// NextSeq hands out the insertion sequence number for a new document.
+// The caller must hold Mutex and have loaded the collection's documents.
+func (c *Collection) NextSeq() int64 {
+	c.seq++
+	return c.seq
+}
+
+// NotifyInsert wakes everything waiting on InsertSignal. The caller must hold Mutex.
+func (c *Collection) NotifyInsert() {
+	if c.insert != nil {
+		close(c.insert)
+		c.insert = nil
+	}
+}
+
+// InsertSignal returns a channel that is closed by the next insert. The caller must hold Mutex.
+func (c *Collection) InsertSignal() <-chan struct{} {
+	if c.insert == nil {
+		c.insert = make(chan struct{})
+	}
+	return c.insert
+}
+
+// SortByInsertion orders documents oldest first by their insertion sequence,
+// falling back to creation time for documents written before sequences were kept
+func SortByInsertion(docs []*Document) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		if docs[i].Seq != docs[j].Seq {
+			return docs[i].Seq < docs[j].Seq
+		}
+		return docs[i].CreatedAt.Before(docs[j].CreatedAt)
+	})
+}
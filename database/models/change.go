@@ -0,0 +1,230 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations recorded in change events
+const (
+	OpInsert           = "insert"
+	OpUpdate           = "update"
+	OpDelete           = "delete"
+	OpRename           = "rename"
+	OpCreateCollection = "createCollection"
+	OpUpdateCollection = "updateCollection"
+	OpDropCollection   = "dropCollection"
+	OpRenameCollection = "renameCollection"
+	OpCreateDatabase   = "createDatabase"
+	OpDropDatabase     = "dropDatabase"
+	OpRenameDatabase   = "renameDatabase"
+)
+
+// ChangeEvent describes one change to a database, collection or document
+type ChangeEvent struct {
+	LSN        uint64      `json:"lsn"` // Position in the change log, assigned when recorded
+	Time       time.Time   `json:"time"`
+	Op         string      `json:"op"`
+	Database   string      `json:"database"`
+	Collection string      `json:"collection,omitempty"`
+	DocumentID string      `json:"documentId,omitempty"`
+	Name       string      `json:"name,omitempty"`     // Name of the document, collection or database after the change
+	OldName    string      `json:"oldName,omitempty"`  // Previous name, for renames
+	Before     *Document   `json:"before,omitempty"`   // Document as it was, for updates, renames and deletes
+	After      *Document   `json:"after,omitempty"`    // Document as it is now, for inserts, updates and renames
+	Metadata   *Collection `json:"metadata,omitempty"` // Collection settings, for collection creates and updates
+
+	Root string `json:"-"` // Storage root the change happened under
+}
+
+// Token returns the resume token identifying the event's position in the change log
+func (e ChangeEvent) Token() string {
+	return strconv.FormatUint(e.LSN, 10)
+}
+
+var (
+	listenersMu sync.RWMutex
+	listeners   []func(ChangeEvent)
+	commits     []func(ChangeEvent) error
+	proposers   []func(*ChangeEvent) (func(error), error)
+)
+
+// OnChange registers a function called synchronously with every change event
+func OnChange(fn func(ChangeEvent)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, fn)
+}
+
+// OnCommit registers a function called synchronously with every change event,
+// after the listeners, that can fail the write that made the change. The change
+// is made by then, so an error tells the writer it may not last, such as when
+// the change log cannot record it.
+func OnCommit(fn func(ChangeEvent) error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	commits = append(commits, fn)
+}
+
+// OnPropose registers a function that must accept every change before it is
+// made, such as a cluster leader that first gets a majority of its nodes to
+// store it. It may give the event its LSN, which the change is then recorded
+// under. Once it accepts a change it returns a function to call with the
+// error that stopped the change being made, or nil once it is made; a change
+// it has nothing to do with gets a nil function.
+func OnPropose(fn func(*ChangeEvent) (func(error), error)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	proposers = append(proposers, fn)
+}
+
+// Change proposes a change, makes it with apply once every proposer has
+// accepted it, and announces it with Emit. Nothing is written before the
+// change is accepted, so a refused change leaves no trace. The caller holds
+// every lock apply needs, so that changes are made in the order they are
+// accepted.
+func Change(event ChangeEvent, apply func() error) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	listenersMu.RLock()
+	propose := proposers
+	listenersMu.RUnlock()
+	var finish []func(error)
+	for _, fn := range propose {
+		done, err := fn(&event)
+		if err != nil {
+			for _, done := range finish {
+				done(err)
+			}
+			return err
+		}
+		if done != nil {
+			finish = append(finish, done)
+		}
+	}
+
+	made := apply()
+	err := made
+	if made == nil {
+		err = Emit(event)
+	}
+	for _, done := range finish {
+		done(made)
+	}
+	return err
+}
+
+// Emit delivers a change event to every registered listener, then to the
+// commit functions, and returns the first error they return as a CommitError
+func Emit(event ChangeEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, fn := range listeners {
+		fn(event)
+	}
+	for _, fn := range commits {
+		if err := fn(event); err != nil {
+			return &CommitError{Err: err}
+		}
+	}
+	return nil
+}
+
+// CommitError is the error Emit returns when a commit function fails. The
+// change it announced stands, so a writer keeps its in-memory state in step
+// with it rather than rolling back.
+type CommitError struct {
+	Err error
+}
+
+func (e *CommitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// Uncommitted reports whether err only means a change that was made may not last
+func Uncommitted(err error) bool {
+	var commit *CommitError
+	return errors.As(err, &commit)
+}
+
+// PendingError is the error a proposer returns for a change it accepted but
+// could not see through in time, such as a cluster leader that lost its
+// majority. The change was not made, so a writer rolls back as for any other
+// failure, but it may still be made later, by whatever makes changes arriving
+// from elsewhere.
+type PendingError struct {
+	Err error
+}
+
+func (e *PendingError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PendingError) Unwrap() error {
+	return e.Err
+}
+
+// Pending reports whether err means a change that was not made may still be
+func Pending(err error) bool {
+	var pending *PendingError
+	return errors.As(err, &pending)
+}
+
+// Change makes a change to this collection with apply, filling in where it
+// happened; see Change
+func (c *Collection) Change(event ChangeEvent, apply func() error) error {
+	event.Database = c.DatabaseName()
+	event.Collection = c.Name
+	event.Root = filepath.Dir(filepath.Dir(c.Path))
+	return Change(event, apply)
+}
+
+// Settings returns a copy of the collection's persisted settings, without its documents
+func (c *Collection) Settings() *Collection {
+	settings := &Collection{
+		Name:    c.Name,
+		Path:    c.Path,
+		Indexes: append([]Index(nil), c.Indexes...),
+	}
+	if c.History != nil {
+		history := *c.History
+		settings.History = &history
+	}
+	if c.Capped != nil {
+		capped := *c.Capped
+		settings.Capped = &capped
+	}
+	settings.Encrypted = append([]EncryptedField(nil), c.Encrypted...)
+	if c.Compression != nil {
+		compression := *c.Compression
+		settings.Compression = &compression
+	}
+	return settings
+}
+
+// Snapshot returns a copy of the document that later changes to it will not affect
+func (d *Document) Snapshot() *Document {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil
+	}
+	var snapshot Document
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return nil
+	}
+	return &snapshot
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChangeOutcomes(t *testing.T) {
+	// The functions registered here act only on events of this test's database
+	const database = "change-outcomes"
+	var proposed, committed error
+	OnPropose(func(event *ChangeEvent) (func(error), error) {
+		if event.Database != database {
+			return nil, nil
+		}
+		return nil, proposed
+	})
+	OnCommit(func(event ChangeEvent) error {
+		if event.Database != database {
+			return nil
+		}
+		return committed
+	})
+
+	tests := []struct {
+		name            string
+		proposed        error
+		committed       error
+		wantMade        bool
+		wantUncommitted bool
+		wantPending     bool
+	}{
+		{"accepted", nil, nil, true, false, false},
+		{"refused", errors.New("refused"), nil, false, false, false},
+		{"pending", &PendingError{Err: errors.New("no majority")}, nil, false, false, true},
+		{"made but not recorded", nil, errors.New("disk full"), true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proposed, committed = tt.proposed, tt.committed
+			made := false
+			err := Change(ChangeEvent{Op: OpInsert, Database: database}, func() error {
+				made = true
+				return nil
+			})
+			if made != tt.wantMade {
+				t.Errorf("Change() made the change = %v, want %v", made, tt.wantMade)
+			}
+			if (err != nil) != (tt.proposed != nil || tt.committed != nil) {
+				t.Errorf("Change() error = %v", err)
+			}
+			if got := Uncommitted(err); got != tt.wantUncommitted {
+				t.Errorf("Uncommitted(%v) = %v, want %v", err, got, tt.wantUncommitted)
+			}
+			if got := Pending(err); got != tt.wantPending {
+				t.Errorf("Pending(%v) = %v, want %v", err, got, tt.wantPending)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"Build-your-own-database/database/storage"
+)
+
+// MetadataFile is the name of the file holding a collection's metadata
+const MetadataFile = "metadata.json"
+
+// DatabaseName returns the name of the database the collection is stored in
+func (c *Collection) DatabaseName() string {
+	return filepath.Base(filepath.Dir(c.Path))
+}
+
+// NewDocument builds a document stored in the collection; it is not written until saved
+func (c *Collection) NewDocument(id, name string, data map[string]interface{}) *Document {
+	return &Document{
+		ID:   id,
+		Name: name,
+		Data: data,
+		Path: filepath.Join(c.Path, id+".json"),
+		col:  c,
+	}
+}
+
+// Adopt builds a document stored in the collection from a copy of one kept
+// elsewhere, such as in a change event, with its metadata as it is
+func (c *Collection) Adopt(d *Document) *Document {
+	doc := c.NewDocument(d.ID, d.Name, d.Data)
+	doc.CreatedAt = d.CreatedAt
+	doc.UpdatedAt = d.UpdatedAt
+	doc.Revision = d.Revision
+	doc.Size = d.Size
+	doc.ExpireAt = d.ExpireAt
+	doc.Seq = d.Seq
+	if doc.Data == nil {
+		doc.Data = make(map[string]interface{})
+	}
+	return doc
+}
+
+// ReadDocument decodes a single document file belonging to the collection
+func (c *Collection) ReadDocument(path string) (*Document, error) {
+	raw, err := storage.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.DecodeDocument(path, raw)
+}
+
+// DecodeDocument decodes the contents of a document file stored at path,
+// read from wherever they are kept
+func (c *Collection) DecodeDocument(path string, raw []byte) (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, storage.Corrupt(path, "invalid document: %v", err)
+	}
+	if doc.Data == nil {
+		doc.Data = make(map[string]interface{})
+	}
+	doc.Path = path
+	doc.col = c
+
+	// Documents written before metadata was tracked take the file's times
+	if doc.CreatedAt.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			doc.CreatedAt = info.ModTime().UTC()
+			doc.UpdatedAt = doc.CreatedAt
+		}
+	}
+	return &doc, nil
+}
+
+// DocumentFiles lists the paths of every document file in the collection directory
+func (c *Collection) DocumentFiles() ([]string, error) {
+	entries, err := os.ReadDir(c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collection directory: %v", err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == MetadataFile || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		paths = append(paths, filepath.Join(c.Path, entry.Name()))
+	}
+	return paths, nil
+}
+
+// LoadDocuments brings every document stored on disk into Documents.
+// Documents already in memory are kept as they are. A file that cannot be read
+// fails the load, with a *storage.CorruptionError when it is damaged, so that
+// queries, counts and name and unique checks never pass over a document they
+// cannot see; the load is tried again on the next call, once fsck has dealt
+// with the file. The caller must hold whatever lock guards the collection's
+// Documents map.
+func (c *Collection) LoadDocuments() error {
+	if c.loaded {
+		return nil
+	}
+
+	paths, err := c.DocumentFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		doc, err := c.ReadDocument(path)
+		if err != nil {
+			return fmt.Errorf("collection '%s' has a document that cannot be read (run fsck): %w", c.Name, err)
+		}
+		if _, exists := c.Documents[doc.ID]; !exists {
+			c.Documents[doc.ID] = doc
+		}
+		if doc.Seq > c.seq {
+			c.seq = doc.Seq
+		}
+	}
+
+	c.loaded = true
+	return nil
+}
+
+// CheckUnique rejects a document that repeats, in the field of a unique
+// index, a value another document of the collection holds. Only Data is
+// compared, never metadata. The caller must hold Mutex and have loaded the
+// collection's documents.
+func (c *Collection) CheckUnique(d *Document) error {
+	for _, index := range c.Indexes {
+		if !index.Unique {
+			continue
+		}
+		val, ok := lookup(d.Data, index.Field)
+		if !ok {
+			continue
+		}
+		for id, other := range c.Documents {
+			if id == d.ID {
+				continue
+			}
+			if existing, ok := lookup(other.Data, index.Field); ok && Equal(existing, val) {
+				return fmt.Errorf("duplicate value '%v' for unique index '%s'", val, index.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyUnique loads the collection's documents and checks that none breaks
+// a unique index, for writes made without the check such as replayed changes.
+// The caller must hold Mutex.
+func (c *Collection) VerifyUnique() error {
+	if err := c.LoadDocuments(); err != nil {
+		return err
+	}
+	for _, doc := range c.Documents {
+		if err := c.CheckUnique(doc); err != nil {
+			return fmt.Errorf("collection '%s', document '%s': %v", c.Name, doc.Name, err)
+		}
+	}
+	return nil
+}
+
+// Relocate points the collection at a new directory once its files have been
+// moved there, rewriting the path recorded in every document file
+func (c *Collection) Relocate(path string) error {
+	c.Path = path
+
+	paths, err := c.DocumentFiles()
+	if err != nil {
+		return err
+	}
+	for _, docPath := range paths {
+		doc, err := c.ReadDocument(docPath)
+		if err != nil {
+			return fmt.Errorf("failed to relocate document '%s': %v", filepath.Base(docPath), err)
+		}
+		if err := doc.write(); err != nil {
+			return fmt.Errorf("failed to relocate document '%s': %v", doc.Name, err)
+		}
+		if loaded, ok := c.Documents[doc.ID]; ok {
+			loaded.Path = doc.Path
+		}
+	}
+	return nil
+}
+
+// CloneData deep-copies document data so the copy can change independently
+func CloneData(data map[string]interface{}) map[string]interface{} {
+	if copied, ok := Normalize(data).(map[string]interface{}); ok {
+		return copied
+	}
+	return make(map[string]interface{})
+}
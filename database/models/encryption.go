@@ -0,0 +1,102 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FieldMode is how an encrypted field is encrypted
+type FieldMode string
+
+const (
+	// Deterministic encryption gives equal values equal ciphertexts, so the
+	// field can still be matched for equality and covered by unique indexes
+	Deterministic FieldMode = "deterministic"
+	// Randomized encryption reveals nothing about the values but cannot be queried
+	Randomized FieldMode = "randomized"
+)
+
+// EncryptedField marks a field path whose values are encrypted by the client
+// before they reach the collection; the database only ever stores ciphertext
+type EncryptedField struct {
+	Path string    `json:"path"` // Field name or dotted path into nested objects
+	Mode FieldMode `json:"mode"`
+}
+
+// Validate rejects fields without a path or with an unknown mode
+func (f EncryptedField) Validate() error {
+	if f.Path == "" {
+		return fmt.Errorf("invalid encrypted field: no path")
+	}
+	if f.Mode != Deterministic && f.Mode != Randomized {
+		return fmt.Errorf("invalid encryption mode '%s' for field '%s'", f.Mode, f.Path)
+	}
+	return nil
+}
+
+// EncryptedField returns the encryption declared for a field path, if any
+func (c *Collection) EncryptedField(path string) (EncryptedField, bool) {
+	for _, field := range c.Encrypted {
+		if field.Path == path {
+			return field, true
+		}
+	}
+	return EncryptedField{}, false
+}
+
+var (
+	sealedMu    sync.RWMutex
+	checkSealed func([]EncryptedField, map[string]interface{}) error
+)
+
+// OnSeal registers the function that rejects clear values in encrypted fields,
+// which Save applies to every encrypted field a write changes. The package
+// that seals values registers it, as this one cannot tell them apart.
+func OnSeal(fn func(fields []EncryptedField, data map[string]interface{}) error) {
+	sealedMu.Lock()
+	defer sealedMu.Unlock()
+	checkSealed = fn
+}
+
+// checkEncrypted rejects a document whose encrypted fields were given clear
+// values since before, the version it overwrites. Fields left as they were
+// pass, so values stored before a field was marked do not block other writes.
+func (c *Collection) checkEncrypted(d, before *Document) error {
+	var changed []EncryptedField
+	for _, field := range c.Encrypted {
+		value, ok := lookup(d.Data, field.Path)
+		if !ok || value == nil {
+			continue
+		}
+		if before != nil {
+			if previous, ok := lookup(before.Data, field.Path); ok && Equal(previous, value) {
+				continue
+			}
+		}
+		changed = append(changed, field)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	sealedMu.RLock()
+	check := checkSealed
+	sealedMu.RUnlock()
+	if check == nil {
+		return fmt.Errorf("cannot write encrypted field '%s': no field encryption is available to check it", changed[0].Path)
+	}
+	return check(changed, d.Data)
+}
+
+// errOpened is returned when a document holding decrypted fields is written
+var errOpened = fmt.Errorf("document holds decrypted fields; update it through its document manager")
+
+// Opened returns a copy of the document carrying data with its encrypted
+// fields decrypted. The copy refuses Save and Rename, so the decrypted values
+// cannot be written back in clear.
+func (d *Document) Opened(data map[string]interface{}) *Document {
+	opened := *d
+	opened.Data = data
+	opened.opened = true
+	return &opened
+}
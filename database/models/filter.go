@@ -0,0 +1,81 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Filter selects documents whose fields equal the given values.
+// Keys are field names; nested fields can be reached with dotted paths ("address.city").
+type Filter map[string]interface{}
+
+// Match reports whether every field in the filter equals the document's value
+func (f Filter) Match(d *Document) bool {
+	for key, want := range f {
+		got, ok := d.Field(key)
+		if !ok || !Equal(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Field looks up a value by name in Data, following dotted paths into nested
+// objects. The metadata fields createdAt, updatedAt, revision and size,
+// maintained by the database, are read only when Data has no field of that
+// name, so a document's own fields are never hidden by them.
+func (d *Document) Field(key string) (interface{}, bool) {
+	if v, ok := lookup(d.Data, key); ok {
+		return v, true
+	}
+	switch key {
+	case "createdAt":
+		return d.CreatedAt, true
+	case "updatedAt":
+		return d.UpdatedAt, true
+	case "revision":
+		return d.Revision, true
+	case "size":
+		return d.Size, true
+	}
+	return nil, false
+}
+
+func lookup(data map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := data[key]; ok {
+		return v, true
+	}
+	head, rest, found := strings.Cut(key, ".")
+	if !found {
+		return nil, false
+	}
+	nested, ok := data[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookup(nested, rest)
+}
+
+// Equal compares two field values the way they would compare once stored as JSON,
+// so an int written in this process matches the float64 read back from disk.
+func Equal(a, b interface{}) bool {
+	return reflect.DeepEqual(Normalize(a), Normalize(b))
+}
+
+// Normalize converts a value to the form encoding/json produces when decoding it
+func Normalize(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, string, bool, float64:
+		return v
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return v
+	}
+	return out
+}
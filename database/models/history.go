@@ -0,0 +1,214 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/storage"
+)
+
+// HistoryDir is the directory inside a collection that holds previous document versions
+const HistoryDir = ".history"
+
+// HistoryOptions controls how many previous versions of each document a collection keeps
+type HistoryOptions struct {
+	MaxVersions int `json:"maxVersions,omitempty"` // Versions kept per document, 0 for no limit
+	MaxAgeDays  int `json:"maxAgeDays,omitempty"`  // Days a version is kept once replaced, 0 for no limit
+}
+
+// Archive reads the version of a document currently on disk before it is
+// overwritten or deleted, copying it into the collection's history if the
+// collection keeps one. It returns that version, or nil for a new document.
+func (c *Collection) Archive(d *Document) (*Document, error) {
+	previous, raw, err := c.previous(d.Path, d.Name)
+	if previous == nil || err != nil {
+		return previous, err
+	}
+	return previous, c.keep(d.ID, previous, raw)
+}
+
+// Previous reads the version of a document currently on disk, as Archive
+// does, without archiving it
+func (c *Collection) Previous(d *Document) (*Document, error) {
+	previous, _, err := c.previous(d.Path, d.Name)
+	return previous, err
+}
+
+// previous reads the version of the document named name stored at path, with
+// the file's contents, or nil for none
+func (c *Collection) previous(path, name string) (*Document, []byte, error) {
+	raw, err := storage.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if storage.IsCorrupt(err) {
+		// The write replaces the damaged file; there is no version to keep
+		fmt.Println("Overwriting damaged document file:", err)
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read previous version of '%s': %v", name, err)
+	}
+
+	var previous Document
+	if err := json.Unmarshal(raw, &previous); err != nil {
+		// Nothing sensible to keep from an unreadable file
+		return nil, nil, nil
+	}
+	return &previous, raw, nil
+}
+
+// keep copies a previous version of the document with the given ID, read as
+// raw, into the collection's history if it keeps one
+func (c *Collection) keep(id string, previous *Document, raw []byte) error {
+	if c.History == nil {
+		return nil
+	}
+
+	dir := filepath.Join(c.Path, HistoryDir, id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create history for '%s': %v", previous.Name, err)
+	}
+	versionPath := filepath.Join(dir, strconv.FormatInt(previous.Revision, 10)+".json")
+	if err := storage.WriteCompressed(versionPath, raw, c.Compression); err != nil {
+		return fmt.Errorf("failed to archive '%s' revision %d: %v", previous.Name, previous.Revision, err)
+	}
+	_, err := c.pruneHistory(dir)
+	return err
+}
+
+// Versions returns the archived versions of a document, oldest first
+func (c *Collection) Versions(id string) ([]*Document, error) {
+	dir := filepath.Join(c.Path, HistoryDir, id)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+
+	var versions []*Document
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		doc, err := c.ReadDocument(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		// Versions of every document share names, so a version sealed for
+		// one document could be copied into another's history
+		if doc.ID != id {
+			continue
+		}
+		// Versions describe where the document lives, not where the copy is kept,
+		// and are detached so saving one cannot overwrite the live document
+		doc.Path = filepath.Join(c.Path, id+".json")
+		doc.col = nil
+		versions = append(versions, doc)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Revision < versions[j].Revision })
+	return versions, nil
+}
+
+// ArchivedIDs lists the IDs of every document with archived versions,
+// including documents that have since been deleted
+func (c *Collection) ArchivedIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(c.Path, HistoryDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// PruneHistory drops the archived versions that fall outside the retention
+// options from the history of every document, deleted ones included, and
+// returns how many it dropped. Writes prune only their own document's
+// history, so versions past MaxAgeDays are otherwise kept until the document
+// is written again. The caller must hold the collection's Mutex.
+func (c *Collection) PruneHistory() (int, error) {
+	if c.History == nil {
+		return 0, nil
+	}
+	ids, err := c.ArchivedIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, id := range ids {
+		dir := filepath.Join(c.Path, HistoryDir, id)
+		n, err := c.pruneHistory(dir)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+		// Fails, leaving it, unless every version is gone
+		os.Remove(dir)
+	}
+	return pruned, nil
+}
+
+// pruneHistory drops the versions in dir that fall outside the retention
+// options and returns how many it dropped
+func (c *Collection) pruneHistory(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	type version struct {
+		path     string
+		revision int64
+		archived time.Time
+	}
+	var versions []version
+	for _, entry := range entries {
+		rev, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version{filepath.Join(dir, entry.Name()), rev, info.ModTime()})
+	}
+	// Newest first
+	sort.Slice(versions, func(i, j int) bool { return versions[i].revision > versions[j].revision })
+
+	cutoff := time.Time{}
+	if c.History.MaxAgeDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -c.History.MaxAgeDays)
+	}
+	pruned := 0
+	for i, v := range versions {
+		tooMany := c.History.MaxVersions > 0 && i >= c.History.MaxVersions
+		tooOld := !cutoff.IsZero() && v.archived.Before(cutoff)
+		if tooMany || tooOld {
+			if err := os.Remove(v.path); err != nil {
+				return pruned, fmt.Errorf("failed to prune history: %v", err)
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
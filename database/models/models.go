@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-)
+	"time"
 
+	"Build-your-own-database/database/storage"
+)
 
 // GoDB is the central database manager
 type GoDB struct {
@@ -18,28 +20,51 @@ type GoDB struct {
 
 // Database represents a database in the system
 type Database struct {
-	Name        string                  `json:"name"`        // Name of the database
-	Path        string                  `json:"path"`        // Path where the database is stored
-	Collections map[string]*Collection  `json:"collections"` // List of collections in the database
-	Mutex       sync.RWMutex            // Protects access to Collections
+	Name        string                 `json:"name"`        // Name of the database
+	Path        string                 `json:"path"`        // Path where the database is stored
+	Collections map[string]*Collection `json:"collections"` // List of collections in the database
+	Mutex       sync.RWMutex           // Protects access to Collections
 }
 
 // Collection represents a collection inside a database
 type Collection struct {
-	Name      string                   `json:"name"`
-	Path      string                   `json:"path"`
-	Documents map[string]*Document     `json:"documents"`
+	Name        string               `json:"name"`
+	Path        string               `json:"path"`
+	Documents   map[string]*Document `json:"-"`                     // Loaded documents, stored in their own files
+	Indexes     []Index              `json:"indexes,omitempty"`     // Indexes declared on the collection
+	History     *HistoryOptions      `json:"history,omitempty"`     // Retention of previous document versions
+	Capped      *CappedOptions       `json:"capped,omitempty"`      // Size limits that evict the oldest documents
+	Encrypted   []EncryptedField     `json:"encrypted,omitempty"`   // Fields the client encrypts before saving
+	Compression *storage.Compression `json:"compression,omitempty"` // How document files are compressed
 
-	mu sync.Mutex `json:"-"` // Prevent mutex from being serialized
+	Mutex  sync.RWMutex  `json:"-"` // Protects access to Documents
+	loaded bool          // Set once every document on disk is in Documents
+	seq    int64         // Highest insertion sequence number handed out
+	insert chan struct{} // Closed and replaced whenever a document is inserted
 }
 
+// Index declares a field that documents in a collection are indexed on
+type Index struct {
+	Field              string `json:"field"`                        // Data field the index covers
+	Unique             bool   `json:"unique"`                       // Reject documents that repeat an indexed value
+	ExpireAfterSeconds int64  `json:"expireAfterSeconds,omitempty"` // TTL: expire documents this long after the field's date
+}
 
 // Document represents an individual document inside a collection
 type Document struct {
-	ID   string                 `json:"id"`   // Document ID
-	Name string 				`json:"name"`
-	Data map[string]interface{} `json:"data"` // Key-value data
-	Path string                 `json:"path"` // Path to the file on disk (optional)
+	ID        string                 `json:"id"` // Document ID
+	Name      string                 `json:"name"`
+	Data      map[string]interface{} `json:"data"`               // Key-value data
+	Path      string                 `json:"path"`               // Path to the file on disk (optional)
+	CreatedAt time.Time              `json:"createdAt"`          // Set when the document is first written
+	UpdatedAt time.Time              `json:"updatedAt"`          // Set on every write
+	Revision  int64                  `json:"revision"`           // Incremented on every write, starting at 1
+	Size      int64                  `json:"size"`               // Size of the encoded data in bytes
+	ExpireAt  *time.Time             `json:"expireAt,omitempty"` // Document is removed once this passes
+	Seq       int64                  `json:"seq,omitempty"`      // Insertion order within the collection
+
+	col    *Collection // Collection the document belongs to, if known
+	opened bool        // Holds decrypted fields, so it must not be written back as is
 }
 
 // KeyValue represents a single key-value pair
@@ -55,13 +80,18 @@ type Response struct {
 	Data    interface{} `json:"data"`    // Any additional data (optional)
 }
 
-
 func (d *Document) Add(key string, value interface{}) error {
 	if _, exists := d.Data[key]; exists {
 		return fmt.Errorf("key '%s' already exists", key)
 	}
 	d.Data[key] = value
-	return d.save()
+	if err := d.Save(); err != nil {
+		if !Uncommitted(err) {
+			delete(d.Data, key)
+		}
+		return err
+	}
+	return nil
 }
 
 func (d *Document) Find(key string) (interface{}, bool) {
@@ -73,32 +103,163 @@ func (d *Document) Update(key string, value interface{}) error {
 	if _, exists := d.Data[key]; !exists {
 		return fmt.Errorf("key '%s' not found", key)
 	}
+	previous := d.Data[key]
 	d.Data[key] = value
-	return d.save()
+	if err := d.Save(); err != nil {
+		if !Uncommitted(err) {
+			d.Data[key] = previous
+		}
+		return err
+	}
+	return nil
 }
 
 func (d *Document) DeleteKey(key string) error {
 	if _, exists := d.Data[key]; !exists {
 		return fmt.Errorf("key '%s' not found", key)
 	}
+	previous := d.Data[key]
 	delete(d.Data, key)
-	return d.save()
+	if err := d.Save(); err != nil {
+		if !Uncommitted(err) {
+			d.Data[key] = previous
+		}
+		return err
+	}
+	return nil
 }
 
+// errNoFile is returned when a document without a file of its own, such as one
+// a remote server returned, is written
+var errNoFile = fmt.Errorf("document has no file here; update it through its document manager")
+
 func (d *Document) Rename(newID string) error {
-	newPath := filepath.Join(filepath.Dir(d.Path), newID+".json")
-	if err := os.Rename(d.Path, newPath); err != nil {
+	oldID, oldPath := d.ID, d.Path
+	d.ID = newID
+	d.Path = filepath.Join(filepath.Dir(oldPath), newID+".json")
+	if err := d.save(oldPath); err != nil {
+		if !Uncommitted(err) {
+			d.ID, d.Path = oldID, oldPath
+		}
 		return err
 	}
-	d.ID = newID
-	d.Path = newPath
-	return d.save()
+	return nil
+}
+
+// Save writes the document to its file, stamping its metadata fields.
+// In a collection, the document must not break a unique index or give an
+// encrypted field a clear value, the version being overwritten is archived if
+// the collection keeps history, and the write is made as an insert, update or
+// rename change (see Change). The caller must hold the collection's Mutex, as
+// Add, Update and DeleteKey's callers must.
+func (d *Document) Save() error {
+	return d.save(d.Path)
 }
 
-func (d *Document) save() error {
+// save is Save for a document whose file is at from, which it is moved from
+// when the document's path has changed. Files are copied rather than renamed,
+// as encrypted files are sealed under their name.
+func (d *Document) save(from string) error {
+	if d.opened {
+		return errOpened
+	}
+	if from == "" || d.Path == "" {
+		return errNoFile
+	}
+	if d.col == nil {
+		d.touch()
+		return d.move(from)
+	}
+
+	if err := d.col.LoadDocuments(); err != nil {
+		return err
+	}
+	if err := d.col.CheckUnique(d); err != nil {
+		return err
+	}
+
+	before, raw, err := d.col.previous(from, d.Name)
+	if err != nil {
+		return err
+	}
+	if err := d.col.checkEncrypted(d, before); err != nil {
+		return err
+	}
+	stamped := *d
+	d.touch()
+
+	event := ChangeEvent{Op: OpUpdate, DocumentID: d.ID, Name: d.Name, Before: before, After: d.Snapshot()}
+	switch {
+	case before == nil:
+		event.Op = OpInsert
+	case before.Name != d.Name:
+		event.Op = OpRename
+		event.OldName = before.Name
+	}
+	err = d.col.Change(event, func() error {
+		if before != nil {
+			if err := d.col.keep(d.ID, before, raw); err != nil {
+				return err
+			}
+		}
+		return d.move(from)
+	})
+	if err != nil && !Uncommitted(err) {
+		// The change was not made, so neither was the stamp
+		d.CreatedAt, d.UpdatedAt, d.Revision, d.Size = stamped.CreatedAt, stamped.UpdatedAt, stamped.Revision, stamped.Size
+	}
+	return err
+}
+
+// move writes the document to its file and removes the file at from, if
+// that is another
+func (d *Document) move(from string) error {
+	if err := d.write(); err != nil {
+		return err
+	}
+	if from != d.Path {
+		if err := os.Remove(from); err != nil {
+			os.Remove(d.Path)
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite writes the document back to its file as it is, without stamping
+// metadata, archiving or announcing a change. Used to repair files.
+func (d *Document) Rewrite() error {
+	if d.opened {
+		return errOpened
+	}
+	if d.Path == "" {
+		return errNoFile
+	}
+	return d.write()
+}
+
+// write encodes the document to its file as it is, without touching metadata
+func (d *Document) write() error {
 	data, err := json.MarshalIndent(d, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(d.Path, data, 0644)
+	var compression *storage.Compression
+	if d.col != nil {
+		compression = d.col.Compression
+	}
+	return storage.WriteCompressed(d.Path, data, compression)
+}
+
+// touch updates the metadata fields maintained on every write
+func (d *Document) touch() {
+	now := time.Now().UTC()
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = now
+	}
+	d.UpdatedAt = now
+	d.Revision++
+	if raw, err := json.Marshal(d.Data); err == nil {
+		d.Size = int64(len(raw))
+	}
 }
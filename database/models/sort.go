@@ -0,0 +1,67 @@
+package models
+
+import (
+	"cmp"
+	"sort"
+	"time"
+)
+
+// SortDocuments orders documents by a field, as named for Document.Field.
+// Documents missing the field sort first; ties keep their relative order.
+func SortDocuments(docs []*Document, field string, descending bool) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		a, _ := docs[i].Field(field)
+		b, _ := docs[j].Field(field)
+		if descending {
+			return Compare(b, a) < 0
+		}
+		return Compare(a, b) < 0
+	})
+}
+
+// Compare orders two field values, returning -1, 0 or 1.
+// Values of different kinds are ordered null < numbers < strings < booleans < others.
+func Compare(a, b interface{}) int {
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			return ta.Compare(tb)
+		}
+	}
+
+	a, b = Normalize(a), Normalize(b)
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return cmp.Compare(ra, rb)
+	}
+
+	switch va := a.(type) {
+	case float64:
+		return cmp.Compare(va, b.(float64))
+	case string:
+		return cmp.Compare(va, b.(string))
+	case bool:
+		vb := b.(bool)
+		switch {
+		case va == vb:
+			return 0
+		case !va:
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bool:
+		return 3
+	}
+	return 4
+}
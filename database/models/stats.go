@@ -0,0 +1,60 @@
+package models
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// StorageEngine names how collections are kept on disk: one JSON file per document
+const StorageEngine = "json-files"
+
+// CollectionStats summarises the size and layout of a collection
+type CollectionStats struct {
+	Name            string           `json:"name"`
+	Documents       int              `json:"documents"`       // Live (unexpired) documents
+	DataSize        int64            `json:"dataSize"`        // Total encoded size of document data
+	AvgDocumentSize float64          `json:"avgDocumentSize"` // DataSize / Documents
+	StorageSize     int64            `json:"storageSize"`     // Bytes used on disk, including history
+	IndexSizes      map[string]int64 `json:"indexSizes"`      // Estimated bytes of each index's entries
+	StorageEngine   string           `json:"storageEngine"`
+
+	Compression      string  `json:"compression,omitempty"` // Algorithm compressing document files, if any
+	UncompressedSize int64   `json:"uncompressedSize"`      // Bytes of the document files before compression
+	CompressedSize   int64   `json:"compressedSize"`        // Bytes of the document files on disk
+	CompressionRatio float64 `json:"compressionRatio"`      // UncompressedSize / CompressedSize
+}
+
+// DiskUsage walks a file or directory, returning the bytes its files take and
+// the most recent modification time found
+func DiskUsage(path string) (int64, time.Time, error) {
+	var size int64
+	var modified time.Time
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return size, modified, err
+}
+
+// DatabaseStats summarises the contents and footprint of a database
+type DatabaseStats struct {
+	Name         string    `json:"name"`
+	Collections  int       `json:"collections"`
+	Documents    int       `json:"documents"`    // Live documents across all collections
+	DataSize     int64     `json:"dataSize"`     // Total encoded size of document data
+	Bytes        int64     `json:"bytes"`        // Bytes used on disk
+	LastModified time.Time `json:"lastModified"` // Most recent change to any file in the database
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Expired reports whether a document has passed its expireAt time or the
+// expiry of one of the collection's TTL indexes
+func (c *Collection) Expired(d *Document, now time.Time) bool {
+	if d.ExpireAt != nil && !now.Before(*d.ExpireAt) {
+		return true
+	}
+
+	for _, index := range c.Indexes {
+		if index.ExpireAfterSeconds <= 0 {
+			continue
+		}
+		val, ok := d.Field(index.Field)
+		if !ok {
+			continue
+		}
+		start, ok := asTime(val)
+		if !ok {
+			continue
+		}
+		if !now.Before(start.Add(time.Duration(index.ExpireAfterSeconds) * time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// asTime interprets a field value as a point in time. Strings must be RFC 3339,
+// the format time values take once they are stored as JSON; Extended JSON
+// dates ({"$date": ...}) are accepted too.
+func asTime(val interface{}) (time.Time, bool) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case *time.Time:
+		if v == nil {
+			return time.Time{}, false
+		}
+		return *v, !v.IsZero()
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case map[string]interface{}:
+		if date, ok := v["$date"]; ok && len(v) == 1 {
+			return asTime(date)
+		}
+	}
+	return time.Time{}, false
+}
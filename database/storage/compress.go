@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Compression algorithms
+const (
+	Gzip  = "gzip"  // gzip framing, widely readable
+	Flate = "flate" // Raw deflate, a few bytes smaller than gzip
+	Dict  = "dict"  // Deflate primed with a dictionary trained on the collection's documents
+)
+
+// Algorithm bytes in frame headers
+const (
+	algorithmGzip byte = 1 + iota
+	algorithmFlate
+	algorithmDict
+)
+
+var algorithmNames = map[byte]string{algorithmGzip: Gzip, algorithmFlate: Flate, algorithmDict: Dict}
+
+// DictionariesDir is the directory under a storage root holding compression dictionaries
+const DictionariesDir = ".dictionaries"
+
+// MaxDictionarySize is the most of a dictionary deflate can refer back to
+const MaxDictionarySize = 32 << 10
+
+const dictIDSize = 8
+
+// DictID names a compression dictionary by its content
+type DictID [dictIDSize]byte
+
+func (id DictID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Compression configures how files are compressed before they are stored
+type Compression struct {
+	Algorithm  string `json:"algorithm"`            // Gzip, Flate or Dict
+	Level      int    `json:"level,omitempty"`      // 1 (fastest) to 9 (smallest), 0 for the default
+	Dictionary string `json:"dictionary,omitempty"` // ID of the trained dictionary, for Dict
+}
+
+// Validate rejects unknown algorithms and levels
+func (c *Compression) Validate() error {
+	if _, _, err := c.header(); err != nil {
+		return err
+	}
+	if c.Level < 0 || c.Level > 9 {
+		return fmt.Errorf("invalid compression level %d, expected 1 to 9", c.Level)
+	}
+	return nil
+}
+
+// header returns the algorithm byte and dictionary written in frame headers
+func (c *Compression) header() (byte, DictID, error) {
+	var id DictID
+	switch c.Algorithm {
+	case Gzip:
+		return algorithmGzip, id, nil
+	case Flate:
+		return algorithmFlate, id, nil
+	case Dict:
+		if _, err := hex.Decode(id[:], []byte(c.Dictionary)); err != nil || len(c.Dictionary) != 2*dictIDSize {
+			return 0, id, fmt.Errorf("invalid compression dictionary '%s'", c.Dictionary)
+		}
+		return algorithmDict, id, nil
+	}
+	return 0, id, fmt.Errorf("invalid compression algorithm '%s', expected %s, %s or %s", c.Algorithm, Gzip, Flate, Dict)
+}
+
+func (c *Compression) level() int {
+	if c.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return c.Level
+}
+
+func compress(r *root, c *Compression, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch c.Algorithm {
+	case Gzip:
+		w, err = gzip.NewWriterLevel(&buf, c.level())
+	case Flate:
+		w, err = flate.NewWriter(&buf, c.level())
+	case Dict:
+		_, id, headerErr := c.header()
+		if headerErr != nil {
+			return nil, headerErr
+		}
+		dict, dictErr := r.dictionary(id)
+		if dictErr != nil {
+			return nil, dictErr
+		}
+		w, err = flate.NewWriterDict(&buf, c.level(), dict)
+	default:
+		return nil, fmt.Errorf("invalid compression algorithm '%s'", c.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(r *root, algorithm byte, id DictID, payload []byte) ([]byte, error) {
+	var rd io.ReadCloser
+	switch algorithm {
+	case algorithmGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("decompression failed: %v", err)
+		}
+		rd = zr
+	case algorithmFlate:
+		rd = flate.NewReader(bytes.NewReader(payload))
+	case algorithmDict:
+		dict, err := r.dictionary(id)
+		if err != nil {
+			return nil, err
+		}
+		rd = flate.NewReaderDict(bytes.NewReader(payload), dict)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %d", algorithm)
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed: %v", err)
+	}
+	return data, nil
+}
+
+// SaveDictionary stores a compression dictionary under a registered root and
+// returns its ID. Dictionaries are kept for as long as the root exists, since
+// files compressed with them may still be in history or the trash.
+func SaveDictionary(rootPath string, dict []byte) (DictID, error) {
+	var id DictID
+	if len(dict) == 0 || len(dict) > MaxDictionarySize {
+		return id, fmt.Errorf("invalid dictionary size %d, expected 1 to %d bytes", len(dict), MaxDictionarySize)
+	}
+	r := rootFor(rootPath)
+	if r == nil {
+		return id, fmt.Errorf("'%s' is not a storage root", rootPath)
+	}
+
+	sum := sha256.Sum256(dict)
+	copy(id[:], sum[:])
+	dir := filepath.Join(r.path, DictionariesDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return id, fmt.Errorf("failed to store dictionary: %v", err)
+	}
+	if err := WriteFile(filepath.Join(dir, id.String()), dict); err != nil {
+		return id, fmt.Errorf("failed to store dictionary: %v", err)
+	}
+
+	r.dictMu.Lock()
+	r.dicts[id] = dict
+	r.dictMu.Unlock()
+	return id, nil
+}
+
+// dictionary loads a dictionary by ID, caching it
+func (r *root) dictionary(id DictID) ([]byte, error) {
+	if r == nil {
+		return nil, fmt.Errorf("dictionary %s is only available under a storage root", id)
+	}
+	r.dictMu.Lock()
+	defer r.dictMu.Unlock()
+	if dict, ok := r.dicts[id]; ok {
+		return dict, nil
+	}
+	dict, err := ReadFile(filepath.Join(r.path, DictionariesDir, id.String()))
+	if err != nil {
+		return nil, fmt.Errorf("compression dictionary %s is missing: %v", id, err)
+	}
+	r.dicts[id] = dict
+	return dict, nil
+}
+
+// TrainDictionary builds a deflate dictionary of at most size bytes from
+// sample documents. Lines, and the "key": prefixes of lines, that recur across
+// samples are kept by how many bytes they would save, the most valuable last
+// where deflate reaches them most cheaply. It returns nil when nothing recurs.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size <= 0 || size > MaxDictionarySize {
+		size = MaxDictionarySize
+	}
+
+	counts := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]bool)
+		for _, line := range bytes.SplitAfter(sample, []byte("\n")) {
+			candidates := []string{string(line)}
+			if colon := bytes.Index(line, []byte(`": `)); colon >= 0 {
+				candidates = append(candidates, string(line[:colon+3]))
+			}
+			for _, candidate := range candidates {
+				if len(candidate) >= 4 && !seen[candidate] {
+					seen[candidate] = true
+					counts[candidate]++
+				}
+			}
+		}
+	}
+
+	type scored struct {
+		text  string
+		score int
+	}
+	var pieces []scored
+	for text, count := range counts {
+		if count >= 2 {
+			pieces = append(pieces, scored{text, count * len(text)})
+		}
+	}
+	sort.Slice(pieces, func(i, j int) bool {
+		if pieces[i].score != pieces[j].score {
+			return pieces[i].score > pieces[j].score
+		}
+		return pieces[i].text < pieces[j].text
+	})
+
+	var chosen []string
+	total := 0
+	for _, piece := range pieces {
+		if total+len(piece.text) > size {
+			continue
+		}
+		chosen = append(chosen, piece.text)
+		total += len(piece.text)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	dict := make([]byte, 0, total)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		dict = append(dict, chosen[i]...)
+	}
+	return dict
+}
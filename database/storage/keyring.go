@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"Build-your-own-database/config"
+)
+
+// KeyringFile is the file under a storage root holding its wrapped data keys
+const KeyringFile = ".keyring.json"
+
+// KeyID names a data key in the header of the files it sealed
+type KeyID [keyIDSize]byte
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Keyring holds the data keys of a storage root. Each database gets its own
+// keys; the newest one seals new writes and older ones stay to read files not
+// yet rewritten. Data keys are stored wrapped by the master key, never in clear.
+type Keyring struct {
+	path string
+
+	mu      sync.RWMutex
+	master  []byte
+	entries []keyEntry
+	keys    map[KeyID][]byte // Unwrapped data keys
+	active  map[string]KeyID // Newest key of each database
+	strict  bool             // Only files sealed under their name are read
+}
+
+// keyringFile is the content of the keyring file
+type keyringFile struct {
+	Keys   []keyEntry `json:"keys"`
+	Strict bool       `json:"strict,omitempty"`
+}
+
+// keyEntry is a data key as stored in the keyring file
+type keyEntry struct {
+	ID        string    `json:"id"`
+	Database  string    `json:"database"`
+	Wrapped   []byte    `json:"wrapped"` // Nonce followed by the sealed key
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// KeyInfo describes a data key without revealing it
+type KeyInfo struct {
+	ID        string    `json:"id"`
+	Database  string    `json:"database"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OpenKeyring loads the keyring of a storage root, creating an empty one if
+// needed. It fails if the master key does not unwrap the stored keys. A new
+// keyring for an empty root is strict from the start, as the root holds no
+// files from before encryption.
+func OpenKeyring(rootPath string, master []byte) (*Keyring, error) {
+	return openKeyring(rootPath, master, true)
+}
+
+// openKeyring is OpenKeyring, creating the keyring of an empty root only if create is set
+func openKeyring(rootPath string, master []byte, create bool) (*Keyring, error) {
+	k := &Keyring{
+		path:   filepath.Join(rootPath, KeyringFile),
+		master: master,
+		keys:   make(map[KeyID][]byte),
+		active: make(map[string]KeyID),
+	}
+
+	raw, err := os.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		if !create || !emptyDir(rootPath) {
+			return k, nil
+		}
+		if err := os.MkdirAll(rootPath, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to write keyring: %v", err)
+		}
+		k.strict = true
+		return k, k.save([]keyEntry{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+	var file keyringFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring: %v", err)
+	}
+	k.strict = file.Strict
+
+	for _, entry := range file.Keys {
+		id, key, err := unwrap(master, entry)
+		if err != nil {
+			return nil, err
+		}
+		k.entries = append(k.entries, entry)
+		k.keys[id] = key
+		k.active[entry.Database] = id
+	}
+	return k, nil
+}
+
+// ActiveKey returns the key sealing new writes to a database, creating the
+// database's first key if it has none
+func (k *Keyring) ActiveKey(database string) (KeyID, []byte, error) {
+	k.mu.RLock()
+	id, ok := k.active[database]
+	key := k.keys[id]
+	k.mu.RUnlock()
+	if ok {
+		return id, key, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id, ok := k.active[database]; ok {
+		return id, k.keys[id], nil
+	}
+	return k.addKey(database)
+}
+
+// Key returns a data key by ID
+func (k *Keyring) Key(id KeyID) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("data key %s is not in the keyring", id)
+	}
+	return key, nil
+}
+
+// Rotate gives a database a new data key for every later write. Files already
+// written stay readable with the previous key until they are rewritten.
+func (k *Keyring) Rotate(database string) (KeyID, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	id, _, err := k.addKey(database)
+	return id, err
+}
+
+// Rewrap re-encrypts every data key under a new master key. No file needs to
+// be rewritten; the new master key must be configured from then on.
+func (k *Keyring) Rewrap(master []byte) error {
+	if len(master) != 32 {
+		return fmt.Errorf("master key must be 32 bytes, got %d", len(master))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entries := make([]keyEntry, len(k.entries))
+	for i, entry := range k.entries {
+		var id KeyID
+		if _, err := hex.Decode(id[:], []byte(entry.ID)); err != nil {
+			return fmt.Errorf("invalid key ID '%s'", entry.ID)
+		}
+		wrapped, err := wrap(master, id, k.keys[id])
+		if err != nil {
+			return err
+		}
+		entry.Wrapped = wrapped
+		entries[i] = entry
+	}
+	if err := k.save(entries); err != nil {
+		return err
+	}
+	k.entries = entries
+	k.master = master
+	return nil
+}
+
+// Strict reports whether the root only accepts files encrypted under their
+// name, refusing plain files and files sealed before names were
+func (k *Keyring) Strict() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.strict
+}
+
+// SetStrict makes the keyring strict once every file of its root is sealed
+// under its name. There is no way back short of editing the keyring file.
+func (k *Keyring) SetStrict() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.strict = true
+	if err := k.save(k.entries); err != nil {
+		k.strict = false
+		return err
+	}
+	return nil
+}
+
+// Keys lists the data keys, oldest first
+func (k *Keyring) Keys() []KeyInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	infos := make([]KeyInfo, len(k.entries))
+	for i, entry := range k.entries {
+		infos[i] = KeyInfo{
+			ID:        entry.ID,
+			Database:  entry.Database,
+			Active:    k.active[entry.Database].String() == entry.ID,
+			CreatedAt: entry.CreatedAt,
+		}
+	}
+	return infos
+}
+
+// addKey creates a data key for a database and makes it active. The caller must hold mu.
+func (k *Keyring) addKey(database string) (KeyID, []byte, error) {
+	var id KeyID
+	key := make([]byte, 32)
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return id, nil, err
+	}
+	wrapped, err := wrap(k.master, id, key)
+	if err != nil {
+		return id, nil, err
+	}
+
+	entry := keyEntry{ID: id.String(), Database: database, Wrapped: wrapped, CreatedAt: time.Now().UTC()}
+	entries := append(append([]keyEntry(nil), k.entries...), entry)
+	if err := k.save(entries); err != nil {
+		return id, nil, err
+	}
+	k.entries = entries
+	k.keys[id] = key
+	k.active[database] = id
+	return id, key, nil
+}
+
+// save replaces the keyring file. The keyring holds only wrapped keys, so it
+// is written in the clear.
+func (k *Keyring) save(entries []keyEntry) error {
+	raw, err := json.MarshalIndent(keyringFile{Keys: entries, Strict: k.strict}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("failed to write keyring: %v", err)
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		return fmt.Errorf("failed to write keyring: %v", err)
+	}
+	return nil
+}
+
+// emptyDir reports whether a directory is empty or missing
+func emptyDir(path string) bool {
+	entries, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && len(entries) == 0
+}
+
+func wrap(master []byte, id KeyID, key []byte) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, id[:]), nil
+}
+
+func unwrap(master []byte, entry keyEntry) (KeyID, []byte, error) {
+	var id KeyID
+	if _, err := hex.Decode(id[:], []byte(entry.ID)); err != nil {
+		return id, nil, fmt.Errorf("invalid key ID '%s' in keyring", entry.ID)
+	}
+	if len(entry.Wrapped) < nonceSize {
+		return id, nil, fmt.Errorf("data key %s is truncated", entry.ID)
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return id, nil, err
+	}
+	key, err := gcm.Open(nil, entry.Wrapped[:nonceSize], entry.Wrapped[nonceSize:], id[:])
+	if err != nil {
+		return id, nil, fmt.Errorf("the master key does not unwrap data key %s; is it the right key?", entry.ID)
+	}
+	return id, key, nil
+}
+
+// Rotate gives a database under a registered root a new data key
+func Rotate(rootPath, database string) (KeyID, error) {
+	keyring, err := KeyringOf(filepath.Join(rootPath, database))
+	if err != nil {
+		return KeyID{}, err
+	}
+	if keyring == nil {
+		return KeyID{}, errNoMasterKey
+	}
+	return keyring.Rotate(database)
+}
+
+// MasterKey reads the configured master key, nil when encryption is off
+func MasterKey() ([]byte, error) {
+	value := config.EncryptionKey
+	if value == "" && config.EncryptionKeyFile != "" {
+		raw, err := os.ReadFile(config.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		if len(raw) == 32 {
+			return raw, nil
+		}
+		value = string(raw)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return ParseKey(value)
+}
+
+// ParseKey decodes a 32-byte key written in hex or base64
+func ParseKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 32 bytes in hex or base64")
+}
+
+// GenerateKey returns a new random key in base64, for use as a master key
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
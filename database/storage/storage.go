@@ -0,0 +1,555 @@
+// Package storage reads and writes the files under a storage root: documents,
+// collection metadata, history versions, trash entries and change log records.
+//
+// Every file written is framed: a short header, a CRC32C checksum verified on
+// every read, and the payload. Files that fail the check, or cannot be
+// decrypted or decompressed, are reported as a *CorruptionError.
+//
+// Files of collections with compression enabled are compressed first, with
+// gzip, raw deflate or deflate with a dictionary trained on the collection's
+// own documents.
+//
+// With a master key configured, every file is sealed with AES-GCM under a data
+// key of the database it belongs to. Files then start with a short header
+// naming the key, so they stay readable after the key is rotated and after
+// they move between databases. The file's name is authenticated with it, so a
+// sealed file copied over another fails to decrypt instead of being read as
+// the other. Plain JSON files from before framing are still read as they are
+// until the store is sealed (see Keyring.Strict), which lets a store switch
+// encryption on and migrate through a rotation.
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// magic starts every framed file; JSON files cannot start with it
+var magic = []byte{'G', 'D', 'B', 1}
+
+// Frame flags
+const (
+	flagEncrypted byte = 1 << iota
+	flagCompressed
+	flagChecksum
+	flagBound // The file name is part of the encryption's additional data
+)
+
+const (
+	keyIDSize    = 8
+	nonceSize    = 12
+	checksumSize = 4
+)
+
+// castagnoli is the CRC32C table used for file checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError reports a stored file that cannot be trusted: its checksum
+// does not match, it cannot be decrypted or decompressed, or its content does
+// not decode
+type CorruptionError struct {
+	Path   string
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt file %s: %s", e.Path, e.Reason)
+}
+
+// Corrupt returns a *CorruptionError for path
+func Corrupt(path, format string, args ...interface{}) error {
+	return &CorruptionError{Path: path, Reason: fmt.Sprintf(format, args...)}
+}
+
+// IsCorrupt reports whether err is or wraps a *CorruptionError
+func IsCorrupt(err error) bool {
+	var corrupt *CorruptionError
+	return errors.As(err, &corrupt)
+}
+
+// root is a registered storage root and its keyring, if encryption is on
+type root struct {
+	path    string
+	keyring *Keyring
+	err     error // Why the keyring could not be opened; files then cannot be read or written
+
+	dictMu sync.Mutex
+	dicts  map[DictID][]byte // Compression dictionaries loaded so far
+
+	readOnly string // Why the managers refuse changes, empty while they accept them; guarded by rootsMu
+	opened   int    // Callers of Open still reading the root, 0 for one from Init; guarded by rootsMu
+}
+
+var (
+	rootsMu sync.RWMutex
+	roots   = make(map[string]*root)
+)
+
+// Init registers a storage root, opening or creating its keyring when a master
+// key is configured. Files outside registered roots are read and written in
+// plaintext. A root whose keyring cannot be opened refuses every file rather
+// than silently writing plaintext.
+func Init(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	rootsMu.Lock()
+	defer rootsMu.Unlock()
+	if r, ok := roots[abs]; ok {
+		return r.err
+	}
+
+	r := &root{path: abs, dicts: make(map[DictID][]byte)}
+	master, err := MasterKey()
+	if err == nil && master != nil {
+		r.keyring, err = OpenKeyring(abs, master)
+	}
+	if err != nil {
+		r.err = fmt.Errorf("encryption at rest: %v", err)
+	}
+	roots[abs] = r
+	return r.err
+}
+
+// Open makes the files of a directory copied out of a storage root, such as a
+// backup, readable with the keyring and dictionaries copied along, until the
+// returned function is called. Unlike Init it never creates a keyring in the
+// directory, and the directory stops being a root once every caller that
+// opened it is done.
+func Open(path string) (func(), error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rootsMu.Lock()
+	defer rootsMu.Unlock()
+	r, ok := roots[abs]
+	if ok && r.opened == 0 {
+		return func() {}, r.err
+	}
+	if !ok {
+		r = &root{path: abs, dicts: make(map[DictID][]byte)}
+		master, err := MasterKey()
+		if err == nil && master != nil {
+			r.keyring, err = openKeyring(abs, master, false)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encryption at rest: %v", err)
+		}
+		roots[abs] = r
+	}
+	r.opened++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rootsMu.Lock()
+			defer rootsMu.Unlock()
+			if r.opened--; r.opened == 0 {
+				delete(roots, abs)
+			}
+		})
+	}, nil
+}
+
+// Encrypted reports whether files under a root are written encrypted
+func Encrypted(path string) bool {
+	r := rootFor(path)
+	return r != nil && r.keyring != nil
+}
+
+// KeyringOf returns the keyring of a registered root, nil when encryption is off
+func KeyringOf(path string) (*Keyring, error) {
+	r := rootFor(path)
+	if r == nil {
+		return nil, nil
+	}
+	return r.keyring, r.err
+}
+
+// ErrReadOnly is returned, wrapped, for changes refused under a read-only root
+var ErrReadOnly = errors.New("read-only")
+
+// SetReadOnly makes the managers of a registered root refuse changes, giving
+// reason in their errors, or accept them again when reason is empty. Files are
+// still written by whatever applies changes to the root directly, such as a
+// replica following its primary.
+func SetReadOnly(path, reason string) error {
+	r := rootFor(path)
+	if r == nil {
+		return fmt.Errorf("'%s' is not a storage root", path)
+	}
+	rootsMu.Lock()
+	defer rootsMu.Unlock()
+	r.readOnly = reason
+	return nil
+}
+
+// Writable returns an error wrapping ErrReadOnly if the root holding path is read-only
+func Writable(path string) error {
+	r := rootFor(path)
+	if r == nil {
+		return nil
+	}
+	rootsMu.RLock()
+	defer rootsMu.RUnlock()
+	if r.readOnly != "" {
+		return fmt.Errorf("%w: %s", ErrReadOnly, r.readOnly)
+	}
+	return nil
+}
+
+// WriteFile stores data at path, encrypted if its root has a keyring. The file
+// is replaced atomically, so readers never see a partial write.
+func WriteFile(path string, data []byte) error {
+	return WriteCompressed(path, data, nil)
+}
+
+// WriteCompressed is WriteFile compressing data first, unless c is nil
+func WriteCompressed(path string, data []byte, c *Compression) error {
+	encoded, err := encode(path, data, c)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, encoded, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReadFile returns the contents of a file written by WriteFile, or of a plain file
+func ReadFile(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(path, raw)
+}
+
+// Rewrite reads a file and writes it back, sealing it under the current data
+// key of its database and keeping its compression. Used to rotate keys and to
+// encrypt existing files.
+func Rewrite(path string) error {
+	return Copy(path, path)
+}
+
+// Copy reads the file at src and writes its contents to dst, keeping its
+// compression. The contents are decoded under the root of src and sealed again
+// under the root of dst, so files can move between roots with different keys.
+func Copy(src, dst string) error {
+	raw, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f, err := parseFrame(src, raw)
+	if err != nil {
+		return err
+	}
+	data, err := Decode(src, raw)
+	if err != nil {
+		return err
+	}
+	return WriteCompressed(dst, data, f.compression())
+}
+
+// Encode frames data to be stored at path
+func Encode(path string, data []byte) ([]byte, error) {
+	return encode(path, data, nil)
+}
+
+func encode(path string, data []byte, c *Compression) ([]byte, error) {
+	r := rootFor(path)
+	if r != nil && r.err != nil {
+		return nil, r.err
+	}
+	encrypt := r != nil && r.keyring != nil
+
+	header := append(make([]byte, 0, 64), magic...)
+	flags := flagChecksum
+	if c != nil {
+		flags |= flagCompressed
+	}
+	if encrypt {
+		flags |= flagEncrypted | flagBound
+	}
+	header = append(header, flags)
+
+	payload := data
+	if c != nil {
+		algorithm, dictID, err := c.header()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, algorithm)
+		if algorithm == algorithmDict {
+			header = append(header, dictID[:]...)
+		}
+		if payload, err = compress(r, c, data); err != nil {
+			return nil, fmt.Errorf("failed to compress %s: %v", filepath.Base(path), err)
+		}
+	}
+	if encrypt {
+		id, key, err := r.keyring.ActiveKey(databaseOf(r.path, path))
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, id[:]...)
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		header = append(header, nonce...)
+
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		payload = gcm.Seal(nil, nonce, payload, binding(path, header))
+	}
+
+	// The checksum covers the header before it and the payload after it
+	sum := crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, payload)
+	framed := make([]byte, 0, len(header)+checksumSize+len(payload))
+	framed = append(framed, header...)
+	framed = binary.BigEndian.AppendUint32(framed, sum)
+	return append(framed, payload...), nil
+}
+
+// Decode returns the contents of a stored file, decrypting and decompressing
+// it if needed. path is where the file is stored, or was before it moved to
+// the trash: the name it was sealed under must match.
+func Decode(path string, raw []byte) ([]byte, error) {
+	return decode(path, raw, true)
+}
+
+// DecodeEntry is Decode for an entry of an append-only log, such as the change
+// log. Entries are checksummed and never moved between files, and logs keep
+// entries from before the store was sealed, so they are accepted unsealed.
+func DecodeEntry(path string, raw []byte) ([]byte, error) {
+	return decode(path, raw, false)
+}
+
+func decode(path string, raw []byte, strict bool) ([]byte, error) {
+	r := rootFor(path)
+	strict = strict && r.strict()
+	if !bytes.HasPrefix(raw, magic) {
+		if strict {
+			return nil, Corrupt(path, "the file is not encrypted")
+		}
+		return raw, nil
+	}
+	f, err := parseFrame(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	if strict && f.flags&(flagEncrypted|flagBound) != flagEncrypted|flagBound {
+		return nil, Corrupt(path, "the file is not encrypted under its name")
+	}
+	payload := raw[f.size:]
+	if f.flags&flagChecksum != 0 {
+		sum := crc32.Update(crc32.Checksum(raw[:f.checksumAt], castagnoli), castagnoli, payload)
+		if sum != binary.BigEndian.Uint32(raw[f.checksumAt:]) {
+			return nil, Corrupt(path, "checksum mismatch")
+		}
+	}
+
+	if f.flags&flagEncrypted != 0 {
+		if r != nil && r.err != nil {
+			return nil, r.err
+		}
+		if r == nil || r.keyring == nil {
+			return nil, fmt.Errorf("%s is encrypted but no encryption key is configured", filepath.Base(path))
+		}
+		key, err := r.keyring.Key(f.keyID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		additional := raw[:f.checksumAt]
+		if f.flags&flagBound != 0 {
+			additional = binding(path, additional)
+		}
+		payload, err = gcm.Open(nil, f.nonce, payload, additional)
+		if err != nil {
+			return nil, Corrupt(path, "decryption failed, the file was damaged or tampered with")
+		}
+	}
+
+	if f.flags&flagCompressed != 0 {
+		data, err := decompress(r, f.algorithm, f.dictID, payload)
+		if err != nil {
+			return nil, Corrupt(path, "%v", err)
+		}
+		return data, nil
+	}
+	return payload, nil
+}
+
+// frame is the parsed header of a framed file
+type frame struct {
+	flags      byte
+	algorithm  byte   // Compression algorithm, with flagCompressed
+	dictID     DictID // Compression dictionary, with algorithmDict
+	keyID      KeyID  // Data key, with flagEncrypted
+	nonce      []byte
+	checksumAt int // Offset of the checksum, with flagChecksum; the header before it is authenticated
+	size       int // Header length; the payload follows
+}
+
+// parseFrame reads the header of a framed file. Plain files parse as a frame
+// without flags.
+func parseFrame(path string, raw []byte) (frame, error) {
+	var f frame
+	if !bytes.HasPrefix(raw, magic) {
+		return f, nil
+	}
+	truncated := Corrupt(path, "truncated header")
+
+	at := len(magic)
+	if len(raw) < at+1 {
+		return f, truncated
+	}
+	f.flags = raw[at]
+	at++
+	if f.flags&^(flagEncrypted|flagCompressed|flagChecksum|flagBound) != 0 {
+		return f, Corrupt(path, "unsupported storage flags %#x", f.flags)
+	}
+
+	if f.flags&flagCompressed != 0 {
+		if len(raw) < at+1 {
+			return f, truncated
+		}
+		f.algorithm = raw[at]
+		at++
+		if f.algorithm == algorithmDict {
+			if len(raw) < at+dictIDSize {
+				return f, truncated
+			}
+			copy(f.dictID[:], raw[at:])
+			at += dictIDSize
+		}
+	}
+	if f.flags&flagEncrypted != 0 {
+		if len(raw) < at+keyIDSize+nonceSize {
+			return f, truncated
+		}
+		copy(f.keyID[:], raw[at:])
+		at += keyIDSize
+		f.nonce = raw[at : at+nonceSize]
+		at += nonceSize
+	}
+	f.checksumAt = at
+	if f.flags&flagChecksum != 0 {
+		if len(raw) < at+checksumSize {
+			return f, truncated
+		}
+		at += checksumSize
+	}
+	f.size = at
+	return f, nil
+}
+
+// compression returns the settings that produce the frame's compression, nil if uncompressed
+func (f frame) compression() *Compression {
+	if f.flags&flagCompressed == 0 {
+		return nil
+	}
+	c := &Compression{Algorithm: algorithmNames[f.algorithm]}
+	if f.algorithm == algorithmDict {
+		c.Dictionary = f.dictID.String()
+	}
+	return c
+}
+
+// binding returns the additional data sealing a file: its header followed by
+// the file's name. The name, not the whole path, so files stay readable after
+// their collection or database is renamed, copied or restored from a backup.
+func binding(path string, header []byte) []byte {
+	return append(append([]byte(nil), header...), filepath.Base(path)...)
+}
+
+// strict reports whether the root only accepts files sealed under their name
+func (r *root) strict() bool {
+	return r != nil && r.keyring != nil && r.keyring.Strict()
+}
+
+// rootFor finds the registered root a path is or lies under
+func rootFor(path string) *root {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+
+	rootsMu.RLock()
+	defer rootsMu.RUnlock()
+	var best *root
+	for dir, r := range roots {
+		inside := abs == dir || strings.HasPrefix(abs, dir+string(filepath.Separator))
+		if inside && (best == nil || len(dir) > len(best.path)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// databaseOf names the database a path belongs to: the first directory below
+// the root, such as "shop" or internal ones like ".system" and ".changes"
+func databaseOf(rootPath, path string) string {
+	abs, _ := filepath.Abs(path)
+	rel, err := filepath.Rel(rootPath, abs)
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return first
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// errNoMasterKey is returned by operations that need encryption to be configured
+var errNoMasterKey = errors.New("no encryption key is configured (ENCRYPTION_KEY or ENCRYPTION_KEY_FILE)")
+
+// NeedsSealing reports whether stored file contents would be refused by a
+// strict keyring: plain JSON files and files not encrypted under their name.
+// Other unframed files, such as the Raft log, hold entries sealed one by one.
+func NeedsSealing(raw []byte) bool {
+	if !bytes.HasPrefix(raw, magic) {
+		return json.Valid(raw)
+	}
+	return len(raw) <= len(magic) || raw[len(magic)]&(flagEncrypted|flagBound) != flagEncrypted|flagBound
+}
+
+// HasChecksum reports whether stored file contents carry a checksum; files
+// written before checksums, or plain files, do not
+func HasChecksum(raw []byte) bool {
+	return bytes.HasPrefix(raw, magic) && len(raw) > len(magic) && raw[len(magic)]&flagChecksum != 0
+}
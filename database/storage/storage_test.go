@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"Build-your-own-database/config"
+)
+
+func TestOpen(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(key string) { config.EncryptionKey = key }(config.EncryptionKey)
+	config.EncryptionKey = key
+
+	// A file sealed under one root, copied with its keyring into a backup
+	src := t.TempDir()
+	if err := Init(src); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join("shop", "items", "a.json")
+	if err := os.MkdirAll(filepath.Join(src, "shop", "items"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(filepath.Join(src, file), []byte(`{"n":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	backup := t.TempDir()
+	for _, name := range []string{KeyringFile, file} {
+		raw, err := os.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(backup, name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(backup, name), raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		opens    int
+		closes   int
+		readable bool
+	}{
+		{"never opened", 0, 0, false},
+		{"open", 1, 0, true},
+		{"closed", 1, 1, false},
+		{"opened twice, closed once", 2, 1, true},
+		{"opened twice, closed twice", 2, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dones []func()
+			for i := 0; i < tt.opens; i++ {
+				done, err := Open(backup)
+				if err != nil {
+					t.Fatalf("Open() error = %v", err)
+				}
+				dones = append(dones, done)
+			}
+			for i := 0; i < tt.closes; i++ {
+				dones[i]()
+				dones[i]() // Calling it again must not close another caller's
+			}
+			defer func() {
+				for _, done := range dones[tt.closes:] {
+					done()
+				}
+			}()
+
+			data, err := ReadFile(filepath.Join(backup, file))
+			if readable := err == nil && string(data) == `{"n":1}`; readable != tt.readable {
+				t.Errorf("ReadFile() = %q, %v, want readable %v", data, err, tt.readable)
+			}
+			if registered := rootFor(backup) != nil; registered != tt.readable {
+				t.Errorf("backup registered = %v, want %v", registered, tt.readable)
+			}
+		})
+	}
+
+	empty := t.TempDir()
+	done, err := Open(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if _, err := os.Stat(filepath.Join(empty, KeyringFile)); !os.IsNotExist(err) {
+		t.Errorf("Open() created a keyring in the directory: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// ExportCollection writes the documents of a collection matching opts.Filter
+// to w, oldest first, and returns how many it wrote. Each record holds the
+// document's data with its name under NameField.
+func ExportCollection(cm *collections.CollectionManager, name string, w io.Writer, opts ExportOptions) (int, error) {
+	format, err := checkFormat(opts.Format)
+	if err != nil {
+		return 0, err
+	}
+	collection, err := cm.UseCollection(name)
+	if err != nil {
+		return 0, err
+	}
+	docManager := documents.NewDocumentManager(collection).WithContext(cm.Context())
+	if opts.FieldKey != nil {
+		docManager = docManager.WithFieldKey(opts.FieldKey)
+	}
+	docs, err := docManager.FindDocuments(opts.Filter)
+	if err != nil {
+		return 0, err
+	}
+
+	records := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		record := make(map[string]interface{}, len(doc.Data)+1)
+		for key, val := range doc.Data {
+			record[key] = val
+		}
+		record[NameField] = doc.Name
+		records[i] = record
+	}
+
+	buffered := bufio.NewWriter(w)
+	var out recordWriter
+	switch format {
+	case JSONL:
+		out = &jsonlWriter{w: buffered}
+	case JSON:
+		out = &jsonWriter{w: buffered}
+	case CSV:
+		columns := opts.Fields
+		if len(columns) == 0 {
+			columns = columnsOf(records)
+		}
+		out = &csvWriter{w: csv.NewWriter(buffered), columns: columns}
+	}
+
+	batch := batchSize(opts.BatchSize)
+	progress := Progress{Collection: name, Total: len(docs)}
+	for i, record := range records {
+		if err := out.write(docs[i], record); err != nil {
+			return i, fmt.Errorf("failed to export document '%s': %v", docs[i].Name, err)
+		}
+		if (i+1)%batch == 0 {
+			if err := out.flush(); err != nil {
+				return i + 1, err
+			}
+			if err := buffered.Flush(); err != nil {
+				return i + 1, err
+			}
+			progress.Documents = i + 1
+			report(opts.Progress, progress)
+		}
+	}
+	if err := out.close(); err != nil {
+		return len(docs), err
+	}
+	if err := buffered.Flush(); err != nil {
+		return len(docs), err
+	}
+
+	progress.Documents, progress.Done = len(docs), true
+	report(opts.Progress, progress)
+	fmt.Printf("Exported %d document(s) from collection '%s'\n", len(docs), name)
+	return len(docs), nil
+}
+
+// ExportDatabase writes every collection of a database to its own file in dir,
+// named after the collection with the format as extension, and returns how
+// many documents it wrote
+func ExportDatabase(cm *collections.CollectionManager, dir string, opts ExportOptions) (int, error) {
+	format, err := checkFormat(opts.Format)
+	if err != nil {
+		return 0, err
+	}
+	names, err := cm.ListCollections()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return 0, fmt.Errorf("failed to create export directory: %v", err)
+	}
+
+	total := 0
+	for _, name := range names {
+		file, err := os.Create(filepath.Join(dir, name+"."+format))
+		if err != nil {
+			return total, fmt.Errorf("failed to create export file: %v", err)
+		}
+		count, err := ExportCollection(cm, name, file, opts)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// report passes progress to fn, if there is one
+func report(fn func(Progress), progress Progress) {
+	if fn != nil {
+		fn(progress)
+	}
+}
+
+// recordWriter encodes exported records in one format
+type recordWriter interface {
+	write(doc *models.Document, record map[string]interface{}) error
+	flush() error // Pushes buffered records to the output
+	close() error // Ends the output, writing any closing syntax
+}
+
+type jsonlWriter struct {
+	w io.Writer
+}
+
+func (j *jsonlWriter) write(_ *models.Document, record map[string]interface{}) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(raw, '\n'))
+	return err
+}
+
+func (j *jsonlWriter) flush() error { return nil }
+func (j *jsonlWriter) close() error { return nil }
+
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonWriter) write(_ *models.Document, record map[string]interface{}) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	separator := ",\n  "
+	if j.count == 0 {
+		separator = "[\n  "
+	}
+	j.count++
+	if _, err := io.WriteString(j.w, separator); err != nil {
+		return err
+	}
+	_, err = j.w.Write(raw)
+	return err
+}
+
+func (j *jsonWriter) flush() error { return nil }
+
+func (j *jsonWriter) close() error {
+	end := "\n]\n"
+	if j.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+type csvWriter struct {
+	w       *csv.Writer
+	columns []string
+	started bool
+}
+
+func (c *csvWriter) write(doc *models.Document, record map[string]interface{}) error {
+	if !c.started {
+		c.started = true
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+	}
+	row := make(map[string]interface{})
+	flatten("", record, row)
+	cells := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		val, ok := row[column]
+		if !ok && column != NameField {
+			val, ok = doc.Field(column)
+		}
+		cells[i] = formatCell(val, ok)
+	}
+	return c.w.Write(cells)
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) close() error {
+	if !c.started {
+		c.started = true
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+	}
+	return c.flush()
+}
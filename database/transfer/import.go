@@ -0,0 +1,254 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/document"
+)
+
+// ImportCollection creates a document from every record read from r, creating
+// the collection if it does not exist. Each record names its document in
+// opts.NameField. A record whose name is taken fails the import unless
+// opts.Upsert is set, in which case the document's data is replaced. Records
+// before a failing one stay imported.
+func ImportCollection(cm *collections.CollectionManager, name string, r io.Reader, opts ImportOptions) (*Result, error) {
+	format, err := checkFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	nameField := opts.NameField
+	if nameField == "" {
+		nameField = NameField
+	}
+
+	collection, err := cm.UseCollection(name)
+	if err != nil {
+		if collection, err = cm.CreateCollection(name); err != nil {
+			return nil, err
+		}
+	}
+	docManager := documents.NewDocumentManager(collection).WithContext(cm.Context())
+	if opts.FieldKey != nil {
+		docManager = docManager.WithFieldKey(opts.FieldKey)
+	}
+
+	var in recordReader
+	buffered := bufio.NewReader(r)
+	switch format {
+	case JSONL:
+		in = &jsonlReader{d: json.NewDecoder(buffered)}
+	case JSON:
+		in = &jsonReader{d: json.NewDecoder(buffered)}
+	case CSV:
+		in = &csvReader{r: csv.NewReader(buffered), columns: opts.Columns, name: nameField, infer: !opts.NoInfer}
+	}
+
+	result := &Result{Collection: name}
+	batch := batchSize(opts.BatchSize)
+	progress := Progress{Collection: name}
+	for {
+		record, err := in.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("invalid record %d: %v", progress.Documents+1, err)
+		}
+		progress.Documents++
+
+		docName, ok := record[nameField].(string)
+		if !ok || docName == "" {
+			return result, fmt.Errorf("invalid record %d: no '%s' field naming the document", progress.Documents, nameField)
+		}
+		if nameField == NameField {
+			delete(record, NameField)
+		}
+		if err := put(docManager, docName, record, opts.Upsert, result); err != nil {
+			return result, fmt.Errorf("failed to import record %d ('%s'): %v", progress.Documents, docName, err)
+		}
+
+		if progress.Documents%batch == 0 {
+			report(opts.Progress, progress)
+		}
+	}
+
+	progress.Done = true
+	report(opts.Progress, progress)
+	fmt.Printf("Imported %d document(s) into collection '%s': %d inserted, %d updated\n",
+		progress.Documents, name, result.Inserted, result.Updated)
+	return result, nil
+}
+
+// ImportDatabase imports every file in dir whose extension names a format
+// into the collection named after the file, as ExportDatabase writes them.
+// opts.Format, when set, limits the import to files of that format.
+func ImportDatabase(cm *collections.CollectionManager, dir string, opts ImportOptions) ([]*Result, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import directory: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var results []*Result
+	for _, entry := range entries {
+		format := FormatOf(entry.Name())
+		if entry.IsDir() || format == "" || (opts.Format != "" && opts.Format != format) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return results, err
+		}
+		fileOpts := opts
+		fileOpts.Format = format
+		result, err := ImportCollection(cm, strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), file, fileOpts)
+		file.Close()
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to import '%s': %v", entry.Name(), err)
+		}
+	}
+	return results, nil
+}
+
+// put creates a document, or replaces the data of the one holding its name when upsert is set
+func put(dm *documents.DocumentManager, name string, data map[string]interface{}, upsert bool, result *Result) error {
+	_, err := dm.CreateDocument(name, data)
+	if err == nil {
+		result.Inserted++
+		return nil
+	}
+	if !upsert || !strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+
+	existing, err := dm.UseDocument(name)
+	if err != nil {
+		return err
+	}
+	var unset []string
+	for key := range existing.Data {
+		if _, kept := data[key]; !kept {
+			unset = append(unset, key)
+		}
+	}
+	if _, err := dm.UpdateDocument(name, data, unset); err != nil {
+		return err
+	}
+	result.Updated++
+	return nil
+}
+
+// recordReader decodes imported records in one format, returning io.EOF after the last
+type recordReader interface {
+	next() (map[string]interface{}, error)
+}
+
+type jsonlReader struct {
+	d *json.Decoder
+}
+
+func (j *jsonlReader) next() (map[string]interface{}, error) {
+	var record map[string]interface{}
+	if err := j.d.Decode(&record); err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	return record, nil
+}
+
+type jsonReader struct {
+	d       *json.Decoder
+	started bool
+}
+
+func (j *jsonReader) next() (map[string]interface{}, error) {
+	if !j.started {
+		j.started = true
+		token, err := j.d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if token != json.Delim('[') {
+			return nil, fmt.Errorf("expected a JSON array")
+		}
+	}
+	if !j.d.More() {
+		if _, err := j.d.Token(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	var record map[string]interface{}
+	if err := j.d.Decode(&record); err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	return record, nil
+}
+
+type csvReader struct {
+	r       *csv.Reader
+	columns map[string]string // Header to field
+	name    string            // Field naming the document
+	infer   bool
+	fields  []string // Field of each column, "" to skip
+}
+
+func (c *csvReader) next() (map[string]interface{}, error) {
+	if c.fields == nil {
+		header, err := c.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		c.fields = make([]string, len(header))
+		for i, name := range header {
+			field := name
+			if mapped, ok := c.columns[name]; ok {
+				field = mapped
+			}
+			if field != "-" {
+				c.fields[i] = field
+			}
+		}
+	}
+
+	row, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	record := make(map[string]interface{})
+	for i, text := range row {
+		field := c.fields[i]
+		if field == "" {
+			continue
+		}
+		// The name is always text, so names such as "42" survive
+		if !c.infer || field == c.name {
+			if text != "" {
+				setPath(record, field, text)
+			}
+			continue
+		}
+		if val, ok := inferCell(text); ok {
+			setPath(record, field, val)
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,208 @@
+// Package transfer moves documents in and out of collections as JSON Lines,
+// JSON arrays or CSV, so data can be exchanged with other tools without
+// writing code against the document manager.
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Build-your-own-database/database/fieldcrypt"
+	"Build-your-own-database/database/models"
+)
+
+// Formats documents are exchanged in
+const (
+	JSONL = "jsonl" // One JSON object per line
+	JSON  = "json"  // A single JSON array of objects
+	CSV   = "csv"   // A header row naming fields, then one row per document
+)
+
+// NameField is the field of an exported record holding the document name
+const NameField = "_name"
+
+// defaultBatchSize is how many documents are handled between progress reports
+const defaultBatchSize = 1000
+
+// Progress reports how far an export or import has got
+type Progress struct {
+	Collection string `json:"collection"`
+	Documents  int    `json:"documents"`       // Documents written or records read so far
+	Total      int    `json:"total,omitempty"` // Documents to export, unknown for imports
+	Done       bool   `json:"done"`            // Set on the last report of the collection
+}
+
+// ExportOptions controls how a collection is exported
+type ExportOptions struct {
+	Format    string          // JSONL, JSON or CSV; JSONL when empty
+	Filter    models.Filter   // Export only the documents matching it
+	Fields    []string        // CSV columns in order, dotted for nested fields; default every field found
+	BatchSize int             // Documents written between flushes and progress reports
+	FieldKey  *fieldcrypt.Key // Exports encrypted fields in clear when set
+	Progress  func(Progress)  // Called after every batch, if set
+}
+
+// ImportOptions controls how records are turned into documents
+type ImportOptions struct {
+	Format    string            // JSONL, JSON or CSV; JSONL when empty
+	NameField string            // Field naming each document; NameField when empty. Other fields stay in the data.
+	Upsert    bool              // Replace documents whose name exists instead of failing
+	Columns   map[string]string // CSV header to field, dotted for nested fields; "-" skips the column
+	NoInfer   bool              // Keep every CSV value as a string instead of inferring numbers, booleans and JSON
+	BatchSize int               // Records read between progress reports
+	FieldKey  *fieldcrypt.Key   // Encrypts marked fields on the way in when set
+	Progress  func(Progress)    // Called after every batch, if set
+}
+
+// Result counts what an import did to a collection
+type Result struct {
+	Collection string `json:"collection"`
+	Inserted   int    `json:"inserted"`
+	Updated    int    `json:"updated"`
+}
+
+// FormatOf picks a format from a file name's extension, "" if none matches
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return JSONL
+	case ".json":
+		return JSON
+	case ".csv":
+		return CSV
+	}
+	return ""
+}
+
+// ParseColumns reads a CSV header mapping written as "header=field,...",
+// for ImportOptions.Columns
+func ParseColumns(spec string) (map[string]string, error) {
+	columns := make(map[string]string)
+	if spec == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		header, field, ok := strings.Cut(pair, "=")
+		if !ok || header == "" || field == "" {
+			return nil, fmt.Errorf("invalid column mapping '%s', expected header=field", pair)
+		}
+		columns[header] = field
+	}
+	return columns, nil
+}
+
+// checkFormat validates a format, defaulting to JSONL
+func checkFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return JSONL, nil
+	case JSONL, JSON, CSV:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid format '%s', expected %s, %s or %s", format, JSONL, JSON, CSV)
+}
+
+// batchSize returns size, or the default when it is not positive
+func batchSize(size int) int {
+	if size <= 0 {
+		return defaultBatchSize
+	}
+	return size
+}
+
+// flatten adds the fields of data to row under dotted names. Objects are
+// flattened; every other value, arrays included, is kept as it is.
+func flatten(prefix string, data map[string]interface{}, row map[string]interface{}) {
+	for key, val := range data {
+		if nested, ok := val.(map[string]interface{}); ok && len(nested) > 0 {
+			flatten(prefix+key+".", nested, row)
+			continue
+		}
+		row[prefix+key] = val
+	}
+}
+
+// columnsOf lists the flattened fields of every record, the name first and the rest sorted
+func columnsOf(records []map[string]interface{}) []string {
+	seen := map[string]bool{NameField: true}
+	var columns []string
+	for _, record := range records {
+		row := make(map[string]interface{})
+		flatten("", record, row)
+		for key := range row {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return append([]string{NameField}, columns...)
+}
+
+// formatCell renders a value as CSV text: strings as they are, nothing for
+// null or a missing field, and anything else as JSON
+func formatCell(val interface{}, ok bool) string {
+	if !ok || val == nil {
+		return ""
+	}
+	if s, isString := val.(string); isString {
+		return s
+	}
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(raw)
+}
+
+// inferCell turns CSV text back into a value: empty cells are skipped, and
+// numbers, booleans, null and JSON objects or arrays are recognised
+func inferCell(text string) (interface{}, bool) {
+	switch text {
+	case "":
+		return nil, false
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "null":
+		return nil, true
+	}
+	// Leading zeros mark codes such as "007", which stay text
+	digits := strings.TrimPrefix(text, "-")
+	if len(digits) < 2 || digits[0] != '0' || digits[1] == '.' {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil && !strings.ContainsAny(text, "xXnN") {
+			return f, true
+		}
+	}
+	if text[0] == '{' || text[0] == '[' {
+		var val interface{}
+		if err := json.Unmarshal([]byte(text), &val); err == nil {
+			return val, true
+		}
+	}
+	return text, true
+}
+
+// setPath stores a value under a dotted field name, creating nested objects
+func setPath(data map[string]interface{}, path string, val interface{}) {
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		data[path] = val
+		return
+	}
+	child, ok := data[head].(map[string]interface{})
+	if !ok {
+		child = make(map[string]interface{})
+		data[head] = child
+	}
+	setPath(child, rest, val)
+}
@@ -0,0 +1,279 @@
+package trash
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/storage"
+)
+
+// Dir is the directory under the storage root where deleted items are kept
+const Dir = ".trash"
+
+const (
+	entryFile = "entry.json" // Describes what was deleted
+	dataName  = "data"       // Holds the deleted file or directory, under its own name
+)
+
+// Kind is the level of the item that was deleted
+type Kind string
+
+const (
+	KindDatabase   Kind = "database"
+	KindCollection Kind = "collection"
+	KindDocument   Kind = "document"
+)
+
+// Entry describes one deleted item waiting in the trash
+type Entry struct {
+	ID         string    `json:"id"`                   // Trash entry ID, used to restore or purge
+	Kind       Kind      `json:"kind"`                 // What was deleted
+	Database   string    `json:"database"`             // Database the item belonged to (or was)
+	Collection string    `json:"collection,omitempty"` // Collection, for collections and documents
+	Name       string    `json:"name"`                 // Name of the deleted item
+	DocumentID string    `json:"documentId,omitempty"` // Internal ID, for documents
+	Path       string    `json:"path"`                 // Where the item lived before deletion
+	File       string    `json:"file,omitempty"`       // Where the item is kept, relative to the entry
+	DeletedAt  time.Time `json:"deletedAt"`
+}
+
+// Data returns the path of the deleted item in the trash entry's directory.
+// Entries from before items kept their names hold the item as "data" itself.
+func (e *Entry) Data(root string) string {
+	if e.File == "" {
+		return filepath.Join(root, Dir, e.ID, dataName)
+	}
+	return filepath.Join(root, Dir, e.ID, filepath.FromSlash(e.File))
+}
+
+// Move puts the file or directory at entry.Path into the trash under root.
+// It keeps its name, which encrypted files are sealed under.
+func Move(root string, entry Entry) (*Entry, error) {
+	entry.ID = newID()
+	entry.File = dataName + "/" + filepath.Base(entry.Path)
+	entry.DeletedAt = time.Now().UTC()
+
+	dir := filepath.Join(root, Dir, entry.ID)
+	if err := os.MkdirAll(filepath.Join(dir, dataName), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create trash entry: %v", err)
+	}
+	if err := writeEntry(dir, &entry); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := os.Rename(entry.Path, entry.Data(root)); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to move %s '%s' to trash: %v", entry.Kind, entry.Name, err)
+	}
+	return &entry, nil
+}
+
+// List returns every entry in the trash under root, oldest first
+func List(root string) ([]Entry, error) {
+	dirs, err := os.ReadDir(filepath.Join(root, Dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trash: %v", err)
+	}
+
+	var entries []Entry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		entry, err := Get(root, d.Name())
+		if err != nil {
+			fmt.Println("Skipping unreadable trash entry:", err)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt.Before(entries[j].DeletedAt) })
+	return entries, nil
+}
+
+// Get reads a single trash entry
+func Get(root, id string) (*Entry, error) {
+	if !validID(id) {
+		return nil, fmt.Errorf("invalid trash entry ID '%s'", id)
+	}
+	path := filepath.Join(root, Dir, id, entryFile)
+	raw, err := storage.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("trash entry '%s' does not exist", id)
+		}
+		return nil, err
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, storage.Corrupt(path, "invalid trash entry '%s': %v", id, err)
+	}
+	return &entry, nil
+}
+
+// Read returns the contents of a deleted file, as stored and still encoded,
+// without restoring it
+func Read(root, id string) ([]byte, error) {
+	entry, err := Get(root, id)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(entry.Data(root))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trash entry '%s': %v", id, err)
+	}
+	return raw, nil
+}
+
+// Restore moves an item back to the path it was deleted from.
+// It fails if something has since been created at that path.
+func Restore(root, id string) (*Entry, error) {
+	entry, err := Get(root, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(entry.Path); err == nil {
+		return nil, fmt.Errorf("cannot restore %s '%s': '%s' already exists", entry.Kind, entry.Name, entry.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.Path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to recreate parent of '%s': %v", entry.Path, err)
+	}
+
+	dir := filepath.Join(root, Dir, id)
+	if err := os.Rename(entry.Data(root), entry.Path); err != nil {
+		return nil, fmt.Errorf("failed to restore %s '%s': %v", entry.Kind, entry.Name, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("restored '%s' but failed to clear its trash entry: %v", entry.Name, err)
+	}
+	return entry, nil
+}
+
+// Discard removes a trash entry whose item has been restored other than by Restore
+func Discard(root, id string) error {
+	if !validID(id) {
+		return fmt.Errorf("invalid trash entry ID '%s'", id)
+	}
+	if err := os.RemoveAll(filepath.Join(root, Dir, id)); err != nil {
+		return fmt.Errorf("failed to clear trash entry '%s': %v", id, err)
+	}
+	return nil
+}
+
+// Purge permanently removes trash entries deleted more than olderThan ago,
+// limited to those match accepts when match is not nil. It returns how many were removed.
+func Purge(root string, olderThan time.Duration, match func(Entry) bool) (int, error) {
+	entries, err := List(root)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	purged := 0
+	for _, entry := range entries {
+		if entry.DeletedAt.After(cutoff) || (match != nil && !match(entry)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, Dir, entry.ID)); err != nil {
+			return purged, fmt.Errorf("failed to purge trash entry '%s': %v", entry.ID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Rewrite applies change to every entry under root, saving those it reports
+// changed. Used when what entries refer to moves, such as a renamed collection.
+func Rewrite(root string, change func(*Entry) bool) error {
+	entries, err := List(root)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if change(&entries[i]) {
+			if err := writeEntry(filepath.Join(root, Dir, entries[i].ID), &entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Upgrade moves the documents of entries from before items kept their names
+// under their names, so they can be sealed under them
+func Upgrade(root string) error {
+	entries, err := List(root)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if entry.File != "" || entry.Kind != KindDocument {
+			continue
+		}
+		dir := filepath.Join(root, Dir, entry.ID)
+		moved := filepath.Join(dir, filepath.Base(entry.Path))
+		if err := os.Rename(entry.Data(root), moved); err != nil {
+			return fmt.Errorf("failed to upgrade trash entry '%s': %v", entry.ID, err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, dataName), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to upgrade trash entry '%s': %v", entry.ID, err)
+		}
+		entry.File = dataName + "/" + filepath.Base(entry.Path)
+		if err := os.Rename(moved, entry.Data(root)); err != nil {
+			return fmt.Errorf("failed to upgrade trash entry '%s': %v", entry.ID, err)
+		}
+		if err := writeEntry(dir, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(dir string, entry *Entry) error {
+	raw, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFile(filepath.Join(dir, entryFile), raw); err != nil {
+		return fmt.Errorf("failed to write trash entry: %v", err)
+	}
+	return nil
+}
+
+// idTime is the layout of the deletion time that starts a trash entry ID
+const idTime = "20060102T150405.000000000"
+
+// newID returns a trash entry ID that sorts by deletion time
+func newID() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return time.Now().UTC().Format(idTime) + "-" + hex.EncodeToString(suffix)
+}
+
+// validID reports whether id has the form newID gives, so it names a
+// directory of the trash and nothing outside it
+func validID(id string) bool {
+	stamp, suffix, ok := strings.Cut(id, "-")
+	if !ok || len(stamp) != len(idTime) || len(suffix) != 8 {
+		return false
+	}
+	if _, err := time.Parse(idTime, stamp); err != nil {
+		return false
+	}
+	_, err := hex.DecodeString(suffix)
+	return err == nil
+}
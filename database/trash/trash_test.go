@@ -0,0 +1,66 @@
+package trash
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEntryIDs(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "shop", "items", "a.json")
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := Move(root, Entry{Kind: KindDocument, Database: "shop", Collection: "items", Name: "a", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An entry file outside the trash, which no ID may reach
+	outside := filepath.Join(root, "outside")
+	if err := os.MkdirAll(outside, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntry(outside, &Entry{ID: "../outside", Kind: KindDatabase, Name: "x", Path: filepath.Join(root, "x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr string
+	}{
+		{"from Move", entry.ID, ""},
+		{"well formed but missing", "20240601T120000.000000000-0badc0de", "does not exist"},
+		{"parent directory", "../outside", "invalid"},
+		{"nested parent directory", entry.ID + "/../../outside", "invalid"},
+		{"absolute", outside, "invalid"},
+		{"empty", "", "invalid"},
+		{"bad time", "20241301T120000.000000000-0badc0de", "invalid"},
+		{"bad suffix", "20240601T120000.000000000-0badc0dz", "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Get(root, tt.id)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Get(%q) error = %v", tt.id, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Get(%q) error = %v, want one saying %q", tt.id, err, tt.wantErr)
+			}
+			if tt.wantErr == "invalid" {
+				if err := Discard(root, tt.id); err == nil {
+					t.Errorf("Discard(%q) removed a path outside the trash", tt.id)
+				}
+			}
+		})
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("the directory outside the trash is gone: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package typed
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// TypedCollection stores values of a struct type T as documents of a collection.
+// Fields are converted using their json tags. A godb tag declares extra behaviour:
+//
+//	Email string `json:"email" godb:"index,unique"` // index the field, rejecting duplicates
+//	ID    string `json:"id" godb:"name"`            // use the field as the document name
+type TypedCollection[T any] struct {
+	docs      *documents.DocumentManager
+	nameField string // JSON name of the field tagged godb:"name"
+}
+
+// fieldSpec is the parsed godb tag of a single struct field
+type fieldSpec struct {
+	jsonName string
+	name     bool
+	index    bool
+	unique   bool
+}
+
+// NewTypedCollection opens the named collection, creating it if needed,
+// and declares the indexes requested by T's struct tags
+func NewTypedCollection[T any](cm *collections.CollectionManager, name string) (*TypedCollection[T], error) {
+	specs, err := parseTags(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := cm.UseCollection(name)
+	if err != nil {
+		if collection, err = cm.CreateCollection(name); err != nil {
+			return nil, err
+		}
+	}
+
+	tc := &TypedCollection[T]{docs: documents.NewDocumentManager(collection).WithContext(cm.Context())}
+	for _, spec := range specs {
+		if spec.name {
+			tc.nameField = spec.jsonName
+		}
+		if spec.index || spec.unique {
+			if err := cm.CreateIndex(name, spec.jsonName, spec.unique); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tc, nil
+}
+
+// Insert stores a value as a new document named after its godb:"name" field
+func (tc *TypedCollection[T]) Insert(value T) (*models.Document, error) {
+	data, err := toData(value)
+	if err != nil {
+		return nil, err
+	}
+	if tc.nameField == "" {
+		return nil, fmt.Errorf("type %T has no field tagged godb:\"name\"", value)
+	}
+	name := fmt.Sprint(data[tc.nameField])
+	if data[tc.nameField] == nil || name == "" {
+		return nil, fmt.Errorf("field '%s' must be set to insert a document", tc.nameField)
+	}
+	return tc.docs.CreateDocument(name, data)
+}
+
+// Get loads the document with the given name into a T
+func (tc *TypedCollection[T]) Get(name string) (T, error) {
+	var value T
+	doc, err := tc.docs.UseDocument(name)
+	if err != nil {
+		return value, err
+	}
+	return fromData[T](doc.Data)
+}
+
+// Find returns every document matching the filter, decoded into T
+func (tc *TypedCollection[T]) Find(filter models.Filter) ([]T, error) {
+	docs, err := tc.docs.FindDocuments(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]T, 0, len(docs))
+	for _, doc := range docs {
+		value, err := fromData[T](doc.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode document '%s': %v", doc.Name, err)
+		}
+		results = append(results, value)
+	}
+	return results, nil
+}
+
+// Delete removes the document with the given name
+func (tc *TypedCollection[T]) Delete(name string) error {
+	return tc.docs.DeleteDocument(name)
+}
+
+// toData converts a value to document data through its json tags
+func toData(value interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %T: %v", value, err)
+	}
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("%T does not encode to a JSON object: %v", value, err)
+	}
+	return data, nil
+}
+
+// fromData converts document data back into a T
+func fromData[T any](data map[string]interface{}) (T, error) {
+	var value T
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return value, err
+	}
+	err = json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// parseTags reads the godb tags of a struct type (or pointer to one)
+func parseTags(t reflect.Type) ([]fieldSpec, error) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("typed collections need a struct type, got %s", t)
+	}
+
+	var specs []fieldSpec
+	names := 0
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("godb")
+		if !ok || !field.IsExported() {
+			continue
+		}
+
+		spec := fieldSpec{jsonName: field.Name}
+		if jsonTag := field.Tag.Get("json"); jsonTag != "" {
+			jsonName, _, _ := strings.Cut(jsonTag, ",")
+			if jsonName == "-" {
+				return nil, fmt.Errorf("field %s has a godb tag but is not stored", field.Name)
+			}
+			if jsonName != "" {
+				spec.jsonName = jsonName
+			}
+		}
+
+		for _, opt := range strings.Split(tag, ",") {
+			switch strings.TrimSpace(opt) {
+			case "name":
+				spec.name = true
+				names++
+			case "index":
+				spec.index = true
+			case "unique":
+				spec.unique = true
+			case "":
+			default:
+				return nil, fmt.Errorf("unknown godb tag option '%s' on field %s", opt, field.Name)
+			}
+		}
+		specs = append(specs, spec)
+	}
+
+	if names > 1 {
+		return nil, fmt.Errorf("%s has more than one field tagged godb:\"name\"", t)
+	}
+	return specs, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"Build-your-own-database/database/collections"
 	"Build-your-own-database/database/db"
@@ -9,8 +10,14 @@ import (
 )
 
 func main() {
+	// Subcommands such as "serve" replace the walkthrough below
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
 	// Initialize DB Manager
 	dbManager := db.NewDBManager()
+	defer dbManager.Close()
 
 	dbName := "test_db"
 	colName := "test_collection"
@@ -0,0 +1,488 @@
+// Package cluster runs a storage root as one member of a Raft cluster of, in
+// practice, three or five nodes. The members elect a leader, which alone takes
+// writes. Every change its managers propose is appended to the Raft log first
+// and made only once a majority of the members has stored it, in log order,
+// so the leader never holds a change the cluster could lose. The others apply
+// committed changes in the same order, through DBManager.Apply, and every
+// member records them in its change log under the leader's LSNs, so every
+// member's change log is the same entry for entry and any of them can take
+// over.
+//
+// The Raft log is compacted into snapshots. A snapshot is the storage root
+// itself as of a change log position, so a member that falls behind the
+// compacted part catches up by replaying the leader's change log from its own
+// position. Reads are served locally by default; Barrier makes them
+// linearizable by first confirming leadership with a majority and waiting for
+// the node to apply everything committed by then. Members are added and
+// removed one at a time through the log.
+//
+// Members talk over TCP with JSON messages, one request and one response per
+// line, after a hello carrying the cluster's shared key. A member's address is
+// its identity.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"Build-your-own-database/database/changes"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// Roles a node reports
+const (
+	RoleFollower  = "follower"  // Applies the leader's changes and refuses writes
+	RoleCandidate = "candidate" // Asking for votes to become leader
+	RoleLeader    = "leader"    // Takes writes and replicates them
+)
+
+// maxBatch is how many entries, or changes while catching up, go in one request
+const maxBatch = 64
+
+// Status describes a node's part in the cluster
+type Status struct {
+	ID       string         `json:"id"` // This node's cluster address
+	Role     string         `json:"role"`
+	Term     uint64         `json:"term"`
+	Leader   string         `json:"leader,omitempty"`
+	Writable bool           `json:"writable"` // Whether this node takes writes now
+	Members  []MemberStatus `json:"members"`
+	Commit   uint64         `json:"commitIndex"`
+	Applied  uint64         `json:"appliedIndex"`
+	Last     uint64         `json:"lastIndex"`
+	LSN      uint64         `json:"lsn"` // Last change in this node's change log
+	Snapshot SnapshotStatus `json:"snapshot"`
+	Error    string         `json:"error,omitempty"` // Why the node stopped applying changes
+}
+
+// MemberStatus is a node's view of one member. Match and LastContact are only
+// known to the leader.
+type MemberStatus struct {
+	Address     string     `json:"address"`
+	Match       uint64     `json:"matchIndex,omitempty"`  // Last entry known to be stored on the member
+	LastContact *time.Time `json:"lastContact,omitempty"` // When the member last answered the leader
+}
+
+// SnapshotStatus describes the last snapshot the Raft log was compacted to
+type SnapshotStatus struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	LSN   uint64 `json:"lsn"`
+}
+
+// Node is a storage root's membership in a cluster
+type Node struct {
+	dbm  *db.DBManager
+	log  *changes.Log
+	root string
+	addr string
+
+	// Key is the shared secret members present to each other; empty for none
+	Key string
+	// Heartbeat is how often the leader contacts idle members
+	Heartbeat time.Duration
+	// ElectionTimeout is how long a follower waits without hearing from a
+	// leader before calling an election, randomised up to twice as long. A
+	// leader that has not heard from a majority for as long steps down.
+	ElectionTimeout time.Duration
+	// Timeout bounds requests to other members, and how long writes, reads
+	// and membership changes wait for the cluster
+	Timeout time.Duration
+	// SnapshotEvery is how many applied entries the Raft log keeps before it is compacted
+	SnapshotEvery uint64
+	// RetryInterval is how long Join waits between attempts
+	RetryInterval time.Duration
+
+	ctx    context.Context // Ends every loop when the node is closed
+	cancel context.CancelFunc
+
+	applyMu sync.Mutex // Held while applying changes, by the applier or a snapshot
+
+	mu       sync.Mutex
+	raft     *raftLog
+	role     string
+	term     uint64
+	votedFor string
+	leader   string
+	members  []string  // Configuration in effect: the last one in the log
+	contact  time.Time // When a leader or a candidate granted a vote was last heard from
+	timeout  time.Duration
+	commit   uint64
+	applied  uint64
+	lsn      uint64 // LSN of the last change applied
+	ready    bool   // Set once a leader has applied every earlier entry and takes writes
+	diverged error  // Set once the node's changes are found to differ from the cluster's
+	signal   chan struct{}
+	wake     chan struct{} // Wakes the applier
+
+	// Leader state, reset each term
+	termCtx   context.Context    // Ends with the term, for its replicators and proposals
+	stop      context.CancelFunc // Ends termCtx
+	peers     map[string]*replicator
+	proposed  uint64               // LSN of the last change proposed
+	proposals map[uint64]*proposal // Changes waiting to be made, by Raft index
+	clients   map[string]*client
+}
+
+// proposal is a change the leader's managers wait to make until it commits
+type proposal struct {
+	turn     chan struct{} // Closed once the change is committed and every one before it applied
+	finished chan error    // Receives whether the change was made
+}
+
+var (
+	nodesMu sync.Mutex
+	nodes   = make(map[string]*Node)
+)
+
+func init() {
+	models.OnPropose(propose)
+}
+
+// propose holds up a change to a cluster node's storage root until the
+// cluster has committed it
+func propose(event *models.ChangeEvent) (func(error), error) {
+	if event.Root == "" {
+		return nil, nil
+	}
+	root, err := filepath.Abs(event.Root)
+	if err != nil {
+		return nil, nil
+	}
+	nodesMu.Lock()
+	n := nodes[root]
+	nodesMu.Unlock()
+	if n == nil {
+		return nil, nil
+	}
+	return n.propose(event)
+}
+
+// New creates the cluster node of a DBManager's storage root, reachable by
+// other members at addr, which is also its identity in the cluster. Its
+// managers refuse writes until it is elected leader. A node that has never
+// been part of a cluster waits to be bootstrapped or added to one.
+func New(dbm *db.DBManager, addr string) (*Node, error) {
+	if host, _, err := net.SplitHostPort(addr); err != nil || host == "" {
+		return nil, fmt.Errorf("invalid cluster address '%s': give a host and port other members can reach, e.g. 127.0.0.1:7500", addr)
+	}
+	root, err := filepath.Abs(dbm.Root())
+	if err != nil {
+		return nil, err
+	}
+	log, err := changes.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	raft, st, err := openLog(root)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		dbm:             dbm,
+		log:             log,
+		root:            root,
+		addr:            addr,
+		Heartbeat:       100 * time.Millisecond,
+		ElectionTimeout: time.Second,
+		Timeout:         5 * time.Second,
+		SnapshotEvery:   1000,
+		RetryInterval:   2 * time.Second,
+		ctx:             ctx,
+		cancel:          cancel,
+		raft:            raft,
+		role:            RoleFollower,
+		term:            st.Term,
+		votedFor:        st.VotedFor,
+		commit:          raft.snapshot.Index,
+		applied:         raft.snapshot.Index,
+		lsn:             raft.snapshot.LSN,
+		contact:         time.Now(),
+		wake:            make(chan struct{}, 1),
+		clients:         make(map[string]*client),
+	}
+	n.members = n.configAt(raft.lastIndex())
+	n.resetTimeout()
+
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	if nodes[root] != nil {
+		cancel()
+		raft.close()
+		return nil, fmt.Errorf("storage root '%s' already has a cluster node", root)
+	}
+	if err := storage.SetReadOnly(root, n.readOnlyReason()); err != nil {
+		cancel()
+		raft.close()
+		return nil, err
+	}
+	nodes[root] = n
+	return n, nil
+}
+
+// Bootstrap makes the node one of the founding members of a new cluster. Every
+// founding member must be bootstrapped with the same members, from an empty
+// storage root, unless it is the only one: a single member may start from a
+// root that already holds data, and grow by adding members that copy it. A
+// node that already belongs to a cluster ignores Bootstrap.
+func (n *Node) Bootstrap(members []string) error {
+	members = normalize(members)
+	if !slices.Contains(members, n.addr) {
+		return fmt.Errorf("invalid bootstrap: members %v do not include this node, %s", members, n.addr)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.term > 0 || n.raft.lastIndex() > 0 {
+		return nil
+	}
+	lsn := n.log.LastLSN()
+	if lsn > 0 && len(members) > 1 {
+		return fmt.Errorf("invalid bootstrap: this storage root already holds changes; bootstrap a one-member cluster on it and add the other members, which copy it")
+	}
+
+	// The configuration goes in as a snapshot of the root as it is, so members
+	// added later copy the changes already in it
+	snap := snapshot{Index: 1, Term: 1, LSN: lsn, Members: members}
+	if err := n.raft.compact(snap); err != nil {
+		return err
+	}
+	if err := n.raft.saveState(state{Term: 1}); err != nil {
+		return err
+	}
+	n.term = 1
+	n.commit, n.applied, n.lsn = 1, 1, lsn
+	n.members = members
+	fmt.Printf("Bootstrapped cluster with members %v\n", members)
+	return nil
+}
+
+// Status reports the node's role, its view of the members and how far it has got
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	status := Status{
+		ID:       n.addr,
+		Role:     n.role,
+		Term:     n.term,
+		Leader:   n.leader,
+		Writable: n.role == RoleLeader && n.ready,
+		Members:  []MemberStatus{},
+		Commit:   n.commit,
+		Applied:  n.applied,
+		Last:     n.raft.lastIndex(),
+		LSN:      n.log.LastLSN(),
+		Snapshot: SnapshotStatus{Index: n.raft.snapshot.Index, Term: n.raft.snapshot.Term, LSN: n.raft.snapshot.LSN},
+	}
+	if n.diverged != nil {
+		status.Error = n.diverged.Error()
+	}
+	for _, addr := range n.members {
+		member := MemberStatus{Address: addr}
+		if n.role == RoleLeader {
+			if addr == n.addr {
+				member.Match = n.raft.lastIndex()
+			} else if p := n.peers[addr]; p != nil {
+				contact := p.contact
+				member.Match = p.match
+				if !contact.IsZero() {
+					member.LastContact = &contact
+				}
+			}
+		}
+		status.Members = append(status.Members, member)
+	}
+	return status
+}
+
+// Close stops the node taking part in the cluster. Its storage root stays read-only.
+func (n *Node) Close() {
+	n.cancel()
+	n.mu.Lock()
+	n.stepDown(n.term)
+	clients := n.clients
+	n.clients = make(map[string]*client)
+	n.mu.Unlock()
+	for _, c := range clients {
+		c.close()
+	}
+	n.mu.Lock()
+	n.raft.close()
+	n.mu.Unlock()
+
+	nodesMu.Lock()
+	delete(nodes, n.root)
+	nodesMu.Unlock()
+}
+
+// changed returns a channel closed the next time the node's state moves on;
+// the caller holds mu
+func (n *Node) changed() <-chan struct{} {
+	if n.signal == nil {
+		n.signal = make(chan struct{})
+	}
+	return n.signal
+}
+
+// notify wakes everything waiting on changed; the caller holds mu
+func (n *Node) notify() {
+	if n.signal != nil {
+		close(n.signal)
+		n.signal = nil
+	}
+}
+
+// propose appends a change to the Raft log, giving it the next LSN, and waits
+// until it is committed and every entry before it applied. The change is made
+// only then, by the caller, which tells the applier through the function
+// returned. The caller holds its collection's lock meanwhile, so a leader
+// that cannot commit within Timeout steps down rather than keep writers
+// waiting. A change whose fate is left open that way, or by losing the
+// leadership, is withdrawn with a PendingError: the caller rolls back, and
+// this node makes the change as a follower should the cluster commit it.
+func (n *Node) propose(event *models.ChangeEvent) (func(error), error) {
+	e, err := n.changeEntry(*event)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	if reason := n.readOnlyReason(); reason != "" {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", storage.ErrReadOnly, reason)
+	}
+	event.LSN = n.proposed + 1
+	e.Event.LSN = event.LSN
+	e.Index, e.Term = n.raft.lastIndex()+1, n.term
+	if err := n.raft.append(e); err != nil {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("failed to propose change: %v", err)
+	}
+	n.proposed = event.LSN
+	p := &proposal{turn: make(chan struct{}), finished: make(chan error, 1)}
+	n.proposals[e.Index] = p
+	ended := n.termCtx.Done()
+	n.wakeReplicators()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	finish := func(err error) { p.finished <- err }
+	deadline := time.NewTimer(n.Timeout)
+	defer deadline.Stop()
+	var reason string
+	select {
+	case <-p.turn:
+		return finish, nil
+	case <-deadline.C:
+		reason = fmt.Sprintf("a majority of the cluster did not store it within %v", n.Timeout)
+	case <-ended:
+		reason = "this node is no longer the cluster leader"
+	case <-n.ctx.Done():
+		reason = "the cluster node was closed"
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-p.turn:
+		return finish, nil
+	default:
+	}
+	if n.proposals[e.Index] == p {
+		delete(n.proposals, e.Index)
+	}
+	// Only a follower can leave the change to the cluster: a leader would go
+	// on to take writes based on a state without it
+	select {
+	case <-ended:
+	default:
+		fmt.Printf("Stepping down as cluster leader: change at LSN %d was not committed, as %s\n", event.LSN, reason)
+		n.stepDown(n.term)
+	}
+	return nil, &models.PendingError{Err: fmt.Errorf("change at LSN %d is pending: %s; it was not made here, and the cluster makes it only should it commit", event.LSN, reason)}
+}
+
+// readOnlyReason says why the node refuses writes, or is empty while it takes
+// them; the caller holds mu
+func (n *Node) readOnlyReason() string {
+	switch {
+	case n.diverged != nil:
+		return fmt.Sprintf("this node has left the cluster: %v", n.diverged)
+	case n.role == RoleLeader && n.ready:
+		return ""
+	case n.role == RoleLeader:
+		return "this node was just elected cluster leader and is still applying earlier changes; retry shortly"
+	case n.leader != "":
+		return fmt.Sprintf("this node is a cluster follower; send writes to the leader at %s", n.leader)
+	case len(n.members) == 0:
+		return "this node has not joined a cluster yet"
+	}
+	return "the cluster has no leader yet; retry shortly"
+}
+
+// updateWritable lets the storage root take writes only while the node is a
+// ready leader; the caller holds mu
+func (n *Node) updateWritable() {
+	storage.SetReadOnly(n.root, n.readOnlyReason())
+}
+
+// configAt returns the configuration in effect at index: the last one in the
+// log up to it, or the snapshot's; the caller holds mu
+func (n *Node) configAt(index uint64) []string {
+	for i := min(index, n.raft.lastIndex()); i > n.raft.snapshot.Index; i-- {
+		if e := n.raft.entries[i-n.raft.snapshot.Index-1]; e.Type == entryMembers {
+			return e.Members
+		}
+	}
+	return n.raft.snapshot.Members
+}
+
+// pendingConfig reports whether the configuration in effect is not committed
+// yet; the caller holds mu
+func (n *Node) pendingConfig() bool {
+	for i := n.raft.lastIndex(); i > n.commit && i > n.raft.snapshot.Index; i-- {
+		if n.raft.entries[i-n.raft.snapshot.Index-1].Type == entryMembers {
+			return true
+		}
+	}
+	return false
+}
+
+// isMember reports whether addr is a voting member; the caller holds mu
+func (n *Node) isMember(addr string) bool {
+	return slices.Contains(n.members, addr)
+}
+
+// quorum returns how many members make a majority; the caller holds mu
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+// resetTimeout picks a new random election timeout; the caller holds mu
+func (n *Node) resetTimeout() {
+	n.timeout = n.ElectionTimeout + time.Duration(rand.Int63n(int64(n.ElectionTimeout)))
+}
+
+// normalize sorts member addresses and drops duplicates and blanks
+func normalize(members []string) []string {
+	var out []string
+	for _, m := range members {
+		if m = strings.TrimSpace(m); m != "" && !slices.Contains(out, m) {
+			out = append(out, m)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
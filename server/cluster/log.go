@@ -0,0 +1,325 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// Dir is the directory under the storage root that holds a node's Raft state
+const Dir = ".raft"
+
+const (
+	logFile      = "log"
+	stateFile    = "state.json"
+	snapshotFile = "snapshot.json"
+)
+
+// Entry types
+const (
+	entryChange  = "change"  // A change event to apply
+	entryMembers = "members" // A new configuration, in effect from when it is appended
+	entryNoop    = "noop"    // Appended by each new leader so entries of earlier terms can commit
+)
+
+// entry is one record of the Raft log
+type entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"`
+
+	Event      *models.ChangeEvent `json:"event,omitempty"`
+	Dictionary []byte              `json:"dictionary,omitempty"` // Compression dictionary the event configures
+	Members    []string            `json:"members,omitempty"`    // Every voting member, for configurations
+}
+
+// state is what a node must remember across restarts to vote safely
+type state struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// snapshot marks the point the Raft log was compacted to. The state it
+// stands for is the storage root itself, as of the change at LSN.
+type snapshot struct {
+	Index   uint64   `json:"index"` // Last entry the snapshot replaces
+	Term    uint64   `json:"term"`  // Term of that entry
+	LSN     uint64   `json:"lsn"`   // Last change applied up to that entry
+	Members []string `json:"members"`
+}
+
+// raftLog holds the entries after the last snapshot, in memory and in a file
+// of one encoded entry per line. It is guarded by the node's mutex.
+type raftLog struct {
+	dir      string
+	file     *os.File
+	size     int64
+	offsets  []int64 // offsets[i] is where entries[i] starts in the file
+	snapshot snapshot
+	entries  []entry
+}
+
+// openLog loads the Raft log kept under a storage root, creating it if needed
+func openLog(root string) (*raftLog, state, error) {
+	l := &raftLog{dir: filepath.Join(root, Dir)}
+	var st state
+	if err := os.MkdirAll(l.dir, os.ModePerm); err != nil {
+		return nil, st, fmt.Errorf("failed to create Raft directory: %v", err)
+	}
+	if err := readJSON(filepath.Join(l.dir, stateFile), &st); err != nil {
+		return nil, st, err
+	}
+	if err := readJSON(filepath.Join(l.dir, snapshotFile), &l.snapshot); err != nil {
+		return nil, st, err
+	}
+	if err := l.load(); err != nil {
+		return nil, st, err
+	}
+	return l, st, nil
+}
+
+// load reads the entries in the log file and opens it for appending. A torn
+// final line, left by a crash mid-append, is cut off.
+func (l *raftLog) load() error {
+	path := filepath.Join(l.dir, logFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open Raft log: %v", err)
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to read Raft log: %v", err)
+		}
+		e, err := decodeEntry(path, line)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		// Entries the snapshot covers are left behind by a crash while compacting
+		if e.Index > l.snapshot.Index {
+			if e.Index != l.lastIndex()+1 {
+				file.Close()
+				return storage.Corrupt(path, "entry %d does not follow entry %d", e.Index, l.lastIndex())
+			}
+			l.entries = append(l.entries, e)
+			l.offsets = append(l.offsets, offset)
+		}
+		offset += int64(len(line))
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to repair Raft log: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = offset
+	return nil
+}
+
+// lastIndex returns the index of the last entry, or of the snapshot when there is none
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshot.Index + uint64(len(l.entries))
+}
+
+// lastTerm returns the term of the last entry, or of the snapshot when there is none
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapshot.Term
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, which must not be before the snapshot
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	switch {
+	case index == l.snapshot.Index:
+		return l.snapshot.Term, true
+	case index < l.snapshot.Index || index > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[index-l.snapshot.Index-1].Term, true
+}
+
+// at returns the entry at index, which must be in the log
+func (l *raftLog) at(index uint64) entry {
+	return l.entries[index-l.snapshot.Index-1]
+}
+
+// slice returns up to max entries starting at index, which must follow the snapshot
+func (l *raftLog) slice(index uint64, max int) []entry {
+	if index <= l.snapshot.Index || index > l.lastIndex() {
+		return nil
+	}
+	entries := l.entries[index-l.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]entry(nil), entries...)
+}
+
+// append writes entries, which must follow the last one, and syncs the file
+func (l *raftLog) append(entries ...entry) error {
+	path := filepath.Join(l.dir, logFile)
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		line, err := encodeEntry(path, e)
+		if err != nil {
+			return fmt.Errorf("failed to encode Raft entry: %v", err)
+		}
+		offsets = append(offsets, l.size+int64(buf.Len()))
+		buf.Write(line)
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to append to Raft log: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync Raft log: %v", err)
+	}
+	l.entries = append(l.entries, entries...)
+	l.offsets = append(l.offsets, offsets...)
+	l.size += int64(buf.Len())
+	return nil
+}
+
+// truncate removes the entry at index and every entry after it
+func (l *raftLog) truncate(index uint64) error {
+	if index <= l.snapshot.Index || index > l.lastIndex() {
+		return nil
+	}
+	i := index - l.snapshot.Index - 1
+	if err := l.file.Truncate(l.offsets[i]); err != nil {
+		return fmt.Errorf("failed to truncate Raft log: %v", err)
+	}
+	if _, err := l.file.Seek(l.offsets[i], io.SeekStart); err != nil {
+		return err
+	}
+	l.size = l.offsets[i]
+	l.entries = l.entries[:i]
+	l.offsets = l.offsets[:i]
+	return nil
+}
+
+// compact records a snapshot and drops the entries it covers, keeping those
+// after it when the log holds the snapshot's last entry, and none otherwise.
+// The snapshot is saved before the file is rewritten, so a crash in between
+// leaves entries load skips.
+func (l *raftLog) compact(snap snapshot) error {
+	var keep []entry
+	if term, ok := l.term(snap.Index); ok && term == snap.Term && snap.Index < l.lastIndex() {
+		keep = l.slice(snap.Index+1, len(l.entries))
+	}
+	if err := writeJSON(filepath.Join(l.dir, snapshotFile), snap); err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.dir, logFile)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to compact Raft log: %v", err)
+	}
+	old := l.file
+	l.file, l.size, l.offsets, l.entries = file, 0, nil, nil
+	l.snapshot = snap
+	if err := l.append(keep...); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		file.Close()
+		l.file = old
+		return fmt.Errorf("failed to compact Raft log: %v", err)
+	}
+	old.Close()
+	return nil
+}
+
+// saveState records the current term and vote
+func (l *raftLog) saveState(st state) error {
+	return writeJSON(filepath.Join(l.dir, stateFile), st)
+}
+
+// close closes the log file
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
+
+// encodeEntry turns an entry into a log line: the base64 of its JSON framed,
+// checksummed and, when the storage root is encrypted, sealed like a stored file
+func encodeEntry(path string, e entry) ([]byte, error) {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	framed, err := storage.Encode(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(base64.StdEncoding.EncodeToString(framed)), '\n'), nil
+}
+
+// decodeEntry reads a log line written by encodeEntry
+func decodeEntry(path string, line []byte) (entry, error) {
+	var e entry
+	framed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSuffix(line, []byte("\n"))))
+	if err != nil {
+		return e, storage.Corrupt(path, "undecodable Raft entry")
+	}
+	raw, err := storage.DecodeEntry(path, framed)
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return e, storage.Corrupt(path, "invalid Raft entry: %v", err)
+	}
+	return e, nil
+}
+
+// readJSON decodes a file written by writeJSON into v, leaving v as it is when
+// the file does not exist
+func readJSON(path string, v interface{}) error {
+	raw, err := storage.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(path), err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return storage.Corrupt(path, "invalid %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// writeJSON replaces a file with the JSON of v
+func writeJSON(path string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFile(path, append(raw, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Barrier waits until this node has applied every change the cluster had
+// committed when Barrier was called, so a read made after it sees every write
+// acknowledged before it: a linearizable read. The leader first confirms it
+// still leads by hearing from a majority; a follower asks the leader how far
+// the log is committed.
+func (n *Node) Barrier(ctx context.Context) error {
+	index, err := n.readIndex()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.NewTimer(n.Timeout)
+	defer deadline.Stop()
+	for {
+		n.mu.Lock()
+		applied, diverged := n.applied, n.diverged
+		changed := n.changed()
+		n.mu.Unlock()
+		if diverged != nil {
+			return diverged
+		}
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("failed to read: this node did not catch up with the cluster within %v", n.Timeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readIndex returns the commit index as of now, once the leader has confirmed
+// no other leader could have committed past it
+func (n *Node) readIndex() (uint64, error) {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		c, err := n.leaderClient()
+		n.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		var reply readResponse
+		if err := c.call(reqRead, struct{}{}, &reply, n.Timeout); err != nil {
+			return 0, fmt.Errorf("failed to read through cluster leader %s: %v", c.addr, err)
+		}
+		return reply.Index, nil
+	}
+	defer n.mu.Unlock()
+	if !n.ready {
+		return 0, fmt.Errorf("failed to read: %s", n.readOnlyReason())
+	}
+
+	index, term, start := n.commit, n.term, time.Now()
+	n.wakeReplicators()
+	deadline := time.NewTimer(n.Timeout)
+	defer deadline.Stop()
+	for {
+		if n.role != RoleLeader || n.term != term {
+			return 0, fmt.Errorf("failed to read: this node lost the cluster leadership")
+		}
+		count := 0
+		for _, addr := range n.members {
+			if p := n.peers[addr]; addr == n.addr || p != nil && !p.contact.Before(start) {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			return index, nil
+		}
+
+		changed := n.changed()
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+		}
+		n.mu.Lock()
+		if time.Since(start) >= n.Timeout {
+			return 0, fmt.Errorf("failed to read: a majority of the cluster did not answer within %v", n.Timeout)
+		}
+	}
+}
+
+// leaderClient returns the client of the current leader; the caller holds mu
+func (n *Node) leaderClient() (*client, error) {
+	if n.leader == "" {
+		return nil, fmt.Errorf("the cluster has no leader yet; retry shortly")
+	}
+	return n.clientFor(n.leader), nil
+}
+
+// AddMember adds a node, already listening at addr, to the cluster and
+// returns the members once the change is committed. It counts toward
+// majorities at once, while it copies the leader's changes, so add members
+// one at a time. A follower passes the change on to the leader.
+func (n *Node) AddMember(addr string) ([]string, error) {
+	return n.changeMembers(membersRequest{Add: addr})
+}
+
+// RemoveMember removes a member from the cluster and returns the members once
+// the change is committed. A leader that removes itself steps down once it is.
+func (n *Node) RemoveMember(addr string) ([]string, error) {
+	return n.changeMembers(membersRequest{Remove: addr})
+}
+
+// changeMembers appends a configuration adding or removing one member, on
+// the leader, and waits for it to commit
+func (n *Node) changeMembers(args membersRequest) ([]string, error) {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		c, err := n.leaderClient()
+		n.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		var reply membersResponse
+		if err := c.call(reqMembers, args, &reply, n.Timeout); err != nil {
+			if isRemote(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to reach cluster leader %s: %v", c.addr, err)
+		}
+		return reply.Members, nil
+	}
+	defer n.mu.Unlock()
+	if !n.ready {
+		return nil, fmt.Errorf("failed to change members: %s", n.readOnlyReason())
+	}
+	if n.pendingConfig() {
+		return nil, fmt.Errorf("invalid membership change: the previous one is not committed yet; retry shortly")
+	}
+
+	members := slices.Clone(n.members)
+	switch {
+	case args.Add != "":
+		if host, _, err := net.SplitHostPort(args.Add); err != nil || host == "" {
+			return nil, fmt.Errorf("invalid cluster address '%s': give a host and port other members can reach, e.g. 127.0.0.1:7500", args.Add)
+		}
+		if slices.Contains(members, args.Add) {
+			return nil, fmt.Errorf("cluster member %s already exists", args.Add)
+		}
+		members = normalize(append(members, args.Add))
+	case args.Remove != "":
+		if !slices.Contains(members, args.Remove) {
+			return nil, fmt.Errorf("cluster member %s does not exist", args.Remove)
+		}
+		if len(members) == 1 {
+			return nil, fmt.Errorf("invalid membership change: %s is the last member", args.Remove)
+		}
+		members = slices.DeleteFunc(members, func(m string) bool { return m == args.Remove })
+	default:
+		return nil, fmt.Errorf("invalid membership change: name a member to add or remove")
+	}
+
+	// Only a majority of the new members can commit the change, so it must be
+	// able to reach one. A member being added is taken to be listening.
+	reachable := 0
+	for _, addr := range members {
+		if p := n.peers[addr]; addr == n.addr || addr == args.Add || p != nil && time.Since(p.contact) < n.ElectionTimeout {
+			reachable++
+		}
+	}
+	if reachable < len(members)/2+1 {
+		return nil, fmt.Errorf("invalid membership change: only %d of the %d members it leaves answer, fewer than a majority; bring members back first", reachable, len(members))
+	}
+
+	e := entry{Index: n.raft.lastIndex() + 1, Term: n.term, Type: entryMembers, Members: members}
+	if err := n.raft.append(e); err != nil {
+		return nil, err
+	}
+	n.members = members
+	fmt.Printf("Changing cluster members to %v\n", members)
+	term, start := n.term, time.Now()
+	n.startReplicators(n.termCtx)
+	n.wakeReplicators()
+	n.advanceCommit()
+
+	deadline := time.NewTimer(n.Timeout)
+	defer deadline.Stop()
+	for n.commit < e.Index {
+		if n.role != RoleLeader || n.term != term {
+			return nil, fmt.Errorf("failed to change members: this node lost the cluster leadership, so the change may be lost")
+		}
+		if time.Since(start) >= n.Timeout {
+			return nil, fmt.Errorf("failed to change members: a majority of the cluster did not store the change within %v", n.Timeout)
+		}
+		changed := n.changed()
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+		}
+		n.mu.Lock()
+	}
+	return members, nil
+}
+
+// Join asks the member at addr to add this node to its cluster, retrying
+// until it is added, or found to be a member already, or the node is closed
+func (n *Node) Join(addr string) {
+	for {
+		n.mu.Lock()
+		c := n.clientFor(addr)
+		n.mu.Unlock()
+		var reply membersResponse
+		err := c.call(reqMembers, membersRequest{Add: n.addr}, &reply, n.Timeout)
+		switch {
+		case err == nil:
+			fmt.Printf("Joined the cluster through %s; members are %v\n", addr, reply.Members)
+			return
+		case strings.Contains(err.Error(), "already exists"):
+			return
+		}
+
+		fmt.Printf("Failed to join the cluster through %s, retrying in %v: %v\n", addr, n.RetryInterval, err)
+		select {
+		case <-time.After(n.RetryInterval):
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,757 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// errStopped ends a leader's loops once it is no longer the leader of their term
+var errStopped = errors.New("no longer the leader of this term")
+
+// replicator is the leader's view of one other member
+type replicator struct {
+	addr    string
+	next    uint64    // Next entry to send
+	match   uint64    // Last entry known to be stored on the member
+	lsn     uint64    // The member's last change, as it last reported
+	contact time.Time // When the last request the member answered was sent
+	wake    chan struct{}
+}
+
+// hold names the change log's hold on the changes a member may still need
+// from this leader's log to catch up
+func (p *replicator) hold() string {
+	return "cluster member " + p.addr
+}
+
+// Start runs the node's election timer and applies committed entries.
+// ListenAndServe calls it; call it directly only with Serve.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetTimeout()
+	n.contact = time.Now()
+	n.mu.Unlock()
+
+	go n.run()
+	go n.applier()
+	n.wakeApplier()
+}
+
+// run calls elections when the leader goes quiet, and steps down a leader
+// that loses touch with a majority, until the node is closed
+func (n *Node) run() {
+	ticker := time.NewTicker(n.Heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			return
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.role == RoleLeader:
+			n.checkQuorum()
+		case n.diverged == nil && n.isMember(n.addr) && time.Since(n.contact) >= n.timeout:
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// campaign starts an election for the next term; the caller holds mu
+func (n *Node) campaign() {
+	n.role = RoleCandidate
+	n.term++
+	n.votedFor = n.addr
+	n.leader = ""
+	n.contact = time.Now()
+	n.resetTimeout()
+	if err := n.saveState(); err != nil {
+		fmt.Println("Failed to save Raft state:", err)
+		n.role = RoleFollower
+		return
+	}
+	n.updateWritable()
+	fmt.Printf("Calling an election for term %d\n", n.term)
+
+	args := voteRequest{Term: n.term, Candidate: n.addr, LastIndex: n.raft.lastIndex(), LastTerm: n.raft.lastTerm()}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, addr := range n.members {
+		if addr == n.addr {
+			continue
+		}
+		c := n.clientFor(addr)
+		go func() {
+			var reply voteResponse
+			if err := c.call(reqVote, args, &reply, n.ElectionTimeout); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if n.role != RoleCandidate || n.term != args.Term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over as leader of the current term. Writes wait until
+// the no-op it appends commits and every entry before it is applied; see
+// maybeReady. The caller holds mu.
+func (n *Node) becomeLeader() {
+	n.role = RoleLeader
+	n.leader = n.addr
+	n.ready = false
+	noop := entry{Index: n.raft.lastIndex() + 1, Term: n.term, Type: entryNoop}
+	if err := n.raft.append(noop); err != nil {
+		fmt.Println("Failed to start term as cluster leader:", err)
+		n.stepDown(n.term)
+		return
+	}
+
+	n.termCtx, n.stop = context.WithCancel(n.ctx)
+	n.peers = make(map[string]*replicator)
+	n.proposals = make(map[uint64]*proposal)
+	n.startReplicators(n.termCtx)
+	fmt.Printf("Elected cluster leader for term %d\n", n.term)
+	n.updateWritable()
+	n.advanceCommit()
+	n.notify()
+}
+
+// stepDown makes the node a follower, moving to a newer term if given one;
+// the caller holds mu
+func (n *Node) stepDown(term uint64) {
+	if n.role == RoleLeader {
+		fmt.Printf("No longer cluster leader, in term %d\n", max(term, n.term))
+		n.leader = ""
+	}
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		if err := n.saveState(); err != nil {
+			fmt.Println("Failed to save Raft state:", err)
+		}
+	}
+	n.role = RoleFollower
+	n.ready = false
+	if n.stop != nil {
+		n.stop()
+		n.termCtx, n.stop = nil, nil
+	}
+	for _, p := range n.peers {
+		n.log.Release(p.hold())
+	}
+	n.peers = nil
+	n.proposals = nil
+	n.updateWritable()
+	n.notify()
+}
+
+// follow records a request from the leader of a term, stepping down to follow
+// it if needed; the caller holds mu
+func (n *Node) follow(term uint64, leader string) {
+	if term > n.term || n.role != RoleFollower {
+		n.stepDown(term)
+	}
+	n.contact = time.Now()
+	if n.leader != leader {
+		n.leader = leader
+		fmt.Printf("Following cluster leader %s in term %d\n", leader, n.term)
+		n.updateWritable()
+	}
+}
+
+// checkQuorum steps down a leader that has not heard from a majority within
+// the election timeout, so a leader cut off from the rest stops taking writes
+// before they elect another; the caller holds mu
+func (n *Node) checkQuorum() {
+	count := 0
+	for _, addr := range n.members {
+		if p := n.peers[addr]; addr == n.addr || p != nil && time.Since(p.contact) < n.ElectionTimeout {
+			count++
+		}
+	}
+	if count < n.quorum() {
+		fmt.Printf("Lost contact with a majority of the cluster in term %d\n", n.term)
+		n.stepDown(n.term)
+	}
+}
+
+// startReplicators starts sending entries to members that have no replicator
+// yet; the caller holds mu
+func (n *Node) startReplicators(ctx context.Context) {
+	for _, addr := range n.members {
+		if addr == n.addr || n.peers[addr] != nil {
+			continue
+		}
+		p := &replicator{addr: addr, next: n.raft.lastIndex() + 1, contact: time.Now(), wake: make(chan struct{}, 1)}
+		n.peers[addr] = p
+		go n.replicate(ctx, p, n.term, n.clientFor(addr))
+	}
+}
+
+// wakeReplicators has every replicator send what it has now; the caller holds mu
+func (n *Node) wakeReplicators() {
+	for _, p := range n.peers {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate keeps one member up to date for the rest of the term, sending
+// new entries as they are appended and a heartbeat when there are none
+func (n *Node) replicate(ctx context.Context, p *replicator, term uint64, c *client) {
+	for {
+		more, err := n.replicateOnce(p, term, c)
+		if errors.Is(err, errStopped) || ctx.Err() != nil {
+			return
+		}
+		if more && err == nil {
+			continue
+		}
+		select {
+		case <-p.wake:
+		case <-time.After(n.Heartbeat):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replicateOnce sends a member the next entries it needs, or the changes up
+// to the snapshot when it needs entries compacted away, and reports whether
+// it needs more
+func (n *Node) replicateOnce(p *replicator, term uint64, c *client) (bool, error) {
+	n.mu.Lock()
+	if n.role != RoleLeader || n.term != term || n.peers[p.addr] != p {
+		n.mu.Unlock()
+		return false, errStopped
+	}
+	// A removed member gets entries until its removal commits, so it learns of it
+	if !n.isMember(p.addr) && !n.pendingConfig() {
+		delete(n.peers, p.addr)
+		n.log.Release(p.hold())
+		n.mu.Unlock()
+		return false, errStopped
+	}
+	if p.next <= n.raft.snapshot.Index {
+		snap, after := n.raft.snapshot, p.lsn
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term, c, snap, after)
+	}
+	prevTerm, _ := n.raft.term(p.next - 1)
+	args := appendRequest{
+		Term:      term,
+		Leader:    n.addr,
+		PrevIndex: p.next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   n.raft.slice(p.next, maxBatch),
+		Commit:    n.commit,
+	}
+	n.mu.Unlock()
+
+	sent := time.Now()
+	var reply appendResponse
+	err := c.call(reqAppend, args, &reply, n.ElectionTimeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !n.answered(p, term, reply.Term, sent) {
+		return false, errStopped
+	}
+	p.lsn = reply.LSN
+	n.log.Retain(p.hold(), p.lsn)
+	if !reply.Success {
+		p.next = max(1, min(p.next-1, reply.Last+1))
+		return true, nil
+	}
+	p.match = max(p.match, args.PrevIndex+uint64(len(args.Entries)))
+	p.next = p.match + 1
+	n.advanceCommit()
+	return p.next <= n.raft.lastIndex(), nil
+}
+
+// answered records a member's answer to a request sent at sent, and reports
+// whether the node is still the leader of term; the caller holds mu
+func (n *Node) answered(p *replicator, term, replyTerm uint64, sent time.Time) bool {
+	if replyTerm > n.term {
+		n.stepDown(replyTerm)
+		return false
+	}
+	if n.role != RoleLeader || n.term != term {
+		return false
+	}
+	if sent.After(p.contact) {
+		p.contact = sent
+	}
+	n.notify()
+	return true
+}
+
+// sendSnapshot sends a member the next changes it lacks from this node's
+// change log, up to the snapshot, and the snapshot once it has them all
+func (n *Node) sendSnapshot(p *replicator, term uint64, c *client, snap snapshot, after uint64) (bool, error) {
+	args := snapshotRequest{Term: term, Leader: n.addr, Snapshot: snap, After: min(after, snap.LSN)}
+	if args.After > 0 {
+		event, err := n.log.Entry(args.After)
+		if err != nil {
+			return false, err
+		}
+		args.AfterTime = &event.Time
+	}
+	if args.After < snap.LSN {
+		changes, err := n.changesAfter(args.After, snap.LSN)
+		if err != nil {
+			fmt.Printf("Failed to read changes for cluster member %s: %v\n", p.addr, err)
+			return false, err
+		}
+		args.Changes = changes
+	}
+
+	sent := time.Now()
+	var reply snapshotResponse
+	err := c.call(reqSnapshot, args, &reply, n.Timeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !n.answered(p, term, reply.Term, sent) {
+		return false, errStopped
+	}
+	p.lsn = reply.LSN
+	n.log.Retain(p.hold(), p.lsn)
+	if reply.Installed {
+		p.match = max(p.match, snap.Index)
+		p.next = p.match + 1
+		fmt.Printf("Cluster member %s caught up to the snapshot at index %d (LSN %d)\n", p.addr, snap.Index, snap.LSN)
+	}
+	return true, nil
+}
+
+// changesAfter reads up to maxBatch changes from the change log after one
+// LSN, up to and including another
+func (n *Node) changesAfter(after, until uint64) ([]entry, error) {
+	var out []entry
+	err := n.log.Read(after, func(event models.ChangeEvent) error {
+		if event.LSN > until || len(out) == maxBatch {
+			return errStopped
+		}
+		e, err := n.changeEntry(event)
+		if err != nil {
+			return err
+		}
+		out = append(out, e)
+		return nil
+	})
+	if errors.Is(err, errStopped) {
+		err = nil
+	}
+	return out, err
+}
+
+// changeEntry wraps a change in an entry, with the compression dictionary it
+// configures, if any, so members can apply it
+func (n *Node) changeEntry(event models.ChangeEvent) (entry, error) {
+	e := entry{Type: entryChange, Event: &event}
+	if c := event.Metadata; c != nil && c.Compression != nil && c.Compression.Dictionary != "" {
+		dict, err := storage.ReadFile(filepath.Join(n.root, storage.DictionariesDir, c.Compression.Dictionary))
+		if err != nil {
+			return e, fmt.Errorf("failed to read compression dictionary %s: %v", c.Compression.Dictionary, err)
+		}
+		e.Dictionary = dict
+	}
+	return e, nil
+}
+
+// advanceCommit commits the last entry of the current term a majority
+// stores, and every entry before it; the caller holds mu
+func (n *Node) advanceCommit() {
+	for index := n.raft.lastIndex(); index > n.commit; index-- {
+		if term, _ := n.raft.term(index); term != n.term {
+			break
+		}
+		count := 0
+		for _, addr := range n.members {
+			if p := n.peers[addr]; addr == n.addr || p != nil && p.match >= index {
+				count++
+			}
+		}
+		if count < n.quorum() {
+			continue
+		}
+
+		n.commit = index
+		n.wakeApplier()
+		n.notify()
+		break
+	}
+
+	// A leader that removed itself hands over once the removal commits
+	if n.role == RoleLeader && !n.isMember(n.addr) && !n.pendingConfig() {
+		fmt.Println("Removed from the cluster; stepping down")
+		n.stepDown(n.term)
+	}
+}
+
+// wakeApplier has the applier apply what is committed
+func (n *Node) wakeApplier() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// applier applies committed entries, in order, until the node is closed
+func (n *Node) applier() {
+	for {
+		select {
+		case <-n.wake:
+		case <-n.ctx.Done():
+			return
+		}
+		n.applyCommitted()
+	}
+}
+
+// applyCommitted applies every committed entry not applied yet, in order, on
+// the leader as on the other members
+func (n *Node) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	for {
+		n.mu.Lock()
+		if n.diverged != nil || n.applied >= n.commit {
+			n.maybeReady()
+			n.maybeCompact()
+			n.mu.Unlock()
+			return
+		}
+		batch := n.raft.slice(n.applied+1, min(maxBatch, int(n.commit-n.applied)))
+		if len(batch) == 0 {
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+
+		for _, e := range batch {
+			if e.Type == entryChange {
+				if err := n.applyEntry(e); err != nil {
+					n.mu.Lock()
+					n.diverge(err)
+					n.mu.Unlock()
+					return
+				}
+			}
+			n.mu.Lock()
+			if e.Index > n.applied {
+				n.applied = e.Index
+				if e.Event != nil {
+					n.lsn = e.Event.LSN
+				}
+			}
+			n.notify()
+			n.mu.Unlock()
+		}
+	}
+}
+
+// applyEntry applies a committed change. One this leader's managers proposed
+// and still wait on is theirs to make, now its turn has come; the rest, and
+// any they fail to make, are applied as a follower applies them. The caller
+// holds applyMu.
+func (n *Node) applyEntry(e entry) error {
+	n.mu.Lock()
+	p := n.proposals[e.Index]
+	if p != nil {
+		delete(n.proposals, e.Index)
+		close(p.turn)
+	}
+	n.mu.Unlock()
+	if p == nil {
+		return n.applyChange(e)
+	}
+
+	if err := <-p.finished; err != nil {
+		fmt.Printf("Applying the change at LSN %d its writer failed to make: %v\n", e.Event.LSN, err)
+		return n.applyChange(e)
+	}
+	// A change made but not recorded is recorded here, so the log has no gap
+	if n.log.LastLSN() < e.Event.LSN {
+		return n.log.Mirror(*e.Event)
+	}
+	return nil
+}
+
+// applyChange applies a change from the leader and records it in the change
+// log under the leader's LSN. A change the log holds already is checked to be
+// the same one instead; the caller holds applyMu.
+func (n *Node) applyChange(e entry) error {
+	event := *e.Event
+	last := n.log.LastLSN()
+	switch {
+	case event.LSN <= last:
+		mine, err := n.log.Entry(event.LSN)
+		if err != nil {
+			return err
+		}
+		if !mine.Time.Equal(event.Time) || mine.Op != event.Op {
+			return fmt.Errorf("this node's change at LSN %d is not the cluster's, so it made changes the cluster never committed", event.LSN)
+		}
+		return nil
+	case event.LSN > last+1:
+		return fmt.Errorf("the cluster's change at LSN %d does not follow this node's last change, at LSN %d", event.LSN, last)
+	}
+
+	if len(e.Dictionary) > 0 {
+		if _, err := storage.SaveDictionary(n.root, e.Dictionary); err != nil {
+			return err
+		}
+	}
+	if err := n.dbm.Apply(event); err != nil {
+		return err
+	}
+	return n.log.Mirror(event)
+}
+
+// diverge stops the node applying changes for good, because its storage root
+// no longer matches the cluster's, and returns why; the caller holds mu
+func (n *Node) diverge(err error) error {
+	if n.diverged == nil {
+		n.diverged = fmt.Errorf("%v; remove it from the cluster, empty its data directory and add it back", err)
+		fmt.Println("Stopped applying cluster changes:", n.diverged)
+		n.stepDown(n.term)
+	}
+	return n.diverged
+}
+
+// maybeReady lets a new leader take writes once the no-op of its term has
+// committed and every entry before it is applied, so the changes it proposes
+// follow the last one applied. The caller holds mu.
+func (n *Node) maybeReady() {
+	if n.role != RoleLeader || n.ready || n.applied < n.commit {
+		return
+	}
+	if term, _ := n.raft.term(n.commit); term != n.term {
+		return
+	}
+	n.ready = true
+	n.proposed = n.lsn
+	n.updateWritable()
+	fmt.Printf("Cluster leader for term %d is taking writes after LSN %d\n", n.term, n.lsn)
+}
+
+// maybeCompact compacts the Raft log once enough entries are applied; the caller holds mu
+func (n *Node) maybeCompact() {
+	if n.SnapshotEvery > 0 && n.applied-n.raft.snapshot.Index >= n.SnapshotEvery {
+		if err := n.compact(); err != nil {
+			fmt.Println("Failed to compact the Raft log:", err)
+		}
+	}
+}
+
+// compact replaces the applied entries of the Raft log with a snapshot; the
+// caller holds mu
+func (n *Node) compact() error {
+	if n.applied <= n.raft.snapshot.Index {
+		return nil
+	}
+	term, _ := n.raft.term(n.applied)
+	snap := snapshot{Index: n.applied, Term: term, LSN: n.lsn, Members: n.configAt(n.applied)}
+	if err := n.raft.compact(snap); err != nil {
+		return err
+	}
+	fmt.Printf("Compacted the Raft log to a snapshot at index %d (LSN %d)\n", snap.Index, snap.LSN)
+	return nil
+}
+
+// Snapshot compacts the Raft log up to the last applied entry now, rather
+// than waiting for SnapshotEvery entries
+func (n *Node) Snapshot() (SnapshotStatus, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.compact()
+	snap := n.raft.snapshot
+	return SnapshotStatus{Index: snap.Index, Term: snap.Term, LSN: snap.LSN}, err
+}
+
+// saveState records the term and vote; the caller holds mu
+func (n *Node) saveState() error {
+	return n.raft.saveState(state{Term: n.term, VotedFor: n.votedFor})
+}
+
+// handleVote answers a candidate. A member that has heard from a leader
+// within the election timeout ignores candidates, so a member that was
+// removed, or cut off for a while, cannot disrupt the cluster.
+func (n *Node) handleVote(args voteRequest) voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if args.Term > n.term && (n.role == RoleLeader || n.leader != "" && time.Since(n.contact) < n.ElectionTimeout) {
+		return voteResponse{Term: n.term}
+	}
+	if args.Term > n.term {
+		n.stepDown(args.Term)
+	}
+	reply := voteResponse{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+
+	upToDate := args.LastTerm > n.raft.lastTerm() || args.LastTerm == n.raft.lastTerm() && args.LastIndex >= n.raft.lastIndex()
+	if (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		n.votedFor = args.Candidate
+		if err := n.saveState(); err != nil {
+			fmt.Println("Failed to save Raft state:", err)
+			return reply
+		}
+		n.contact = time.Now()
+		reply.Granted = true
+	}
+	return reply
+}
+
+// handleAppend stores the leader's entries after the one it names, once this
+// node's log holds that one too, replacing any of its own that conflict
+func (n *Node) handleAppend(args appendRequest) (appendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	reply := appendResponse{Term: n.term, Last: n.raft.lastIndex(), LSN: n.log.LastLSN()}
+	if args.Term < n.term {
+		return reply, nil
+	}
+	n.follow(args.Term, args.Leader)
+	reply.Term = n.term
+	if args.PrevIndex > n.raft.lastIndex() {
+		return reply, nil
+	}
+
+	entries, prev := args.Entries, args.PrevIndex
+	if prev < n.raft.snapshot.Index {
+		// Entries up to the snapshot are committed, so they match
+		skip := n.raft.snapshot.Index - prev
+		entries = entries[min(skip, uint64(len(entries))):]
+		prev = n.raft.snapshot.Index
+	} else if term, _ := n.raft.term(prev); term != args.PrevTerm {
+		reply.Last = prev - 1
+		return reply, nil
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.raft.lastIndex() {
+			if term, _ := n.raft.term(e.Index); term == e.Term {
+				continue
+			}
+			if e.Index <= n.commit {
+				return reply, n.diverge(fmt.Errorf("leader %s sent entry %d conflicting with a committed one", args.Leader, e.Index))
+			}
+			if err := n.raft.truncate(e.Index); err != nil {
+				return reply, err
+			}
+		}
+		if err := n.raft.append(entries[i:]...); err != nil {
+			return reply, err
+		}
+		break
+	}
+	n.members = n.configAt(n.raft.lastIndex())
+
+	if commit := min(args.Commit, prev+uint64(len(entries))); commit > n.commit {
+		n.commit = commit
+		n.wakeApplier()
+	}
+	reply.Success = true
+	reply.Last = n.raft.lastIndex()
+	return reply, nil
+}
+
+// handleSnapshot replays the leader's changes after this node's last one and,
+// once it has every change up to the snapshot, compacts its Raft log to it
+func (n *Node) handleSnapshot(args snapshotRequest) (snapshotResponse, error) {
+	n.mu.Lock()
+	reply := snapshotResponse{Term: n.term}
+	if args.Term < n.term {
+		n.mu.Unlock()
+		return reply, nil
+	}
+	n.follow(args.Term, args.Leader)
+	reply.Term = n.term
+	diverged := n.diverged
+	n.mu.Unlock()
+	if diverged != nil {
+		return reply, diverged
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	reply.LSN = n.log.LastLSN()
+	if args.After > reply.LSN || args.After < reply.LSN && len(args.Changes) > 0 {
+		return reply, nil
+	}
+	if args.After > 0 {
+		mine, err := n.log.Entry(args.After)
+		if err != nil {
+			return reply, err
+		}
+		if args.AfterTime == nil || !mine.Time.Equal(*args.AfterTime) {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return reply, n.diverge(fmt.Errorf("this node's change at LSN %d is not the leader's", args.After))
+		}
+	}
+	for _, e := range args.Changes {
+		if err := n.applyChange(e); err != nil {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return reply, n.diverge(err)
+		}
+		reply.LSN = e.Event.LSN
+	}
+	if reply.LSN < args.Snapshot.LSN {
+		return reply, nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	snap := args.Snapshot
+	if snap.Index > n.raft.snapshot.Index {
+		if err := n.raft.compact(snap); err != nil {
+			return reply, err
+		}
+		n.members = n.configAt(n.raft.lastIndex())
+		fmt.Printf("Caught up to the cluster's snapshot at index %d (LSN %d)\n", snap.Index, snap.LSN)
+	}
+	n.commit = max(n.commit, snap.Index)
+	n.applied = max(n.applied, snap.Index)
+	n.lsn = max(n.lsn, snap.LSN)
+	n.notify()
+	reply.Installed = true
+	return reply, nil
+}
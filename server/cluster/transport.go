@@ -0,0 +1,322 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Request types
+const (
+	reqHello    = "hello"    // First on each connection: the cluster key
+	reqVote     = "vote"     // Candidate to member: asks for its vote
+	reqAppend   = "append"   // Leader to member: entries to store, or a heartbeat
+	reqSnapshot = "snapshot" // Leader to member: changes to replay up to a snapshot
+	reqRead     = "read"     // Member to leader: asks for a read index
+	reqMembers  = "members"  // Member to leader: asks to add or remove a member
+)
+
+// request is one call from a node to another
+type request struct {
+	Type string          `json:"type"`
+	Key  string          `json:"key,omitempty"` // Hello: the cluster's shared key
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// response answers a request
+type response struct {
+	Body  json.RawMessage `json:"body,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"lastIndex"`
+	LastTerm  uint64 `json:"lastTerm"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prevIndex"`
+	PrevTerm  uint64  `json:"prevTerm"`
+	Entries   []entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	Last    uint64 `json:"last"` // The member's last entry, where the leader should look on failure
+	LSN     uint64 `json:"lsn"`  // The member's last change
+}
+
+// snapshotRequest carries the leader's changes after the member's position,
+// up to the snapshot, and the snapshot itself once they are all sent
+type snapshotRequest struct {
+	Term      uint64     `json:"term"`
+	Leader    string     `json:"leader"`
+	Snapshot  snapshot   `json:"snapshot"`
+	After     uint64     `json:"after"`               // LSN the changes follow
+	AfterTime *time.Time `json:"afterTime,omitempty"` // When the leader made the change at After
+	Changes   []entry    `json:"changes,omitempty"`   // Entries holding only an event and its dictionary
+}
+
+type snapshotResponse struct {
+	Term      uint64 `json:"term"`
+	LSN       uint64 `json:"lsn"`       // The member's last change
+	Installed bool   `json:"installed"` // Whether the member has reached the snapshot
+}
+
+type readResponse struct {
+	Index uint64 `json:"index"`
+}
+
+type membersRequest struct {
+	Add    string `json:"add,omitempty"`
+	Remove string `json:"remove,omitempty"`
+}
+
+type membersResponse struct {
+	Members []string `json:"members"`
+}
+
+// ListenAndServe listens on the node's address, starts it taking part in the
+// cluster and serves other members until the listener fails
+func (n *Node) ListenAndServe() error {
+	listener, err := net.Listen("tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Cluster listening on", n.addr)
+	n.Start()
+	return n.Serve(listener)
+}
+
+// Serve accepts other members on a listener until it is closed
+func (n *Node) Serve(listener net.Listener) error {
+	defer listener.Close()
+	go func() {
+		<-n.ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if n.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go n.serveConn(conn)
+	}
+}
+
+// serveConn answers one member's requests, in order, until it disconnects
+func (n *Node) serveConn(conn net.Conn) {
+	defer conn.Close()
+	in := json.NewDecoder(bufio.NewReader(conn))
+	w := bufio.NewWriter(conn)
+	out := json.NewEncoder(w)
+
+	conn.SetReadDeadline(time.Now().Add(n.Timeout))
+	var hello request
+	if err := in.Decode(&hello); err != nil || hello.Type != reqHello {
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.Key), []byte(n.Key)) != 1 {
+		fmt.Printf("Refused cluster connection from %s: wrong cluster key\n", conn.RemoteAddr())
+		out.Encode(response{Error: "permission denied: wrong cluster key"})
+		w.Flush()
+		return
+	}
+	if err := out.Encode(response{}); err != nil || w.Flush() != nil {
+		return
+	}
+
+	for {
+		conn.SetReadDeadline(time.Time{})
+		var req request
+		if err := in.Decode(&req); err != nil {
+			return
+		}
+		body, err := n.handle(req)
+		resp := response{Body: body}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		conn.SetWriteDeadline(time.Now().Add(n.Timeout))
+		if err := out.Encode(resp); err != nil || w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// handle runs one request and returns the JSON of its answer
+func (n *Node) handle(req request) (json.RawMessage, error) {
+	var reply interface{}
+	var err error
+	switch req.Type {
+	case reqVote:
+		var args voteRequest
+		if err = json.Unmarshal(req.Body, &args); err == nil {
+			reply = n.handleVote(args)
+		}
+	case reqAppend:
+		var args appendRequest
+		if err = json.Unmarshal(req.Body, &args); err == nil {
+			reply, err = n.handleAppend(args)
+		}
+	case reqSnapshot:
+		var args snapshotRequest
+		if err = json.Unmarshal(req.Body, &args); err == nil {
+			reply, err = n.handleSnapshot(args)
+		}
+	case reqRead:
+		var index uint64
+		if index, err = n.readIndex(); err == nil {
+			reply = readResponse{Index: index}
+		}
+	case reqMembers:
+		var args membersRequest
+		if err = json.Unmarshal(req.Body, &args); err == nil {
+			var members []string
+			members, err = n.changeMembers(args)
+			reply = membersResponse{Members: members}
+		}
+	default:
+		err = fmt.Errorf("invalid cluster request type '%s'", req.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(reply)
+}
+
+// client is a connection to another member. Calls on it take turns.
+type client struct {
+	addr string
+	key  string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	in   *json.Decoder
+	out  *json.Encoder
+}
+
+// clientFor returns the client of a member, creating it if needed; the caller holds mu
+func (n *Node) clientFor(addr string) *client {
+	c := n.clients[addr]
+	if c == nil {
+		c = &client{addr: addr, key: n.Key}
+		n.clients[addr] = c
+	}
+	return c
+}
+
+// call sends a request and decodes its answer into reply, connecting first if
+// needed. The whole call must finish within timeout; when the member cannot be
+// reached the connection is dropped, to be made again by the next call.
+func (c *client) call(typ string, args, reply interface{}, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	if c.conn == nil {
+		if err := c.connect(timeout); err != nil {
+			return err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	resp, err := c.roundTrip(request{Type: typ, Body: body})
+	if err != nil {
+		if !isRemote(err) {
+			c.drop()
+		}
+		return err
+	}
+	return json.Unmarshal(resp.Body, reply)
+}
+
+// connect dials the member and sends the hello; the caller holds c.mu
+func (c *client) connect(timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", c.addr, timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.w = bufio.NewWriter(conn)
+	c.in = json.NewDecoder(bufio.NewReader(conn))
+	c.out = json.NewEncoder(c.w)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.roundTrip(request{Type: reqHello, Key: c.key}); err != nil {
+		c.drop()
+		return fmt.Errorf("cluster member %s refused the connection: %v", c.addr, err)
+	}
+	return nil
+}
+
+// roundTrip writes a request and reads its response; the caller holds c.mu
+func (c *client) roundTrip(req request) (response, error) {
+	var resp response
+	if err := c.out.Encode(req); err != nil {
+		return resp, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return resp, err
+	}
+	if err := c.in.Decode(&resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, &remoteError{resp.Error}
+	}
+	return resp, nil
+}
+
+// remoteError is an error the other member answered with; the connection is fine
+type remoteError struct {
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+// drop closes the connection; the caller holds c.mu
+func (c *client) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// close closes the connection
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop()
+}
+
+// isRemote reports whether err is an answer from the other member rather than
+// a failure to reach it
+func isRemote(err error) bool {
+	var remote *remoteError
+	return errors.As(err, &remote)
+}
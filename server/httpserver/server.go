@@ -0,0 +1,801 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+	"Build-your-own-database/database/transfer"
+	"Build-your-own-database/server/cluster"
+	"Build-your-own-database/server/replication"
+	"Build-your-own-database/server/shard"
+)
+
+// Server exposes the database over HTTP: JSON endpoints for databases,
+// collections and documents, plus change streams over SSE and WebSocket
+type Server struct {
+	dbm   *db.DBManager
+	users *auth.UserManager
+	mux   *http.ServeMux
+
+	// BufferSize is how many change events may queue for one streaming client;
+	// a client that falls further behind is disconnected and must resume
+	BufferSize int
+	// Heartbeat is how often idle streams send a keep-alive
+	Heartbeat time.Duration
+	// WriteTimeout bounds how long a single write to a streaming client may block
+	WriteTimeout time.Duration
+	// Replication reports on and promotes this server's replication node, if it has one
+	Replication *replication.Node
+	// Cluster reports on and changes the members of this server's cluster, if it is in one
+	Cluster *cluster.Node
+	// LinearizableReads makes every read wait for a cluster Barrier first; a
+	// request can ask for either behaviour with ?consistency=linearizable or local
+	LinearizableReads bool
+	// Shards routes the document endpoints of sharded collections to their
+	// shards and manages their layouts, if set
+	Shards *shard.Manager
+	// BackupDir is the directory backups are taken into and restored from;
+	// the paths requests name are relative to it. Backup and restore requests
+	// are refused when it is empty.
+	BackupDir string
+	// ShardDir is the directory shards named by a path are created in; the
+	// paths requests name are relative to it. Directory shards are refused
+	// when it is empty.
+	ShardDir string
+}
+
+// New creates a server backed by a DBManager
+func New(dbm *db.DBManager) *Server {
+	s := &Server{
+		dbm:          dbm,
+		users:        auth.NewUserManager(dbm),
+		mux:          http.NewServeMux(),
+		BufferSize:   256,
+		Heartbeat:    15 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	s.mux.HandleFunc("GET /databases", s.listDatabases)
+	s.mux.HandleFunc("POST /databases", s.createDatabase)
+	s.mux.HandleFunc("DELETE /databases/{db}", s.deleteDatabase)
+	s.mux.HandleFunc("GET /databases/{db}/changes", s.watch)
+	s.mux.HandleFunc("POST /databases/{db}/rotate-key", s.rotateKey)
+	s.mux.HandleFunc("POST /backup", s.backup)
+	s.mux.HandleFunc("POST /restore", s.restore)
+	s.mux.HandleFunc("GET /replication", s.replicationStatus)
+	s.mux.HandleFunc("POST /replication/promote", s.promote)
+	s.mux.HandleFunc("GET /cluster", s.clusterStatus)
+	s.mux.HandleFunc("POST /cluster/members", s.addMember)
+	s.mux.HandleFunc("DELETE /cluster/members/{address}", s.removeMember)
+	s.mux.HandleFunc("POST /cluster/snapshot", s.snapshot)
+	s.mux.HandleFunc("GET /shards", s.listSharded)
+	s.mux.HandleFunc("POST /shards", s.createSharded)
+	s.mux.HandleFunc("GET /shards/{db}/{col}", s.shardStats)
+	s.mux.HandleFunc("POST /shards/{db}/{col}", s.addShard)
+	s.mux.HandleFunc("POST /shards/{db}/{col}/rebalance", s.rebalance)
+
+	s.mux.HandleFunc("GET /databases/{db}/collections", s.listCollections)
+	s.mux.HandleFunc("POST /databases/{db}/collections", s.createCollection)
+	s.mux.HandleFunc("DELETE /databases/{db}/collections/{col}", s.deleteCollection)
+	s.mux.HandleFunc("GET /databases/{db}/collections/{col}/changes", s.watch)
+
+	s.mux.HandleFunc("GET /databases/{db}/collections/{col}/documents", s.findDocuments)
+	s.mux.HandleFunc("POST /databases/{db}/collections/{col}/documents", s.createDocument)
+	s.mux.HandleFunc("GET /databases/{db}/collections/{col}/documents/{name}", s.getDocument)
+	s.mux.HandleFunc("PATCH /databases/{db}/collections/{col}/documents/{name}", s.updateDocument)
+	s.mux.HandleFunc("DELETE /databases/{db}/collections/{col}/documents/{name}", s.deleteDocument)
+	s.mux.HandleFunc("GET /databases/{db}/collections/{col}/export", s.exportCollection)
+	s.mux.HandleFunc("POST /databases/{db}/collections/{col}/import", s.importCollection)
+	return s
+}
+
+// ServeHTTP implements http.Handler. Once users exist, every request must
+// carry HTTP Basic credentials, and runs with the user's roles; until then
+// only local clients are served.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var remote net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = addr
+	}
+	required, err := s.users.Required(remote)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	if required {
+		name, password, ok := r.BasicAuth()
+		if !ok {
+			unauthorized(w, errors.New("authentication required"))
+			return
+		}
+		user, err := s.users.Authenticate(name, password)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+		identity, err := s.users.Identity(user)
+		if err != nil {
+			respond(w, nil, err)
+			return
+		}
+		r = r.WithContext(access.WithIdentity(r.Context(), identity))
+	}
+	if s.linearizable(r) {
+		if err := s.Cluster.Barrier(r.Context()); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, models.Response{Message: err.Error()})
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// linearizable reports whether a request is a read that must see every write
+// the cluster acknowledged before it
+func (s *Server) linearizable(r *http.Request) bool {
+	if s.Cluster == nil || r.Method != http.MethodGet {
+		return false
+	}
+	switch r.URL.Query().Get("consistency") {
+	case "linearizable":
+		return true
+	case "local":
+		return false
+	}
+	return s.LinearizableReads
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="godb", charset="UTF-8"`)
+	writeJSON(w, http.StatusUnauthorized, models.Response{Message: err.Error()})
+}
+
+// ListenAndServe serves HTTP on addr until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	fmt.Println("HTTP server listening on", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) listDatabases(w http.ResponseWriter, r *http.Request) {
+	names, err := s.databases(r).ListDatabases()
+	respond(w, names, err)
+}
+
+func (s *Server) createDatabase(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	_, err := s.databases(r).CreateDatabase(body.Name)
+	respondStatus(w, http.StatusCreated, body.Name, err)
+}
+
+func (s *Server) deleteDatabase(w http.ResponseWriter, r *http.Request) {
+	respond(w, nil, s.databases(r).DeleteDatabase(r.PathValue("db")))
+}
+
+// rotateKey re-encrypts a database under a new data key while it stays online
+func (s *Server) rotateKey(w http.ResponseWriter, r *http.Request) {
+	id, err := s.databases(r).RotateKeys(r.PathValue("db"))
+	respond(w, map[string]string{"key": id.String()}, err)
+}
+
+// backup copies databases, or the changes made since an earlier backup, to a
+// directory on the server while they stay online
+func (s *Server) backup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Dest      string   `json:"dest"`
+		Databases []string `json:"databases"`
+		Base      string   `json:"base"` // Take an incremental backup continuing this one
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	dest, err := s.backupPath(body.Dest)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	var manifest *db.BackupManifest
+	if body.Base != "" {
+		var base string
+		if base, err = s.backupPath(body.Base); err == nil {
+			manifest, err = s.databases(r).BackupIncremental(dest, base)
+		}
+	} else {
+		manifest, err = s.databases(r).Backup(dest, body.Databases...)
+	}
+	respondStatus(w, http.StatusCreated, manifest, err)
+}
+
+// restore brings databases back from backup directories on the server,
+// optionally to an earlier point in time
+func (s *Server) restore(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Source     string    `json:"source"`
+		Database   string    `json:"database"`
+		As         string    `json:"as"`
+		Increments []string  `json:"increments"`
+		UntilLSN   uint64    `json:"untilLsn"`
+		UntilTime  time.Time `json:"untilTime"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	source, err := s.backupPath(body.Source)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	increments := make([]string, len(body.Increments))
+	for i, increment := range body.Increments {
+		if increments[i], err = s.backupPath(increment); err != nil {
+			respond(w, nil, err)
+			return
+		}
+	}
+	names, err := s.databases(r).RestoreBackup(source, db.RestoreOptions{
+		Database:   body.Database,
+		As:         body.As,
+		Increments: increments,
+		UntilLSN:   body.UntilLSN,
+		UntilTime:  body.UntilTime,
+	})
+	respondStatus(w, http.StatusCreated, names, err)
+}
+
+// backupPath resolves a backup named in a request inside BackupDir, so
+// clients cannot reach other paths on the server
+func (s *Server) backupPath(name string) (string, error) {
+	if s.BackupDir == "" {
+		return "", fmt.Errorf("%w: backups over HTTP are disabled; set BACKUP_PATH to enable them", access.ErrDenied)
+	}
+	if !relative(name) {
+		return "", fmt.Errorf("invalid backup path '%s': give a path relative to the backup directory, without '..'", name)
+	}
+	return filepath.Join(s.BackupDir, name), nil
+}
+
+// shardLocation resolves a shard named in a request. Directories are resolved
+// inside ShardDir, as backups are inside BackupDir; servers, which this one
+// then connects to, may only be named by admins of every database.
+func (s *Server) shardLocation(ctx context.Context, location string) (string, error) {
+	if strings.HasPrefix(location, "tcp://") {
+		if err := access.Check(ctx, access.Admin, access.AnyDatabase, ""); err != nil {
+			return "", err
+		}
+		return location, nil
+	}
+	if s.ShardDir == "" {
+		return "", fmt.Errorf("%w: directory shards over HTTP are disabled; set SHARD_PATH to enable them", access.ErrDenied)
+	}
+	if !relative(location) {
+		return "", fmt.Errorf("invalid shard location '%s': give tcp://host:port or a path relative to the shard directory, without '..'", location)
+	}
+	return filepath.Join(s.ShardDir, location), nil
+}
+
+// relative reports whether name is a relative path that stays inside the
+// directory it is joined to
+func relative(name string) bool {
+	if name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// replicationStatus reports whether this server is a primary or a replica and
+// how far behind its primary, or its replicas, are
+func (s *Server) replicationStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.replicating(w) {
+		return
+	}
+	if err := access.Check(r.Context(), access.Read, access.AnyDatabase, ""); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	respond(w, s.Replication.Status(), nil)
+}
+
+// promote makes a replica stop following its primary and accept writes
+func (s *Server) promote(w http.ResponseWriter, r *http.Request) {
+	if !s.replicating(w) {
+		return
+	}
+	if err := access.Check(r.Context(), access.Admin, access.AnyDatabase, ""); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	err := s.Replication.Promote()
+	respond(w, s.Replication.Status(), err)
+}
+
+// replicating answers 404 when the server takes no part in replication
+func (s *Server) replicating(w http.ResponseWriter) bool {
+	if s.Replication == nil {
+		writeJSON(w, http.StatusNotFound, models.Response{Message: "replication is not enabled on this server"})
+		return false
+	}
+	return true
+}
+
+// clusterStatus reports this server's role in its cluster and its view of the members
+func (s *Server) clusterStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.clustered(w) {
+		return
+	}
+	if err := access.Check(r.Context(), access.Read, access.AnyDatabase, ""); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	respond(w, s.Cluster.Status(), nil)
+}
+
+// addMember adds a node to the cluster, through the leader
+func (s *Server) addMember(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Address string `json:"address"`
+	}
+	if !s.clustered(w) || !decodeBody(w, r, &body) {
+		return
+	}
+	if err := access.Check(r.Context(), access.Admin, access.AnyDatabase, ""); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	members, err := s.Cluster.AddMember(body.Address)
+	respond(w, members, err)
+}
+
+// removeMember removes a node from the cluster, through the leader
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request) {
+	if !s.clustered(w) {
+		return
+	}
+	if err := access.Check(r.Context(), access.Admin, access.AnyDatabase, ""); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	members, err := s.Cluster.RemoveMember(r.PathValue("address"))
+	respond(w, members, err)
+}
+
+// snapshot compacts this server's Raft log now
+func (s *Server) snapshot(w http.ResponseWriter, r *http.Request) {
+	if !s.clustered(w) {
+		return
+	}
+	if err := access.Check(r.Context(), access.Admin, access.AnyDatabase, ""); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	snap, err := s.Cluster.Snapshot()
+	respond(w, snap, err)
+}
+
+// listSharded lists the layouts of the sharded collections the user may read
+func (s *Server) listSharded(w http.ResponseWriter, r *http.Request) {
+	if !s.sharding(w) {
+		return
+	}
+	layouts, err := s.Shards.WithContext(r.Context()).List()
+	respond(w, layouts, err)
+}
+
+// createSharded makes a collection sharded over the given directories or servers
+func (s *Server) createSharded(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Database   string   `json:"database"`
+		Collection string   `json:"collection"`
+		Key        string   `json:"key"`
+		Shards     []string `json:"shards"`
+	}
+	if !s.sharding(w) || !decodeBody(w, r, &body) {
+		return
+	}
+	for i, location := range body.Shards {
+		var err error
+		if body.Shards[i], err = s.shardLocation(r.Context(), location); err != nil {
+			respond(w, nil, err)
+			return
+		}
+	}
+	router, err := s.Shards.WithContext(r.Context()).Create(body.Database, body.Collection, body.Key, body.Shards)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	respondStatus(w, http.StatusCreated, router.Layout(), nil)
+}
+
+// shardStats reports a sharded collection's layout and how many documents each shard holds
+func (s *Server) shardStats(w http.ResponseWriter, r *http.Request) {
+	router, ok := s.router(w, r)
+	if !ok {
+		return
+	}
+	stats, err := router.Stats()
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	layout := router.Layout()
+	respond(w, map[string]interface{}{"key": layout.Key, "shards": stats}, nil)
+}
+
+// addShard adds an empty shard to a sharded collection
+func (s *Server) addShard(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Location string `json:"location"`
+	}
+	router, ok := s.router(w, r)
+	if !ok || !decodeBody(w, r, &body) {
+		return
+	}
+	location, err := s.shardLocation(r.Context(), body.Location)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	if err := router.AddShard(location); err != nil {
+		respond(w, nil, err)
+		return
+	}
+	respond(w, router.Layout(), nil)
+}
+
+// rebalance spreads a sharded collection's buckets evenly over its shards
+func (s *Server) rebalance(w http.ResponseWriter, r *http.Request) {
+	router, ok := s.router(w, r)
+	if !ok {
+		return
+	}
+	report, err := router.Rebalance()
+	respond(w, report, err)
+}
+
+// router returns the router of the sharded collection named in the path,
+// answering the request itself when there is none
+func (s *Server) router(w http.ResponseWriter, r *http.Request) (*shard.Router, bool) {
+	if !s.sharding(w) {
+		return nil, false
+	}
+	router, err := s.Shards.Router(r.PathValue("db"), r.PathValue("col"))
+	if err != nil {
+		respond(w, nil, err)
+		return nil, false
+	}
+	return router.WithContext(r.Context()), true
+}
+
+// sharding answers 404 when the server does not route sharded collections
+func (s *Server) sharding(w http.ResponseWriter) bool {
+	if s.Shards == nil {
+		writeJSON(w, http.StatusNotFound, models.Response{Message: "sharding is not enabled on this server"})
+		return false
+	}
+	return true
+}
+
+// clustered answers 404 when the server is not in a cluster
+func (s *Server) clustered(w http.ResponseWriter) bool {
+	if s.Cluster == nil {
+		writeJSON(w, http.StatusNotFound, models.Response{Message: "cluster mode is not enabled on this server"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) listCollections(w http.ResponseWriter, r *http.Request) {
+	cm, err := s.collections(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	names, err := cm.ListCollections()
+	respond(w, names, err)
+}
+
+func (s *Server) createCollection(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	cm, err := s.collections(r)
+	if err == nil {
+		_, err = cm.CreateCollection(body.Name)
+	}
+	respondStatus(w, http.StatusCreated, body.Name, err)
+}
+
+func (s *Server) deleteCollection(w http.ResponseWriter, r *http.Request) {
+	cm, err := s.collections(r)
+	if err == nil {
+		err = cm.DeleteCollection(r.PathValue("col"))
+	}
+	respond(w, nil, err)
+}
+
+func (s *Server) findDocuments(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	dm, err := s.documents(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	docs, err := dm.FindDocuments(filter)
+	respond(w, docs, err)
+}
+
+func (s *Server) createDocument(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string                 `json:"name"`
+		Data map[string]interface{} `json:"data"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Data == nil {
+		body.Data = make(map[string]interface{})
+	}
+	dm, err := s.documents(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	doc, err := dm.CreateDocument(body.Name, body.Data)
+	respondStatus(w, http.StatusCreated, doc, err)
+}
+
+func (s *Server) getDocument(w http.ResponseWriter, r *http.Request) {
+	dm, err := s.documents(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	doc, err := dm.UseDocument(r.PathValue("name"))
+	respond(w, doc, err)
+}
+
+func (s *Server) updateDocument(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Set   map[string]interface{} `json:"set"`
+		Unset []string               `json:"unset"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	dm, err := s.documents(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	doc, err := dm.UpdateDocument(r.PathValue("name"), body.Set, body.Unset)
+	respond(w, doc, err)
+}
+
+func (s *Server) deleteDocument(w http.ResponseWriter, r *http.Request) {
+	dm, err := s.documents(r)
+	if err == nil {
+		err = dm.DeleteDocument(r.PathValue("name"))
+	}
+	respond(w, nil, err)
+}
+
+// databases returns the DBManager acting for the request's user
+// exportCollection streams the collection's documents as JSON Lines, a JSON
+// array or CSV (format query parameter), optionally filtered
+func (s *Server) exportCollection(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseFilter(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	cm, err := s.collections(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	opts := transfer.ExportOptions{Format: query.Get("format"), Filter: filter}
+	if fields := query.Get("fields"); fields != "" {
+		opts.Fields = strings.Split(fields, ",")
+	}
+
+	contentType := "application/x-ndjson"
+	switch opts.Format {
+	case transfer.JSON:
+		contentType = "application/json"
+	case transfer.CSV:
+		contentType = "text/csv"
+	}
+	out := &lazyWriter{w: w, contentType: contentType}
+	if _, err := transfer.ExportCollection(cm, r.PathValue("col"), out, opts); err != nil {
+		if !out.started {
+			respond(w, nil, err)
+			return
+		}
+		// The response is under way; cutting it short is all that is left
+		fmt.Println("Export failed:", err)
+		return
+	}
+	out.start()
+}
+
+// importCollection creates documents from the records in the request body,
+// read as JSON Lines, a JSON array or CSV (format query parameter)
+func (s *Server) importCollection(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	columns, err := transfer.ParseColumns(query.Get("columns"))
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	cm, err := s.collections(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	result, err := transfer.ImportCollection(cm, r.PathValue("col"), r.Body, transfer.ImportOptions{
+		Format:    query.Get("format"),
+		NameField: query.Get("name"),
+		Upsert:    query.Get("upsert") == "true",
+		Columns:   columns,
+		NoInfer:   query.Get("noinfer") == "true",
+	})
+	if err != nil {
+		// Records before the failing one stay imported, so say how far it got
+		writeJSON(w, statusFor(err), models.Response{Message: err.Error(), Data: result})
+		return
+	}
+	respond(w, result, nil)
+}
+
+// lazyWriter sends the response header on the first write, so a handler can
+// still answer with an error if it fails before producing any output
+type lazyWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	started     bool
+}
+
+func (l *lazyWriter) start() {
+	if !l.started {
+		l.started = true
+		l.w.Header().Set("Content-Type", l.contentType)
+		l.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (l *lazyWriter) Write(p []byte) (int, error) {
+	l.start()
+	return l.w.Write(p)
+}
+
+func (s *Server) databases(r *http.Request) *db.DBManager {
+	return s.dbm.WithContext(r.Context())
+}
+
+// collections returns a CollectionManager for the database named in the path
+func (s *Server) collections(r *http.Request) (*collections.CollectionManager, error) {
+	database, err := s.databases(r).UseDatabase(r.PathValue("db"))
+	if err != nil {
+		return nil, err
+	}
+	return collections.NewCollectionManager(database).WithContext(r.Context()), nil
+}
+
+// documentStore is what the document endpoints need: a collection's
+// DocumentManager, or the Router of a sharded collection
+type documentStore interface {
+	CreateDocument(name string, data map[string]interface{}) (*models.Document, error)
+	UseDocument(name string) (*models.Document, error)
+	UpdateDocument(name string, set map[string]interface{}, unset []string) (*models.Document, error)
+	DeleteDocument(name string) error
+	FindDocuments(filter models.Filter) ([]*models.Document, error)
+}
+
+// documents returns the documents of the collection named in the path,
+// through its router when it is sharded
+func (s *Server) documents(r *http.Request) (documentStore, error) {
+	if s.Shards != nil && s.Shards.Sharded(r.PathValue("db"), r.PathValue("col")) {
+		router, err := s.Shards.Router(r.PathValue("db"), r.PathValue("col"))
+		if err != nil {
+			return nil, err
+		}
+		return router.WithContext(r.Context()), nil
+	}
+	cm, err := s.collections(r)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := cm.UseCollection(r.PathValue("col"))
+	if err != nil {
+		return nil, err
+	}
+	return documents.NewDocumentManager(collection).WithContext(r.Context()), nil
+}
+
+// parseFilter reads the optional JSON filter query parameter
+func parseFilter(r *http.Request) (models.Filter, error) {
+	raw := r.URL.Query().Get("filter")
+	if raw == "" {
+		return nil, nil
+	}
+	var filter models.Filter
+	if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+	return filter, nil
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, models.Response{Message: fmt.Sprintf("invalid request body: %v", err)})
+		return false
+	}
+	return true
+}
+
+func respond(w http.ResponseWriter, data interface{}, err error) {
+	respondStatus(w, http.StatusOK, data, err)
+}
+
+func respondStatus(w http.ResponseWriter, status int, data interface{}, err error) {
+	if err != nil {
+		writeJSON(w, statusFor(err), models.Response{Message: err.Error()})
+		return
+	}
+	writeJSON(w, status, models.Response{Success: true, Message: "ok", Data: data})
+}
+
+// statusFor maps the managers' error messages to HTTP status codes
+func statusFor(err error) int {
+	msg := err.Error()
+	switch {
+	case storage.IsCorrupt(err):
+		// Damaged files are the server's problem, whatever their message says
+		return http.StatusInternalServerError
+	case strings.Contains(msg, access.ErrDenied.Error()), strings.Contains(msg, storage.ErrReadOnly.Error()):
+		return http.StatusForbidden
+	case strings.Contains(msg, "does not exist"), strings.Contains(msg, "not found"):
+		return http.StatusNotFound
+	case strings.Contains(msg, "already exists"), strings.Contains(msg, "duplicate value"):
+		return http.StatusConflict
+	case strings.Contains(msg, "invalid"):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
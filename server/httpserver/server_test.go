@@ -0,0 +1,96 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"Build-your-own-database/database/access"
+)
+
+func TestBackupPath(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		dir     string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"relative", dir, "2024-06-01", filepath.Join(dir, "2024-06-01"), false},
+		{"nested", dir, "shop/full", filepath.Join(dir, "shop", "full"), false},
+		{"empty", dir, "", "", true},
+		{"absolute", dir, "/etc", "", true},
+		{"parent", dir, "../outside", "", true},
+		{"parent inside", dir, "shop/../../outside", "", true},
+		{"no backup directory", "", "2024-06-01", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{BackupDir: tt.dir}
+			got, err := s.backupPath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("backupPath(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backupPath(%q) error = %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("backupPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (&Server{}).backupPath("x"); !errors.Is(err, access.ErrDenied) {
+		t.Errorf("backupPath() without a backup directory error = %v, want permission denied", err)
+	}
+}
+
+func TestShardLocation(t *testing.T) {
+	dir := t.TempDir()
+	collectionAdmin := access.WithIdentity(context.Background(), &access.Identity{User: "ann", Grants: []access.Grant{
+		{Database: "shop", Collection: "orders", Privileges: []access.Privilege{access.Admin}},
+	}})
+	admin := access.WithIdentity(context.Background(), &access.Identity{User: "root", Grants: []access.Grant{
+		{Database: access.AnyDatabase, Privileges: []access.Privilege{access.Admin}},
+	}})
+	tests := []struct {
+		name     string
+		dir      string
+		ctx      context.Context
+		location string
+		want     string
+		wantErr  error // Checked with errors.Is when set
+		fails    bool
+	}{
+		{"relative directory", dir, collectionAdmin, "orders-1", filepath.Join(dir, "orders-1"), nil, false},
+		{"absolute directory", dir, admin, "/etc/orders", "", nil, true},
+		{"parent directory", dir, admin, "../orders", "", nil, true},
+		{"empty", dir, admin, "", "", nil, true},
+		{"no shard directory", "", admin, "orders-1", "", access.ErrDenied, true},
+		{"server, collection admin", dir, collectionAdmin, "tcp://10.0.0.5:7070", "", access.ErrDenied, true},
+		{"server, admin of every database", "", admin, "tcp://10.0.0.5:7070", "tcp://10.0.0.5:7070", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{ShardDir: tt.dir}
+			got, err := s.shardLocation(tt.ctx, tt.location)
+			if tt.fails {
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+					t.Fatalf("shardLocation(%q) = %q, %v, want error %v", tt.location, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("shardLocation(%q) error = %v", tt.location, err)
+			}
+			if got != tt.want {
+				t.Errorf("shardLocation(%q) = %q, want %q", tt.location, got, tt.want)
+			}
+		})
+	}
+}
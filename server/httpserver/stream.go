@@ -0,0 +1,220 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/changes"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+)
+
+// relay buffers change events between a watch and one streaming client.
+// If the client falls BufferSize events behind, the watch is cancelled
+// rather than letting events pile up; the client is then told where to
+// resume once it has drained what was already buffered.
+type relay struct {
+	events   chan models.ChangeEvent
+	overflow chan struct{} // Closed when the client fell too far behind
+}
+
+func (s *Server) startRelay(stream *changes.Stream, cancel context.CancelFunc) *relay {
+	rl := &relay{
+		events:   make(chan models.ChangeEvent, s.BufferSize),
+		overflow: make(chan struct{}),
+	}
+	go func() {
+		defer close(rl.events)
+		for event := range stream.C {
+			select {
+			case rl.events <- event:
+			default:
+				close(rl.overflow)
+				cancel()
+				return
+			}
+		}
+	}()
+	return rl
+}
+
+// overflowed reports whether the relay gave up on a slow client
+func (rl *relay) overflowed() bool {
+	select {
+	case <-rl.overflow:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch streams changes to a database or collection. Clients asking for a
+// WebSocket upgrade get WebSocket messages, everyone else Server-Sent Events.
+//
+// Query parameters: filter (JSON document filter), ops (comma separated),
+// fullDocument=true and resumeAfter (a token from an earlier event). SSE
+// clients reconnecting with Last-Event-ID resume from that event.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	opts, err := watchOptions(r)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var stream *changes.Stream
+	if col := r.PathValue("col"); col != "" {
+		database, err := s.databases(r).UseDatabase(r.PathValue("db"))
+		if err != nil {
+			respond(w, nil, err)
+			return
+		}
+		stream, err = collections.NewCollectionManager(database).WithContext(r.Context()).Watch(ctx, col, opts)
+	} else {
+		stream, err = s.databases(r).Watch(ctx, r.PathValue("db"), opts)
+	}
+	if err != nil {
+		respondStatus(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	rl := s.startRelay(stream, cancel)
+	if isWebSocketUpgrade(r) {
+		s.streamWebSocket(w, r, rl, cancel, stream.Start)
+	} else {
+		s.streamSSE(w, r, rl, stream.Start)
+	}
+}
+
+func (s *Server) streamSSE(w http.ResponseWriter, r *http.Request, rl *relay, lastToken string) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(format string, args ...interface{}) error {
+		rc.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := send(": watching\n\n"); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(s.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-rl.events:
+			if !ok {
+				if rl.overflowed() {
+					send("event: overflow\ndata: %s\n\n", overflowMessage(lastToken))
+				}
+				return
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if err := send("id: %s\nevent: %s\ndata: %s\n\n", event.Token(), event.Op, payload); err != nil {
+				return
+			}
+			lastToken = event.Token()
+		case <-heartbeat.C:
+			if err := send(": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) streamWebSocket(w http.ResponseWriter, r *http.Request, rl *relay, cancel context.CancelFunc, lastToken string) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.close()
+
+	// The client only sends control frames; reading them notices a close
+	go func() {
+		ws.readLoop()
+		cancel()
+	}()
+
+	heartbeat := time.NewTicker(s.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-rl.events:
+			if !ok {
+				if rl.overflowed() {
+					ws.writeText(s.WriteTimeout, overflowMessage(lastToken))
+				}
+				return
+			}
+			message, err := json.Marshal(struct {
+				Type  string             `json:"type"`
+				Token string             `json:"token"`
+				Event models.ChangeEvent `json:"event"`
+			}{"change", event.Token(), event})
+			if err != nil {
+				return
+			}
+			if err := ws.writeText(s.WriteTimeout, message); err != nil {
+				return
+			}
+			lastToken = event.Token()
+		case <-heartbeat.C:
+			if err := ws.writePing(s.WriteTimeout); err != nil {
+				return
+			}
+		case <-ws.done:
+			return
+		}
+	}
+}
+
+// overflowMessage tells a client that fell behind where to resume from
+func overflowMessage(lastToken string) []byte {
+	message, _ := json.Marshal(map[string]string{
+		"type":        "overflow",
+		"message":     "client fell too far behind; reconnect with resumeAfter",
+		"resumeAfter": lastToken,
+	})
+	return message
+}
+
+func watchOptions(r *http.Request) (changes.WatchOptions, error) {
+	query := r.URL.Query()
+	filter, err := parseFilter(r)
+	if err != nil {
+		return changes.WatchOptions{}, err
+	}
+
+	opts := changes.WatchOptions{
+		Filter:       filter,
+		FullDocument: query.Get("fullDocument") == "true",
+		ResumeAfter:  query.Get("resumeAfter"),
+	}
+	if ops := query.Get("ops"); ops != "" {
+		opts.Ops = strings.Split(ops, ",")
+	}
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		opts.ResumeAfter = lastID
+	}
+	return opts, nil
+}
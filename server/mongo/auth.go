@@ -0,0 +1,120 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/auth"
+)
+
+// preAuth lists the commands answered before a connection authenticates
+var preAuth = map[string]bool{
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"buildInfo":    true,
+	"buildinfo":    true,
+	"ping":         true,
+	"endSessions":  true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"logout":       true,
+}
+
+// authorize rejects commands from unauthenticated connections once users
+// exist, and from clients on other hosts until then
+func (s *Server) authorize(sess *session, name string) error {
+	if sess.user != nil || preAuth[name] {
+		return nil
+	}
+	required, err := s.users.Required(sess.remote)
+	if err != nil {
+		return err
+	}
+	if required {
+		return newError(codeUnauthorized, fmt.Sprintf("command %s requires authentication", name))
+	}
+	return nil
+}
+
+// saslStart begins a SCRAM-SHA-256 conversation
+func (s *Server) saslStart(sess *session, database string, cmd D) (D, error) {
+	if mechanism, _ := cmd.Get("mechanism").(string); mechanism != auth.ScramMechanism {
+		return nil, newError(codeMechanismUnavailable, fmt.Sprintf("unsupported mechanism '%v'", cmd.Get("mechanism")))
+	}
+	payload, err := saslPayload(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.conversations++
+	sess.conversationID = sess.conversations
+	sess.conversation = s.users.NewScram()
+	options, _ := cmd.Get("options").(D)
+	sess.skipEmptyExchange = truthy(options.Get("skipEmptyExchange"))
+	return s.saslStep(sess, payload)
+}
+
+// saslContinue feeds the next client message to the open conversation
+func (s *Server) saslContinue(sess *session, database string, cmd D) (D, error) {
+	id := number(cmd.Get("conversationId"))
+	if sess.conversation == nil || int32(id) != sess.conversationID {
+		return nil, newError(codeProtocolError, "no SASL session state found")
+	}
+	payload, err := saslPayload(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// After the server's final message the client may send an empty one
+	if sess.user != nil && len(payload) == 0 {
+		sess.conversation = nil
+		return D{{"conversationId", sess.conversationID}, {"done", true}, {"payload", Binary{}}}, nil
+	}
+	return s.saslStep(sess, payload)
+}
+
+func (s *Server) saslStep(sess *session, payload []byte) (D, error) {
+	reply, done, err := sess.conversation.Step(payload)
+	if err != nil {
+		sess.conversation = nil
+		return nil, newError(codeAuthenticationFailed, "Authentication failed.")
+	}
+	if done {
+		user := sess.conversation.User()
+		identity, err := s.users.Identity(user)
+		if err != nil {
+			return nil, err
+		}
+		sess.user = user
+		sess.ctx = access.WithIdentity(context.Background(), identity)
+		// With skipEmptyExchange the final server message ends the conversation
+		if sess.skipEmptyExchange {
+			sess.conversation = nil
+		} else {
+			done = false
+		}
+	}
+	return D{{"conversationId", sess.conversationID}, {"done", done}, {"payload", Binary{Data: reply}}}, nil
+}
+
+func (s *Server) logout(sess *session, database string, cmd D) (D, error) {
+	sess.user = nil
+	sess.ctx = context.Background()
+	sess.conversation = nil
+	return D{}, nil
+}
+
+// saslPayload reads a SASL message, which drivers send as binary or a string
+func saslPayload(cmd D) ([]byte, error) {
+	switch p := cmd.Get("payload").(type) {
+	case Binary:
+		return p.Data, nil
+	case string:
+		return []byte(p), nil
+	case nil:
+		return nil, nil
+	}
+	return nil, newError(codeBadValue, "SASL payload must be binary data")
+}
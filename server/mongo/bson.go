@@ -0,0 +1,363 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// D is a BSON document whose field order is kept, as commands require
+type D []E
+
+// E is one field of a D
+type E struct {
+	Key   string
+	Value interface{}
+}
+
+// A is a BSON array
+type A []interface{}
+
+// ObjectID is the 12-byte identifier MongoDB uses for generated _id values
+type ObjectID [12]byte
+
+// Hex returns the identifier as 24 hexadecimal digits
+func (id ObjectID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Binary is BSON binary data with its subtype
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+// Timestamp is the BSON internal timestamp type
+type Timestamp struct {
+	T, I uint32
+}
+
+// Regex is a BSON regular expression
+type Regex struct {
+	Pattern, Options string
+}
+
+// Get returns the value of a field, nil if absent
+func (d D) Get(key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// Has reports whether the document has a field
+func (d D) Has(key string) bool {
+	for _, e := range d {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// BSON element types
+const (
+	typeDouble    = 0x01
+	typeString    = 0x02
+	typeDocument  = 0x03
+	typeArray     = 0x04
+	typeBinary    = 0x05
+	typeUndefined = 0x06
+	typeObjectID  = 0x07
+	typeBool      = 0x08
+	typeDateTime  = 0x09
+	typeNull      = 0x0A
+	typeRegex     = 0x0B
+	typeInt32     = 0x10
+	typeTimestamp = 0x11
+	typeInt64     = 0x12
+	typeMinKey    = 0xFF
+	typeMaxKey    = 0x7F
+)
+
+var errTruncated = errors.New("truncated BSON")
+
+// maxDepth is how deeply documents and arrays may nest, so a hostile message
+// cannot exhaust the stack
+const maxDepth = 100
+
+// decodeDocument decodes one document from the start of b, nested depth
+// levels deep, and returns the bytes it used
+func decodeDocument(b []byte, depth int) (D, int, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("BSON document nested more than %d levels deep", maxDepth)
+	}
+	if len(b) < 5 {
+		return nil, 0, errTruncated
+	}
+	size := int(int32(binary.LittleEndian.Uint32(b)))
+	if size < 5 || size > len(b) || b[size-1] != 0 {
+		return nil, 0, fmt.Errorf("invalid BSON document length %d", size)
+	}
+
+	doc := D{}
+	pos := 4
+	for pos < size-1 {
+		typ := b[pos]
+		pos++
+		key, n, err := readCString(b[pos:size])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		value, n, err := decodeValue(typ, b[pos:size-1], depth)
+		if err != nil {
+			return nil, 0, fmt.Errorf("field '%s': %v", key, err)
+		}
+		pos += n
+		doc = append(doc, E{Key: key, Value: value})
+	}
+	return doc, size, nil
+}
+
+// decodeValue decodes one value of the given type from the start of b, in a
+// document nested depth levels deep, and returns the bytes it used
+func decodeValue(typ byte, b []byte, depth int) (interface{}, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return errTruncated
+		}
+		return nil
+	}
+
+	switch typ {
+	case typeDouble:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), 8, nil
+	case typeString:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		n := int(int32(binary.LittleEndian.Uint32(b)))
+		if n < 1 || len(b) < 4+n {
+			return nil, 0, errTruncated
+		}
+		return string(b[4 : 4+n-1]), 4 + n, nil
+	case typeDocument:
+		return decodeDocument(b, depth+1)
+	case typeArray:
+		doc, n, err := decodeDocument(b, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		arr := make(A, len(doc))
+		for i, e := range doc {
+			arr[i] = e.Value
+		}
+		return arr, n, nil
+	case typeBinary:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		n := int(int32(binary.LittleEndian.Uint32(b)))
+		if n < 0 || len(b) < 5+n {
+			return nil, 0, errTruncated
+		}
+		return Binary{Subtype: b[4], Data: append([]byte(nil), b[5:5+n]...)}, 5 + n, nil
+	case typeUndefined, typeNull, typeMinKey, typeMaxKey:
+		return nil, 0, nil
+	case typeObjectID:
+		if err := need(12); err != nil {
+			return nil, 0, err
+		}
+		var id ObjectID
+		copy(id[:], b)
+		return id, 12, nil
+	case typeBool:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		return b[0] != 0, 1, nil
+	case typeDateTime:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return time.UnixMilli(int64(binary.LittleEndian.Uint64(b))).UTC(), 8, nil
+	case typeRegex:
+		pattern, n, err := readCString(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		options, m, err := readCString(b[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return Regex{Pattern: pattern, Options: options}, n + m, nil
+	case typeInt32:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return int32(binary.LittleEndian.Uint32(b)), 4, nil
+	case typeTimestamp:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return Timestamp{I: binary.LittleEndian.Uint32(b), T: binary.LittleEndian.Uint32(b[4:])}, 8, nil
+	case typeInt64:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(b)), 8, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported BSON type 0x%02x", typ)
+}
+
+func readCString(b []byte) (string, int, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", 0, errTruncated
+	}
+	return string(b[:i]), i + 1, nil
+}
+
+// encodeDocument encodes a D or a map; map fields are written in sorted order
+func encodeDocument(doc interface{}) ([]byte, error) {
+	return appendDocument(nil, doc)
+}
+
+func appendDocument(buf []byte, doc interface{}) ([]byte, error) {
+	var fields D
+	switch d := doc.(type) {
+	case D:
+		fields = d
+	case map[string]interface{}:
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fields = append(fields, E{Key: k, Value: d[k]})
+		}
+	default:
+		return nil, fmt.Errorf("cannot encode %T as a BSON document", doc)
+	}
+
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	for _, e := range fields {
+		var err error
+		if buf, err = appendElement(buf, e.Key, e.Value); err != nil {
+			return nil, err
+		}
+	}
+	buf = append(buf, 0)
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start))
+	return buf, nil
+}
+
+func appendElement(buf []byte, key string, value interface{}) ([]byte, error) {
+	header := func(typ byte) {
+		buf = append(buf, typ)
+		buf = append(buf, key...)
+		buf = append(buf, 0)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		header(typeNull)
+	case float64:
+		header(typeDouble)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	case float32:
+		header(typeDouble)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(float64(v)))
+	case string:
+		header(typeString)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(v)+1))
+		buf = append(buf, v...)
+		buf = append(buf, 0)
+	case D, map[string]interface{}:
+		header(typeDocument)
+		return appendDocument(buf, v)
+	case A:
+		header(typeArray)
+		return appendArray(buf, v)
+	case []interface{}:
+		header(typeArray)
+		return appendArray(buf, v)
+	case []D:
+		header(typeArray)
+		arr := make([]interface{}, len(v))
+		for i, d := range v {
+			arr[i] = d
+		}
+		return appendArray(buf, arr)
+	case []string:
+		header(typeArray)
+		arr := make([]interface{}, len(v))
+		for i, s := range v {
+			arr[i] = s
+		}
+		return appendArray(buf, arr)
+	case Binary:
+		header(typeBinary)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(v.Data)))
+		buf = append(buf, v.Subtype)
+		buf = append(buf, v.Data...)
+	case ObjectID:
+		header(typeObjectID)
+		buf = append(buf, v[:]...)
+	case bool:
+		header(typeBool)
+		if v {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	case time.Time:
+		header(typeDateTime)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v.UnixMilli()))
+	case Regex:
+		header(typeRegex)
+		buf = append(buf, v.Pattern...)
+		buf = append(buf, 0)
+		buf = append(buf, v.Options...)
+		buf = append(buf, 0)
+	case int32:
+		header(typeInt32)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(v))
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return appendElement(buf, key, int32(v))
+		}
+		return appendElement(buf, key, int64(v))
+	case int64:
+		header(typeInt64)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+	case Timestamp:
+		header(typeTimestamp)
+		buf = binary.LittleEndian.AppendUint32(buf, v.I)
+		buf = binary.LittleEndian.AppendUint32(buf, v.T)
+	default:
+		return nil, fmt.Errorf("cannot encode %T as BSON", value)
+	}
+	return buf, nil
+}
+
+func appendArray(buf []byte, arr []interface{}) ([]byte, error) {
+	doc := make(D, len(arr))
+	for i, v := range arr {
+		doc[i] = E{Key: fmt.Sprint(i), Value: v}
+	}
+	return appendDocument(buf, doc)
+}
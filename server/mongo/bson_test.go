@@ -0,0 +1,102 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// nested returns a document holding levels documents, each inside the last
+// under the key "a"
+func nested(levels int) []byte {
+	// A document holding k levels is 8 bytes longer than one holding k-1
+	doc := make([]byte, 0, 5+8*levels)
+	for k := levels; k > 0; k-- {
+		doc = binary.LittleEndian.AppendUint32(doc, uint32(5+8*k))
+		doc = append(doc, typeDocument, 'a', 0)
+	}
+	doc = append(doc, 5, 0, 0, 0, 0)
+	return append(doc, make([]byte, levels)...)
+}
+
+func TestDecodeDocumentDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		levels  int
+		wantErr bool
+	}{
+		{"flat", 0, false},
+		{"shallow", 3, false},
+		{"at the limit", maxDepth, false},
+		{"past the limit", maxDepth + 1, true},
+		{"hostile", 1_000_000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := nested(tt.levels)
+			doc, n, err := decodeDocument(raw, 0)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "nested more than") {
+					t.Fatalf("decodeDocument() error = %v, want a nesting error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeDocument() error = %v", err)
+			}
+			if n != len(raw) {
+				t.Errorf("decodeDocument() used %d bytes, want %d", n, len(raw))
+			}
+			depth := 0
+			for len(doc) > 0 {
+				doc, _ = doc.Get("a").(D)
+				depth++
+			}
+			if tt.levels > 0 && depth != tt.levels {
+				t.Errorf("decoded %d levels, want %d", depth, tt.levels)
+			}
+		})
+	}
+}
+
+func TestReadMessageLimit(t *testing.T) {
+	// An OP_MSG whose body is one empty document under the ping command
+	body, err := encodeDocument(D{{"ping", int32(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := func(size int) []byte {
+		section := append([]byte{0, 0, 0, 0, 0}, body...)
+		section = append(section, make([]byte, size)...)
+		header := make([]byte, 16)
+		binary.LittleEndian.PutUint32(header, uint32(16+len(section)))
+		binary.LittleEndian.PutUint32(header[12:], opMsg)
+		return append(header, section...)
+	}
+
+	tests := []struct {
+		name    string
+		padding int
+		limit   int32
+		wantErr bool
+	}{
+		{"small before auth", 0, maxPreAuthMessageSize, false},
+		{"large before auth", maxPreAuthMessageSize, maxPreAuthMessageSize, true},
+		{"large after auth", maxPreAuthMessageSize, maxMessageSize, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readMessage(bytes.NewReader(frame(tt.padding)), tt.limit)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid message length") {
+					t.Fatalf("readMessage() error = %v, want a length error", err)
+				}
+				return
+			}
+			if err != nil && strings.Contains(err.Error(), "invalid message length") {
+				t.Fatalf("readMessage() error = %v", err)
+			}
+		})
+	}
+}
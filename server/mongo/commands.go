@@ -0,0 +1,764 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/models"
+)
+
+type commandFunc func(s *Server, sess *session, database string, cmd D) (D, error)
+
+var commandTable = map[string]commandFunc{
+	"hello":            (*Server).hello,
+	"isMaster":         (*Server).hello,
+	"ismaster":         (*Server).hello,
+	"ping":             okCommand,
+	"endSessions":      okCommand,
+	"buildInfo":        buildInfo,
+	"buildinfo":        buildInfo,
+	"getCmdLineOpts":   getCmdLineOpts,
+	"getParameter":     getParameter,
+	"connectionStatus": connectionStatus,
+	"getLog":           getLog,
+	"whatsmyuri":       okCommand,
+	"killCursors":      killCursors,
+	"getMore":          getMore,
+	"saslStart":        (*Server).saslStart,
+	"saslContinue":     (*Server).saslContinue,
+	"logout":           (*Server).logout,
+
+	"insert":          (*Server).insert,
+	"find":            (*Server).find,
+	"update":          (*Server).update,
+	"delete":          (*Server).delete,
+	"count":           (*Server).count,
+	"aggregate":       (*Server).aggregate,
+	"listDatabases":   (*Server).listDatabases,
+	"listCollections": (*Server).listCollections,
+	"listIndexes":     (*Server).listIndexes,
+	"createIndexes":   (*Server).createIndexes,
+	"create":          (*Server).create,
+	"drop":            (*Server).drop,
+	"dropDatabase":    (*Server).dropDatabase,
+}
+
+// run executes a command document and returns its reply
+func (s *Server) run(sess *session, cmd D) D {
+	if len(cmd) == 0 {
+		return errorReply(fmt.Errorf("empty command"), codeBadValue)
+	}
+	name := cmd[0].Key
+	fn, ok := commandTable[name]
+	if !ok {
+		return errorReply(newError(codeCommandNotFound, fmt.Sprintf("no such command: '%s'", name)), codeCommandNotFound)
+	}
+
+	if err := s.authorize(sess, name); err != nil {
+		return errorReply(err, codeInternalError)
+	}
+
+	database, _ := cmd.Get("$db").(string)
+	if database == "" {
+		database = "test"
+	}
+	reply, err := fn(s, sess, database, cmd)
+	if err != nil {
+		return errorReply(err, codeInternalError)
+	}
+	return append(reply, E{"ok", 1.0})
+}
+
+func okCommand(s *Server, sess *session, database string, cmd D) (D, error) {
+	return D{}, nil
+}
+
+func (s *Server) hello(sess *session, database string, cmd D) (D, error) {
+	primary := "isWritablePrimary"
+	if cmd[0].Key != "hello" {
+		primary = "ismaster"
+	}
+	reply := D{
+		{primary, true},
+		{"helloOk", true},
+		{"maxBsonObjectSize", int32(16 * 1024 * 1024)},
+		{"maxMessageSizeBytes", int32(maxMessageSize)},
+		{"maxWriteBatchSize", int32(100000)},
+		{"localTime", time.Now()},
+		{"logicalSessionTimeoutMinutes", int32(30)},
+		{"connectionId", sess.id},
+		{"minWireVersion", int32(0)},
+		{"maxWireVersion", int32(17)},
+		{"readOnly", s.dbm.Writable() != nil},
+	}
+	if cmd.Has("saslSupportedMechs") {
+		reply = append(reply, E{"saslSupportedMechs", A{auth.ScramMechanism}})
+	}
+	return reply, nil
+}
+
+func buildInfo(s *Server, sess *session, database string, cmd D) (D, error) {
+	return D{
+		{"version", "6.0.0"},
+		{"gitVersion", "godb"},
+		{"versionArray", A{int32(6), int32(0), int32(0), int32(0)}},
+		{"bits", int32(64)},
+		{"maxBsonObjectSize", int32(16 * 1024 * 1024)},
+		{"modules", A{}},
+	}, nil
+}
+
+func getCmdLineOpts(s *Server, sess *session, database string, cmd D) (D, error) {
+	return D{{"argv", A{}}, {"parsed", D{}}}, nil
+}
+
+func getParameter(s *Server, sess *session, database string, cmd D) (D, error) {
+	return D{{"featureCompatibilityVersion", D{{"version", "6.0"}}}}, nil
+}
+
+func connectionStatus(s *Server, sess *session, database string, cmd D) (D, error) {
+	users := A{}
+	if sess.user != nil {
+		users = append(users, D{{"user", sess.user.Name}, {"db", "admin"}})
+	}
+	return D{{"authInfo", D{{"authenticatedUsers", users}, {"authenticatedUserRoles", A{}}}}}, nil
+}
+
+func getLog(s *Server, sess *session, database string, cmd D) (D, error) {
+	return D{{"totalLinesWritten", int32(0)}, {"log", A{}}}, nil
+}
+
+// Results are always returned whole in the first batch, so no cursor stays open
+func killCursors(s *Server, sess *session, database string, cmd D) (D, error) {
+	return D{{"cursorsKilled", A{}}, {"cursorsNotFound", cmd.Get("cursors")}, {"cursorsAlive", A{}}, {"cursorsUnknown", A{}}}, nil
+}
+
+func getMore(s *Server, sess *session, database string, cmd D) (D, error) {
+	return nil, newError(codeCursorNotFound, fmt.Sprintf("cursor id %v not found", cmd.Get("getMore")))
+}
+
+// collectionName reads the collection a command targets from its first field
+func collectionName(cmd D) (string, error) {
+	name, ok := cmd[0].Value.(string)
+	if !ok || name == "" {
+		return "", newError(codeBadValue, fmt.Sprintf("collection name for '%s' must be a string", cmd[0].Key))
+	}
+	return name, nil
+}
+
+// asData converts an optional BSON document argument to stored form
+func asData(v interface{}) (map[string]interface{}, error) {
+	switch d := v.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case D:
+		return toData(d).(map[string]interface{}), nil
+	}
+	return nil, newError(codeBadValue, fmt.Sprintf("expected a document, got %T", v))
+}
+
+func cursorReply(database, collection string, docs []interface{}) D {
+	if docs == nil {
+		docs = []interface{}{}
+	}
+	return D{{"cursor", D{
+		{"firstBatch", A(docs)},
+		{"id", int64(0)},
+		{"ns", database + "." + collection},
+	}}}
+}
+
+func (s *Server) insert(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	docs, _ := cmd.Get("documents").(A)
+	ordered := !cmd.Has("ordered") || truthy(cmd.Get("ordered"))
+
+	dm, _, err := s.open(sess, database, coll, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int32
+	var writeErrors A
+	for i, item := range docs {
+		doc, ok := item.(D)
+		if !ok {
+			return nil, newError(codeBadValue, "documents must be documents")
+		}
+		if !doc.Has("_id") {
+			doc = append(D{{"_id", newObjectID()}}, doc...)
+		}
+		_, err := dm.CreateDocument(documentName(doc.Get("_id")), toData(doc).(map[string]interface{}))
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		n++
+	}
+
+	reply := D{{"n", n}}
+	if len(writeErrors) > 0 {
+		reply = append(reply, E{"writeErrors", writeErrors})
+	}
+	return reply, nil
+}
+
+func writeError(index int, err error) D {
+	code := errorCode(err, codeBadValue)
+	msg := err.Error()
+	if code == codeDuplicateKey {
+		msg = "E11000 duplicate key error: " + msg
+	}
+	return D{{"index", int32(index)}, {"code", code}, {"errmsg", msg}}
+}
+
+func (s *Server) find(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := asData(cmd.Get("filter"))
+	if err != nil {
+		return nil, err
+	}
+	_, docs, err := s.query(sess, database, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		data[i] = doc.data
+	}
+	if spec, ok := cmd.Get("sort").(D); ok {
+		sortData(data, spec)
+	}
+	data = window(data, int(number(cmd.Get("skip"))), int(number(cmd.Get("limit"))))
+
+	projection, _ := cmd.Get("projection").(D)
+	batch := make([]interface{}, len(data))
+	for i, d := range data {
+		batch[i] = toBSON(project(d, projection))
+	}
+	return cursorReply(database, coll, batch), nil
+}
+
+// window applies skip and limit; a negative limit is treated like its absolute value
+func window(data []map[string]interface{}, skip, limit int) []map[string]interface{} {
+	if skip > 0 {
+		if skip >= len(data) {
+			return nil
+		}
+		data = data[skip:]
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(data) {
+		data = data[:limit]
+	}
+	return data
+}
+
+func (s *Server) update(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	updates, _ := cmd.Get("updates").(A)
+	ordered := !cmd.Has("ordered") || truthy(cmd.Get("ordered"))
+
+	var n, modified int32
+	var upserted, writeErrors A
+	for i, item := range updates {
+		spec, ok := item.(D)
+		if !ok {
+			return nil, newError(codeBadValue, "updates must be documents")
+		}
+		matched, changed, id, err := s.updateOne(sess, database, coll, spec)
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered {
+				break
+			}
+			continue
+		}
+		n += matched
+		modified += changed
+		if id != nil {
+			upserted = append(upserted, D{{"index", int32(i)}, {"_id", id}})
+		}
+	}
+
+	reply := D{{"n", n}, {"nModified", modified}}
+	if len(upserted) > 0 {
+		reply = append(reply, E{"upserted", upserted})
+	}
+	if len(writeErrors) > 0 {
+		reply = append(reply, E{"writeErrors", writeErrors})
+	}
+	return reply, nil
+}
+
+// updateOne applies one update statement {q, u, upsert, multi}. It returns
+// how many documents matched and changed, and the _id of an upserted document.
+func (s *Server) updateOne(sess *session, database, coll string, spec D) (int32, int32, interface{}, error) {
+	filter, err := asData(spec.Get("q"))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if _, ok := spec.Get("u").(A); ok {
+		return 0, 0, nil, newError(codeBadValue, "pipeline updates are not supported")
+	}
+	update, err := asData(spec.Get("u"))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	dm, docs, err := s.query(sess, database, coll, filter)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(docs) > 1 && !truthy(spec.Get("multi")) {
+		docs = docs[:1]
+	}
+
+	var changed int32
+	for _, doc := range docs {
+		data, err := applyUpdate(doc.data, update)
+		if err != nil {
+			return 0, 0, nil, badValue(err)
+		}
+		if models.Equal(data, doc.data) {
+			continue
+		}
+		if err := save(dm, doc, data); err != nil {
+			return 0, 0, nil, err
+		}
+		changed++
+	}
+	if len(docs) > 0 || !truthy(spec.Get("upsert")) {
+		return int32(len(docs)), changed, nil, nil
+	}
+
+	// Upsert: start from the filter's equality conditions, then apply the update
+	base := make(map[string]interface{})
+	for key, cond := range filter {
+		if !strings.HasPrefix(key, "$") && !isOperatorDocument(cond) {
+			if err := setPath(base, key, cond); err != nil {
+				return 0, 0, nil, badValue(err)
+			}
+		}
+	}
+	data, err := applyUpdate(base, update)
+	if err != nil {
+		return 0, 0, nil, badValue(err)
+	}
+	if _, ok := data["_id"]; !ok {
+		data["_id"] = toData(newObjectID())
+	}
+	dm, _, err = s.open(sess, database, coll, true)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if _, err := dm.CreateDocument(documentName(data["_id"]), data); err != nil {
+		return 0, 0, nil, err
+	}
+	return 1, 0, toBSON(data["_id"]), nil
+}
+
+func (s *Server) delete(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	deletes, _ := cmd.Get("deletes").(A)
+
+	var n int32
+	for _, item := range deletes {
+		spec, ok := item.(D)
+		if !ok {
+			return nil, newError(codeBadValue, "deletes must be documents")
+		}
+		filter, err := asData(spec.Get("q"))
+		if err != nil {
+			return nil, err
+		}
+		dm, docs, err := s.query(sess, database, coll, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) > 1 && number(spec.Get("limit")) == 1 {
+			docs = docs[:1]
+		}
+		for _, doc := range docs {
+			if err := dm.DeleteDocument(doc.name); err != nil {
+				return nil, err
+			}
+			n++
+		}
+	}
+	return D{{"n", n}}, nil
+}
+
+func (s *Server) count(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := asData(cmd.Get("query"))
+	if err != nil {
+		return nil, err
+	}
+	_, docs, err := s.query(sess, database, coll, filter)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		data[i] = doc.data
+	}
+	data = window(data, int(number(cmd.Get("skip"))), int(number(cmd.Get("limit"))))
+	return D{{"n", int32(len(data))}}, nil
+}
+
+// aggregate supports the stages drivers use for counting and simple queries:
+// $match, $sort, $skip, $limit, $project, $count and $group with a constant _id
+func (s *Server) aggregate(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, _ := cmd.Get("pipeline").(A)
+
+	_, docs, err := s.query(sess, database, coll, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	data := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		data[i] = doc.data
+	}
+
+	for _, item := range pipeline {
+		stage, ok := item.(D)
+		if !ok || len(stage) != 1 {
+			return nil, newError(codeBadValue, "each pipeline stage must have exactly one field")
+		}
+		if data, err = applyStage(data, stage[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	batch := make([]interface{}, len(data))
+	for i, d := range data {
+		batch[i] = toBSON(d)
+	}
+	return cursorReply(database, coll, batch), nil
+}
+
+func applyStage(data []map[string]interface{}, stage E) ([]map[string]interface{}, error) {
+	switch stage.Key {
+	case "$match":
+		filter, err := asData(stage.Value)
+		if err != nil {
+			return nil, err
+		}
+		var matched []map[string]interface{}
+		for _, d := range data {
+			ok, err := matches(d, filter)
+			if err != nil {
+				return nil, badValue(err)
+			}
+			if ok {
+				matched = append(matched, d)
+			}
+		}
+		return matched, nil
+	case "$sort":
+		spec, _ := stage.Value.(D)
+		sortData(data, spec)
+		return data, nil
+	case "$skip":
+		return window(data, int(number(stage.Value)), 0), nil
+	case "$limit":
+		return window(data, 0, int(number(stage.Value))), nil
+	case "$project":
+		spec, _ := stage.Value.(D)
+		projected := make([]map[string]interface{}, len(data))
+		for i, d := range data {
+			projected[i] = project(d, spec)
+		}
+		return projected, nil
+	case "$count":
+		field, _ := stage.Value.(string)
+		if len(data) == 0 {
+			return nil, nil
+		}
+		return []map[string]interface{}{{field: int64(len(data))}}, nil
+	case "$group":
+		return group(data, stage.Value)
+	}
+	return nil, newError(codeBadValue, fmt.Sprintf("unsupported pipeline stage %s", stage.Key))
+}
+
+// group folds every document into one group with $sum accumulators
+func group(data []map[string]interface{}, spec interface{}) ([]map[string]interface{}, error) {
+	fields, ok := spec.(D)
+	if !ok {
+		return nil, newError(codeBadValue, "$group needs a document")
+	}
+	if id, ok := fields.Get("_id").(string); ok && strings.HasPrefix(id, "$") {
+		return nil, newError(codeBadValue, "$group only supports a constant _id")
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	result := map[string]interface{}{"_id": toData(fields.Get("_id"))}
+	for _, f := range fields {
+		if f.Key == "_id" {
+			continue
+		}
+		acc, ok := f.Value.(D)
+		if !ok || len(acc) != 1 || acc[0].Key != "$sum" {
+			return nil, newError(codeBadValue, fmt.Sprintf("unsupported accumulator for '%s'", f.Key))
+		}
+		var total float64
+		for _, d := range data {
+			if path, ok := acc[0].Value.(string); ok && strings.HasPrefix(path, "$") {
+				value, _ := getPath(d, path[1:])
+				total += number(models.Normalize(value))
+			} else {
+				total += number(acc[0].Value)
+			}
+		}
+		result[f.Key] = total
+	}
+	return []map[string]interface{}{result}, nil
+}
+
+func (s *Server) listDatabases(sess *session, database string, cmd D) (D, error) {
+	names, err := s.databases(sess).ListDatabases()
+	if err != nil {
+		return nil, err
+	}
+	nameOnly := truthy(cmd.Get("nameOnly"))
+
+	var total int64
+	databases := A{}
+	for _, name := range names {
+		if nameOnly {
+			databases = append(databases, D{{"name", name}})
+			continue
+		}
+		stats, err := s.databases(sess).DatabaseStats(name)
+		if err != nil && errorCode(err, codeInternalError) == codeUnauthorized {
+			// Listed for a collection-level grant, without the right to its stats
+			databases = append(databases, D{{"name", name}, {"sizeOnDisk", int64(0)}, {"empty", false}})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		total += stats.Bytes
+		databases = append(databases, D{
+			{"name", name},
+			{"sizeOnDisk", stats.Bytes},
+			{"empty", stats.Documents == 0},
+		})
+	}
+	if nameOnly {
+		return D{{"databases", databases}}, nil
+	}
+	return D{{"databases", databases}, {"totalSize", total}, {"totalSizeMb", total >> 20}}, nil
+}
+
+func (s *Server) listCollections(sess *session, database string, cmd D) (D, error) {
+	filter, err := asData(cmd.Get("filter"))
+	if err != nil {
+		return nil, err
+	}
+	cm, err := s.collections(sess, database, false)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if cm != nil {
+		if names, err = cm.ListCollections(); err != nil {
+			return nil, err
+		}
+	}
+
+	nameOnly := truthy(cmd.Get("nameOnly"))
+	var batch []interface{}
+	for _, name := range names {
+		info := D{{"name", name}, {"type", "collection"}}
+		if !nameOnly {
+			info = append(info,
+				E{"options", D{}},
+				E{"info", D{{"readOnly", false}}},
+				E{"idIndex", D{{"v", int32(2)}, {"key", D{{"_id", int32(1)}}}, {"name", "_id_"}}},
+			)
+		}
+		ok, err := matches(toData(info).(map[string]interface{}), filter)
+		if err != nil {
+			return nil, badValue(err)
+		}
+		if ok {
+			batch = append(batch, info)
+		}
+	}
+	return cursorReply(database, "$cmd.listCollections", batch), nil
+}
+
+func (s *Server) listIndexes(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	_, col, err := s.open(sess, database, coll, false)
+	if err != nil {
+		return nil, err
+	}
+	if col == nil {
+		return nil, newError(codeNamespaceNotFound, fmt.Sprintf("ns does not exist: %s.%s", database, coll))
+	}
+
+	col.Mutex.RLock()
+	indexes := append([]models.Index(nil), col.Indexes...)
+	col.Mutex.RUnlock()
+
+	batch := []interface{}{D{{"v", int32(2)}, {"key", D{{"_id", int32(1)}}}, {"name", "_id_"}}}
+	for _, index := range indexes {
+		spec := D{{"v", int32(2)}, {"key", D{{index.Field, int32(1)}}}, {"name", index.Field + "_1"}}
+		if index.Unique {
+			spec = append(spec, E{"unique", true})
+		}
+		if index.ExpireAfterSeconds > 0 {
+			spec = append(spec, E{"expireAfterSeconds", index.ExpireAfterSeconds})
+		}
+		batch = append(batch, spec)
+	}
+	return cursorReply(database, coll, batch), nil
+}
+
+// createIndexes maps single-field index specifications onto collection indexes
+func (s *Server) createIndexes(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	specs, _ := cmd.Get("indexes").(A)
+
+	_, existing, err := s.open(sess, database, coll, false)
+	if err != nil {
+		return nil, err
+	}
+	_, col, err := s.open(sess, database, coll, true)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := s.collections(sess, database, false)
+	if err != nil {
+		return nil, err
+	}
+
+	countIndexes := func() int32 {
+		col.Mutex.RLock()
+		defer col.Mutex.RUnlock()
+		return int32(len(col.Indexes)) + 1 // _id is always indexed
+	}
+	before := countIndexes()
+
+	for _, item := range specs {
+		spec, ok := item.(D)
+		if !ok {
+			return nil, newError(codeBadValue, "index specifications must be documents")
+		}
+		key, _ := spec.Get("key").(D)
+		if len(key) != 1 {
+			return nil, newError(codeCannotCreateIndex, "only single-field indexes are supported")
+		}
+		field := key[0].Key
+		if field == "_id" {
+			continue
+		}
+		if spec.Has("expireAfterSeconds") {
+			seconds := int64(number(spec.Get("expireAfterSeconds")))
+			err = cm.CreateTTLIndex(coll, field, time.Duration(seconds)*time.Second)
+		} else {
+			err = cm.CreateIndex(coll, field, truthy(spec.Get("unique")))
+		}
+		if err != nil {
+			return nil, newError(codeCannotCreateIndex, err.Error())
+		}
+	}
+
+	return D{
+		{"numIndexesBefore", before},
+		{"numIndexesAfter", countIndexes()},
+		{"createdCollectionAutomatically", existing == nil},
+	}, nil
+}
+
+func (s *Server) create(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := s.collections(sess, database, true)
+	if err != nil {
+		return nil, err
+	}
+	var opts []collections.CollectionOption
+	if truthy(cmd.Get("capped")) {
+		opts = append(opts, collections.WithCapped(int(number(cmd.Get("max"))), int64(number(cmd.Get("size")))))
+	}
+	if _, err := cm.CreateCollection(coll, opts...); err != nil {
+		return nil, err
+	}
+	return D{}, nil
+}
+
+func (s *Server) drop(sess *session, database string, cmd D) (D, error) {
+	coll, err := collectionName(cmd)
+	if err != nil {
+		return nil, err
+	}
+	_, col, err := s.open(sess, database, coll, false)
+	if err != nil {
+		return nil, err
+	}
+	if col == nil {
+		return nil, newError(codeNamespaceNotFound, "ns not found")
+	}
+	col.Mutex.RLock()
+	indexes := int32(len(col.Indexes)) + 1
+	col.Mutex.RUnlock()
+
+	cm, err := s.collections(sess, database, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := cm.DeleteCollection(coll); err != nil {
+		return nil, err
+	}
+	return D{{"nIndexesWas", indexes}, {"ns", database + "." + coll}}, nil
+}
+
+func (s *Server) dropDatabase(sess *session, database string, cmd D) (D, error) {
+	if err := s.databases(sess).DeleteDatabase(database); err != nil && !isMissing(err) {
+		return nil, err
+	}
+	return D{{"dropped", database}}, nil
+}
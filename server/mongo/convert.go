@@ -0,0 +1,198 @@
+package mongo
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Documents are stored as plain JSON data. BSON types JSON cannot express
+// are kept in MongoDB Extended JSON form ({"$oid": ...}, {"$date": ...}), so
+// they come back with their original type.
+
+// toData converts a BSON value into the form stored in documents
+func toData(value interface{}) interface{} {
+	switch v := value.(type) {
+	case D:
+		data := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			data[e.Key] = toData(e.Value)
+		}
+		return data
+	case A:
+		arr := make([]interface{}, len(v))
+		for i, item := range v {
+			arr[i] = toData(item)
+		}
+		return arr
+	case int32:
+		return int64(v)
+	case ObjectID:
+		return map[string]interface{}{"$oid": v.Hex()}
+	case time.Time:
+		return map[string]interface{}{"$date": v.UTC().Format(time.RFC3339Nano)}
+	case Binary:
+		return map[string]interface{}{"$binary": map[string]interface{}{
+			"base64":  base64.StdEncoding.EncodeToString(v.Data),
+			"subType": fmt.Sprintf("%02x", v.Subtype),
+		}}
+	case Timestamp:
+		return map[string]interface{}{"$timestamp": map[string]interface{}{"t": int64(v.T), "i": int64(v.I)}}
+	case Regex:
+		return map[string]interface{}{"$regularExpression": map[string]interface{}{"pattern": v.Pattern, "options": v.Options}}
+	}
+	return value
+}
+
+// toBSON converts stored data back into BSON values. Documents come back
+// with _id first and the other fields in sorted order.
+func toBSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if special, ok := fromExtended(v); ok {
+			return special
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			if k != "_id" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		doc := make(D, 0, len(v))
+		if id, ok := v["_id"]; ok {
+			doc = append(doc, E{Key: "_id", Value: toBSON(id)})
+		}
+		for _, k := range keys {
+			doc = append(doc, E{Key: k, Value: toBSON(v[k])})
+		}
+		return doc
+	case []interface{}:
+		arr := make(A, len(v))
+		for i, item := range v {
+			arr[i] = toBSON(item)
+		}
+		return arr
+	case float64:
+		// JSON does not keep integer types; integral values become integers again
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return toBSON(int64(v))
+		}
+		return v
+	case int64:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int32(v)
+		}
+		return v
+	case int:
+		return toBSON(int64(v))
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return toBSON(n)
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// fromExtended recognizes a single-key Extended JSON wrapper
+func fromExtended(v map[string]interface{}) (interface{}, bool) {
+	if len(v) != 1 {
+		return nil, false
+	}
+	if s, ok := v["$oid"].(string); ok {
+		raw, err := hex.DecodeString(s)
+		if err == nil && len(raw) == 12 {
+			var id ObjectID
+			copy(id[:], raw)
+			return id, true
+		}
+	}
+	if s, ok := v["$date"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+	}
+	if b, ok := v["$binary"].(map[string]interface{}); ok {
+		data, err := base64.StdEncoding.DecodeString(fmt.Sprint(b["base64"]))
+		var subtype byte
+		fmt.Sscanf(fmt.Sprint(b["subType"]), "%02x", &subtype)
+		if err == nil {
+			return Binary{Subtype: subtype, Data: data}, true
+		}
+	}
+	if ts, ok := v["$timestamp"].(map[string]interface{}); ok {
+		return Timestamp{T: uint32(number(ts["t"])), I: uint32(number(ts["i"]))}, true
+	}
+	if re, ok := v["$regularExpression"].(map[string]interface{}); ok {
+		return Regex{Pattern: fmt.Sprint(re["pattern"]), Options: fmt.Sprint(re["options"])}, true
+	}
+	return nil, false
+}
+
+// documentName derives the stored document's name from its _id
+func documentName(id interface{}) string {
+	switch v := id.(type) {
+	case string:
+		return v
+	case ObjectID:
+		return v.Hex()
+	case map[string]interface{}:
+		if oid, ok := v["$oid"].(string); ok {
+			return oid
+		}
+	}
+	raw, _ := json.Marshal(toData(id))
+	return string(raw)
+}
+
+var objectIDCounter atomic.Uint32
+
+// processUnique is the random part of ObjectIDs generated by this process
+var processUnique = func() [5]byte {
+	var b [5]byte
+	rand.Read(b[:])
+	return b
+}()
+
+// newObjectID generates an ObjectID the way MongoDB drivers do: a timestamp,
+// a per-process random value and a counter
+func newObjectID() ObjectID {
+	var id ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(time.Now().Unix()))
+	copy(id[4:9], processUnique[:])
+	n := objectIDCounter.Add(1)
+	id[9], id[10], id[11] = byte(n>>16), byte(n>>8), byte(n)
+	return id
+}
+
+// number reads a BSON or stored numeric value as a float64
+func number(v interface{}) float64 {
+	switch n := v.(type) {
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// truthy interprets values such as projection and option flags (1, true)
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return number(v) != 0
+}
@@ -0,0 +1,92 @@
+package mongo
+
+import (
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/storage"
+)
+
+// MongoDB error codes used in replies
+const (
+	codeInternalError        = 1
+	codeBadValue             = 2
+	codeUnauthorized         = 13
+	codeProtocolError        = 17
+	codeAuthenticationFailed = 18
+	codeNamespaceNotFound    = 26
+	codeCursorNotFound       = 43
+	codeNamespaceExists      = 48
+	codeCommandNotFound      = 59
+	codeCannotCreateIndex    = 67
+	codeMechanismUnavailable = 334
+	codeNotWritablePrimary   = 10107
+	codeDuplicateKey         = 11000
+)
+
+var codeNames = map[int32]string{
+	codeInternalError:        "InternalError",
+	codeBadValue:             "BadValue",
+	codeUnauthorized:         "Unauthorized",
+	codeProtocolError:        "ProtocolError",
+	codeAuthenticationFailed: "AuthenticationFailed",
+	codeNamespaceNotFound:    "NamespaceNotFound",
+	codeCursorNotFound:       "CursorNotFound",
+	codeNamespaceExists:      "NamespaceExists",
+	codeCommandNotFound:      "CommandNotFound",
+	codeCannotCreateIndex:    "CannotCreateIndex",
+	codeMechanismUnavailable: "MechanismUnavailable",
+	codeNotWritablePrimary:   "NotWritablePrimary",
+	codeDuplicateKey:         "DuplicateKey",
+}
+
+// commandError is an error with the code MongoDB would report for it
+type commandError struct {
+	code int32
+	msg  string
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+func newError(code int32, msg string) error {
+	return &commandError{code: code, msg: msg}
+}
+
+func badValue(err error) error {
+	return &commandError{code: codeBadValue, msg: err.Error()}
+}
+
+// errorCode picks the code for an error, guessing from the managers' messages
+func errorCode(err error, fallback int32) int32 {
+	if ce, ok := err.(*commandError); ok {
+		return ce.code
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, access.ErrDenied.Error()):
+		return codeUnauthorized
+	case strings.Contains(msg, storage.ErrReadOnly.Error()):
+		return codeNotWritablePrimary
+	case strings.Contains(msg, "already exists") && strings.Contains(msg, "document"),
+		strings.Contains(msg, "duplicate value"):
+		return codeDuplicateKey
+	case strings.Contains(msg, "already exists"):
+		return codeNamespaceExists
+	case strings.Contains(msg, "does not exist"):
+		return codeNamespaceNotFound
+	}
+	return fallback
+}
+
+// errorReply is the reply to a failed command
+func errorReply(err error, fallback int32) D {
+	code := errorCode(err, fallback)
+	return D{
+		{"ok", 0.0},
+		{"errmsg", err.Error()},
+		{"code", code},
+		{"codeName", codeNames[code]},
+	}
+}
@@ -0,0 +1,189 @@
+package mongo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Opcodes of the MongoDB wire protocol
+const (
+	opReply = 1
+	opQuery = 2004
+	opMsg   = 2013
+)
+
+// OP_MSG flag bits
+const (
+	flagChecksumPresent = 1 << 0
+	flagMoreToCome      = 1 << 1
+)
+
+const maxMessageSize = 48000000
+
+// maxPreAuthMessageSize caps the messages of a connection that has yet to
+// authenticate, which need only carry the handshake and SASL exchange
+const maxPreAuthMessageSize = 64 * 1024
+
+// message is a request read from a client, reduced to the command it carries
+type message struct {
+	requestID int32
+	opCode    int32
+	command   D    // Command document, with OP_MSG document sequences folded in
+	noReply   bool // The client set moreToCome and expects no response
+}
+
+// readMessage reads the next OP_MSG or legacy OP_QUERY command, of at most
+// limit bytes
+func readMessage(r io.Reader, limit int32) (*message, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int32(binary.LittleEndian.Uint32(header[0:]))
+	if length < 16 || length > limit {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body := make([]byte, length-16)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	msg := &message{
+		requestID: int32(binary.LittleEndian.Uint32(header[4:])),
+		opCode:    int32(binary.LittleEndian.Uint32(header[12:])),
+	}
+	var err error
+	switch msg.opCode {
+	case opMsg:
+		err = msg.parseMsg(body)
+	case opQuery:
+		err = msg.parseQuery(body)
+	default:
+		err = fmt.Errorf("unsupported opcode %d", msg.opCode)
+	}
+	return msg, err
+}
+
+// parseMsg reads OP_MSG: flags, one body section and any document sequences
+func (msg *message) parseMsg(b []byte) error {
+	if len(b) < 4 {
+		return errTruncated
+	}
+	flags := binary.LittleEndian.Uint32(b)
+	msg.noReply = flags&flagMoreToCome != 0
+	b = b[4:]
+	if flags&flagChecksumPresent != 0 {
+		if len(b) < 4 {
+			return errTruncated
+		}
+		b = b[:len(b)-4]
+	}
+
+	var sequences D
+	for len(b) > 0 {
+		kind := b[0]
+		b = b[1:]
+		switch kind {
+		case 0:
+			doc, n, err := decodeDocument(b, 0)
+			if err != nil {
+				return err
+			}
+			msg.command = doc
+			b = b[n:]
+		case 1:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			size := int(int32(binary.LittleEndian.Uint32(b)))
+			if size < 4 || size > len(b) {
+				return errTruncated
+			}
+			section := b[4:size]
+			b = b[size:]
+			identifier, n, err := readCString(section)
+			if err != nil {
+				return err
+			}
+			section = section[n:]
+			docs := A{}
+			for len(section) > 0 {
+				doc, n, err := decodeDocument(section, 0)
+				if err != nil {
+					return err
+				}
+				docs = append(docs, doc)
+				section = section[n:]
+			}
+			sequences = append(sequences, E{Key: identifier, Value: docs})
+		default:
+			return fmt.Errorf("unknown OP_MSG section kind %d", kind)
+		}
+	}
+	if msg.command == nil {
+		return fmt.Errorf("OP_MSG without a body section")
+	}
+	msg.command = append(msg.command, sequences...)
+	return nil
+}
+
+// parseQuery reads a legacy OP_QUERY, which drivers still use for the first
+// handshake; only commands against "<db>.$cmd" are supported
+func (msg *message) parseQuery(b []byte) error {
+	if len(b) < 4 {
+		return errTruncated
+	}
+	collection, n, err := readCString(b[4:])
+	if err != nil {
+		return err
+	}
+	pos := 4 + n + 8 // Skip numberToSkip and numberToReturn
+	if len(b) < pos {
+		return errTruncated
+	}
+	query, _, err := decodeDocument(b[pos:], 0)
+	if err != nil {
+		return err
+	}
+
+	dot := strings.LastIndex(collection, ".")
+	if dot < 0 || collection[dot+1:] != "$cmd" {
+		return fmt.Errorf("OP_QUERY is only supported for commands, not '%s'", collection)
+	}
+	// Commands may be wrapped as {$query: {...}} along with read preferences
+	if inner, ok := query.Get("$query").(D); ok {
+		query = inner
+	}
+	msg.command = append(query, E{Key: "$db", Value: collection[:dot]})
+	return nil
+}
+
+// encodeReply builds the response to msg carrying one document, in the same
+// protocol the request used
+func encodeReply(msg *message, requestID int32, reply D) ([]byte, error) {
+	doc, err := encodeDocument(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 16, 16+20+len(doc))
+	if msg.opCode == opQuery {
+		buf = binary.LittleEndian.AppendUint32(buf, 0) // responseFlags
+		buf = binary.LittleEndian.AppendUint64(buf, 0) // cursorID
+		buf = binary.LittleEndian.AppendUint32(buf, 0) // startingFrom
+		buf = binary.LittleEndian.AppendUint32(buf, 1) // numberReturned
+		binary.LittleEndian.PutUint32(buf[12:], opReply)
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, 0) // flagBits
+		buf = append(buf, 0)                           // body section
+		binary.LittleEndian.PutUint32(buf[12:], opMsg)
+	}
+	buf = append(buf, doc...)
+
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(msg.requestID))
+	return buf, nil
+}
@@ -0,0 +1,358 @@
+package mongo
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/models"
+)
+
+// Queries, sorts, projections and updates work on documents in their stored
+// form; filters and updates are converted with toData before use.
+
+// getPath resolves a dotted path such as "address.city" or "tags.0"
+func getPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = data
+	for _, part := range strings.Split(path, ".") {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			value, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setPath sets a dotted path, creating intermediate documents as needed
+func setPath(data map[string]interface{}, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	current := data
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part]
+		if !ok {
+			created := make(map[string]interface{})
+			current[part] = created
+			current = created
+			continue
+		}
+		nested, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot create field '%s' in element of type %T", part, next)
+		}
+		current = nested
+	}
+	current[parts[len(parts)-1]] = value
+	return nil
+}
+
+// unsetPath removes a dotted path if present
+func unsetPath(data map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	current := data
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := current[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = nested
+	}
+	delete(current, parts[len(parts)-1])
+}
+
+// orderable converts Extended JSON dates to time.Time so they order correctly
+func orderable(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		if s, ok := m["$date"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t
+			}
+		}
+	}
+	return v
+}
+
+// compareValues orders two stored values
+func compareValues(a, b interface{}) int {
+	return models.Compare(orderable(a), orderable(b))
+}
+
+// sameKind reports whether range operators may compare two values, which
+// like MongoDB they only do within numbers, strings or dates
+func sameKind(a, b interface{}) bool {
+	kind := func(v interface{}) string {
+		switch orderable(v).(type) {
+		case float64, int64, int32, int:
+			return "number"
+		case string:
+			return "string"
+		case time.Time:
+			return "date"
+		}
+		return ""
+	}
+	ka := kind(a)
+	return ka != "" && ka == kind(b)
+}
+
+var queryOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true, "$exists": true,
+}
+
+// isOperatorDocument reports whether a condition is {$op: ...} rather than a value
+func isOperatorDocument(cond interface{}) bool {
+	m, ok := cond.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return false
+	}
+	for key := range m {
+		if !queryOperators[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether stored data satisfies a filter
+func matches(data map[string]interface{}, filter map[string]interface{}) (bool, error) {
+	for key, cond := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := cond.([]interface{})
+			if !ok || len(clauses) == 0 {
+				return false, fmt.Errorf("%s must be a nonempty array", key)
+			}
+			matched := 0
+			for _, clause := range clauses {
+				sub, ok := clause.(map[string]interface{})
+				if !ok {
+					return false, fmt.Errorf("%s entries must be documents", key)
+				}
+				ok, err := matches(data, sub)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					matched++
+				}
+			}
+			if (key == "$and" && matched != len(clauses)) || (key == "$or" && matched == 0) || (key == "$nor" && matched > 0) {
+				return false, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return false, fmt.Errorf("unknown top level operator: %s", key)
+		}
+
+		value, found := getPath(data, key)
+		if !isOperatorDocument(cond) {
+			if !equalsCondition(value, found, cond) {
+				return false, nil
+			}
+			continue
+		}
+		for op, arg := range cond.(map[string]interface{}) {
+			ok, err := applyOperator(op, value, found, arg)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// equalsCondition implements equality, where an array field matches if any element does
+func equalsCondition(value interface{}, found bool, cond interface{}) bool {
+	if cond == nil {
+		return !found || value == nil
+	}
+	if !found {
+		return false
+	}
+	if models.Equal(value, cond) {
+		return true
+	}
+	if arr, ok := value.([]interface{}); ok {
+		for _, item := range arr {
+			if models.Equal(item, cond) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func applyOperator(op string, value interface{}, found bool, arg interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return equalsCondition(value, found, arg), nil
+	case "$ne":
+		return !equalsCondition(value, found, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		if !found || !sameKind(value, arg) {
+			return false, nil
+		}
+		c := compareValues(value, arg)
+		switch op {
+		case "$gt":
+			return c > 0, nil
+		case "$gte":
+			return c >= 0, nil
+		case "$lt":
+			return c < 0, nil
+		}
+		return c <= 0, nil
+	case "$in", "$nin":
+		options, ok := arg.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		in := false
+		for _, option := range options {
+			if equalsCondition(value, found, option) {
+				in = true
+				break
+			}
+		}
+		return in == (op == "$in"), nil
+	case "$exists":
+		return found == truthy(arg), nil
+	}
+	return false, fmt.Errorf("unknown operator: %s", op)
+}
+
+// sortData orders documents by a sort specification such as {age: -1, name: 1}
+func sortData(docs []map[string]interface{}, spec D) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range spec {
+			a, _ := getPath(docs[i], e.Key)
+			b, _ := getPath(docs[j], e.Key)
+			c := compareValues(a, b)
+			if number(e.Value) < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// project applies an inclusion or exclusion projection of top-level fields;
+// _id is kept unless excluded explicitly
+func project(data map[string]interface{}, spec D) map[string]interface{} {
+	if len(spec) == 0 {
+		return data
+	}
+	include := false
+	for _, e := range spec {
+		if e.Key != "_id" && truthy(e.Value) {
+			include = true
+		}
+	}
+
+	result := make(map[string]interface{})
+	if include {
+		for _, e := range spec {
+			if truthy(e.Value) {
+				top, _, _ := strings.Cut(e.Key, ".")
+				if value, ok := data[top]; ok {
+					result[top] = value
+				}
+			}
+		}
+		if id, ok := data["_id"]; ok && (!spec.Has("_id") || truthy(spec.Get("_id"))) {
+			result["_id"] = id
+		}
+		return result
+	}
+
+	for key, value := range data {
+		result[key] = value
+	}
+	for _, e := range spec {
+		if !truthy(e.Value) {
+			unsetPath(result, e.Key)
+		}
+	}
+	return result
+}
+
+// applyUpdate returns data changed by an update: either operators ($set,
+// $unset, $inc) or a replacement document, which keeps the _id
+func applyUpdate(data map[string]interface{}, update map[string]interface{}) (map[string]interface{}, error) {
+	operators := 0
+	for key := range update {
+		if strings.HasPrefix(key, "$") {
+			operators++
+		}
+	}
+	if operators > 0 && operators != len(update) {
+		return nil, fmt.Errorf("update document cannot mix operators and fields")
+	}
+
+	if operators == 0 {
+		replaced := models.CloneData(update)
+		if id, ok := data["_id"]; ok {
+			if newID, ok := replaced["_id"]; ok && !models.Equal(id, newID) {
+				return nil, fmt.Errorf("the _id field cannot be changed")
+			}
+			replaced["_id"] = id
+		}
+		return replaced, nil
+	}
+
+	updated := models.CloneData(data)
+	for op, arg := range update {
+		fields, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s needs a document", op)
+		}
+		for path, value := range fields {
+			if path == "_id" {
+				return nil, fmt.Errorf("the _id field cannot be changed")
+			}
+			switch op {
+			case "$set":
+				if err := setPath(updated, path, value); err != nil {
+					return nil, err
+				}
+			case "$unset":
+				unsetPath(updated, path)
+			case "$inc":
+				current, found := getPath(updated, path)
+				if found && !sameKind(current, float64(0)) {
+					return nil, fmt.Errorf("cannot apply $inc to a value of non-numeric type")
+				}
+				if !sameKind(value, float64(0)) {
+					return nil, fmt.Errorf("cannot increment with non-numeric argument")
+				}
+				if err := setPath(updated, path, number(models.Normalize(current))+number(models.Normalize(value))); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("unknown modifier: %s", op)
+			}
+		}
+	}
+	return updated, nil
+}
@@ -0,0 +1,122 @@
+// Package mongo speaks enough of the MongoDB wire protocol (OP_MSG, with the
+// legacy OP_QUERY handshake) and BSON for the mongo shell and drivers to use
+// the store: hello, insert, find, update, delete, listDatabases,
+// listCollections, createIndexes and drop, plus the commands the shell
+// issues when it connects. Once users exist, clients authenticate with
+// SCRAM-SHA-256 through saslStart and saslContinue.
+//
+// A document's _id becomes the stored document's name; the rest of the
+// fields, _id included, are its data.
+package mongo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/db"
+)
+
+// Server answers MongoDB commands from a DBManager
+type Server struct {
+	dbm   *db.DBManager
+	users *auth.UserManager
+
+	connections atomic.Int64
+	requests    atomic.Int32
+}
+
+// New creates a MongoDB-compatible server backed by a DBManager
+func New(dbm *db.DBManager) *Server {
+	return &Server{dbm: dbm, users: auth.NewUserManager(dbm)}
+}
+
+// ListenAndServe serves on a TCP address until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("MongoDB protocol server listening on", addr)
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on a listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// session is the per-connection state
+type session struct {
+	id     int64
+	remote net.Addr        // Decides, until users exist, whether the client is served
+	user   *auth.User      // Set once authenticated
+	ctx    context.Context // Carries the user's identity to the managers
+
+	conversation      *auth.Scram // Open SASL conversation
+	conversationID    int32       // Its conversationId
+	conversations     int32       // Conversations started, for numbering
+	skipEmptyExchange bool        // The client needs no final empty round
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &session{id: s.connections.Add(1), remote: conn.RemoteAddr(), ctx: context.Background()}
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readMessage(reader, s.messageLimit(sess))
+		if err != nil {
+			if msg == nil {
+				if !errors.Is(err, io.EOF) {
+					fmt.Println("MongoDB connection error:", err)
+				}
+				return
+			}
+			// The frame was read but not understood; the client gets an error reply
+			msg.command = nil
+		}
+
+		var reply D
+		if msg.command == nil {
+			reply = errorReply(fmt.Errorf("bad message: %v", err), codeProtocolError)
+		} else {
+			reply = s.run(sess, msg.command)
+		}
+		if msg.noReply {
+			continue
+		}
+
+		out, err := encodeReply(msg, s.requests.Add(1), reply)
+		if err != nil {
+			out, _ = encodeReply(msg, s.requests.Add(1), errorReply(err, codeInternalError))
+		}
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// messageLimit is the largest message a connection may send next: small
+// until it authenticates, once users exist or if it may not be served without them
+func (s *Server) messageLimit(sess *session) int32 {
+	if sess.user != nil {
+		return maxMessageSize
+	}
+	if required, err := s.users.Required(sess.remote); err == nil && !required {
+		return maxMessageSize
+	}
+	return maxPreAuthMessageSize
+}
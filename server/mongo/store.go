@@ -0,0 +1,117 @@
+package mongo
+
+import (
+	"strings"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// stored is a document as the commands see it: its name and a private copy of its data
+type stored struct {
+	name string
+	data map[string]interface{}
+}
+
+// databases returns the DBManager acting for the session's user
+func (s *Server) databases(sess *session) *db.DBManager {
+	return s.dbm.WithContext(sess.ctx)
+}
+
+// collections returns a CollectionManager for a database. Unless create is
+// set, a missing database gives a nil manager.
+func (s *Server) collections(sess *session, database string, create bool) (*collections.CollectionManager, error) {
+	dbm := s.databases(sess)
+	db, err := dbm.UseDatabase(database)
+	if err != nil && isMissing(err) && create {
+		db, err = dbm.CreateDatabase(database)
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			db, err = dbm.UseDatabase(database)
+		}
+	}
+	if err != nil {
+		if isMissing(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return collections.NewCollectionManager(db).WithContext(sess.ctx), nil
+}
+
+// open returns a DocumentManager for a collection, creating the database and
+// collection when create is set, as MongoDB does on first write. Otherwise a
+// missing collection gives a nil manager.
+func (s *Server) open(sess *session, database, collection string, create bool) (*documents.DocumentManager, *models.Collection, error) {
+	cm, err := s.collections(sess, database, create)
+	if err != nil || cm == nil {
+		return nil, nil, err
+	}
+	col, err := cm.UseCollection(collection)
+	if err != nil && isMissing(err) && create {
+		col, err = cm.CreateCollection(collection)
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			col, err = cm.UseCollection(collection)
+		}
+	}
+	if err != nil {
+		if isMissing(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	return documents.NewDocumentManager(col).WithContext(sess.ctx), col, nil
+}
+
+// query returns copies of the documents of a collection that match a filter,
+// in insertion order. Documents written through other APIs get their name as _id.
+func (s *Server) query(sess *session, database, collection string, filter map[string]interface{}) (*documents.DocumentManager, []stored, error) {
+	dm, col, err := s.open(sess, database, collection, false)
+	if err != nil || dm == nil {
+		return dm, nil, err
+	}
+	docs, err := dm.FindDocuments(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	col.Mutex.RLock()
+	all := make([]stored, len(docs))
+	for i, doc := range docs {
+		all[i] = stored{name: doc.Name, data: models.CloneData(doc.Data)}
+	}
+	col.Mutex.RUnlock()
+
+	var results []stored
+	for _, doc := range all {
+		if _, ok := doc.data["_id"]; !ok {
+			doc.data["_id"] = doc.name
+		}
+		ok, err := matches(doc.data, filter)
+		if err != nil {
+			return nil, nil, badValue(err)
+		}
+		if ok {
+			results = append(results, doc)
+		}
+	}
+	return dm, results, nil
+}
+
+// save writes changed data over a stored document in one update
+func save(dm *documents.DocumentManager, doc stored, data map[string]interface{}) error {
+	var unset []string
+	for key := range doc.data {
+		if _, ok := data[key]; !ok {
+			unset = append(unset, key)
+		}
+	}
+	_, err := dm.UpdateDocument(doc.name, data, unset)
+	return err
+}
+
+// isMissing reports whether an error from the managers means "not found"
+func isMissing(err error) bool {
+	return strings.Contains(err.Error(), "does not exist")
+}
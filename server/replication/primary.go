@@ -0,0 +1,188 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// peer is a replica connected to this node
+type peer struct {
+	status ReplicaStatus // Guarded by Node.mu
+}
+
+// ListenAndServe serves replicas on a TCP address until it fails
+func (n *Node) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Replication listening on", addr)
+	return n.Serve(listener)
+}
+
+// Serve accepts replicas on a listener until it is closed
+func (n *Node) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go n.serveReplica(conn)
+	}
+}
+
+// serveReplica streams this node's change log to one replica, from the
+// position its hello names, until either side goes away
+func (n *Node) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	in := json.NewDecoder(bufio.NewReader(conn))
+	out := newSender(conn)
+
+	conn.SetReadDeadline(time.Now().Add(n.Timeout))
+	var hello message
+	if err := in.Decode(&hello); err != nil || hello.Type != msgHello {
+		fmt.Printf("Replication handshake with %s failed: %v\n", addr, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err := n.admit(hello, conn.RemoteAddr()); err != nil {
+		fmt.Printf("Refused replica %s: %v\n", addr, err)
+		out.send(message{Type: msgError, Error: err.Error()}, true)
+		return
+	}
+
+	p := &peer{status: ReplicaStatus{Address: addr, User: hello.User, ConnectedAt: time.Now().UTC(), LSN: hello.After}}
+	n.mu.Lock()
+	n.replicas[p] = struct{}{}
+	n.mu.Unlock()
+	// The change log keeps what the replica still needs while it is connected
+	hold := "replica " + addr
+	n.log.Retain(hold, hello.After)
+	acked := make(chan struct{}) // Closed once acknowledgements can no longer move the hold
+	defer func() {
+		<-acked
+		n.log.Release(hold)
+		n.mu.Lock()
+		delete(n.replicas, p)
+		n.mu.Unlock()
+	}()
+	fmt.Printf("Replica %s connected after LSN %d\n", addr, hello.After)
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	// Acknowledgements, until the replica disconnects
+	go func() {
+		defer close(acked)
+		defer cancel()
+		for {
+			var ack message
+			if err := in.Decode(&ack); err != nil {
+				return
+			}
+			if ack.Type == msgAck {
+				n.mu.Lock()
+				p.status.LSN = ack.LSN
+				n.mu.Unlock()
+				n.log.Retain(hold, ack.LSN)
+			}
+		}
+	}()
+
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(n.Heartbeat)
+		defer ticker.Stop()
+		for {
+			if err := out.send(message{Type: msgHeartbeat, LSN: n.log.LastLSN()}, true); err != nil {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err := n.log.Follow(ctx, hello.After, func(event models.ChangeEvent) error {
+		return n.sendChange(out, event)
+	})
+	if ctx.Err() == nil {
+		out.send(message{Type: msgError, Error: err.Error()}, true)
+	}
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("disconnected")
+	}
+	fmt.Printf("Replica %s stopped: %v\n", addr, err)
+}
+
+// admit checks a replica's credentials, once users exist, and that the
+// position it holds is one this node's log went through. Until users exist
+// only a replica on this host is admitted.
+func (n *Node) admit(hello message, remote net.Addr) error {
+	required, err := n.users.Required(remote)
+	if err != nil {
+		return err
+	}
+	if required {
+		user, err := n.users.Authenticate(hello.User, hello.Password)
+		if err != nil {
+			return err
+		}
+		identity, err := n.users.Identity(user)
+		if err != nil {
+			return err
+		}
+		// Replicas receive every change, to users and roles too
+		ctx := access.WithIdentity(context.Background(), identity)
+		if err := access.Check(ctx, access.Admin, access.AnyDatabase, ""); err != nil {
+			return err
+		}
+	}
+
+	last := n.log.LastLSN()
+	if hello.After > last {
+		return fmt.Errorf("replica holds changes up to LSN %d, past this node's last change at LSN %d; it has diverged, so resync it from an empty data directory", hello.After, last)
+	}
+	if hello.After > 0 {
+		entry, err := n.log.Entry(hello.After)
+		if err != nil {
+			return err
+		}
+		if hello.Time == nil || !entry.Time.Equal(*hello.Time) {
+			return fmt.Errorf("replica's change at LSN %d is not this node's; it has diverged, so resync it from an empty data directory", hello.After)
+		}
+	}
+	return nil
+}
+
+// sendChange sends a change, preceded by the compression dictionary it
+// configures, if any. Changes are flushed once the replica has caught up, so
+// a backlog goes out in large writes.
+func (n *Node) sendChange(out *sender, event models.ChangeEvent) error {
+	if c := event.Metadata; c != nil && c.Compression != nil && c.Compression.Dictionary != "" {
+		dict, err := storage.ReadFile(filepath.Join(n.dbm.Root(), storage.DictionariesDir, c.Compression.Dictionary))
+		if err != nil {
+			return fmt.Errorf("failed to read compression dictionary %s: %v", c.Compression.Dictionary, err)
+		}
+		if err := out.send(message{Type: msgDictionary, Dictionary: dict}, false); err != nil {
+			return err
+		}
+	}
+	last := n.log.LastLSN()
+	return out.send(message{Type: msgChange, Event: &event, LSN: last}, event.LSN >= last)
+}
@@ -0,0 +1,100 @@
+package replication
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	documents "Build-your-own-database/database/document"
+)
+
+func TestServeReplicaReleasesHold(t *testing.T) {
+	dbm := db.Open(t.TempDir())
+	defer dbm.Close()
+	database, err := dbm.CreateDatabase("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := collections.NewCollectionManager(database).CreateCollection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := documents.NewDocumentManager(col)
+	if _, err := dm.CreateDocument("a", map[string]interface{}{"n": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tests := []struct {
+		name string
+		stop func(n *Node, replica net.Conn) // Ends the session from one side
+	}{
+		{"replica disconnects", func(n *Node, replica net.Conn) { replica.Close() }},
+		{"primary closes", func(n *Node, replica net.Conn) { n.Close() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Acknowledgements race the end of the session, so try many times
+			for i := 0; i < 20; i++ {
+				for j := 0; j < 3; j++ {
+					if _, err := dm.UpdateDocument("a", map[string]interface{}{"n": i*3 + j}, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				n, err := New(dbm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				replica, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn, err := listener.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				served := make(chan struct{})
+				go func() {
+					n.serveReplica(conn)
+					close(served)
+				}()
+
+				// Positions are counted from the first entry the log still holds
+				first := n.log.FirstLSN()
+				entry, err := n.log.Entry(first)
+				if err != nil {
+					t.Fatal(err)
+				}
+				go io.Copy(io.Discard, replica)
+				go func() {
+					out := json.NewEncoder(replica)
+					out.Encode(message{Type: msgHello, After: first, Time: &entry.Time})
+					for k := 0; out.Encode(message{Type: msgAck, LSN: first + uint64(k%3)}) == nil; k++ {
+					}
+				}()
+				time.Sleep(5 * time.Millisecond)
+				tt.stop(n, replica)
+				<-served
+				replica.Close()
+				n.Close()
+
+				// Nothing holds the log any more, so all but its last entry go
+				if _, err := n.log.Compact(time.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+				if first, last := n.log.FirstLSN(), n.log.LastLSN(); first != last {
+					t.Fatalf("once the replica was gone the log still starts at LSN %d of %d", first, last)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// FollowOptions configures how a replica connects to its primary
+type FollowOptions struct {
+	// User and Password authenticate the replica once the primary has users;
+	// the user needs admin on every database. The password is sent as is,
+	// unencrypted, so replicate only over a trusted network.
+	User     string
+	Password string
+}
+
+// follower is a replica's connection to its primary
+type follower struct {
+	addr   string
+	opts   FollowOptions
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the follower has stopped applying changes
+	status FollowStatus  // Guarded by Node.mu
+}
+
+// stopError is a failure that reconnecting cannot fix, such as a diverged log
+type stopError struct {
+	err error
+}
+
+func (e *stopError) Error() string {
+	return e.err.Error()
+}
+
+// Follow makes the node a replica of the primary at addr. From then on the
+// managers of its storage root refuse writes, and the primary's changes are
+// applied as they arrive, reconnecting whenever the connection drops, until
+// the node is promoted or closed. The node must start from an empty storage
+// root, or from one that followed the same primary before.
+func (n *Node) Follow(addr string, opts FollowOptions) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.follow != nil {
+		return fmt.Errorf("invalid follow: this node already follows %s", n.follow.addr)
+	}
+	reason := fmt.Sprintf("this node is a replica of %s; send writes to the primary", addr)
+	if err := storage.SetReadOnly(n.dbm.Root(), reason); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	f := &follower{addr: addr, opts: opts, cancel: cancel, done: make(chan struct{}), status: FollowStatus{Address: addr}}
+	n.follow = f
+	go n.run(ctx, f)
+	fmt.Printf("Replicating from %s after LSN %d\n", addr, n.log.LastLSN())
+	return nil
+}
+
+// Promote stops following the primary and makes the node accept writes. Its
+// log carries on from the last change it applied; changes the primary made
+// after that are not on it, so replicas holding them must be resynced.
+func (n *Node) Promote() error {
+	n.mu.Lock()
+	f := n.follow
+	n.follow = nil
+	n.mu.Unlock()
+	if f == nil {
+		return fmt.Errorf("invalid promotion: this node is already a primary")
+	}
+
+	f.cancel()
+	<-f.done
+	if err := storage.SetReadOnly(n.dbm.Root(), ""); err != nil {
+		return err
+	}
+	fmt.Printf("Promoted to primary at LSN %d, no longer following %s\n", n.log.LastLSN(), f.addr)
+	return nil
+}
+
+// run keeps a connection to the primary, reconnecting after failures, until
+// ctx ends or a failure reconnecting cannot fix
+func (n *Node) run(ctx context.Context, f *follower) {
+	defer close(f.done)
+	for {
+		err := n.stream(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var stop *stopError
+		stopped := errors.As(err, &stop)
+		n.mu.Lock()
+		f.status.Connected = false
+		f.status.Error = err.Error()
+		f.status.Stopped = stopped
+		n.mu.Unlock()
+		if stopped {
+			fmt.Println("Replication stopped:", err)
+			return
+		}
+
+		fmt.Printf("Replication from %s interrupted, retrying in %v: %v\n", f.addr, n.RetryInterval, err)
+		select {
+		case <-time.After(n.RetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stream connects to the primary once and applies what it sends until the
+// connection fails or ctx ends
+func (n *Node) stream(ctx context.Context, f *follower) error {
+	dialer := net.Dialer{Timeout: n.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	hello := message{Type: msgHello, After: n.log.LastLSN(), User: f.opts.User, Password: f.opts.Password}
+	if hello.After > 0 {
+		entry, err := n.log.Entry(hello.After)
+		if err != nil {
+			return &stopError{err}
+		}
+		hello.Time = &entry.Time
+	}
+	out := newSender(conn)
+	if err := out.send(hello, true); err != nil {
+		return err
+	}
+
+	in := json.NewDecoder(bufio.NewReader(conn))
+	unacked := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(n.Timeout))
+		var msg message
+		if err := in.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("primary %s closed the connection", f.addr)
+			}
+			return err
+		}
+
+		switch msg.Type {
+		case msgError:
+			return &stopError{fmt.Errorf("primary %s refused replication: %s", f.addr, msg.Error)}
+		case msgDictionary:
+			if _, err := storage.SaveDictionary(n.dbm.Root(), msg.Dictionary); err != nil {
+				return &stopError{err}
+			}
+			continue
+		case msgChange:
+			if msg.Event == nil {
+				return fmt.Errorf("invalid change from primary: no event")
+			}
+			if err := n.apply(*msg.Event); err != nil {
+				return &stopError{err}
+			}
+			unacked++
+		case msgHeartbeat:
+		default:
+			return fmt.Errorf("invalid message from primary: unknown type '%s'", msg.Type)
+		}
+
+		applied := n.log.LastLSN()
+		caughtUp := applied >= msg.LSN
+		n.mu.Lock()
+		if !f.status.Connected {
+			fmt.Printf("Connected to primary %s at LSN %d\n", f.addr, msg.LSN)
+		}
+		f.status.Connected = true
+		f.status.Error = ""
+		f.status.PrimaryLSN = max(msg.LSN, applied)
+		if msg.Event != nil {
+			when := msg.Event.Time
+			f.status.LastApplied = &when
+			f.status.LagSeconds = time.Since(when).Seconds()
+		}
+		if caughtUp && msg.Type == msgHeartbeat {
+			f.status.LagSeconds = 0
+		}
+		n.mu.Unlock()
+
+		// Acknowledge on heartbeats, once caught up, and now and then while catching up
+		if msg.Type == msgHeartbeat || caughtUp || unacked >= ackEvery {
+			if err := out.send(message{Type: msgAck, LSN: applied}, true); err != nil {
+				return err
+			}
+			unacked = 0
+		}
+	}
+}
+
+// apply replays a change from the primary, then records it in this node's log
+// under the same LSN. A change replayed but not recorded before a crash is
+// sent again on reconnecting, and replaying it twice leaves it as it is.
+func (n *Node) apply(event models.ChangeEvent) error {
+	if err := n.dbm.Apply(event); err != nil {
+		return err
+	}
+	return n.log.Mirror(event)
+}
@@ -0,0 +1,202 @@
+// Package replication keeps warm standbys of a storage root. A primary serves
+// its change log over TCP; each replica applies the changes in order, records
+// them in its own change log under the same LSNs, and serves reads while
+// refusing writes. A replica can be promoted to take writes, and any node can
+// serve replicas of its own, so replicas can be chained.
+//
+// The protocol is JSON, one message per line. A replica opens with a hello
+// naming the last LSN it holds and when that change was made, so a log that
+// has diverged from the primary's is refused. The primary then sends every
+// change after it, the compression dictionaries they need, and heartbeats
+// carrying its latest LSN while idle. The replica acknowledges what it has
+// applied, which lets the primary report how far behind each replica is.
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/changes"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/models"
+)
+
+// Roles a node reports
+const (
+	RolePrimary = "primary" // Takes writes
+	RoleReplica = "replica" // Follows a primary and refuses writes
+)
+
+// Message types
+const (
+	msgHello      = "hello"      // Replica to primary, first: the position it holds and its credentials
+	msgChange     = "change"     // Primary to replica: the next change to apply
+	msgDictionary = "dictionary" // Primary to replica: a compression dictionary the next change needs
+	msgHeartbeat  = "heartbeat"  // Primary to replica: its latest LSN, sent while idle
+	msgError      = "error"      // Primary to replica: why it refused the replica, before closing
+	msgAck        = "ack"        // Replica to primary: the last LSN applied
+)
+
+// writeTimeout bounds how long a single message may take to send
+const writeTimeout = 30 * time.Second
+
+// ackEvery is how many changes a replica applies between acknowledgements while catching up
+const ackEvery = 100
+
+// message is one line of the protocol, in either direction
+type message struct {
+	Type string `json:"type"`
+
+	After    uint64     `json:"after,omitempty"` // Hello: last LSN the replica holds
+	Time     *time.Time `json:"time,omitempty"`  // Hello: when that change was made
+	User     string     `json:"user,omitempty"`
+	Password string     `json:"password,omitempty"` // Hello: sent in the clear, like everything else
+
+	Event      *models.ChangeEvent `json:"event,omitempty"`
+	Dictionary []byte              `json:"dictionary,omitempty"`
+	LSN        uint64              `json:"lsn,omitempty"` // The primary's latest LSN, or in acks the replica's
+	Error      string              `json:"error,omitempty"`
+}
+
+// Status describes a node's part in replication
+type Status struct {
+	Role     string          `json:"role"`
+	LSN      uint64          `json:"lsn"`               // Last change in this node's log
+	Primary  *FollowStatus   `json:"primary,omitempty"` // The primary followed, while a replica
+	Replicas []ReplicaStatus `json:"replicas"`          // Replicas following this node
+}
+
+// FollowStatus is a replica's view of its primary
+type FollowStatus struct {
+	Address     string     `json:"address"`
+	Connected   bool       `json:"connected"`
+	PrimaryLSN  uint64     `json:"primaryLsn"`            // Latest LSN the primary reported
+	Behind      uint64     `json:"behind"`                // Changes the primary reported that are not applied yet
+	LagSeconds  float64    `json:"lagSeconds"`            // How long after it was made the last change was applied; 0 once caught up
+	LastApplied *time.Time `json:"lastApplied,omitempty"` // When the last change applied was made on the primary
+	Error       string     `json:"error,omitempty"`       // Why the last connection ended
+	Stopped     bool       `json:"stopped,omitempty"`     // Set after a failure retrying cannot fix; see Error
+}
+
+// ReplicaStatus is a primary's view of one replica
+type ReplicaStatus struct {
+	Address     string    `json:"address"`
+	User        string    `json:"user,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LSN         uint64    `json:"lsn"`    // Last change the replica acknowledged
+	Behind      uint64    `json:"behind"` // Changes in this node's log the replica has not acknowledged
+}
+
+// Node is a storage root's part in replication: it serves its change log to
+// replicas and, once told to follow a primary, is a replica itself
+type Node struct {
+	dbm   *db.DBManager
+	log   *changes.Log
+	users *auth.UserManager
+
+	// Heartbeat is how often a primary tells idle replicas its latest LSN
+	Heartbeat time.Duration
+	// Timeout is how long a replica waits to connect, or for any message, before reconnecting
+	Timeout time.Duration
+	// RetryInterval is how long a replica waits between attempts to reconnect
+	RetryInterval time.Duration
+
+	ctx    context.Context // Ends every stream when the node is closed
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	follow   *follower          // Set while this node is a replica
+	replicas map[*peer]struct{} // Replicas connected to this node
+}
+
+// New creates the replication node of a DBManager's storage root. It is a
+// primary until Follow is called.
+func New(dbm *db.DBManager) (*Node, error) {
+	log, err := changes.Open(dbm.Root())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Node{
+		dbm:           dbm,
+		log:           log,
+		users:         auth.NewUserManager(dbm),
+		Heartbeat:     time.Second,
+		Timeout:       10 * time.Second,
+		RetryInterval: 2 * time.Second,
+		ctx:           ctx,
+		cancel:        cancel,
+		replicas:      make(map[*peer]struct{}),
+	}, nil
+}
+
+// Status reports the node's role, its position and how far behind it, or its replicas, are
+func (n *Node) Status() Status {
+	status := Status{Role: RolePrimary, LSN: n.log.LastLSN(), Replicas: []ReplicaStatus{}}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if f := n.follow; f != nil {
+		primary := f.status
+		if primary.PrimaryLSN > status.LSN {
+			primary.Behind = primary.PrimaryLSN - status.LSN
+		}
+		status.Role = RoleReplica
+		status.Primary = &primary
+	}
+	for p := range n.replicas {
+		replica := p.status
+		if status.LSN > replica.LSN {
+			replica.Behind = status.LSN - replica.LSN
+		}
+		status.Replicas = append(status.Replicas, replica)
+	}
+	sort.Slice(status.Replicas, func(i, j int) bool { return status.Replicas[i].Address < status.Replicas[j].Address })
+	return status
+}
+
+// Close stops following the primary, if the node is a replica, and
+// disconnects its replicas. The node stays read-only if it was a replica.
+func (n *Node) Close() {
+	n.cancel()
+	n.mu.Lock()
+	f := n.follow
+	n.mu.Unlock()
+	if f != nil {
+		<-f.done
+	}
+}
+
+// sender writes messages to a connection; it may be shared by goroutines
+type sender struct {
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+func newSender(conn net.Conn) *sender {
+	w := bufio.NewWriter(conn)
+	return &sender{conn: conn, w: w, enc: json.NewEncoder(w)}
+}
+
+// send writes a message, pushing it and any buffered before it onto the
+// connection when flush is set
+func (s *sender) send(msg message, flush bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := s.enc.Encode(msg); err != nil {
+		return err
+	}
+	if flush {
+		return s.w.Flush()
+	}
+	return nil
+}
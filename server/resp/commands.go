@@ -0,0 +1,554 @@
+package resp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Build-your-own-database/database/access"
+)
+
+// command describes one supported Redis command; maxArgs -1 means unlimited
+type command struct {
+	minArgs, maxArgs int
+	run              func(s *Server, sess *session, args []string)
+}
+
+// preAuth lists the commands a connection may run before authenticating
+var preAuth = map[string]bool{"AUTH": true, "HELLO": true, "QUIT": true}
+
+var commandTable = map[string]command{
+	"AUTH":    {1, 2, (*Server).auth},
+	"HELLO":   {0, -1, (*Server).hello},
+	"QUIT":    {0, 0, (*Server).quit},
+	"PING":    {0, 1, (*Server).ping},
+	"ECHO":    {1, 1, (*Server).echo},
+	"COMMAND": {0, -1, (*Server).command},
+	"CLIENT":  {1, -1, (*Server).client},
+	"SELECT":  {1, 1, (*Server).selectDB},
+
+	"GET":     {1, 1, (*Server).get},
+	"SET":     {2, -1, (*Server).set},
+	"DEL":     {1, -1, (*Server).del},
+	"EXISTS":  {1, -1, (*Server).exists},
+	"TYPE":    {1, 1, (*Server).typeOf},
+	"EXPIRE":  {2, 2, (*Server).expire},
+	"TTL":     {1, 1, (*Server).ttl},
+	"HSET":    {3, -1, (*Server).hset},
+	"HGET":    {2, 2, (*Server).hget},
+	"HDEL":    {2, -1, (*Server).hdel},
+	"HGETALL": {1, 1, (*Server).hgetall},
+	"KEYS":    {1, 1, (*Server).keysCmd},
+	"SCAN":    {1, -1, (*Server).scan},
+}
+
+const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+func (s *Server) ping(sess *session, args []string) {
+	if len(args) == 1 {
+		sess.out.bulk(args[0])
+		return
+	}
+	sess.out.simple("PONG")
+}
+
+func (s *Server) echo(sess *session, args []string) {
+	sess.out.bulk(args[0])
+}
+
+func (s *Server) quit(sess *session, args []string) {
+	sess.out.ok()
+	sess.quit = true
+}
+
+// auth authenticates the connection: AUTH password (as user "default") or AUTH user password
+func (s *Server) auth(sess *session, args []string) {
+	name, password := "default", args[0]
+	if len(args) == 2 {
+		name, password = args[0], args[1]
+	}
+	if !s.login(sess, name, password) {
+		return
+	}
+	sess.out.ok()
+}
+
+// login checks credentials and replies with an error if they are wrong
+func (s *Server) login(sess *session, name, password string) bool {
+	user, err := s.users.Authenticate(name, password)
+	if err != nil {
+		sess.out.error("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+	identity, err := s.users.Identity(user)
+	if err != nil {
+		sess.out.fail(err)
+		return false
+	}
+	sess.user = user
+	sess.ctx = access.WithIdentity(context.Background(), identity)
+	return true
+}
+
+// hello negotiates the protocol version and may authenticate:
+// HELLO [2|3 [AUTH user password] [SETNAME name]]
+func (s *Server) hello(sess *session, args []string) {
+	proto := sess.out.proto
+	if len(args) > 0 {
+		var err error
+		proto, err = strconv.Atoi(args[0])
+		if err != nil || (proto != 2 && proto != 3) {
+			sess.out.error("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				sess.out.error("ERR syntax error")
+				return
+			}
+			if !s.login(sess, args[i+1], args[i+2]) {
+				return
+			}
+			i += 2
+		case "SETNAME":
+			i++
+		default:
+			sess.out.error("ERR syntax error")
+			return
+		}
+	}
+	if sess.user == nil {
+		required, err := s.users.Required(sess.remote)
+		if err != nil {
+			sess.out.fail(err)
+			return
+		}
+		if required {
+			sess.out.error("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+			return
+		}
+	}
+	sess.out.proto = proto
+
+	sess.out.mapHeader(6)
+	sess.out.bulk("server")
+	sess.out.bulk("godb")
+	sess.out.bulk("version")
+	sess.out.bulk("1.0.0")
+	sess.out.bulk("proto")
+	sess.out.integer(int64(sess.out.proto))
+	sess.out.bulk("mode")
+	sess.out.bulk("standalone")
+	sess.out.bulk("role")
+	sess.out.bulk("master")
+	sess.out.bulk("modules")
+	sess.out.arrayHeader(0)
+}
+
+// command answers introspection from clients such as redis-cli with an empty list
+func (s *Server) command(sess *session, args []string) {
+	if len(args) > 0 && strings.EqualFold(args[0], "DOCS") {
+		sess.out.mapHeader(0)
+		return
+	}
+	sess.out.arrayHeader(0)
+}
+
+// client accepts connection settings such as CLIENT SETNAME and ignores them
+func (s *Server) client(sess *session, args []string) {
+	sess.out.ok()
+}
+
+// selectDB switches to a database by name, or to "db<n>" for an index n
+func (s *Server) selectDB(sess *session, args []string) {
+	name := args[0]
+	if index, err := strconv.Atoi(name); err == nil {
+		if index < 0 {
+			sess.out.error("ERR DB index is out of range")
+			return
+		}
+		name = fmt.Sprintf("db%d", index)
+	}
+	if strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		sess.out.error(fmt.Sprintf("ERR invalid database name '%s'", name))
+		return
+	}
+	sess.database = name
+	sess.out.ok()
+}
+
+func (s *Server) get(sess *session, args []string) {
+	_, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if doc == nil {
+		sess.out.null()
+		return
+	}
+	value, ok := stringOf(doc)
+	if !ok {
+		sess.out.error(wrongType)
+		return
+	}
+	sess.out.bulk(value)
+}
+
+// set stores a string: SET key value [EX seconds|PX milliseconds] [NX|XX] [KEEPTTL]
+func (s *Server) set(sess *session, args []string) {
+	key, value := args[0], args[1]
+	var expireAt time.Time
+	var nx, xx, keepTTL bool
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				sess.out.error("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				sess.out.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			expireAt = time.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			sess.out.error("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		sess.out.error("ERR syntax error")
+		return
+	}
+
+	dm, doc, err := s.lookup(sess, key, true)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if (nx && doc != nil) || (xx && doc == nil) {
+		sess.out.null()
+		return
+	}
+
+	_, name := splitKey(key)
+	data := map[string]interface{}{valueField: value}
+	if doc == nil {
+		_, err = dm.CreateDocument(name, data)
+	} else {
+		var unset []string
+		for field := range doc.Data {
+			if field != valueField {
+				unset = append(unset, field)
+			}
+		}
+		_, err = dm.UpdateDocument(name, data, unset)
+		if err == nil && expireAt.IsZero() && !keepTTL && doc.ExpireAt != nil {
+			err = dm.SetExpireAt(name, time.Time{})
+		}
+	}
+	if err == nil && !expireAt.IsZero() {
+		err = dm.SetExpireAt(name, expireAt)
+	}
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	sess.out.ok()
+}
+
+func (s *Server) del(sess *session, args []string) {
+	var deleted int64
+	for _, key := range args {
+		dm, doc, err := s.lookup(sess, key, false)
+		if err != nil {
+			sess.out.fail(err)
+			return
+		}
+		if doc == nil {
+			continue
+		}
+		if err := dm.DeleteDocument(doc.Name); err != nil {
+			sess.out.fail(err)
+			return
+		}
+		deleted++
+	}
+	sess.out.integer(deleted)
+}
+
+func (s *Server) exists(sess *session, args []string) {
+	var found int64
+	for _, key := range args {
+		_, doc, err := s.lookup(sess, key, false)
+		if err != nil {
+			sess.out.fail(err)
+			return
+		}
+		if doc != nil {
+			found++
+		}
+	}
+	sess.out.integer(found)
+}
+
+func (s *Server) typeOf(sess *session, args []string) {
+	_, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if doc == nil {
+		sess.out.simple("none")
+		return
+	}
+	sess.out.simple(keyType(doc))
+}
+
+// expire sets a key's time to live in seconds; a non-positive one deletes the key
+func (s *Server) expire(sess *session, args []string) {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		sess.out.error("ERR value is not an integer or out of range")
+		return
+	}
+	dm, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if doc == nil {
+		sess.out.integer(0)
+		return
+	}
+
+	if seconds <= 0 {
+		err = dm.DeleteDocument(doc.Name)
+	} else {
+		err = dm.SetExpireAt(doc.Name, time.Now().Add(time.Duration(seconds)*time.Second))
+	}
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	sess.out.integer(1)
+}
+
+// ttl reports the seconds a key has left, -1 without an expiry and -2 for a missing key
+func (s *Server) ttl(sess *session, args []string) {
+	_, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	switch {
+	case doc == nil:
+		sess.out.integer(-2)
+	case doc.ExpireAt == nil:
+		sess.out.integer(-1)
+	default:
+		sess.out.integer(int64((time.Until(*doc.ExpireAt) + 500*time.Millisecond) / time.Second))
+	}
+}
+
+// hset sets hash fields and replies with how many were new: HSET key field value [field value ...]
+func (s *Server) hset(sess *session, args []string) {
+	if len(args)%2 != 1 {
+		sess.out.error("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+	dm, doc, err := s.lookup(sess, args[0], true)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+
+	fields := make(map[string]interface{})
+	for i := 1; i < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	var added int64
+	for field := range fields {
+		if doc == nil {
+			added++
+		} else if _, ok := doc.Data[field]; !ok {
+			added++
+		}
+	}
+
+	_, name := splitKey(args[0])
+	if doc == nil {
+		_, err = dm.CreateDocument(name, fields)
+	} else {
+		_, err = dm.UpdateDocument(name, fields, nil)
+	}
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	sess.out.integer(added)
+}
+
+func (s *Server) hget(sess *session, args []string) {
+	_, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if doc == nil {
+		sess.out.null()
+		return
+	}
+	value, ok := doc.Data[args[1]]
+	if !ok {
+		sess.out.null()
+		return
+	}
+	sess.out.bulk(format(value))
+}
+
+// hdel removes hash fields; removing the last one deletes the key, as in Redis
+func (s *Server) hdel(sess *session, args []string) {
+	dm, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if doc == nil {
+		sess.out.integer(0)
+		return
+	}
+
+	var unset []string
+	for _, field := range args[1:] {
+		if _, ok := doc.Data[field]; ok {
+			unset = append(unset, field)
+		}
+	}
+	if len(unset) == 0 {
+		sess.out.integer(0)
+		return
+	}
+
+	updated, err := dm.UpdateDocument(doc.Name, nil, unset)
+	if err == nil && len(updated.Data) == 0 {
+		err = dm.DeleteDocument(doc.Name)
+	}
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	sess.out.integer(int64(len(unset)))
+}
+
+func (s *Server) hgetall(sess *session, args []string) {
+	_, doc, err := s.lookup(sess, args[0], false)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	if doc == nil {
+		sess.out.mapHeader(0)
+		return
+	}
+
+	fields := make([]string, 0, len(doc.Data))
+	for field := range doc.Data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	sess.out.mapHeader(len(fields))
+	for _, field := range fields {
+		sess.out.bulk(field)
+		sess.out.bulk(format(doc.Data[field]))
+	}
+}
+
+func (s *Server) keysCmd(sess *session, args []string) {
+	entries, err := s.keys(sess)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+	var matched []string
+	for _, e := range entries {
+		if match(args[0], e.key) {
+			matched = append(matched, e.key)
+		}
+	}
+	sess.out.bulks(matched)
+}
+
+// scan pages through keys: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+// The cursor is a position in the sorted key list.
+func (s *Server) scan(sess *session, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		sess.out.error("ERR invalid cursor")
+		return
+	}
+	pattern, count, typ := "*", 10, ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			sess.out.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				sess.out.error("ERR value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			sess.out.error("ERR syntax error")
+			return
+		}
+	}
+
+	entries, err := s.keys(sess)
+	if err != nil {
+		sess.out.fail(err)
+		return
+	}
+
+	// Like Redis, COUNT bounds the keys examined, not the keys returned
+	var batch []string
+	next := cursor
+	for ; next < len(entries) && next < cursor+count; next++ {
+		e := entries[next]
+		if match(pattern, e.key) && (typ == "" || keyType(e.doc) == typ) {
+			batch = append(batch, e.key)
+		}
+	}
+	if next >= len(entries) {
+		next = 0
+	}
+
+	sess.out.arrayHeader(2)
+	sess.out.bulk(strconv.Itoa(next))
+	sess.out.bulks(batch)
+}
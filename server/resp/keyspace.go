@@ -0,0 +1,234 @@
+package resp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// valueField is the document field holding a string key's value
+const valueField = "value"
+
+// entry is a key together with the document behind it
+type entry struct {
+	key string
+	doc *models.Document
+}
+
+// splitKey maps a key to the collection and document name holding it
+func splitKey(key string) (string, string) {
+	if collection, name, found := strings.Cut(key, ":"); found && collection != "" {
+		return collection, name
+	}
+	return DefaultCollection, key
+}
+
+// joinKey is the inverse of splitKey
+func joinKey(collection, name string) string {
+	if collection == DefaultCollection && !strings.Contains(name, ":") {
+		return name
+	}
+	return collection + ":" + name
+}
+
+// open returns a DocumentManager for a collection of the session's database.
+// Unless create is set, a missing database or collection gives a nil manager.
+func (s *Server) open(sess *session, collection string, create bool) (*documents.DocumentManager, error) {
+	dbm := s.dbm.WithContext(sess.ctx)
+	db, err := dbm.UseDatabase(sess.database)
+	if err != nil && errors.Is(err, documents.ErrNotFound) && create {
+		db, err = dbm.CreateDatabase(sess.database)
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			db, err = dbm.UseDatabase(sess.database)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, documents.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cm := collections.NewCollectionManager(db).WithContext(sess.ctx)
+	col, err := cm.UseCollection(collection)
+	if err != nil && errors.Is(err, documents.ErrNotFound) && create {
+		col, err = cm.CreateCollection(collection)
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			col, err = cm.UseCollection(collection)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, documents.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return documents.NewDocumentManager(col).WithContext(sess.ctx), nil
+}
+
+// lookup finds the document behind a key. The document is nil when the key
+// does not exist; the manager is nil when its collection does not exist either.
+func (s *Server) lookup(sess *session, key string, create bool) (*documents.DocumentManager, *models.Document, error) {
+	collection, name := splitKey(key)
+	dm, err := s.open(sess, collection, create)
+	if err != nil || dm == nil {
+		return dm, nil, err
+	}
+	doc, err := dm.UseDocument(name)
+	if err != nil {
+		if errors.Is(err, documents.ErrNotFound) {
+			return dm, nil, nil
+		}
+		return nil, nil, err
+	}
+	return dm, doc, nil
+}
+
+// keys lists every live key of the session's database visible to its user, in sorted order
+func (s *Server) keys(sess *session) ([]entry, error) {
+	db, err := s.dbm.WithContext(sess.ctx).UseDatabase(sess.database)
+	if err != nil {
+		if errors.Is(err, documents.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cm := collections.NewCollectionManager(db).WithContext(sess.ctx)
+	names, err := cm.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []entry
+	for _, name := range names {
+		col, err := cm.UseCollection(name)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := documents.NewDocumentManager(col).WithContext(sess.ctx).FindDocuments(nil)
+		if err != nil && strings.Contains(err.Error(), access.ErrDenied.Error()) {
+			continue // Visible for another privilege, such as index-manage
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			entries = append(entries, entry{key: joinKey(name, doc.Name), doc: doc})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// keyType reports the Redis type of the document behind a key
+func keyType(doc *models.Document) string {
+	if _, ok := stringOf(doc); ok {
+		return "string"
+	}
+	return "hash"
+}
+
+// stringOf returns the value of a string key
+func stringOf(doc *models.Document) (string, bool) {
+	value, ok := doc.Data[valueField]
+	if !ok || len(doc.Data) != 1 {
+		return "", false
+	}
+	return format(value), true
+}
+
+// format renders a stored value as a Redis string; non-strings become JSON
+func format(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(raw)
+}
+
+// match reports whether a key matches a Redis glob pattern (*, ?, [abc], [^a-z], \x).
+// It backtracks only to the last star, so a pattern of many stars takes time
+// proportional to the pattern times the key rather than exponential time.
+func match(pattern, key string) bool {
+	p, k := 0, 0
+	star, starKey := -1, 0 // Pattern position after the last star, and the key position it was retried from
+	for k < len(key) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, starKey = p, k
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := matchByte(pattern[p:], key[k]); ok {
+				p += n
+				k++
+				continue
+			}
+		}
+		// Let the last star take one more byte and try again from there
+		if star < 0 {
+			return false
+		}
+		starKey++
+		p, k = star, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches c against the element at the start of a pattern other
+// than a star, returning the element's length and whether c matches it
+func matchByte(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// An unterminated class is taken literally
+			return 1, c == '['
+		}
+		class := pattern[1 : end+1]
+		negate := strings.HasPrefix(class, "^")
+		if negate {
+			class = class[1:]
+		}
+		return end + 2, inClass(class, c) != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// inClass reports whether c is in a bracket class such as "a-z0"
+func inClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
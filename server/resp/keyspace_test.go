@@ -0,0 +1,48 @@
+package resp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "order:42", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a*", "a", true},
+		{"**a**", "bab", true},
+		{"[abc", "[abc", true},
+		{"", "", true},
+		{"", "a", false},
+		{strings.Repeat("*a", 30) + "b", strings.Repeat("a", 60), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.key, func(t *testing.T) {
+			start := time.Now()
+			if got := match(tt.pattern, tt.key); got != tt.want {
+				t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("match(%q, %q) took %v", tt.pattern, tt.key, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/storage"
+)
+
+// Limits on what a client may send in one command, like Redis's. Until it
+// authenticates they are tight, so an unknown client cannot make the server
+// hold much memory; AUTH and HELLO fit well within them.
+const (
+	maxArgs              = 1 << 20   // Arguments of one command
+	maxBulkLength        = 512 << 20 // Bytes of one argument (512 MB)
+	maxInlineLength      = 64 << 10  // Bytes of an inline command
+	maxPreAuthArgs       = 10
+	maxPreAuthBulkLength = 16 << 10
+)
+
+var errProtocol = errors.New("protocol error")
+
+// limits bounds the commands readCommand accepts
+type limits struct {
+	args       int
+	bulkLength int
+}
+
+var (
+	fullLimits    = limits{args: maxArgs, bulkLength: maxBulkLength}
+	preAuthLimits = limits{args: maxPreAuthArgs, bulkLength: maxPreAuthBulkLength}
+)
+
+// readCommand reads one command, either a RESP array of bulk strings or an
+// inline command as typed into telnet, within the given limits
+func readCommand(r *bufio.Reader, limit limits) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > limit.args {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, max(count, 0))
+	for i := 0; i < count; i++ {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, header)
+		}
+		length, err := strconv.Atoi(header[1:])
+		if err != nil || length < 0 || length > limit.bulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		// The buffer grows as the data arrives rather than up front, so a
+		// length the client never sends costs nothing
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(length)+2); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		args = append(args, string(buf.Bytes()[:length]))
+	}
+	return args, nil
+}
+
+// readLine reads a CRLF (or bare LF) terminated line without its terminator,
+// of at most maxInlineLength bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLength+2 {
+			return "", fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	s := strings.TrimSuffix(string(line), "\n")
+	return strings.TrimSuffix(s, "\r"), nil
+}
+
+// writer encodes replies in RESP2 or, after HELLO 3, RESP3
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	fmt.Fprintf(w.w, "+%s\r\n", s)
+}
+
+func (w *writer) ok() {
+	w.simple("OK")
+}
+
+func (w *writer) error(msg string) {
+	fmt.Fprintf(w.w, "-%s\r\n", strings.ReplaceAll(msg, "\r\n", " "))
+}
+
+// fail replies with a manager error, as NOPERM when access was denied and
+// READONLY when writes are refused, as on a replica
+func (w *writer) fail(err error) {
+	if strings.Contains(err.Error(), access.ErrDenied.Error()) {
+		w.error("NOPERM " + err.Error())
+		return
+	}
+	if strings.Contains(err.Error(), storage.ErrReadOnly.Error()) {
+		w.error("READONLY " + err.Error())
+		return
+	}
+	w.error("ERR " + err.Error())
+}
+
+func (w *writer) integer(n int64) {
+	fmt.Fprintf(w.w, ":%d\r\n", n)
+}
+
+func (w *writer) bulk(s string) {
+	fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) arrayHeader(n int) {
+	fmt.Fprintf(w.w, "*%d\r\n", n)
+}
+
+func (w *writer) bulks(items []string) {
+	w.arrayHeader(len(items))
+	for _, item := range items {
+		w.bulk(item)
+	}
+}
+
+// mapHeader starts a map of n pairs, flattened to an array in RESP2
+func (w *writer) mapHeader(n int) {
+	if w.proto >= 3 {
+		fmt.Fprintf(w.w, "%%%d\r\n", n)
+		return
+	}
+	w.arrayHeader(2 * n)
+}
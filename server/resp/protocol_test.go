@@ -0,0 +1,63 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// multibulk encodes args as a RESP array of bulk strings
+func multibulk(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	many := make([]string, maxPreAuthArgs+1)
+	for i := range many {
+		many[i] = "x"
+	}
+	long := strings.Repeat("v", maxPreAuthBulkLength+1)
+	tests := []struct {
+		name    string
+		input   string
+		limit   limits
+		want    []string
+		wantErr error
+	}{
+		{"auth before auth", multibulk("AUTH", "alice", "s3cret"), preAuthLimits, []string{"AUTH", "alice", "s3cret"}, nil},
+		{"inline before auth", "PING\r\n", preAuthLimits, []string{"PING"}, nil},
+		{"many arguments before auth", multibulk(many...), preAuthLimits, nil, errProtocol},
+		{"many arguments after auth", multibulk(many...), fullLimits, many, nil},
+		{"long argument before auth", multibulk("SET", "k", long), preAuthLimits, nil, errProtocol},
+		{"long argument after auth", multibulk("SET", "k", long), fullLimits, []string{"SET", "k", long}, nil},
+		{"huge multibulk count", "*1000000000\r\n", fullLimits, nil, errProtocol},
+		{"huge bulk length", "*1\r\n$536870913\r\n", fullLimits, nil, errProtocol},
+		{"bulk length never sent", "*1\r\n$536870912\r\nabc", fullLimits, nil, io.ErrUnexpectedEOF},
+		{"long inline command", strings.Repeat("x", maxInlineLength+1) + "\r\n", fullLimits, nil, errProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readCommand(bufio.NewReader(strings.NewReader(tt.input)), tt.limit)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("readCommand() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readCommand() error = %v", err)
+			}
+			if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") {
+				t.Errorf("readCommand() = %d argument(s), want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Package resp serves the document store over the Redis protocol (RESP2 and
+// RESP3) so redis-cli and Redis client libraries can talk to it.
+//
+// Keys map onto documents: "collection:document" names a document in a
+// collection of the selected database, and a key without a colon lives in
+// DefaultCollection. Hashes are documents whose fields are the hash fields;
+// a string is a document holding it in a single "value" field. SELECT takes
+// a database name, or an index n meaning the database "db<n>".
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/db"
+)
+
+// DefaultCollection holds keys that do not name a collection
+const DefaultCollection = "keys"
+
+// DefaultDatabase is selected when a connection opens
+const DefaultDatabase = "db0"
+
+// Server answers Redis commands from a DBManager
+type Server struct {
+	dbm   *db.DBManager
+	users *auth.UserManager
+}
+
+// New creates a RESP server backed by a DBManager
+func New(dbm *db.DBManager) *Server {
+	return &Server{dbm: dbm, users: auth.NewUserManager(dbm)}
+}
+
+// ListenAndServe serves RESP on a TCP address until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("RESP server listening on", addr)
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on a listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// session is the per-connection state
+type session struct {
+	database string
+	remote   net.Addr        // Decides, until users exist, whether the client is served
+	user     *auth.User      // Set by AUTH or HELLO ... AUTH
+	ctx      context.Context // Carries the user's identity to the managers
+	out      *writer
+	quit     bool
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	sess := &session{
+		database: DefaultDatabase,
+		remote:   conn.RemoteAddr(),
+		ctx:      context.Background(),
+		out:      &writer{w: bufio.NewWriter(conn), proto: 2},
+	}
+
+	for !sess.quit {
+		args, err := readCommand(reader, s.limits(sess))
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				sess.out.error("ERR " + err.Error())
+				sess.out.w.Flush()
+			} else if !errors.Is(err, io.EOF) {
+				fmt.Println("RESP connection error:", err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.dispatch(sess, args)
+		}
+
+		// Replies to pipelined commands go out together once the input is drained
+		if reader.Buffered() == 0 || sess.quit {
+			if err := sess.out.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// limits bounds the next command of a session: tightly until it
+// authenticates, once users exist or if it may not be served without them
+func (s *Server) limits(sess *session) limits {
+	if sess.user != nil {
+		return fullLimits
+	}
+	if required, err := s.users.Required(sess.remote); err == nil && !required {
+		return fullLimits
+	}
+	return preAuthLimits
+}
+
+func (s *Server) dispatch(sess *session, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commandTable[name]
+	if !ok {
+		sess.out.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args)-1 < cmd.minArgs || (cmd.maxArgs >= 0 && len(args)-1 > cmd.maxArgs) {
+		sess.out.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	if sess.user == nil && !preAuth[name] {
+		required, err := s.users.Required(sess.remote)
+		if err != nil {
+			sess.out.fail(err)
+			return
+		}
+		if required {
+			sess.out.error("NOAUTH Authentication required.")
+			return
+		}
+	}
+	cmd.run(s, sess, args[1:])
+}
@@ -0,0 +1,170 @@
+package shard
+
+import (
+	"fmt"
+	"slices"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/storage"
+)
+
+// RebalanceReport describes what Rebalance did
+type RebalanceReport struct {
+	Buckets int `json:"buckets"` // Buckets given to another shard
+	Moved   int `json:"moved"`   // Documents copied to the shard now owning them
+	Removed int `json:"removed"` // Copies removed from shards that do not own them
+}
+
+// AddShard adds an empty shard to the collection. It owns no buckets, and so
+// receives no documents, until Rebalance gives it some.
+func (r *Router) AddShard(location string) error {
+	if err := r.check(access.Admin); err != nil {
+		return err
+	}
+	if err := storage.Writable(r.m.root); err != nil {
+		return err
+	}
+	location, err := r.m.normalize(location)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.Contains(r.layout.Shards, location) {
+		return fmt.Errorf("shard %s already exists", redact(location))
+	}
+	if len(r.layout.Shards) == Buckets {
+		return fmt.Errorf("invalid shard: the collection already has %d shards, the most it can use", Buckets)
+	}
+	r.m.mu.Lock()
+	s, err := r.m.open(location)
+	r.m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := s.documents(r.ctx, r.layout.Database, r.layout.Collection, true); err != nil {
+		return err
+	}
+
+	layout := r.layout
+	layout.Shards = append(slices.Clone(layout.Shards), location)
+	if err := r.m.save(layout); err != nil {
+		return err
+	}
+	r.layout = layout
+	r.shards = append(slices.Clone(r.shards), s)
+	fmt.Printf("Added shard %s to '%s.%s'; rebalance to move documents to it\n", redact(location), layout.Database, layout.Collection)
+	return nil
+}
+
+// Rebalance gives every shard an equal share of the buckets. Each bucket that
+// changes hands is copied to its new shard, which then takes it over, and is
+// removed from the old one; the documents a shard gives up wait for reads and
+// writes while they are copied. Document IDs, revisions and history are not
+// carried over. Running it again after an interruption finishes the job.
+func (r *Router) Rebalance() (RebalanceReport, error) {
+	var report RebalanceReport
+	if err := r.check(access.Admin); err != nil {
+		return report, err
+	}
+	if err := storage.Writable(r.m.root); err != nil {
+		return report, err
+	}
+	r.moving.Lock()
+	defer r.moving.Unlock()
+
+	r.mu.RLock()
+	target := balance(r.layout.Buckets, len(r.shards))
+	count := len(r.shards)
+	database, collection := r.layout.Database, r.layout.Collection
+	r.mu.RUnlock()
+	for src := 0; src < count; src++ {
+		if err := r.move(src, target, &report); err != nil {
+			return report, err
+		}
+	}
+
+	// Copies left where documents used to be, by this run or an interrupted one
+	for i := 0; i < count; i++ {
+		if err := r.clean(i, &report); err != nil {
+			return report, err
+		}
+	}
+	fmt.Printf("Rebalanced '%s.%s': %d bucket(s) and %d document(s) moved, %d stale copies removed\n",
+		database, collection, report.Buckets, report.Moved, report.Removed)
+	return report, nil
+}
+
+// move copies the documents of the buckets a shard gives up to the shards
+// taking them, then hands the buckets over
+func (r *Router) move(src int, target []int, report *RebalanceReport) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	layout := r.layout
+	layout.Buckets = slices.Clone(layout.Buckets)
+	for b, owner := range r.layout.Buckets {
+		if owner == src && target[b] != src {
+			layout.Buckets[b] = target[b]
+		}
+	}
+	if slices.Equal(layout.Buckets, r.layout.Buckets) {
+		return nil
+	}
+
+	docs, err := r.list(src)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		from, to := r.layout.owner(doc), layout.owner(doc)
+		if from != src || to == src {
+			continue
+		}
+		dm, err := r.docs(to)
+		if err != nil {
+			return err
+		}
+		if err := copyDocument(dm, doc); err != nil {
+			return r.shards[to].fail(err)
+		}
+		report.Moved++
+	}
+
+	if err := r.m.save(layout); err != nil {
+		return err
+	}
+	for b := range layout.Buckets {
+		if layout.Buckets[b] != r.layout.Buckets[b] {
+			report.Buckets++
+		}
+	}
+	r.layout = layout
+	return nil
+}
+
+// clean removes the documents a shard holds that another shard owns
+func (r *Router) clean(i int, report *RebalanceReport) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	docs, err := r.list(i)
+	if err != nil {
+		return err
+	}
+	dm, err := r.docs(i)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if r.layout.owner(doc) == i {
+			continue
+		}
+		if err := dm.DeleteDocument(doc.Name); err != nil && !notFound(err) {
+			return r.shards[i].fail(err)
+		}
+		report.Removed++
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// Router sends a sharded collection's document operations to its shards. It
+// offers the same document methods as a DocumentManager.
+type Router struct {
+	*router
+	m   *Manager
+	ctx context.Context // Carries the caller's identity, see WithContext
+}
+
+// router is what every Router of a collection shares
+type router struct {
+	mu     sync.RWMutex // Held for writing while the layout changes or buckets move
+	names  sync.Mutex   // Held while creating and renaming, so names stay unique across shards
+	moving sync.Mutex   // Held by Rebalance
+	layout Layout
+	shards []*shard
+}
+
+// WithContext returns a copy of the router whose operations are checked
+// against the identity in ctx, on the router and on directory shards
+func (r *Router) WithContext(ctx context.Context) *Router {
+	return &Router{router: r.router, m: r.m, ctx: ctx}
+}
+
+// Layout returns the collection's layout, without the passwords of its shards
+func (r *Router) Layout() Layout {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.layout.redacted()
+}
+
+// check verifies the caller holds privilege on the collection
+func (r *Router) check(privilege access.Privilege) error {
+	return access.Check(r.ctx, privilege, r.layout.Database, r.layout.Collection)
+}
+
+// docs returns the manager of the collection on one shard; the caller holds mu
+func (r *Router) docs(i int) (Documents, error) {
+	return r.shards[i].documents(r.ctx, r.layout.Database, r.layout.Collection, false)
+}
+
+// each runs fn on the given shards at once and returns the documents they
+// find that belong to them, with the first error; the caller holds mu
+func (r *Router) each(shards []int, fn func(Documents) ([]*models.Document, error)) ([]*models.Document, error) {
+	results := make([][]*models.Document, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for n, i := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dm, err := r.docs(i)
+			if err != nil {
+				errs[n] = err
+				return
+			}
+			if results[n], err = fn(dm); err != nil {
+				errs[n] = r.shards[i].fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var out []*models.Document
+	for n, i := range shards {
+		if errs[n] != nil {
+			return nil, errs[n]
+		}
+		for _, doc := range results[n] {
+			if r.layout.owner(doc) == i {
+				out = append(out, doc)
+			}
+		}
+	}
+	return out, nil
+}
+
+// all returns the index of every shard; the caller holds mu
+func (r *Router) all() []int {
+	shards := make([]int, len(r.shards))
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+// locate finds the shard holding a document by name; the caller holds mu
+func (r *Router) locate(name string) (int, *models.Document, error) {
+	if r.layout.Key == "" {
+		i := r.layout.Buckets[bucket(name)]
+		dm, err := r.docs(i)
+		if err != nil {
+			return 0, nil, err
+		}
+		doc, err := dm.UseDocument(name)
+		return i, doc, err
+	}
+
+	found, err := r.each(r.all(), func(dm Documents) ([]*models.Document, error) {
+		doc, err := dm.UseDocument(name)
+		if notFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []*models.Document{doc}, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(found) == 0 {
+		return 0, nil, fmt.Errorf("document '%s' %w", name, documents.ErrNotFound)
+	}
+	return r.layout.owner(found[0]), found[0], nil
+}
+
+// CreateDocument stores a new document on the shard owning its shard key.
+// Names are unique across the whole collection.
+func (r *Router) CreateDocument(name string, data map[string]interface{}) (*models.Document, error) {
+	if err := r.check(access.Write); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	doc := &models.Document{Name: name, Data: data}
+	if r.layout.Key != "" {
+		if _, ok := doc.Field(r.layout.Key); !ok {
+			return nil, fmt.Errorf("invalid document: it lacks the shard key '%s'", r.layout.Key)
+		}
+		r.names.Lock()
+		defer r.names.Unlock()
+		if _, _, err := r.locate(name); err == nil {
+			return nil, fmt.Errorf("document with name '%s' already exists", name)
+		} else if !notFound(err) {
+			return nil, err
+		}
+	}
+
+	dm, err := r.docs(r.layout.owner(doc))
+	if err != nil {
+		return nil, err
+	}
+	return dm.CreateDocument(name, data)
+}
+
+// UseDocument returns a document by name
+func (r *Router) UseDocument(name string) (*models.Document, error) {
+	if err := r.check(access.Read); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, doc, err := r.locate(name)
+	return doc, err
+}
+
+// UpdateDocument sets and removes keys of a document. The shard key cannot
+// change, as that would move the document to another shard.
+func (r *Router) UpdateDocument(name string, set map[string]interface{}, unset []string) (*models.Document, error) {
+	if err := r.check(access.Write); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, doc, err := r.locate(name)
+	if err != nil {
+		return nil, err
+	}
+	if key := r.layout.Key; key != "" {
+		changed := slices.ContainsFunc(unset, func(k string) bool { return overlaps(k, key) })
+		for k, v := range set {
+			if overlaps(k, key) && !(k == key && models.Equal(v, r.layout.keyOf(doc))) {
+				changed = true
+			}
+		}
+		if changed {
+			return nil, fmt.Errorf("invalid update: the shard key '%s' cannot change; delete the document and create it again", key)
+		}
+	}
+
+	dm, err := r.docs(i)
+	if err != nil {
+		return nil, err
+	}
+	return dm.UpdateDocument(name, set, unset)
+}
+
+// RenameDocument renames a document. When documents are placed by name, one
+// that now belongs to another shard is copied there and deleted where it was.
+func (r *Router) RenameDocument(oldName, newName string) error {
+	if err := r.check(access.Write); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.names.Lock()
+	defer r.names.Unlock()
+
+	i, doc, err := r.locate(oldName)
+	if err != nil {
+		return err
+	}
+	if _, _, err := r.locate(newName); err == nil {
+		return fmt.Errorf("document '%s' already exists", newName)
+	} else if !notFound(err) {
+		return err
+	}
+	from, err := r.docs(i)
+	if err != nil {
+		return err
+	}
+	j := i
+	if r.layout.Key == "" {
+		j = r.layout.Buckets[bucket(newName)]
+	}
+	if j == i {
+		return from.RenameDocument(oldName, newName)
+	}
+
+	to, err := r.docs(j)
+	if err != nil {
+		return err
+	}
+	moved := *doc
+	moved.Name = newName
+	if err := copyDocument(to, &moved); err != nil {
+		return r.shards[j].fail(err)
+	}
+	// Both copies must not stay live under two names
+	if err := from.DeleteDocument(oldName); err != nil {
+		if undo := to.DeleteDocument(newName); undo != nil {
+			return fmt.Errorf("%v; the copy renamed '%s' on shard %s is left too: %v", r.shards[i].fail(err), newName, redact(r.shards[j].location), undo)
+		}
+		return r.shards[i].fail(err)
+	}
+	return nil
+}
+
+// DeleteDocument deletes a document by name
+func (r *Router) DeleteDocument(name string) error {
+	if err := r.check(access.Write); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, _, err := r.locate(name)
+	if err != nil {
+		return err
+	}
+	dm, err := r.docs(i)
+	if err != nil {
+		return err
+	}
+	return dm.DeleteDocument(name)
+}
+
+// SetExpireAt sets when a document expires; a zero time clears the expiry
+func (r *Router) SetExpireAt(name string, at time.Time) error {
+	if err := r.check(access.Write); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, _, err := r.locate(name)
+	if err != nil {
+		return err
+	}
+	dm, err := r.docs(i)
+	if err != nil {
+		return err
+	}
+	return dm.SetExpireAt(name, at)
+}
+
+// FindDocument returns the documents whose key equals val; like the local
+// manager it reports no error, so a failed query finds nothing
+func (r *Router) FindDocument(key string, val interface{}) []*models.Document {
+	results, err := r.FindDocuments(models.Filter{key: val})
+	if err != nil {
+		fmt.Println("Find failed:", err)
+		return nil
+	}
+	fmt.Printf("Found %d document(s) matching %s = %v\n", len(results), key, val)
+	return results
+}
+
+// FindDocuments returns the documents matching every field of a filter, in
+// the order they were created. A filter on the shard key asks only the shard
+// owning it; any other asks every shard at once.
+func (r *Router) FindDocuments(filter models.Filter) ([]*models.Document, error) {
+	if err := r.check(access.Read); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shards := r.all()
+	if v, ok := filter[r.layout.Key]; ok && r.layout.Key != "" {
+		shards = []int{r.layout.Buckets[bucket(v)]}
+	}
+	results, err := r.each(shards, func(dm Documents) ([]*models.Document, error) {
+		return dm.FindDocuments(filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(results, func(a, b int) bool { return results[a].CreatedAt.Before(results[b].CreatedAt) })
+	return results, nil
+}
+
+// ShardStats describes one shard of a collection
+type ShardStats struct {
+	Location  string `json:"location"`
+	Buckets   int    `json:"buckets"`             // Buckets the shard owns
+	Documents int    `json:"documents"`           // Documents it holds in them
+	Misplaced int    `json:"misplaced,omitempty"` // Copies of documents other shards own, which Rebalance removes
+	Error     string `json:"error,omitempty"`     // Why the shard could not be counted
+}
+
+// Stats counts the buckets and documents of every shard
+func (r *Router) Stats() ([]ShardStats, error) {
+	if err := r.check(access.Read); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := make([]ShardStats, len(r.shards))
+	for i, s := range r.shards {
+		stats[i].Location = redact(s.location)
+	}
+	for _, owner := range r.layout.Buckets {
+		stats[owner].Buckets++
+	}
+	var wg sync.WaitGroup
+	for i := range r.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			docs, err := r.list(i)
+			if err != nil {
+				stats[i].Error = err.Error()
+				return
+			}
+			for _, doc := range docs {
+				if r.layout.owner(doc) == i {
+					stats[i].Documents++
+				} else {
+					stats[i].Misplaced++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return stats, nil
+}
+
+// list returns every document on a shard, whichever shard owns it; the caller holds mu
+func (r *Router) list(i int) ([]*models.Document, error) {
+	dm, err := r.docs(i)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := dm.FindDocuments(nil)
+	if err != nil {
+		return nil, r.shards[i].fail(err)
+	}
+	return docs, nil
+}
+
+// copyDocument stores a copy of a document, with its expiry, replacing a
+// copy of the same name left by an interrupted move
+func copyDocument(to Documents, doc *models.Document) error {
+	_, err := to.CreateDocument(doc.Name, doc.Data)
+	if exists(err) {
+		if err = to.DeleteDocument(doc.Name); err == nil {
+			_, err = to.CreateDocument(doc.Name, doc.Data)
+		}
+	}
+	if err == nil && doc.ExpireAt != nil {
+		err = to.SetExpireAt(doc.Name, *doc.ExpireAt)
+	}
+	return err
+}
+
+// overlaps reports whether changing one field path changes another
+func overlaps(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// notFound reports whether err says a document does not exist
+func notFound(err error) bool {
+	return errors.Is(err, documents.ErrNotFound)
+}
@@ -0,0 +1,468 @@
+// Package shard spreads a collection's documents over several shards, each a
+// storage directory or a server, by the hash of a shard key. The hash picks
+// one of Buckets buckets and the collection's layout assigns every bucket to a
+// shard, so adding a shard and rebalancing moves only the buckets given to it.
+// A Router sends each document operation to the shard owning the document's
+// bucket, and fans queries out to every shard, merging the results.
+//
+// Layouts are kept under the router's own storage root, in .shards. Each shard
+// holds its part as an ordinary collection of the same name. A document found
+// on a shard that does not own its bucket, left behind by an interrupted
+// rebalance, is ignored by reads and removed by the next rebalance.
+package shard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"Build-your-own-database/client"
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+	"Build-your-own-database/database/storage"
+)
+
+// Dir is the directory under the storage root that holds the layouts
+const Dir = ".shards"
+
+// Buckets is how many buckets a shard key hashes into, and so the most shards
+// a collection can use
+const Buckets = 256
+
+// Layout describes a sharded collection: where its shards are and which
+// buckets each owns
+type Layout struct {
+	Database   string   `json:"database"`
+	Collection string   `json:"collection"`
+	Key        string   `json:"key,omitempty"` // Field documents are placed by, dotted for nested fields; empty for the document name
+	Shards     []string `json:"shards"`        // Where each shard is: a directory, or tcp://[user:password@]host:port
+	Buckets    []int    `json:"buckets"`       // Index in Shards of the shard owning each bucket
+}
+
+// bucket returns the bucket a shard key value hashes into. Values are hashed
+// as stored JSON, so an int and the float64 read back land in the same one.
+func bucket(value interface{}) int {
+	raw, _ := json.Marshal(models.Normalize(value))
+	h := fnv.New32a()
+	h.Write(raw)
+	return int(h.Sum32() % Buckets)
+}
+
+// keyOf returns the shard key value of a document
+func (l *Layout) keyOf(doc *models.Document) interface{} {
+	if l.Key == "" {
+		return doc.Name
+	}
+	v, _ := doc.Field(l.Key)
+	return v
+}
+
+// owner returns the shard owning a document
+func (l *Layout) owner(doc *models.Document) int {
+	return l.Buckets[bucket(l.keyOf(doc))]
+}
+
+// balance returns bucket assignments giving every one of n shards an equal
+// share, moving as few buckets as it can from those that own too many
+func balance(buckets []int, n int) []int {
+	out := slices.Clone(buckets)
+	counts := make([]int, n)
+	for _, s := range out {
+		counts[s]++
+	}
+	want := func(s int) int {
+		if s < Buckets%n {
+			return Buckets/n + 1
+		}
+		return Buckets / n
+	}
+	for b, s := range out {
+		if counts[s] <= want(s) {
+			continue
+		}
+		for t := range counts {
+			if counts[t] < want(t) {
+				out[b] = t
+				counts[s]--
+				counts[t]++
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Documents is what the router needs of one shard's part of the collection:
+// a documents.DocumentManager for a directory, a client.DocumentManager for a server
+type Documents interface {
+	CreateDocument(name string, data map[string]interface{}) (*models.Document, error)
+	UseDocument(name string) (*models.Document, error)
+	UpdateDocument(name string, set map[string]interface{}, unset []string) (*models.Document, error)
+	RenameDocument(oldName, newName string) error
+	DeleteDocument(name string) error
+	FindDocuments(filter models.Filter) ([]*models.Document, error)
+	SetExpireAt(name string, at time.Time) error
+}
+
+// shard is an opened shard, shared by the routers using it
+type shard struct {
+	location string
+	local    *db.DBManager     // For a directory
+	remote   *client.DBManager // For a server
+}
+
+// openShard opens a shard by its location. Directories are created if needed
+// and must not be inside the router's own storage root.
+func openShard(root, location string) (*shard, error) {
+	if strings.HasPrefix(location, "tcp://") {
+		u, err := url.Parse(location)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid shard location '%s': use a directory or tcp://[user:password@]host:port", location)
+		}
+		var opts []client.Option
+		if u.User != nil {
+			password, _ := u.User.Password()
+			opts = append(opts, client.WithCredentials(u.User.Username(), password))
+		}
+		remote, err := client.Dial("tcp", u.Host, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach shard %s: %v", redact(location), err)
+		}
+		return &shard{location: location, remote: remote}, nil
+	}
+
+	if within(location, root) {
+		return nil, fmt.Errorf("invalid shard location '%s': it is inside this server's storage root", location)
+	}
+	if err := os.MkdirAll(location, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create shard directory: %v", err)
+	}
+	return &shard{location: location, local: db.Open(location)}, nil
+}
+
+// documents returns the shard's manager of a collection, acting for ctx,
+// creating the database and collection first when create is set
+func (s *shard) documents(ctx context.Context, database, collection string, create bool) (Documents, error) {
+	if s.remote != nil {
+		d, err := s.remote.UseDatabase(database)
+		if err != nil && create {
+			if d, err = s.remote.CreateDatabase(database); exists(err) {
+				d, err = s.remote.UseDatabase(database)
+			}
+		}
+		if err != nil {
+			return nil, s.fail(err)
+		}
+		cm := client.NewCollectionManager(s.remote, d)
+		col, err := cm.UseCollection(collection)
+		if err != nil && create {
+			if col, err = cm.CreateCollection(collection); exists(err) {
+				col, err = cm.UseCollection(collection)
+			}
+		}
+		if err != nil {
+			return nil, s.fail(err)
+		}
+		return client.NewDocumentManager(cm, col), nil
+	}
+
+	dbm := s.local.WithContext(ctx)
+	d, err := dbm.UseDatabase(database)
+	if err != nil && create {
+		if d, err = dbm.CreateDatabase(database); exists(err) {
+			d, err = dbm.UseDatabase(database)
+		}
+	}
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	cm := collections.NewCollectionManager(d).WithContext(ctx)
+	col, err := cm.UseCollection(collection)
+	if err != nil && create {
+		if col, err = cm.CreateCollection(collection); exists(err) {
+			col, err = cm.UseCollection(collection)
+		}
+	}
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	return documents.NewDocumentManager(col).WithContext(ctx), nil
+}
+
+// fail names the shard in an error
+func (s *shard) fail(err error) error {
+	return fmt.Errorf("shard %s: %w", redact(s.location), err)
+}
+
+// close closes the shard's managers
+func (s *shard) close() {
+	if s.remote != nil {
+		s.remote.Close()
+	} else {
+		s.local.Close()
+	}
+}
+
+// Manager keeps the layouts of a storage root's sharded collections and the
+// routers serving them. Use one Manager per storage root, and route each
+// sharded collection through one process only.
+type Manager struct {
+	*state
+	ctx context.Context // Carries the caller's identity, see WithContext
+}
+
+// state is what a Manager shares with its WithContext copies
+type state struct {
+	root string
+
+	mu      sync.Mutex
+	routers map[string]*router // By database and collection
+	shards  map[string]*shard  // By location
+}
+
+// NewManager returns the manager of the sharded collections under dbm's storage root
+func NewManager(dbm *db.DBManager) *Manager {
+	return &Manager{
+		state: &state{
+			root:    dbm.Root(),
+			routers: make(map[string]*router),
+			shards:  make(map[string]*shard),
+		},
+		ctx: context.Background(),
+	}
+}
+
+// WithContext returns a copy of the manager whose operations are checked
+// against the identity in ctx (see the access package)
+func (m *Manager) WithContext(ctx context.Context) *Manager {
+	return &Manager{state: m.state, ctx: ctx}
+}
+
+// Close closes every shard the manager opened
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.shards {
+		s.close()
+	}
+	m.shards = make(map[string]*shard)
+	m.routers = make(map[string]*router)
+}
+
+// Create makes a collection sharded over the given shards, by the hash of
+// key, or of the document name when key is empty. The collection is created
+// on every shard; the storage root itself must not hold a collection of the
+// same name.
+func (m *Manager) Create(database, collection, key string, locations []string) (*Router, error) {
+	if err := access.Check(m.ctx, access.Admin, database, collection); err != nil {
+		return nil, err
+	}
+	if err := storage.Writable(m.root); err != nil {
+		return nil, err
+	}
+	if database == "" || collection == "" || strings.ContainsAny(database+collection, `/\`) || strings.HasPrefix(database, ".") {
+		return nil, fmt.Errorf("invalid sharded collection name '%s.%s'", database, collection)
+	}
+	switch key {
+	case "createdAt", "updatedAt", "revision", "size":
+		return nil, fmt.Errorf("invalid shard key '%s': documents without the field would be placed by the metadata the database keeps under that name, which changes", key)
+	}
+	if len(locations) == 0 || len(locations) > Buckets {
+		return nil, fmt.Errorf("invalid sharded collection: give between 1 and %d shards", Buckets)
+	}
+	if _, err := os.Stat(filepath.Join(m.root, database, collection)); err == nil {
+		return nil, fmt.Errorf("collection '%s.%s' already exists unsharded in this storage root", database, collection)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := os.Stat(m.layoutPath(database, collection)); err == nil {
+		return nil, fmt.Errorf("sharded collection '%s.%s' already exists", database, collection)
+	}
+	layout := Layout{Database: database, Collection: collection, Key: key}
+	for _, location := range locations {
+		location, err := m.normalize(location)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(layout.Shards, location) {
+			return nil, fmt.Errorf("shard %s already exists", redact(location))
+		}
+		layout.Shards = append(layout.Shards, location)
+	}
+	layout.Buckets = balance(make([]int, Buckets), len(layout.Shards))
+
+	r := &router{layout: layout}
+	for _, location := range layout.Shards {
+		s, err := m.open(location)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.documents(m.ctx, database, collection, true); err != nil {
+			return nil, err
+		}
+		r.shards = append(r.shards, s)
+	}
+	if err := m.save(layout); err != nil {
+		return nil, err
+	}
+	m.routers[database+"/"+collection] = r
+	fmt.Printf("Sharded collection '%s.%s' over %d shard(s)\n", database, collection, len(layout.Shards))
+	return &Router{router: r, m: m, ctx: m.ctx}, nil
+}
+
+// Router returns the router of a sharded collection, opening its shards the
+// first time
+func (m *Manager) Router(database, collection string) (*Router, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.routers[database+"/"+collection]
+	if r == nil {
+		var layout Layout
+		raw, err := storage.ReadFile(m.layoutPath(database, collection))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("sharded collection '%s.%s' does not exist", database, collection)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard layout: %v", err)
+		}
+		if err := json.Unmarshal(raw, &layout); err != nil || len(layout.Buckets) != Buckets {
+			return nil, storage.Corrupt(m.layoutPath(database, collection), "invalid shard layout")
+		}
+		r = &router{layout: layout}
+		for _, location := range layout.Shards {
+			s, err := m.open(location)
+			if err != nil {
+				return nil, err
+			}
+			r.shards = append(r.shards, s)
+		}
+		m.routers[database+"/"+collection] = r
+	}
+	return &Router{router: r, m: m, ctx: m.ctx}, nil
+}
+
+// Sharded reports whether a collection is sharded
+func (m *Manager) Sharded(database, collection string) bool {
+	if database == "" || collection == "" {
+		return false
+	}
+	_, err := os.Stat(m.layoutPath(database, collection))
+	return err == nil
+}
+
+// List returns the layouts of the sharded collections the caller may read
+func (m *Manager) List() ([]Layout, error) {
+	paths, err := filepath.Glob(filepath.Join(m.root, Dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	layouts := []Layout{}
+	for _, path := range paths {
+		raw, err := storage.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard layout: %v", err)
+		}
+		var layout Layout
+		if err := json.Unmarshal(raw, &layout); err != nil {
+			return nil, storage.Corrupt(path, "invalid shard layout")
+		}
+		if access.Check(m.ctx, access.Read, layout.Database, layout.Collection) == nil {
+			layouts = append(layouts, layout.redacted())
+		}
+	}
+	return layouts, nil
+}
+
+// open returns the opened shard at a location, opening it if needed; the caller holds mu
+func (m *Manager) open(location string) (*shard, error) {
+	if s := m.shards[location]; s != nil {
+		return s, nil
+	}
+	s, err := openShard(m.root, location)
+	if err != nil {
+		return nil, err
+	}
+	m.shards[location] = s
+	return s, nil
+}
+
+// normalize makes a directory location absolute
+func (m *Manager) normalize(location string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("invalid shard location: it is empty")
+	}
+	if strings.HasPrefix(location, "tcp://") {
+		return location, nil
+	}
+	return filepath.Abs(location)
+}
+
+// layoutPath returns the file a collection's layout is kept in
+func (m *Manager) layoutPath(database, collection string) string {
+	return filepath.Join(m.root, Dir, database, collection+".json")
+}
+
+// save writes a layout
+func (m *Manager) save(layout Layout) error {
+	raw, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	path := m.layoutPath(layout.Database, layout.Collection)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to save shard layout: %v", err)
+	}
+	if err := storage.WriteFile(path, append(raw, '\n')); err != nil {
+		return fmt.Errorf("failed to save shard layout: %v", err)
+	}
+	return nil
+}
+
+// redacted returns a copy of the layout without the passwords of its shards
+func (l Layout) redacted() Layout {
+	l.Shards = slices.Clone(l.Shards)
+	for i, location := range l.Shards {
+		l.Shards[i] = redact(location)
+	}
+	l.Buckets = slices.Clone(l.Buckets)
+	return l
+}
+
+// redact hides the password in a server location
+func redact(location string) string {
+	if u, err := url.Parse(location); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return location
+}
+
+// within reports whether path is root or inside it
+func within(path, root string) bool {
+	path, err1 := filepath.Abs(path)
+	root, err2 := filepath.Abs(root)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// exists reports whether err says something already exists
+func exists(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already exists")
+}
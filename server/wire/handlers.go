@@ -0,0 +1,164 @@
+package wire
+
+import (
+	"Build-your-own-database/database/collections"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/document"
+	"Build-your-own-database/database/models"
+)
+
+// handler runs one operation with a DBManager acting for the caller
+type handler func(dbm *db.DBManager, req Request) (interface{}, error)
+
+var handlers = map[byte]handler{
+	OpPing: func(dbm *db.DBManager, req Request) (interface{}, error) { return "pong", nil },
+	// The connection was authenticated before the handler runs
+	OpAuth: func(dbm *db.DBManager, req Request) (interface{}, error) { return req.Name, nil },
+
+	OpListDatabases: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		return dbm.ListDatabases()
+	},
+	OpCreateDatabase: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		db, err := dbm.CreateDatabase(req.Name)
+		return databaseInfo(db), err
+	},
+	OpUseDatabase: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		db, err := dbm.UseDatabase(req.Name)
+		return databaseInfo(db), err
+	},
+	OpDeleteDatabase: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		return nil, dbm.DeleteDatabase(req.Name)
+	},
+	OpRenameDatabase: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		return nil, dbm.RenameDatabase(req.Name, req.NewName)
+	},
+	OpCopyDatabase: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		db, err := dbm.CopyDatabase(req.Name, req.NewName)
+		return databaseInfo(db), err
+	},
+	OpDatabaseStats: func(dbm *db.DBManager, req Request) (interface{}, error) {
+		return dbm.DatabaseStats(req.Name)
+	},
+
+	OpListCollections: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return cm.ListCollections()
+	}),
+	OpCreateCollection: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		var opts []collections.CollectionOption
+		if req.Settings != nil {
+			opts = append(opts, collections.WithSettings(req.Settings))
+		}
+		col, err := cm.CreateCollection(req.Name, opts...)
+		return collectionInfo(col), err
+	}),
+	OpUseCollection: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		col, err := cm.UseCollection(req.Name)
+		return collectionInfo(col), err
+	}),
+	OpDeleteCollection: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return nil, cm.DeleteCollection(req.Name)
+	}),
+	OpRenameCollection: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return nil, cm.RenameCollection(req.Name, req.NewName)
+	}),
+	OpCloneCollection: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		col, err := cm.CloneCollection(req.Name, req.NewName, req.Filter)
+		return collectionInfo(col), err
+	}),
+	OpCollectionStats: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return cm.Stats(req.Name)
+	}),
+	OpCreateIndex: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return nil, cm.CreateIndex(req.Name, req.Field, req.Unique)
+	}),
+	OpCreateTTLIndex: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return nil, cm.CreateTTLIndex(req.Name, req.Field, req.ExpireAfter)
+	}),
+	OpSetHistory: withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		return nil, cm.SetHistory(req.Name, req.History)
+	}),
+
+	OpCreateDocument: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return dm.CreateDocument(req.Name, req.Data)
+	}),
+	OpUseDocument: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return dm.UseDocument(req.Name)
+	}),
+	OpDeleteDocument: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return nil, dm.DeleteDocument(req.Name)
+	}),
+	OpRenameDocument: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return nil, dm.RenameDocument(req.Name, req.NewName)
+	}),
+	OpFindDocument: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return dm.FindDocument(req.Field, req.Value), nil
+	}),
+	OpFindDocuments: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return dm.FindDocuments(req.Filter)
+	}),
+	OpUpdateDocument: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return dm.UpdateDocument(req.Name, req.Set, req.Unset)
+	}),
+	OpSetExpireAt: withDocuments(func(dm *documents.DocumentManager, req Request) (interface{}, error) {
+		return nil, dm.SetExpireAt(req.Name, req.ExpireAt)
+	}),
+}
+
+// withCollections runs fn with a CollectionManager for req.Database
+func withCollections(fn func(*collections.CollectionManager, Request) (interface{}, error)) handler {
+	return func(dbm *db.DBManager, req Request) (interface{}, error) {
+		db, err := dbm.UseDatabase(req.Database)
+		if err != nil {
+			return nil, err
+		}
+		return fn(collections.NewCollectionManager(db).WithContext(dbm.Context()), req)
+	}
+}
+
+// withDocuments runs fn with a DocumentManager for req.Collection in req.Database
+func withDocuments(fn func(*documents.DocumentManager, Request) (interface{}, error)) handler {
+	return withCollections(func(cm *collections.CollectionManager, req Request) (interface{}, error) {
+		col, err := cm.UseCollection(req.Collection)
+		if err != nil {
+			return nil, err
+		}
+		result, err := fn(documents.NewDocumentManager(col).WithContext(cm.Context()), req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Copy documents while holding the lock their writers take, since
+		// the result is encoded after the manager has returned
+		col.Mutex.RLock()
+		defer col.Mutex.RUnlock()
+		switch docs := result.(type) {
+		case *models.Document:
+			return docs.Snapshot(), nil
+		case []*models.Document:
+			snapshots := make([]*models.Document, len(docs))
+			for i, doc := range docs {
+				snapshots[i] = doc.Snapshot()
+			}
+			return snapshots, nil
+		}
+		return result, nil
+	})
+}
+
+// databaseInfo describes a database without its loaded collections
+func databaseInfo(db *models.Database) *models.Database {
+	if db == nil {
+		return nil
+	}
+	return &models.Database{Name: db.Name, Path: db.Path}
+}
+
+// collectionInfo describes a collection by its settings, without its documents
+func collectionInfo(col *models.Collection) *models.Collection {
+	if col == nil {
+		return nil
+	}
+	col.Mutex.RLock()
+	defer col.Mutex.RUnlock()
+	return col.Settings()
+}
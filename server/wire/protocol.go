@@ -0,0 +1,134 @@
+// Package wire implements the native binary protocol: length-prefixed frames
+// carrying a request ID, so a connection can pipeline many requests and
+// receive their responses in any order.
+//
+// Every frame is
+//
+//	length  uint32  big endian, bytes that follow
+//	id      uint64  big endian, chosen by the client and echoed in the response
+//	code    uint8   operation in requests, status in responses
+//	body    []byte  JSON: a Request, or the result (StatusOK) or error message (StatusError, StatusNotFound)
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize bounds a frame's length to protect both ends from bad input
+const MaxFrameSize = 64 << 20
+
+// MaxPreAuthFrameSize bounds the frames of a connection that has yet to
+// authenticate, which need only carry OpPing and OpAuth
+const MaxPreAuthFrameSize = 64 << 10
+
+const headerSize = 8 + 1
+
+// Response statuses
+const (
+	StatusOK       byte = 0
+	StatusError    byte = 1
+	StatusNotFound byte = 2 // An error saying the document asked for does not exist
+)
+
+// Operations
+const (
+	OpPing byte = iota + 1
+
+	OpListDatabases
+	OpCreateDatabase
+	OpUseDatabase
+	OpDeleteDatabase
+	OpRenameDatabase
+	OpCopyDatabase
+	OpDatabaseStats
+
+	OpListCollections
+	OpCreateCollection
+	OpUseCollection
+	OpDeleteCollection
+	OpRenameCollection
+	OpCloneCollection
+	OpCollectionStats
+	OpCreateIndex
+	OpCreateTTLIndex
+	OpSetHistory
+
+	OpCreateDocument
+	OpUseDocument
+	OpDeleteDocument
+	OpRenameDocument
+	OpFindDocument
+	OpFindDocuments
+	OpUpdateDocument
+	OpSetExpireAt
+
+	OpAuth
+)
+
+// Frame is one request or response
+type Frame struct {
+	ID   uint64
+	Code byte
+	Body []byte
+}
+
+// ReadFrame reads the next frame from r
+func ReadFrame(r io.Reader) (Frame, error) {
+	return readFrame(r, MaxFrameSize, nil)
+}
+
+// refusal is returned by readFrame for a frame refused by its header. The
+// frame's ID and code were read but its body was not, so the stream cannot
+// be read any further.
+type refusal struct {
+	frame Frame
+	err   error
+}
+
+func (r *refusal) Error() string { return r.err.Error() }
+
+// readFrame reads the next frame from r, allowing frames of up to limit bytes.
+// When accept is set, it is given the frame's code before the body is read,
+// and a frame it rejects is returned as a *refusal.
+func readFrame(r io.Reader, limit uint32, accept func(code byte) error) (Frame, error) {
+	var head [4 + headerSize]byte
+	if _, err := io.ReadFull(r, head[:4]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	if length < headerSize || length > limit {
+		return Frame{}, fmt.Errorf("invalid frame length %d", length)
+	}
+	if _, err := io.ReadFull(r, head[4:]); err != nil {
+		return Frame{}, err
+	}
+	frame := Frame{ID: binary.BigEndian.Uint64(head[4:12]), Code: head[12]}
+	if accept != nil {
+		if err := accept(frame.Code); err != nil {
+			return Frame{}, &refusal{frame: frame, err: err}
+		}
+	}
+
+	frame.Body = make([]byte, length-headerSize)
+	if _, err := io.ReadFull(r, frame.Body); err != nil {
+		return Frame{}, err
+	}
+	return frame, nil
+}
+
+// WriteFrame writes a frame to w in a single write
+func WriteFrame(w io.Writer, f Frame) error {
+	length := headerSize + len(f.Body)
+	if length > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the %d byte limit", length, MaxFrameSize)
+	}
+	buf := make([]byte, 4+length)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(length))
+	binary.BigEndian.PutUint64(buf[4:12], f.ID)
+	buf[12] = f.Code
+	copy(buf[13:], f.Body)
+	_, err := w.Write(buf)
+	return err
+}
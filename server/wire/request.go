@@ -0,0 +1,31 @@
+package wire
+
+import (
+	"time"
+
+	"Build-your-own-database/database/models"
+)
+
+// Request carries the arguments of any operation; each uses the fields it needs
+type Request struct {
+	Database   string `json:"database,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Name       string `json:"name,omitempty"`    // Database, collection or document being acted on
+	NewName    string `json:"newName,omitempty"` // Target of renames and copies
+
+	Data   map[string]interface{} `json:"data,omitempty"`
+	Set    map[string]interface{} `json:"set,omitempty"`
+	Unset  []string               `json:"unset,omitempty"`
+	Filter models.Filter          `json:"filter,omitempty"`
+
+	Field       string        `json:"field,omitempty"`
+	Value       interface{}   `json:"value,omitempty"`
+	Unique      bool          `json:"unique,omitempty"`
+	ExpireAfter time.Duration `json:"expireAfter,omitempty"`
+	ExpireAt    time.Time     `json:"expireAt,omitempty"`
+
+	Settings *models.Collection     `json:"settings,omitempty"` // Options of a new collection
+	History  *models.HistoryOptions `json:"history,omitempty"`
+
+	Password string `json:"password,omitempty"` // For OpAuth, with the user in Name
+}
@@ -0,0 +1,197 @@
+package wire
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"Build-your-own-database/database/access"
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/db"
+	"Build-your-own-database/database/document"
+)
+
+// Server answers native protocol requests from a DBManager
+type Server struct {
+	dbm   *db.DBManager
+	users *auth.UserManager
+
+	// MaxInFlight is how many pipelined requests of one connection run at once
+	MaxInFlight int
+}
+
+// New creates a wire protocol server backed by a DBManager
+func New(dbm *db.DBManager) *Server {
+	return &Server{dbm: dbm, users: auth.NewUserManager(dbm), MaxInFlight: 64}
+}
+
+// ListenAndServe serves on a "tcp" address or a "unix" socket path until it fails
+func (s *Server) ListenAndServe(network, addr string) error {
+	if network == "unix" {
+		// A socket left behind by an earlier run would make Listen fail
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wire protocol server listening on %s %s\n", network, addr)
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on a listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle runs the requests of one connection concurrently; responses are
+// written as they complete and matched to requests by ID. Until a connection
+// that must authenticate has done so, its frames are small, only OpPing and
+// OpAuth are read, and each runs before the next frame is read.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var identity atomic.Pointer[access.Identity] // Set by OpAuth
+	var writeMu sync.Mutex
+	var running sync.WaitGroup
+	defer running.Wait()
+	slots := make(chan struct{}, max(s.MaxInFlight, 1))
+	write := func(response Frame) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := WriteFrame(conn, response); err != nil {
+			conn.Close()
+		}
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		denied := s.unauthenticated(conn.RemoteAddr(), &identity)
+		var request Frame
+		var err error
+		if denied != nil {
+			request, err = readFrame(reader, MaxPreAuthFrameSize, func(code byte) error {
+				if code != OpPing && code != OpAuth {
+					return denied
+				}
+				return nil
+			})
+		} else {
+			request, err = ReadFrame(reader)
+		}
+		var refused *refusal
+		if errors.As(err, &refused) {
+			// The body was left unread, so nothing more can be read
+			write(Frame{ID: refused.frame.ID, Code: StatusError, Body: []byte(refused.Error())})
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Println("Wire connection error:", err)
+			}
+			return
+		}
+
+		slots <- struct{}{}
+		running.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			write(s.execute(request, conn.RemoteAddr(), &identity))
+		}()
+		if denied != nil {
+			// OpAuth must have run before the next frame is read under its limits
+			running.Wait()
+		}
+	}
+}
+
+// unauthenticated returns why a connection from remote may not be served
+// until it authenticates, or nil once it may
+func (s *Server) unauthenticated(remote net.Addr, identity *atomic.Pointer[access.Identity]) error {
+	if identity.Load() != nil {
+		return nil
+	}
+	required, err := s.users.Required(remote)
+	if err != nil {
+		return err
+	}
+	if required {
+		return errors.New("authentication required")
+	}
+	return nil
+}
+
+// execute runs one request from a client at remote and builds its response
+// frame. Once users exist, only OpPing and OpAuth are answered before the
+// connection authenticates, and requests run with the roles of the
+// authenticated user; until then only local clients are served.
+func (s *Server) execute(frame Frame, remote net.Addr, identity *atomic.Pointer[access.Identity]) Frame {
+	fail := func(err error) Frame {
+		if errors.Is(err, documents.ErrNotFound) {
+			return Frame{ID: frame.ID, Code: StatusNotFound, Body: []byte(err.Error())}
+		}
+		return Frame{ID: frame.ID, Code: StatusError, Body: []byte(err.Error())}
+	}
+
+	if frame.Code != OpPing && frame.Code != OpAuth {
+		if err := s.unauthenticated(remote, identity); err != nil {
+			return fail(err)
+		}
+	}
+
+	handler, ok := handlers[frame.Code]
+	if !ok {
+		return fail(fmt.Errorf("unknown operation %d", frame.Code))
+	}
+	var request Request
+	if len(frame.Body) > 0 {
+		if err := json.Unmarshal(frame.Body, &request); err != nil {
+			return fail(fmt.Errorf("invalid request: %v", err))
+		}
+	}
+
+	if frame.Code == OpAuth {
+		user, err := s.users.Authenticate(request.Name, request.Password)
+		if err != nil {
+			return fail(err)
+		}
+		resolved, err := s.users.Identity(user)
+		if err != nil {
+			return fail(err)
+		}
+		identity.Store(resolved)
+	}
+
+	ctx := context.Background()
+	if caller := identity.Load(); caller != nil {
+		ctx = access.WithIdentity(ctx, caller)
+	}
+	result, err := handler(s.dbm.WithContext(ctx), request)
+	if err != nil {
+		return fail(err)
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fail(fmt.Errorf("failed to encode result: %v", err))
+	}
+	return Frame{ID: frame.ID, Code: StatusOK, Body: body}
+}
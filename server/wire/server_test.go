@@ -0,0 +1,109 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"Build-your-own-database/database/auth"
+	"Build-your-own-database/database/db"
+)
+
+// header encodes the start of a frame whose body of n bytes is still to come
+func header(id uint64, code byte, n int) []byte {
+	buf := make([]byte, 4+headerSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(headerSize+n))
+	binary.BigEndian.PutUint64(buf[4:12], id)
+	buf[12] = code
+	return buf
+}
+
+// request encodes a whole frame carrying req
+func request(t *testing.T, id uint64, code byte, req Request) []byte {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(header(id, code, len(body)), body...)
+}
+
+func TestPreAuthFrames(t *testing.T) {
+	dbm := db.Open(t.TempDir())
+	defer dbm.Close()
+	if err := auth.NewUserManager(dbm).CreateUser("alice", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go New(dbm).Serve(listener)
+	defer listener.Close()
+
+	login := Request{Name: "alice", Password: "s3cret"}
+	large := Request{Name: strings.Repeat("x", 2*MaxPreAuthFrameSize)}
+
+	type reply struct {
+		id   uint64
+		code byte
+	}
+	tests := []struct {
+		name   string
+		send   [][]byte
+		want   []reply // In the order read
+		closed bool    // The server closes the connection after the replies
+	}{
+		{"ping", [][]byte{request(t, 1, OpPing, Request{})}, []reply{{1, StatusOK}}, false},
+		{"other operation, body never sent", [][]byte{header(1, OpListDatabases, MaxPreAuthFrameSize/2)}, []reply{{1, StatusError}}, true},
+		{"large frame", [][]byte{request(t, 1, OpAuth, large)}, nil, true},
+		{"wrong password", [][]byte{request(t, 1, OpAuth, Request{Name: "alice", Password: "nope"}), request(t, 2, OpListDatabases, Request{})}, []reply{{1, StatusError}, {2, StatusError}}, true},
+		{"pipelined after auth", [][]byte{request(t, 1, OpAuth, login), request(t, 2, OpListDatabases, Request{})}, []reply{{1, StatusOK}, {2, StatusOK}}, false},
+		{"large frame after auth", [][]byte{request(t, 1, OpAuth, login), request(t, 2, OpPing, large)}, []reply{{1, StatusOK}, {2, StatusOK}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// Sent at once, as a pipelining client would
+			var out []byte
+			for _, frame := range tt.send {
+				out = append(out, frame...)
+			}
+			go conn.Write(out)
+
+			reader := bufio.NewReader(conn)
+			for _, want := range tt.want {
+				frame, err := ReadFrame(reader)
+				if err != nil {
+					t.Fatalf("reading reply %d: %v", want.id, err)
+				}
+				if frame.ID != want.id || frame.Code != want.code {
+					t.Fatalf("reply %d with status %d (%s), want %d with status %d", frame.ID, frame.Code, frame.Body, want.id, want.code)
+				}
+			}
+			if !tt.closed {
+				return
+			}
+			if frame, err := ReadFrame(reader); err != io.EOF && !isReset(err) {
+				t.Errorf("connection left open: read %+v, %v", frame, err)
+			}
+		})
+	}
+}
+
+// isReset reports whether err is the server closing a connection it had
+// unread input on, which the client sees as a reset rather than EOF
+func isReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}